@@ -3,6 +3,10 @@ import axios from 'axios';
 
 import SocketConnection from '../../socket-connection';
 
+// files above SINGLE_UPLOAD_BYTES are sent in chunks of CHUNK_BYTES
+const SINGLE_UPLOAD_BYTES = 16 * 1024 * 1024;
+const CHUNK_BYTES = 8 * 1024 * 1024;
+
 import {
   Container,
   Flex,
@@ -51,6 +55,8 @@ class Chat extends Component {
       selectedFile: null,
       selectedFileName: '',
     };
+    // link previews by chat ID, see the preview frame
+    this.pendingPreviews = {};
   }
 
   componentDidMount = async () => {
@@ -63,14 +69,41 @@ class Chat extends Component {
     await this.setState({ socketConn: conn });
     // conn.connect(msg => console.log('message received'));
     // connect to ws connection
-    this.state.socketConn.connect(message => {
+    this.state.socketConn.connect(async message => {
       const msg = JSON.parse(message.data);
+      if (msg.type === 'error') {
+        console.warn('message rejected:', msg.code, msg.message);
+        if (msg.code === 'rate_limited') {
+          // sent once until a message goes through again
+          alert('You are sending messages too fast. Wait a moment before sending more.');
+        }
+        return;
+      }
+      if (msg.type === 'attachment_rejected') {
+        // the malware scan found something in a file we sent
+        console.warn('attachment rejected:', msg.attachment.name, msg.reason);
+        alert(`${msg.attachment.name} was rejected by the malware scan and will not be delivered`);
+        return;
+      }
+      if (msg.type === 'preview') {
+        // may overtake the chat it belongs to, kept until that arrives
+        this.pendingPreviews[msg.chatId] = msg.previews;
+        this.setState({
+          chats: this.state.chats.map(c => (c.id === msg.chatId ? { ...c, previews: msg.previews } : c)),
+        });
+        return;
+      }
 
       // update UI only when message is between from and to
       if (this.state.to === msg.from || this.state.username === msg.from) {
+        const withUrls = await this.withAttachmentUrls(msg);
+        if (this.pendingPreviews[msg.id]) {
+          withUrls.previews = this.pendingPreviews[msg.id];
+          delete this.pendingPreviews[msg.id];
+        }
         this.setState(
           {
-            chats: [...this.state.chats, msg],
+            chats: [...this.state.chats, withUrls],
           },
           () => {}
         );
@@ -96,19 +129,66 @@ class Chat extends Component {
   };
 
   uploadAttachment = async () => {
-    const { selectedFile, endpoint } = this.state;
+    const { selectedFile, endpoint, to } = this.state;
     if (!selectedFile) return null;
+    if (selectedFile.size > SINGLE_UPLOAD_BYTES) return this.uploadInChunks();
     const fd = new FormData();
+    fd.append('to', to);
     fd.append('file', selectedFile);
     const res = await axios.post(`${endpoint}/chat/attachment`, fd, {
       headers: { 'Content-Type': 'multipart/form-data' },
     });
-    if (res.data && res.data.status && res.data.data && res.data.data.url) {
-      return res.data.data.url;
+    if (res.data && res.data.status && res.data.data && res.data.data.id) {
+      return res.data.data;
     }
     return null;
   };
 
+  // large files go through /v1/uploads, a failed chunk is retried from
+  // the offset the server reports
+  uploadInChunks = async () => {
+    const { selectedFile: file, endpoint, to } = this.state;
+    const digest = await crypto.subtle.digest('SHA-256', await file.arrayBuffer());
+    const sha256 = Array.from(new Uint8Array(digest)).map(b => b.toString(16).padStart(2, '0')).join('');
+
+    const created = await axios.post(`${endpoint}/v1/uploads`, { to, name: file.name, size: file.size });
+    const id = created.data.data.id;
+    let offset = 0;
+    let failures = 0;
+    while (offset < file.size) {
+      try {
+        const res = await axios.patch(`${endpoint}/v1/uploads/${id}`, file.slice(offset, offset + CHUNK_BYTES), {
+          headers: { 'Content-Type': 'application/offset+octet-stream', 'Upload-Offset': String(offset) },
+        });
+        offset = res.data.data.offset;
+        failures = 0;
+      } catch (e) {
+        if (++failures > 5) throw e;
+        await new Promise(resolve => setTimeout(resolve, 1000 * failures));
+        const res = await axios.get(`${endpoint}/v1/uploads/${id}`);
+        offset = res.data.data.offset;
+      }
+    }
+    const res = await axios.post(`${endpoint}/v1/uploads/${id}/complete`, { sha256 });
+    return res.data && res.data.data && res.data.data.id ? res.data.data : null;
+  };
+
+  // live chats carry attachment references only, fetch signed links
+  withAttachmentUrls = async msg => {
+    if (!msg.attachments || msg.attachments.length === 0) return msg;
+    const { endpoint } = this.state;
+    const attachments = await Promise.all(msg.attachments.map(async a => {
+      try {
+        const res = await axios.get(`${endpoint}/v1/attachments/${a.id}/url`);
+        const data = (res.data && res.data.data) || {};
+        return { ...a, url: data.url, thumbnailUrl: data.thumbnailUrl };
+      } catch (e) {
+        return a;
+      }
+    }));
+    return { ...msg, attachments };
+  };
+
   sendCurrentMessage = async () => {
     const { username, to, message, selectedFileName, selectedFile } = this.state;
     if (!to) return;
@@ -118,26 +198,28 @@ class Chat extends Component {
     const hasAttachment = !!selectedFile;
     if (!hasText && !hasAttachment) return;
 
-    let attachmentLine = '';
+    let attachments;
+    let note = '';
     if (hasAttachment) {
       try {
-        const url = await this.uploadAttachment();
-        if (url) {
-          attachmentLine = `${url}\n`;
+        const a = await this.uploadAttachment();
+        if (a) {
+          attachments = [{ id: a.id }];
         } else {
-          attachmentLine = `[attachment: ${selectedFileName}]\n`;
+          note = `[attachment: ${selectedFileName}]\n`;
         }
       } catch (e) {
-        attachmentLine = `[attachment: ${selectedFileName}]\n`;
+        note = `[attachment: ${selectedFileName}]\n`;
       }
     }
-    const composed = `${attachmentLine}${hasText ? message : ''}`.trim();
+    const composed = `${note}${hasText ? message : ''}`.trim();
     const msg = {
       type: 'message',
       chat: {
         from: username,
         to: to,
         message: composed,
+        attachments,
       },
     };
 
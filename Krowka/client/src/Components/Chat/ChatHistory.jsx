@@ -12,11 +12,33 @@ const ChatHistory = ({ currentUser, chats = [] }) => {
 
   const isImageUrl = (u) => /\.(png|jpe?g|gif|webp|bmp|svg)$/i.test(u);
   const extractUrls = (text) => {
-    const urlRegex = /(https?:\/\/\S+|\/uploads\/\S+)/g;
+    const urlRegex = /(https?:\/\/\S+|\/v1\/attachments\/\S+)/g;
     return (text || '').match(urlRegex) || [];
   };
 
-  const renderContent = (msg) => {
+  // attachment metadata sent with the history, matched by ID in the link
+  const attachmentFor = (u, attachments) => {
+    const m = u.match(/\/v1\/attachments\/([0-9a-f]{32})/);
+    return m ? (attachments || []).find(a => a.id === m[1]) : undefined;
+  };
+
+  // the server leaves out punctuation that ends the sentence after a link
+  const previewFor = (u, previews) =>
+    (previews || []).find(p => p.url === u) || (previews || []).find(p => u.startsWith(p.url));
+
+  // card for a link the server fetched a preview of
+  const renderPreview = (p, key) => (
+    <Link key={key} href={p.url} isExternal _hover={{ textDecoration: 'none' }}>
+      <Box borderLeftWidth="3px" borderColor="teal.300" pl={2} maxW="xs">
+        {p.siteName && <Text fontSize="xs" opacity={0.8}>{p.siteName}</Text>}
+        <Text fontWeight="semibold" noOfLines={2}>{p.title}</Text>
+        {p.description && <Text fontSize="sm" noOfLines={3}>{p.description}</Text>}
+        {p.image && <Image src={p.image} alt="" maxW="xs" maxH="40" objectFit="cover" borderRadius="md" mt={1} />}
+      </Box>
+    </Link>
+  );
+
+  const renderContent = (msg, attachments, previews) => {
     // Split into lines to allow URL on first line and text below
     const lines = (msg || '').split('\n');
     const nodes = [];
@@ -24,7 +46,17 @@ const ChatHistory = ({ currentUser, chats = [] }) => {
       const urls = extractUrls(line);
       if (urls.length > 0) {
         urls.forEach((u, i) => {
-          if (isImageUrl(u)) {
+          const a = attachmentFor(u, attachments);
+          if (a && a.thumbnailUrl) {
+            nodes.push(
+              <Link key={`thumb-${idx}-${i}`} href={a.url || u} isExternal>
+                <Image src={a.thumbnailUrl} alt={a.name || 'attachment'} width={a.width} height={a.height} maxW="xs" h="auto" borderRadius="md" mb={1} />
+              </Link>
+            );
+          } else if (previewFor(u, previews)) {
+            nodes.push(<Link key={`lnk-${idx}-${i}`} href={u} color="teal.300" isExternal>{u}</Link>);
+            nodes.push(renderPreview(previewFor(u, previews), `pv-${idx}-${i}`));
+          } else if (isImageUrl(u)) {
             nodes.push(<Image key={`img-${idx}-${i}`} src={u} alt="attachment" maxW="xs" borderRadius="md" mb={1} />);
           } else {
             nodes.push(<Link key={`lnk-${idx}-${i}`} href={u} color="teal.300" isExternal>{u}</Link>);
@@ -34,6 +66,19 @@ const ChatHistory = ({ currentUser, chats = [] }) => {
         nodes.push(<Text key={`txt-${idx}`} whiteSpace="pre-wrap">{line}</Text>);
       }
     });
+    // attachments sent with the message rather than linked in its text
+    (attachments || []).forEach((a, i) => {
+      if ((msg || '').includes(a.id)) return;
+      if (a.thumbnailUrl) {
+        nodes.push(
+          <Link key={`att-${i}`} href={a.url} isExternal>
+            <Image src={a.thumbnailUrl} alt={a.name || 'attachment'} width={a.width} height={a.height} maxW="xs" h="auto" borderRadius="md" mb={1} />
+          </Link>
+        );
+      } else {
+        nodes.push(<Link key={`att-${i}`} href={a.url} color="teal.300" isExternal>{a.name || 'attachment'}</Link>);
+      }
+    });
     if (nodes.length === 0) {
       return <Text whiteSpace="pre-wrap">{msg}</Text>;
     }
@@ -60,7 +105,7 @@ const ChatHistory = ({ currentUser, chats = [] }) => {
           borderRadius="xl"
           boxShadow={isOutgoing ? 'md' : 'sm'}
         >
-          {renderContent(m.message)}
+          {renderContent(m.message, m.attachments, m.previews)}
           <Text as="span" display="block" mt={1} fontSize="xs" opacity={0.8} textAlign={isOutgoing ? 'right' : 'left'}>
             {ts.toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' })}
           </Text>
@@ -1,6 +1,9 @@
 class SocketConnection {
   constructor() {
-    this.socket = new WebSocket(`ws://localhost:8081/ws`);
+    // browsers can't set headers on a WebSocket, the token goes along as a
+    // subprotocol
+    const token = localStorage.getItem('krowkaToken');
+    this.socket = new WebSocket(`ws://localhost:8081/ws`, ['krowka.bearer', token]);
   }
 
   connect = cb => {
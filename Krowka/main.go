@@ -1,11 +1,22 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 
+	"Krowka/pkg/blobstore"
+	"Krowka/pkg/config"
 	"Krowka/pkg/httpserver"
+	"Krowka/pkg/logging"
+	"Krowka/pkg/redisrepo"
+	"Krowka/pkg/tracing"
 	"Krowka/pkg/ws"
 
 	"github.com/joho/godotenv"
@@ -16,21 +27,199 @@ func init() {
 	err := godotenv.Load()
 	if err != nil {
 		// Non-fatal: continue if .env is missing in dev environments
-		log.Println(".env not found or unable to load; continuing with environment variables only")
+		slog.Info(".env not found or unable to load; continuing with environment variables only")
 	}
 }
 
+type startFunc func(context.Context, *config.Config) error
+
 func main() {
-	server := flag.String("server", "", "http,websocket")
+	server := flag.String("server", "", "http,websocket,all")
+	configPath := flag.String("config", os.Getenv("KROWKA_CONFIG"), "path to a YAML or TOML config file (default $KROWKA_CONFIG)")
+	printConfig := flag.Bool("print-config", false, "print the effective config with secrets redacted and exit")
+	migrate := flag.Bool("migrate-storage", false, "copy avatars and attachments from the local directories into the configured storage backend and exit")
+	gc := flag.Bool("gc", false, "delete attachments no chat refers to once and exit, add --storage.gc.dry_run=true to only report them")
+	overrides := config.RegisterFlags(flag.CommandLine)
 	flag.Parse()
 
-	if *server == "http" {
-		fmt.Println("http server is starting on :8080")
-		httpserver.StartHTTPServer()
-	} else if *server == "websocket" {
-		fmt.Println("websocket server is starting on :8081")
-		ws.StartWebsocketServer()
-	} else {
-		fmt.Println("invalid server. Available server: http or websocket")
+	cfg, err := config.Load(*configPath, overrides)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		os.Exit(1)
+	}
+
+	if *printConfig {
+		if err := cfg.Print(os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	logger, err := logging.New(os.Stderr, logging.Options{
+		Level:     cfg.Log.Level,
+		Format:    cfg.Log.Format,
+		Sensitive: cfg.Log.Sensitive,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
+	if *migrate {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := migrateStorage(ctx, cfg)
+		stop()
+		if err != nil {
+			slog.Error("storage migration failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *gc {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		err := collectGarbage(ctx, cfg)
+		stop()
+		if err != nil {
+			slog.Error("garbage collection failed", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	servers := map[string]startFunc{}
+	switch *server {
+	case "http":
+		servers["http"] = httpserver.StartHTTPServer
+	case "websocket":
+		servers["websocket"] = ws.StartWebsocketServer
+	case "all":
+		servers["http"] = httpserver.StartHTTPServer
+		servers["websocket"] = ws.StartWebsocketServer
+	default:
+		fmt.Println("invalid server. Available server: http, websocket or all")
+		return
+	}
+
+	// SIGINT/SIGTERM start a graceful shutdown of every server
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Options{
+		Exporter:    cfg.Tracing.Exporter,
+		Endpoint:    cfg.Tracing.Endpoint,
+		Insecure:    cfg.Tracing.Insecure,
+		SampleRatio: cfg.Tracing.SampleRatio,
+		ServiceName: cfg.Tracing.ServiceName,
+	})
+	if err != nil {
+		slog.Error("tracing setup failed", "error", err)
+		os.Exit(1)
+	}
+
+	// one redis client shared by every server in this process
+	redisClient, err := redisrepo.InitialiseRedis(ctx, cfg.Redis)
+	if err != nil {
+		slog.Error("redis connection failed", "error", err)
+		os.Exit(1)
+	}
+
+	if err := run(ctx, cfg, servers); err != nil {
+		slog.Error("server error", "error", err)
+	}
+
+	redisClient.Close()
+
+	// flush spans still buffered by the exporter
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Warn("flushing traces failed", "error", err)
+	}
+	cancel()
+
+	slog.Info("shutdown complete")
+}
+
+// run starts every server and returns once all of them stopped. If one
+// fails the others are shut down too.
+func run(ctx context.Context, cfg *config.Config, servers map[string]startFunc) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errc := make(chan error, len(servers))
+	for name, start := range servers {
+		switch name {
+		case "http":
+			slog.Info("http server is starting", "addr", cfg.HTTP.Addr)
+		case "websocket":
+			slog.Info("websocket server is starting", "addr", cfg.WebSocket.Addr)
+		}
+
+		go func(name string, start startFunc) {
+			err := start(ctx, cfg)
+			if err != nil {
+				err = fmt.Errorf("%s: %w", name, err)
+				cancel()
+			}
+			errc <- err
+		}(name, start)
+	}
+
+	var firstErr error
+	for range servers {
+		if err := <-errc; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// collectGarbage makes one janitor pass over the attachment store
+func collectGarbage(ctx context.Context, cfg *config.Config) error {
+	client, err := redisrepo.InitialiseRedis(ctx, cfg.Redis)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	rep, err := httpserver.CollectGarbage(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("files: %d\norphans: %d (%d bytes)\ndeleted: %d (%d bytes)\n",
+		rep.Files, rep.Orphans, rep.Bytes, rep.Deleted, rep.Reclaimed)
+	return nil
+}
+
+// migrateStorage copies the files below http.avatar_dir and http.upload_dir
+// into the configured backend. It is safe to run again after a failure.
+func migrateStorage(ctx context.Context, cfg *config.Config) error {
+	if cfg.Storage.Backend == "fs" {
+		slog.Info("storage backend is fs, files are already in place")
+		return nil
+	}
+
+	for _, area := range []struct{ name, dir string }{
+		{blobstore.Avatars, cfg.HTTP.AvatarDir},
+		{blobstore.Attachments, cfg.HTTP.UploadDir},
+	} {
+		if _, err := os.Stat(area.dir); errors.Is(err, fs.ErrNotExist) {
+			slog.Info("nothing to migrate", "area", area.name, "dir", area.dir)
+			continue
+		}
+		dst, err := blobstore.Open(ctx, cfg.Storage, area.name, area.dir)
+		if err != nil {
+			return err
+		}
+		res, err := blobstore.Migrate(ctx, os.DirFS(area.dir), dst)
+		slog.Info("storage migrated", "area", area.name, "dir", area.dir,
+			"copied", res.Copied, "skipped", res.Skipped, "bytes", res.Bytes)
+		if err != nil {
+			return fmt.Errorf("%s: %w", area.name, err)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,86 @@
+package model
+
+// scan states of an attachment, those stored before scanning was turned on
+// have none
+const (
+	// ScanPending attachments are waiting for the malware scan and can't
+	// be downloaded yet
+	ScanPending = "pending"
+	// ScanClean attachments were scanned and nothing was found
+	ScanClean = "clean"
+	// ScanQuarantined attachments were found infected and are never
+	// handed out
+	ScanQuarantined = "quarantined"
+	// ScanTooLarge attachments are larger than the scanner accepts. As
+	// nothing vouches for them they are never handed out either.
+	ScanTooLarge = "too_large"
+)
+
+// Attachment is a file sent in the conversation between Owner and Peer.
+// Only those two may download it.
+type Attachment struct {
+	ID        string `json:"id"`
+	Owner     string `json:"owner"`
+	Peer      string `json:"peer"`
+	Name      string `json:"name"`
+	MIME      string `json:"mime"`
+	Size      int64  `json:"size"`
+	CreatedAt int64  `json:"createdAt"`
+
+	// Width and Height are set for images and videos that could be
+	// decoded, with a Blurhash placeholder and a thumbnail of ThumbMIME
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	Blurhash  string `json:"blurhash,omitempty"`
+	ThumbMIME string `json:"-"`
+
+	// Status is the scan state, empty for files that were not scanned
+	Status string `json:"status,omitempty"`
+
+	// Blob is the SHA-256 of the content, which is stored once for every
+	// attachment with the same bytes. Empty for attachments stored before
+	// deduplication, whose file is kept under the ID.
+	Blob string `json:"-"`
+}
+
+// IsParticipant reports whether username is a side of the conversation
+// the attachment belongs to
+func (a *Attachment) IsParticipant(username string) bool {
+	return username != "" && (username == a.Owner || username == a.Peer)
+}
+
+// Downloadable reports whether the scan, if any, let the file through
+func (a *Attachment) Downloadable() bool {
+	return a.Status == "" || a.Status == ScanClean
+}
+
+// AttachmentRef is an attachment as carried by a chat message
+type AttachmentRef struct {
+	ID     string `json:"id"`
+	Name   string `json:"name,omitempty"`
+	MIME   string `json:"mime,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+// Ref is the reference to a for a chat message
+func (a *Attachment) Ref() AttachmentRef {
+	return AttachmentRef{ID: a.ID, Name: a.Name, MIME: a.MIME, Size: a.Size, Width: a.Width, Height: a.Height}
+}
+
+// Upload is an attachment sent in chunks, Offset of its Size bytes have
+// arrived. It becomes the attachment of the same ID once complete.
+type Upload struct {
+	ID        string `json:"id"`
+	Owner     string `json:"owner"`
+	Peer      string `json:"peer"`
+	Name      string `json:"name"`
+	MIME      string `json:"mime,omitempty"`
+	Size      int64  `json:"size"`
+	Offset    int64  `json:"offset"`
+	CreatedAt int64  `json:"createdAt"`
+	// ExpiresAt is when the upload is deleted unless another chunk
+	// arrives
+	ExpiresAt int64 `json:"expiresAt"`
+}
@@ -6,6 +6,10 @@ type Chat struct {
 	To        string `json:"to"`
 	Msg       string `json:"message"`
 	Timestamp int64  `json:"timestamp"`
+
+	// Attachments are files sent with the message. Clients only need to
+	// set the IDs, the server fills in the rest from the upload.
+	Attachments []AttachmentRef `json:"attachments,omitempty"`
 }
 
 type ContactList struct {
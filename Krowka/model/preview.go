@@ -0,0 +1,12 @@
+package model
+
+// LinkPreview is the Open Graph or Twitter card summary of a page linked
+// in a chat. A preview without a Title means the page has none.
+type LinkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	// Image is an absolute http(s) URL, the client loads it directly
+	Image    string `json:"image,omitempty"`
+	SiteName string `json:"siteName,omitempty"`
+}
@@ -0,0 +1,9 @@
+package model
+
+// StorageUsage is what a user's attachments take up against the quota
+type StorageUsage struct {
+	UsedBytes int64 `json:"usedBytes"`
+	Files     int64 `json:"files"`
+	// QuotaBytes is 0 when there is no limit
+	QuotaBytes int64 `json:"quotaBytes"`
+}
@@ -0,0 +1,76 @@
+// Package blobstore keeps uploaded files, avatars and chat attachments, on
+// the local filesystem or in an S3-compatible bucket so that several HTTP
+// servers can share them.
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	"Krowka/pkg/config"
+)
+
+// areas of uploads, each is a separate directory or key prefix
+const (
+	Avatars     = "avatars"
+	Attachments = "attachments"
+)
+
+// ErrNotFound is returned for keys that hold no file
+var ErrNotFound = errors.New("blob not found")
+
+// ErrInvalidKey is returned for keys that are not a clean relative
+// slash-separated path, e.g. ones containing ".."
+var ErrInvalidKey = errors.New("invalid blob key")
+
+// Info describes a stored file
+type Info struct {
+	Key         string
+	Size        int64
+	ContentType string
+	ModTime     time.Time
+}
+
+// Store is a flat namespace of files addressed by slash-separated keys
+type Store interface {
+	// Put streams r into key, replacing any previous file, and returns the
+	// number of bytes written. Nothing is left behind if r fails.
+	Put(ctx context.Context, key string, r io.Reader, contentType string) (int64, error)
+	// Open returns the file for reading, seeking is supported so it can be
+	// served with range requests
+	Open(ctx context.Context, key string) (io.ReadSeekCloser, Info, error)
+	Stat(ctx context.Context, key string) (Info, error)
+	// Rename moves the file at from to to, replacing any file there.
+	// Returns ErrNotFound if from holds no file.
+	Rename(ctx context.Context, from, to string) error
+	// Delete removes key, deleting a missing key is not an error
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every file in no particular order, stopping at
+	// the first error fn returns
+	List(ctx context.Context, fn func(Info) error) error
+	// Check reports whether the store is usable, for readiness probes
+	Check(ctx context.Context) error
+}
+
+// Open returns the store for one area of uploads, e.g. "avatars". The fs
+// backend keeps the area in dir, the s3 backend under <prefix><area>/ in
+// the bucket.
+func Open(ctx context.Context, cfg config.Storage, area, dir string) (Store, error) {
+	switch cfg.Backend {
+	case "s3":
+		return NewS3(ctx, cfg.S3, cfg.S3.Prefix+area+"/")
+	default:
+		return NewFS(dir)
+	}
+}
+
+func validKey(key string) error {
+	if !fs.ValidPath(key) || key == "." {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"Krowka/pkg/config"
+)
+
+// testStore runs the behaviour every backend must share
+func testStore(t *testing.T, s Store) {
+	ctx := context.Background()
+
+	if err := s.Check(ctx); err != nil {
+		t.Fatal("check:", err)
+	}
+
+	n, err := s.Put(ctx, "dir/a.txt", strings.NewReader("hello"), "text/plain")
+	if err != nil || n != 5 {
+		t.Fatalf("put: %d, %v", n, err)
+	}
+
+	f, info, err := s.Open(ctx, "dir/a.txt")
+	if err != nil {
+		t.Fatal("open:", err)
+	}
+	by, err := io.ReadAll(f)
+	f.Close()
+	if err != nil || string(by) != "hello" {
+		t.Fatalf("read %q, %v", by, err)
+	}
+	if info.Key != "dir/a.txt" || info.Size != 5 || !strings.HasPrefix(info.ContentType, "text/plain") {
+		t.Errorf("unexpected info %+v", info)
+	}
+
+	// seeking is what http.ServeContent needs for range requests
+	f, _, _ = s.Open(ctx, "dir/a.txt")
+	if _, err := f.Seek(1, io.SeekStart); err != nil {
+		t.Fatal("seek:", err)
+	}
+	by, _ = io.ReadAll(f)
+	f.Close()
+	if string(by) != "ello" {
+		t.Errorf("read after seek %q", by)
+	}
+
+	if _, err := s.Put(ctx, "dir/a.txt", strings.NewReader("replaced"), "text/plain"); err != nil {
+		t.Fatal("overwrite:", err)
+	}
+	if info, err := s.Stat(ctx, "dir/a.txt"); err != nil || info.Size != 8 {
+		t.Errorf("stat after overwrite: %+v, %v", info, err)
+	}
+
+	// a failing reader leaves nothing behind
+	broken := io.MultiReader(strings.NewReader("part"), errReader{})
+	if _, err := s.Put(ctx, "broken", broken, ""); err == nil {
+		t.Error("put from a failing reader succeeded")
+	}
+	if _, err := s.Stat(ctx, "broken"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("stat after failed put: %v", err)
+	}
+
+	if _, err := s.Put(ctx, "b.txt", strings.NewReader("b"), "text/plain"); err != nil {
+		t.Fatal("put:", err)
+	}
+	listed := map[string]int64{}
+	err = s.List(ctx, func(info Info) error {
+		listed[info.Key] = info.Size
+		return nil
+	})
+	if err != nil || len(listed) != 2 || listed["dir/a.txt"] != 8 || listed["b.txt"] != 1 {
+		t.Errorf("list: %v, %v", listed, err)
+	}
+	stop := errors.New("stop")
+	if err := s.List(ctx, func(Info) error { return stop }); !errors.Is(err, stop) {
+		t.Errorf("list did not stop: %v", err)
+	}
+
+	if err := s.Rename(ctx, "b.txt", "moved/b.txt"); err != nil {
+		t.Fatal("rename:", err)
+	}
+	if _, err := s.Stat(ctx, "b.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("stat after rename: %v", err)
+	}
+	if info, err := s.Stat(ctx, "moved/b.txt"); err != nil || info.Size != 1 {
+		t.Errorf("renamed file: %+v, %v", info, err)
+	}
+	if err := s.Rename(ctx, "b.txt", "moved/b.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("renaming a missing key: %v", err)
+	}
+	s.Delete(ctx, "moved/b.txt")
+
+	if err := s.Delete(ctx, "dir/a.txt"); err != nil {
+		t.Fatal("delete:", err)
+	}
+	if _, _, err := s.Open(ctx, "dir/a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("open after delete: %v", err)
+	}
+	if err := s.Delete(ctx, "dir/a.txt"); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+
+	for _, key := range []string{"../escape", "/abs", "a/../b", "", "."} {
+		if _, err := s.Put(ctx, key, strings.NewReader("x"), ""); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("put %q: %v, want ErrInvalidKey", key, err)
+		}
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestFS(t *testing.T) {
+	s, err := NewFS(t.TempDir() + "/nested")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+
+	entries, _ := os.ReadDir(s.root)
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".upload-") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
+
+// TestS3 runs against a local MinIO, e.g.
+//
+//	docker run -p 9000:9000 minio/minio server /data
+//	S3_TEST_ENDPOINT=localhost:9000 S3_TEST_BUCKET=krowka-test go test ./pkg/blobstore
+//
+// The bucket must exist, credentials default to MinIO's.
+func TestS3(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+	cfg := config.S3{
+		Endpoint:  endpoint,
+		Bucket:    os.Getenv("S3_TEST_BUCKET"),
+		AccessKey: envOr("S3_TEST_ACCESS_KEY", "minioadmin"),
+		SecretKey: envOr("S3_TEST_SECRET_KEY", "minioadmin"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	s, err := NewS3(ctx, cfg, "test-"+time.Now().Format("20060102150405.000")+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, s)
+
+	cfg.Bucket = "krowka-missing-bucket"
+	if _, err := NewS3(ctx, cfg, ""); err == nil {
+		t.Error("missing bucket accepted")
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func TestMigrate(t *testing.T) {
+	src := fstest.MapFS{
+		"alice-me.png":          {Data: []byte("png")},
+		"0123456789abcdef":      {Data: []byte("attachment")},
+		"nested/old.txt":        {Data: []byte("old")},
+		".upload-123":           {Data: []byte("partial write")},
+		".readyz-1/ignored.txt": {Data: []byte("probe")},
+	}
+	dst, err := NewFS(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	res, err := Migrate(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 3 || res.Skipped != 0 || res.Bytes != 16 {
+		t.Errorf("first run: %+v", res)
+	}
+	if info, err := dst.Stat(ctx, "nested/old.txt"); err != nil || info.Size != 3 {
+		t.Errorf("nested file: %+v, %v", info, err)
+	}
+	if _, err := dst.Stat(ctx, ".upload-123"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("hidden file copied: %v", err)
+	}
+
+	// running again only copies what changed
+	src["alice-me.png"] = &fstest.MapFile{Data: []byte("new png")}
+	res, err = Migrate(ctx, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Copied != 1 || res.Skipped != 2 {
+		t.Errorf("second run: %+v", res)
+	}
+}
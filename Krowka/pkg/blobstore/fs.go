@@ -0,0 +1,186 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FS stores files below a local directory
+type FS struct {
+	root string
+}
+
+// NewFS creates root if needed
+func NewFS(root string) (*FS, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &FS{root: root}, nil
+}
+
+func (s *FS) path(key string) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+// Put writes to a temporary file next to the target and renames it into
+// place, readers never see a partial file
+func (s *FS) Put(ctx context.Context, key string, r io.Reader, contentType string) (int64, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(tmp, r)
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s *FS) Open(ctx context.Context, key string) (io.ReadSeekCloser, Info, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, Info{}, notFound(err)
+	}
+	info, err := s.info(key, f.Stat)
+	if err != nil {
+		f.Close()
+		return nil, Info{}, err
+	}
+	return f, info, nil
+}
+
+func (s *FS) Stat(ctx context.Context, key string) (Info, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return Info{}, err
+	}
+	return s.info(key, func() (fs.FileInfo, error) { return os.Stat(path) })
+}
+
+func (s *FS) info(key string, stat func() (fs.FileInfo, error)) (Info, error) {
+	fi, err := stat()
+	if err != nil {
+		return Info{}, notFound(err)
+	}
+	if fi.IsDir() {
+		return Info{}, ErrNotFound
+	}
+	// the filesystem keeps no content type, guess it from the name
+	return Info{
+		Key:         key,
+		Size:        fi.Size(),
+		ContentType: mime.TypeByExtension(filepath.Ext(key)),
+		ModTime:     fi.ModTime(),
+	}, nil
+}
+
+// Rename is atomic, readers of to see the old or the new file
+func (s *FS) Rename(ctx context.Context, from, to string) error {
+	src, err := s.path(from)
+	if err != nil {
+		return err
+	}
+	dst, err := s.path(to)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return notFound(os.Rename(src, dst))
+}
+
+func (s *FS) Delete(ctx context.Context, key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List skips the temporary files of writes in progress and readiness
+// probes
+func (s *FS) List(ctx context.Context, fn func(Info) error) error {
+	return filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(d.Name(), ".") && path != s.root {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, path)
+		if err != nil {
+			return err
+		}
+		info, err := s.info(filepath.ToSlash(rel), d.Info)
+		if errors.Is(err, ErrNotFound) {
+			// deleted while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return fn(info)
+	})
+}
+
+// Check creates and removes a file in the root directory
+func (s *FS) Check(ctx context.Context) error {
+	f, err := os.CreateTemp(s.root, ".readyz-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	f.Close()
+	return os.Remove(name)
+}
+
+func notFound(err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
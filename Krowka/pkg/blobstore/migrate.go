@@ -0,0 +1,71 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"path"
+	"strings"
+)
+
+// MigrateResult counts what Migrate did
+type MigrateResult struct {
+	Copied  int
+	Skipped int
+	Bytes   int64
+}
+
+// Migrate copies every regular file in src into dst under the same key.
+// Files dst already holds with the same size are skipped, so an
+// interrupted migration can simply be run again.
+func Migrate(ctx context.Context, src fs.FS, dst Store) (MigrateResult, error) {
+	var res MigrateResult
+	err := fs.WalkDir(src, ".", func(key string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// leftovers of interrupted writes and readiness probes
+		if strings.HasPrefix(d.Name(), ".") && key != "." {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		existing, err := dst.Stat(ctx, key)
+		if err == nil && existing.Size == fi.Size() {
+			res.Skipped++
+			return nil
+		}
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		f, err := src.Open(key)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := dst.Put(ctx, key, f, mime.TypeByExtension(path.Ext(key)))
+		if err != nil {
+			return err
+		}
+		slog.Debug("blob migrated", "key", key, "size", n)
+		res.Copied++
+		res.Bytes += n
+		return nil
+	})
+	return res, err
+}
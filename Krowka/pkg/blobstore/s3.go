@@ -0,0 +1,164 @@
+package blobstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"Krowka/pkg/config"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// partSize is the buffer each upload of unknown length holds in memory,
+// 5 MiB is the smallest part S3 accepts
+const partSize = 5 << 20
+
+// S3 stores files as objects below a key prefix in an S3-compatible bucket
+// such as AWS S3 or MinIO
+type S3 struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+// NewS3 connects to the bucket and checks that it exists
+func NewS3(ctx context.Context, cfg config.S3, prefix string) (*S3, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("s3 client: %w", err)
+	}
+
+	s := &S3{client: client, bucket: cfg.Bucket, prefix: prefix}
+	if err := s.Check(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *S3) object(key string) (string, error) {
+	if err := validKey(key); err != nil {
+		return "", err
+	}
+	return s.prefix + key, nil
+}
+
+// Put streams r as a multipart upload, an upload that fails midway is
+// aborted by the client
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, contentType string) (int64, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return 0, err
+	}
+	info, err := s.client.PutObject(ctx, s.bucket, name, r, -1, minio.PutObjectOptions{
+		ContentType: contentType,
+		PartSize:    partSize,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (s *S3) Open(ctx context.Context, key string) (io.ReadSeekCloser, Info, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return nil, Info{}, err
+	}
+	obj, err := s.client.GetObject(ctx, s.bucket, name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, Info{}, s3Error(err)
+	}
+	oi, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, Info{}, s3Error(err)
+	}
+	return obj, s.info(key, oi), nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (Info, error) {
+	name, err := s.object(key)
+	if err != nil {
+		return Info{}, err
+	}
+	oi, err := s.client.StatObject(ctx, s.bucket, name, minio.StatObjectOptions{})
+	if err != nil {
+		return Info{}, s3Error(err)
+	}
+	return s.info(key, oi), nil
+}
+
+func (s *S3) info(key string, oi minio.ObjectInfo) Info {
+	return Info{Key: key, Size: oi.Size, ContentType: oi.ContentType, ModTime: oi.LastModified}
+}
+
+// Rename copies the object within the bucket, in parts if it is larger
+// than a single copy allows, and deletes the original
+func (s *S3) Rename(ctx context.Context, from, to string) error {
+	src, err := s.object(from)
+	if err != nil {
+		return err
+	}
+	dst, err := s.object(to)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: src})
+	if err != nil {
+		return s3Error(err)
+	}
+	return s.client.RemoveObject(ctx, s.bucket, src, minio.RemoveObjectOptions{})
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	name, err := s.object(key)
+	if err != nil {
+		return err
+	}
+	return s.client.RemoveObject(ctx, s.bucket, name, minio.RemoveObjectOptions{})
+}
+
+func (s *S3) List(ctx context.Context, fn func(Info) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	// stops the listing when fn fails
+	defer cancel()
+	for oi := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix, Recursive: true}) {
+		if oi.Err != nil {
+			return oi.Err
+		}
+		if err := fn(s.info(strings.TrimPrefix(oi.Key, s.prefix), oi)); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// Check verifies the bucket exists and the credentials may see it
+func (s *S3) Check(ctx context.Context) error {
+	ok, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return fmt.Errorf("s3 bucket %s: %w", s.bucket, err)
+	}
+	if !ok {
+		return fmt.Errorf("s3 bucket %s does not exist", s.bucket)
+	}
+	return nil
+}
+
+func s3Error(err error) error {
+	res := minio.ToErrorResponse(err)
+	if res.Code == minio.NoSuchKey || res.StatusCode == http.StatusNotFound {
+		return ErrNotFound
+	}
+	return err
+}
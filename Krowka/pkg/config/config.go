@@ -0,0 +1,636 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the effective configuration shared by the HTTP and WebSocket
+// servers. Every leaf setting can come from the config file, YAML or TOML
+// with the same keys, an environment variable (env tag) or a flag named
+// after its YAML path, e.g. --http.addr. Precedence, lowest first:
+// defaults, file, environment, flags.
+type Config struct {
+	HTTP      HTTP      `yaml:"http"`
+	WebSocket WebSocket `yaml:"websocket"`
+	Auth      Auth      `yaml:"auth"`
+	Redis     Redis     `yaml:"redis"`
+	Log       Log       `yaml:"log"`
+	Tracing   Tracing   `yaml:"tracing"`
+	Storage   Storage   `yaml:"storage"`
+
+	// ShutdownTimeout bounds how long a server drains after SIGINT/SIGTERM
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT"`
+	// ShutdownDelay keeps serving with /readyz failing before connections
+	// stop being accepted
+	ShutdownDelay time.Duration `yaml:"shutdown_delay" env:"SHUTDOWN_DELAY"`
+
+	// Dev allows settings only fit for a local setup, such as the default
+	// JWT secret
+	Dev bool `yaml:"dev" env:"KROWKA_DEV"`
+}
+
+type HTTP struct {
+	Addr               string   `yaml:"addr" env:"HTTP_ADDR"`
+	CORSOrigins        []string `yaml:"cors_origins" env:"HTTP_CORS_ORIGINS"`
+	AvatarDir          string   `yaml:"avatar_dir" env:"AVATAR_DIR"`
+	UploadDir          string   `yaml:"upload_dir" env:"UPLOAD_DIR"`
+	MaxAvatarBytes     int64    `yaml:"max_avatar_bytes" env:"MAX_AVATAR_BYTES"`
+	MaxAttachmentBytes int64    `yaml:"max_attachment_bytes" env:"MAX_ATTACHMENT_BYTES"`
+
+	// AvatarTypes and AttachmentTypes list the media types accepted for
+	// each kind of upload, detected from the file bytes. Wildcards such
+	// as image/* are allowed. HTML, SVG and script are always rejected.
+	AvatarTypes     []string `yaml:"avatar_types" env:"AVATAR_TYPES"`
+	AttachmentTypes []string `yaml:"attachment_types" env:"ATTACHMENT_TYPES"`
+	// UserQuotaBytes bounds the attachments each user may store, 0 means
+	// no limit
+	UserQuotaBytes int64 `yaml:"user_quota_bytes" env:"USER_QUOTA_BYTES"`
+	// MaxUploadBytes bounds files sent in chunks through /v1/uploads, as
+	// does Scan.MaxBytes while scanning is on, MaxChunkBytes each chunk. Uploads without a chunk for UploadExpiry
+	// are deleted.
+	MaxUploadBytes int64         `yaml:"max_upload_bytes" env:"MAX_UPLOAD_BYTES"`
+	MaxChunkBytes  int64         `yaml:"max_chunk_bytes" env:"MAX_CHUNK_BYTES"`
+	UploadExpiry   time.Duration `yaml:"upload_expiry" env:"UPLOAD_EXPIRY"`
+	// FFmpegPath is the ffmpeg binary that extracts video posters, a bare
+	// name is looked up in PATH. Videos get no poster when it is empty or
+	// missing.
+	FFmpegPath string `yaml:"ffmpeg_path" env:"FFMPEG_PATH"`
+
+	ReadTimeout  time.Duration `yaml:"read_timeout" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout time.Duration `yaml:"write_timeout" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout" env:"HTTP_IDLE_TIMEOUT"`
+	// MinTransferRate in bytes per second stretches WriteTimeout for
+	// attachment downloads and upload completion, by the time the file
+	// takes at that rate
+	MinTransferRate int64 `yaml:"min_transfer_rate" env:"HTTP_MIN_TRANSFER_RATE"`
+
+	// LegacyErrors answers failures with {status:false, message} for
+	// clients that predate the error envelope, and with HTTP 200 unless
+	// the status is 401, 403 or 404
+	LegacyErrors bool `yaml:"legacy_errors" env:"HTTP_LEGACY_ERRORS"`
+}
+
+type WebSocket struct {
+	Addr string `yaml:"addr" env:"WS_ADDR"`
+
+	// HandshakeTimeout bounds the upgrade request, WriteTimeout each frame
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout" env:"WS_HANDSHAKE_TIMEOUT"`
+	WriteTimeout     time.Duration `yaml:"write_timeout" env:"WS_WRITE_TIMEOUT"`
+	// AllowedOrigins lists the browser origins that may connect, such as
+	// https://chat.example.com. "*" allows any. Requests without an Origin
+	// header come from other programs and are not checked.
+	AllowedOrigins []string `yaml:"allowed_origins" env:"WS_ALLOWED_ORIGINS"`
+
+	Previews  Previews  `yaml:"previews"`
+	RateLimit RateLimit `yaml:"rate_limit"`
+}
+
+// RateLimit bounds the frames clients send with token buckets: one per
+// connection kept in memory and one per user shared through Redis. A
+// bucket holds Burst frames and refills at Rate frames per second, a rate
+// of 0 turns it off.
+type RateLimit struct {
+	ConnRate  float64 `yaml:"conn_rate" env:"WS_CONN_RATE"`
+	ConnBurst int     `yaml:"conn_burst" env:"WS_CONN_BURST"`
+	UserRate  float64 `yaml:"user_rate" env:"WS_USER_RATE"`
+	UserBurst int     `yaml:"user_burst" env:"WS_USER_BURST"`
+	// a connection is closed once MaxThrottled of its frames were refused
+	// within AbuseWindow, 0 never closes it
+	MaxThrottled int           `yaml:"max_throttled" env:"WS_MAX_THROTTLED"`
+	AbuseWindow  time.Duration `yaml:"abuse_window" env:"WS_ABUSE_WINDOW"`
+}
+
+// Previews fetches the pages linked in chats to show a summary of them
+type Previews struct {
+	Enabled bool `yaml:"enabled" env:"PREVIEWS_ENABLED"`
+	// Workers is how many pages are fetched at once
+	Workers int `yaml:"workers" env:"PREVIEW_WORKERS"`
+	// Timeout bounds fetching one page, redirects included, MaxBytes how
+	// much of it is read
+	Timeout  time.Duration `yaml:"timeout" env:"PREVIEW_TIMEOUT"`
+	MaxBytes int64         `yaml:"max_bytes" env:"PREVIEW_MAX_BYTES"`
+	// CacheTTL is how long a preview is reused for the same URL
+	CacheTTL time.Duration `yaml:"cache_ttl" env:"PREVIEW_CACHE_TTL"`
+}
+
+type Auth struct {
+	JWTSecret string        `yaml:"jwt_secret" env:"JWT_SECRET" secret:"true"`
+	TokenTTL  time.Duration `yaml:"token_ttl" env:"JWT_TTL"`
+	// URLSigningKey signs attachment download links, the JWT secret is
+	// used when empty
+	URLSigningKey         string        `yaml:"url_signing_key" env:"URL_SIGNING_KEY" secret:"true"`
+	SignedURLTTL          time.Duration `yaml:"signed_url_ttl" env:"SIGNED_URL_TTL"`
+	PasswordMinLength     int           `yaml:"password_min_length" env:"PASSWORD_MIN_LENGTH"`
+	PasswordBlocklistFile string        `yaml:"password_blocklist_file" env:"PASSWORD_BLOCKLIST_FILE"`
+}
+
+type Redis struct {
+	// Mode is standalone, sentinel or cluster
+	Mode string `yaml:"mode" env:"REDIS_MODE"`
+	// Addr is host:port or, in standalone mode, a redis:// or rediss:// URL
+	Addr string `yaml:"addr" env:"REDIS_CONNECTION_STRING"`
+	// Addrs are the sentinel or cluster seed nodes, Addr is used if empty
+	Addrs      []string `yaml:"addrs" env:"REDIS_ADDRS"`
+	MasterName string   `yaml:"master_name" env:"REDIS_SENTINEL_MASTER"`
+
+	// Username selects an ACL user, leave empty for the default user
+	Username         string `yaml:"username" env:"REDIS_USERNAME"`
+	Password         string `yaml:"password" env:"REDIS_PASSWORD" secret:"true"`
+	SentinelPassword string `yaml:"sentinel_password" env:"REDIS_SENTINEL_PASSWORD" secret:"true"`
+	DB               int    `yaml:"db" env:"REDIS_DB"`
+
+	TLS RedisTLS `yaml:"tls"`
+
+	// PoolSize and MinIdleConns are per node, 0 keeps the go-redis default
+	PoolSize     int           `yaml:"pool_size" env:"REDIS_POOL_SIZE"`
+	MinIdleConns int           `yaml:"min_idle_conns" env:"REDIS_MIN_IDLE_CONNS"`
+	DialTimeout  time.Duration `yaml:"dial_timeout" env:"REDIS_DIAL_TIMEOUT"`
+	ReadTimeout  time.Duration `yaml:"read_timeout" env:"REDIS_READ_TIMEOUT"`
+	WriteTimeout time.Duration `yaml:"write_timeout" env:"REDIS_WRITE_TIMEOUT"`
+	PoolTimeout  time.Duration `yaml:"pool_timeout" env:"REDIS_POOL_TIMEOUT"`
+
+	// OperationTimeout bounds each repository call, e.g. saving one chat
+	OperationTimeout time.Duration `yaml:"operation_timeout" env:"REDIS_OPERATION_TIMEOUT"`
+	// ConnectTimeout is how long startup keeps retrying the first ping
+	ConnectTimeout time.Duration `yaml:"connect_timeout" env:"REDIS_CONNECT_TIMEOUT"`
+}
+
+type RedisTLS struct {
+	// Enabled turns on TLS for host:port addresses, rediss:// URLs always
+	// use it
+	Enabled            bool   `yaml:"enabled" env:"REDIS_TLS"`
+	CAFile             string `yaml:"ca_file" env:"REDIS_TLS_CA_FILE"`
+	CertFile           string `yaml:"cert_file" env:"REDIS_TLS_CERT_FILE"`
+	KeyFile            string `yaml:"key_file" env:"REDIS_TLS_KEY_FILE"`
+	ServerName         string `yaml:"server_name" env:"REDIS_TLS_SERVER_NAME"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify" env:"REDIS_TLS_INSECURE_SKIP_VERIFY"`
+}
+
+type Log struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL"`
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+	// Sensitive keeps message bodies and passwords in logs, for local
+	// debugging only
+	Sensitive bool `yaml:"sensitive" env:"LOG_SENSITIVE"`
+}
+
+type Tracing struct {
+	// Exporter is none, stdout or otlp
+	Exporter string `yaml:"exporter" env:"TRACING_EXPORTER"`
+	// Endpoint is the OTLP/HTTP collector, e.g. localhost:4318
+	Endpoint    string  `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	Insecure    bool    `yaml:"insecure" env:"TRACING_INSECURE"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+	ServiceName string  `yaml:"service_name" env:"OTEL_SERVICE_NAME"`
+}
+
+type Storage struct {
+	// Backend is fs, files below http.avatar_dir and http.upload_dir, or
+	// s3 for any S3-compatible object store
+	Backend string `yaml:"backend" env:"STORAGE_BACKEND"`
+	S3      S3     `yaml:"s3"`
+	GC      GC     `yaml:"gc"`
+	Scan    Scan   `yaml:"scan"`
+}
+
+// GC is the janitor that deletes attachments no chat refers to
+type GC struct {
+	// Interval between passes, 0 turns the janitor off
+	Interval time.Duration `yaml:"interval" env:"GC_INTERVAL"`
+	// GracePeriod keeps unreferenced files this long, time for the chat
+	// they were uploaded for to be sent
+	GracePeriod time.Duration `yaml:"grace_period" env:"GC_GRACE_PERIOD"`
+	// DryRun only logs what would be deleted
+	DryRun bool `yaml:"dry_run" env:"GC_DRY_RUN"`
+}
+
+// Scan checks attachments for malware before they can be downloaded
+type Scan struct {
+	// Backend is none or clamd
+	Backend string `yaml:"backend" env:"SCAN_BACKEND"`
+	// ClamdAddr is clamd's host:port, or the path of its unix socket
+	ClamdAddr string `yaml:"clamd_addr" env:"CLAMD_ADDR"`
+	// Timeout bounds the scan of one file
+	Timeout time.Duration `yaml:"timeout" env:"SCAN_TIMEOUT"`
+	// MaxBytes is the largest file scanned, clamd's StreamMaxLength.
+	// Larger files are never handed out, 0 scans every file.
+	MaxBytes int64 `yaml:"max_bytes" env:"SCAN_MAX_BYTES"`
+	// RetryInterval is how often files whose scan failed are tried again
+	RetryInterval time.Duration `yaml:"retry_interval" env:"SCAN_RETRY_INTERVAL"`
+}
+
+type S3 struct {
+	// Endpoint is host:port, e.g. s3.amazonaws.com or localhost:9000
+	Endpoint  string `yaml:"endpoint" env:"S3_ENDPOINT"`
+	Bucket    string `yaml:"bucket" env:"S3_BUCKET"`
+	Region    string `yaml:"region" env:"S3_REGION"`
+	AccessKey string `yaml:"access_key" env:"S3_ACCESS_KEY"`
+	SecretKey string `yaml:"secret_key" env:"S3_SECRET_KEY" secret:"true"`
+	UseSSL    bool   `yaml:"use_ssl" env:"S3_USE_SSL"`
+	// Prefix is put in front of every key, to share a bucket
+	Prefix string `yaml:"prefix" env:"S3_PREFIX"`
+}
+
+const redacted = "<redacted>"
+
+// DefaultJWTSecret is the built-in secret, refused unless Dev is set
+const DefaultJWTSecret = "dev-secret-change-me"
+
+// Default returns the settings the servers used before they were
+// configurable.
+func Default() *Config {
+	return &Config{
+		HTTP: HTTP{
+			Addr:               ":8080",
+			CORSOrigins:        []string{"http://localhost:3000", "http://localhost:3001", "*"},
+			AvatarDir:          "avatars",
+			UploadDir:          "uploads",
+			MaxAvatarBytes:     5 << 20,
+			MaxAttachmentBytes: 20 << 20,
+			AvatarTypes:        []string{"image/png", "image/jpeg", "image/gif", "image/webp"},
+			AttachmentTypes: []string{
+				"image/png", "image/jpeg", "image/gif", "image/webp",
+				"video/mp4", "video/webm", "audio/mpeg", "application/ogg", "audio/wave",
+				"application/pdf", "application/zip", "text/plain",
+			},
+			UserQuotaBytes:  1 << 30,
+			MaxUploadBytes:  2 << 30,
+			MaxChunkBytes:   8 << 20,
+			UploadExpiry:    24 * time.Hour,
+			FFmpegPath:      "ffmpeg",
+			ReadTimeout:     time.Minute,
+			WriteTimeout:    time.Minute,
+			IdleTimeout:     2 * time.Minute,
+			MinTransferRate: 64 << 10,
+		},
+		WebSocket: WebSocket{
+			Addr:             ":8081",
+			HandshakeTimeout: 10 * time.Second,
+			WriteTimeout:     10 * time.Second,
+			AllowedOrigins:   []string{"http://localhost:3000", "http://localhost:3001"},
+			Previews: Previews{
+				Enabled:  true,
+				Workers:  4,
+				Timeout:  5 * time.Second,
+				MaxBytes: 1 << 20,
+				CacheTTL: 24 * time.Hour,
+			},
+			RateLimit: RateLimit{
+				ConnRate:     5,
+				ConnBurst:    20,
+				UserRate:     10,
+				UserBurst:    40,
+				MaxThrottled: 50,
+				AbuseWindow:  10 * time.Second,
+			},
+		},
+		Auth: Auth{
+			JWTSecret:         DefaultJWTSecret,
+			TokenTTL:          24 * time.Hour,
+			SignedURLTTL:      15 * time.Minute,
+			PasswordMinLength: 8,
+		},
+		Redis: Redis{
+			Mode:             "standalone",
+			DB:               0,
+			DialTimeout:      5 * time.Second,
+			ReadTimeout:      3 * time.Second,
+			WriteTimeout:     3 * time.Second,
+			PoolTimeout:      4 * time.Second,
+			OperationTimeout: 3 * time.Second,
+			ConnectTimeout:   time.Minute,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			SampleRatio: 1,
+			ServiceName: "krowka",
+		},
+		Storage: Storage{
+			Backend: "fs",
+			S3:      S3{UseSSL: true},
+			GC: GC{
+				Interval:    6 * time.Hour,
+				GracePeriod: 24 * time.Hour,
+			},
+			Scan: Scan{
+				Backend:       "none",
+				ClamdAddr:     "localhost:3310",
+				Timeout:       time.Minute,
+				MaxBytes:      25 << 20,
+				RetryInterval: 5 * time.Minute,
+			},
+		},
+		ShutdownTimeout: 15 * time.Second,
+	}
+}
+
+// Load builds the effective configuration. path may be empty, flags holds
+// the values collected by RegisterFlags.
+func Load(path string, flags FlagValues) (*Config, error) {
+	c := Default()
+
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+
+	if err := c.applyFlags(flags); err != nil {
+		return nil, err
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// loadFile applies the config file at path, picking the format by its
+// extension. TOML is read into a table and decoded like YAML, so that both
+// share the yaml tags, durations and the check for unknown keys.
+func (c *Config) loadFile(path string) error {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != ".yaml" && ext != ".yml" && ext != ".toml" {
+		return fmt.Errorf("config file %s: must be YAML (.yaml, .yml) or TOML (.toml)", path)
+	}
+	by, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config file: %w", err)
+	}
+
+	if ext == ".toml" {
+		var table map[string]interface{}
+		if err := toml.Unmarshal(by, &table); err != nil {
+			return fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+		if by, err = yaml.Marshal(table); err != nil {
+			return fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(by))
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parsing config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c *Config) Validate() error {
+	var errs []error
+	invalid := func(path, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+	}
+
+	if _, _, err := net.SplitHostPort(c.HTTP.Addr); err != nil {
+		invalid("http.addr", "%q is not a host:port address", c.HTTP.Addr)
+	}
+	if _, _, err := net.SplitHostPort(c.WebSocket.Addr); err != nil {
+		invalid("websocket.addr", "%q is not a host:port address", c.WebSocket.Addr)
+	}
+	for _, o := range c.WebSocket.AllowedOrigins {
+		if u, err := url.Parse(o); o != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+			invalid("websocket.allowed_origins", "%q is not an origin such as https://chat.example.com", o)
+		}
+	}
+	if c.HTTP.AvatarDir == "" {
+		invalid("http.avatar_dir", "must not be empty")
+	}
+	if c.HTTP.UploadDir == "" {
+		invalid("http.upload_dir", "must not be empty")
+	}
+	if c.HTTP.MaxAvatarBytes <= 0 {
+		invalid("http.max_avatar_bytes", "must be positive, got %d", c.HTTP.MaxAvatarBytes)
+	}
+	if c.HTTP.MaxAttachmentBytes <= 0 {
+		invalid("http.max_attachment_bytes", "must be positive, got %d", c.HTTP.MaxAttachmentBytes)
+	}
+	validateTypes("http.avatar_types", c.HTTP.AvatarTypes, invalid)
+	validateTypes("http.attachment_types", c.HTTP.AttachmentTypes, invalid)
+	if c.HTTP.UserQuotaBytes < 0 {
+		invalid("http.user_quota_bytes", "must not be negative, got %d", c.HTTP.UserQuotaBytes)
+	}
+	if c.HTTP.MaxUploadBytes <= 0 {
+		invalid("http.max_upload_bytes", "must be positive, got %d", c.HTTP.MaxUploadBytes)
+	}
+	if c.HTTP.MaxChunkBytes <= 0 {
+		invalid("http.max_chunk_bytes", "must be positive, got %d", c.HTTP.MaxChunkBytes)
+	}
+	if c.HTTP.MinTransferRate <= 0 {
+		invalid("http.min_transfer_rate", "must be positive, got %d", c.HTTP.MinTransferRate)
+	}
+	for _, t := range []struct {
+		path string
+		d    time.Duration
+	}{
+		{"http.read_timeout", c.HTTP.ReadTimeout},
+		{"http.write_timeout", c.HTTP.WriteTimeout},
+		{"http.idle_timeout", c.HTTP.IdleTimeout},
+		{"http.upload_expiry", c.HTTP.UploadExpiry},
+		{"storage.gc.grace_period", c.Storage.GC.GracePeriod},
+		{"storage.scan.timeout", c.Storage.Scan.Timeout},
+		{"storage.scan.retry_interval", c.Storage.Scan.RetryInterval},
+		{"websocket.handshake_timeout", c.WebSocket.HandshakeTimeout},
+		{"websocket.write_timeout", c.WebSocket.WriteTimeout},
+		{"websocket.previews.timeout", c.WebSocket.Previews.Timeout},
+		{"websocket.previews.cache_ttl", c.WebSocket.Previews.CacheTTL},
+		{"websocket.rate_limit.abuse_window", c.WebSocket.RateLimit.AbuseWindow},
+		{"redis.dial_timeout", c.Redis.DialTimeout},
+		{"redis.read_timeout", c.Redis.ReadTimeout},
+		{"redis.write_timeout", c.Redis.WriteTimeout},
+		{"redis.pool_timeout", c.Redis.PoolTimeout},
+		{"redis.operation_timeout", c.Redis.OperationTimeout},
+		{"redis.connect_timeout", c.Redis.ConnectTimeout},
+		{"shutdown_timeout", c.ShutdownTimeout},
+	} {
+		if t.d <= 0 {
+			invalid(t.path, "must be positive, got %s", t.d)
+		}
+	}
+	if c.WebSocket.Previews.Workers < 1 {
+		invalid("websocket.previews.workers", "must be at least 1, got %d", c.WebSocket.Previews.Workers)
+	}
+	if c.WebSocket.Previews.MaxBytes <= 0 {
+		invalid("websocket.previews.max_bytes", "must be positive, got %d", c.WebSocket.Previews.MaxBytes)
+	}
+	c.validateRateLimit(invalid)
+	if c.Storage.GC.Interval < 0 {
+		invalid("storage.gc.interval", "must not be negative, got %s", c.Storage.GC.Interval)
+	}
+	if c.ShutdownDelay < 0 {
+		invalid("shutdown_delay", "must not be negative, got %s", c.ShutdownDelay)
+	}
+	if c.Auth.JWTSecret == "" {
+		invalid("auth.jwt_secret", "must not be empty")
+	} else if c.Auth.JWTSecret == DefaultJWTSecret && !c.Dev {
+		invalid("auth.jwt_secret", "the default secret is only allowed with dev set")
+	}
+	if c.Auth.TokenTTL <= 0 {
+		invalid("auth.token_ttl", "must be positive, got %s", c.Auth.TokenTTL)
+	}
+	if c.Auth.SignedURLTTL <= 0 {
+		invalid("auth.signed_url_ttl", "must be positive, got %s", c.Auth.SignedURLTTL)
+	}
+	if c.Auth.PasswordMinLength < 1 {
+		invalid("auth.password_min_length", "must be at least 1, got %d", c.Auth.PasswordMinLength)
+	}
+	c.validateRedis(invalid)
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		invalid("log.level", "must be one of debug, info, warn, error, got %q", c.Log.Level)
+	}
+	if c.Log.Format != "text" && c.Log.Format != "json" {
+		invalid("log.format", "must be text or json, got %q", c.Log.Format)
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout", "otlp":
+	default:
+		invalid("tracing.exporter", "must be one of none, stdout, otlp, got %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		invalid("tracing.sample_ratio", "must be between 0 and 1, got %g", c.Tracing.SampleRatio)
+	}
+	if c.Tracing.ServiceName == "" {
+		invalid("tracing.service_name", "must not be empty")
+	}
+	switch c.Storage.Backend {
+	case "fs":
+	case "s3":
+		if c.Storage.S3.Endpoint == "" {
+			invalid("storage.s3.endpoint", "must be set for the s3 backend")
+		}
+		if c.Storage.S3.Bucket == "" {
+			invalid("storage.s3.bucket", "must be set for the s3 backend")
+		}
+		if strings.Contains(c.Storage.S3.Endpoint, "://") {
+			invalid("storage.s3.endpoint", "must be host:port without a scheme, use storage.s3.use_ssl")
+		}
+	default:
+		invalid("storage.backend", "must be fs or s3, got %q", c.Storage.Backend)
+	}
+	switch c.Storage.Scan.Backend {
+	case "none":
+	case "clamd":
+		if c.Storage.Scan.ClamdAddr == "" {
+			invalid("storage.scan.clamd_addr", "must be set for the clamd backend")
+		}
+	default:
+		invalid("storage.scan.backend", "must be none or clamd, got %q", c.Storage.Scan.Backend)
+	}
+	if c.Storage.Scan.MaxBytes < 0 {
+		invalid("storage.scan.max_bytes", "must not be negative, got %d", c.Storage.Scan.MaxBytes)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateTypes checks an upload allowlist holds type/subtype or type/*
+// entries
+func validateTypes(path string, types []string, invalid func(path, format string, args ...interface{})) {
+	if len(types) == 0 {
+		invalid(path, "must list at least one media type")
+	}
+	for _, t := range types {
+		major, minor, ok := strings.Cut(t, "/")
+		if !ok || major == "" || major == "*" || minor == "" || strings.ContainsAny(t, " ;,") {
+			invalid(path, "%q is not a media type such as image/png or image/*", t)
+		}
+	}
+}
+
+func (c *Config) validateRedis(invalid func(path, format string, args ...interface{})) {
+	r := c.Redis
+	if r.Addr == "" && len(r.Addrs) == 0 {
+		invalid("redis.addr", "must be set (REDIS_CONNECTION_STRING)")
+	}
+	switch r.Mode {
+	case "standalone":
+	case "sentinel":
+		if r.MasterName == "" {
+			invalid("redis.master_name", "must be set in sentinel mode")
+		}
+	case "cluster":
+		if r.DB != 0 {
+			invalid("redis.db", "must be 0 in cluster mode, got %d", r.DB)
+		}
+	default:
+		invalid("redis.mode", "must be one of standalone, sentinel, cluster, got %q", r.Mode)
+	}
+	if r.Mode != "standalone" && strings.Contains(r.Addr, "://") {
+		invalid("redis.addr", "URLs are only supported in standalone mode, use host:port")
+	}
+	if r.DB < 0 {
+		invalid("redis.db", "must not be negative, got %d", r.DB)
+	}
+	if r.PoolSize < 0 {
+		invalid("redis.pool_size", "must not be negative, got %d", r.PoolSize)
+	}
+	if r.MinIdleConns < 0 {
+		invalid("redis.min_idle_conns", "must not be negative, got %d", r.MinIdleConns)
+	}
+	if (r.TLS.CertFile == "") != (r.TLS.KeyFile == "") {
+		invalid("redis.tls", "cert_file and key_file must be set together")
+	}
+}
+
+func (c *Config) validateRateLimit(invalid func(path, format string, args ...interface{})) {
+	rl := c.WebSocket.RateLimit
+	for _, b := range []struct {
+		name  string
+		rate  float64
+		burst int
+	}{{"conn", rl.ConnRate, rl.ConnBurst}, {"user", rl.UserRate, rl.UserBurst}} {
+		if b.rate < 0 {
+			invalid("websocket.rate_limit."+b.name+"_rate", "must not be negative, got %g", b.rate)
+		}
+		if b.rate > 0 && b.burst < 1 {
+			invalid("websocket.rate_limit."+b.name+"_burst", "must be at least 1, got %d", b.burst)
+		}
+	}
+	if rl.MaxThrottled < 0 {
+		invalid("websocket.rate_limit.max_throttled", "must not be negative, got %d", rl.MaxThrottled)
+	}
+}
+
+// Print writes the configuration as YAML with secrets redacted.
+func (c *Config) Print(w io.Writer) error {
+	cp := *c
+	err := walk(&cp, func(s setting) error {
+		if s.field.Tag.Get("secret") == "true" && s.value.String() != "" {
+			s.value.SetString(redacted)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	defer enc.Close()
+
+	return enc.Encode(&cp)
+}
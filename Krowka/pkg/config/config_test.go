@@ -0,0 +1,159 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "krowka.yaml")
+	os.WriteFile(path, []byte(`
+http:
+  addr: ":9000"
+  max_avatar_bytes: 1024
+websocket:
+  addr: ":9001"
+auth:
+  jwt_secret: file-secret
+  token_ttl: 1h
+redis:
+  addr: file:6379
+`), 0644)
+
+	t.Setenv("REDIS_CONNECTION_STRING", "env:6379")
+	t.Setenv("HTTP_ADDR", ":9100")
+	t.Setenv("HTTP_CORS_ORIGINS", "https://a.example, https://b.example")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"--http.addr=:9200", "--redis.db=3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Load(path, flags)
+	if err != nil {
+		t.Fatal("load", err)
+	}
+
+	if c.HTTP.Addr != ":9200" {
+		t.Error("flag should win over env and file, got", c.HTTP.Addr)
+	}
+	if c.Redis.Addr != "env:6379" {
+		t.Error("env should win over file, got", c.Redis.Addr)
+	}
+	if c.WebSocket.Addr != ":9001" || c.HTTP.MaxAvatarBytes != 1024 || c.Auth.TokenTTL != time.Hour {
+		t.Error("file values not applied", c.WebSocket.Addr, c.HTTP.MaxAvatarBytes, c.Auth.TokenTTL)
+	}
+	if c.Redis.DB != 3 {
+		t.Error("flag value not applied, got", c.Redis.DB)
+	}
+	if len(c.HTTP.CORSOrigins) != 2 || c.HTTP.CORSOrigins[1] != "https://b.example" {
+		t.Error("list not parsed from env", c.HTTP.CORSOrigins)
+	}
+	if c.HTTP.MaxAttachmentBytes != 20<<20 {
+		t.Error("default lost", c.HTTP.MaxAttachmentBytes)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "krowka.toml")
+	os.WriteFile(path, []byte(`
+dev = true
+shutdown_timeout = "20s"
+
+[http]
+addr = ":9000"
+cors_origins = ["https://a.example"]
+max_avatar_bytes = 1024
+
+[websocket.rate_limit]
+conn_rate = 2.5
+
+[storage.scan]
+backend = "clamd"
+`), 0644)
+	t.Setenv("REDIS_CONNECTION_STRING", "localhost:6379")
+
+	c, err := Load(path, nil)
+	if err != nil {
+		t.Fatal("load", err)
+	}
+	if c.HTTP.Addr != ":9000" || c.HTTP.MaxAvatarBytes != 1024 || len(c.HTTP.CORSOrigins) != 1 {
+		t.Error("http not applied", c.HTTP.Addr, c.HTTP.MaxAvatarBytes, c.HTTP.CORSOrigins)
+	}
+	if !c.Dev || c.ShutdownTimeout != 20*time.Second || c.WebSocket.RateLimit.ConnRate != 2.5 || c.Storage.Scan.Backend != "clamd" {
+		t.Error("values not applied", c.Dev, c.ShutdownTimeout, c.WebSocket.RateLimit.ConnRate, c.Storage.Scan.Backend)
+	}
+	if c.WebSocket.Addr != Default().WebSocket.Addr {
+		t.Error("default lost", c.WebSocket.Addr)
+	}
+
+	// unknown keys are refused as in YAML
+	os.WriteFile(path, []byte("[http]\nadress = \":9000\"\n"), 0644)
+	if _, err := Load(path, nil); err == nil || !strings.Contains(err.Error(), "adress") {
+		t.Error("expected unknown key to be refused, got", err)
+	}
+}
+
+func TestLoadValidation(t *testing.T) {
+	t.Setenv("REDIS_CONNECTION_STRING", "")
+	t.Setenv("MAX_ATTACHMENT_BYTES", "0")
+	t.Setenv("SCAN_BACKEND", "antivirus")
+	t.Setenv("PREVIEW_WORKERS", "0")
+	t.Setenv("WS_USER_BURST", "0")
+	t.Setenv("WS_ALLOWED_ORIGINS", "https://chat.example.com,chat.example.com")
+
+	_, err := Load("", nil)
+	if err == nil {
+		t.Fatal("expected validation error")
+	}
+
+	for _, want := range []string{"redis.addr", "http.max_attachment_bytes", "storage.scan.backend", "websocket.previews.workers", "websocket.rate_limit.user_burst", "websocket.allowed_origins"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+
+	// the built-in JWT secret is only good for development
+	for _, dev := range []string{"false", "true"} {
+		t.Setenv("KROWKA_DEV", dev)
+		_, err := Load("", nil)
+		if refused := strings.Contains(err.Error(), "auth.jwt_secret"); refused != (dev == "false") {
+			t.Errorf("dev %s: error %q", dev, err)
+		}
+	}
+
+	ini := filepath.Join(t.TempDir(), "krowka.ini")
+	os.WriteFile(ini, []byte("[http]\naddr = :9000\n"), 0644)
+	if _, err := Load(ini, nil); err == nil || !strings.Contains(err.Error(), "TOML") {
+		t.Error("expected an unknown format to be refused, got", err)
+	}
+
+	t.Setenv("MAX_ATTACHMENT_BYTES", "lots")
+	if _, err := Load("", nil); err == nil || !strings.Contains(err.Error(), "$MAX_ATTACHMENT_BYTES") {
+		t.Error("expected parse error naming the variable, got", err)
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	c := Default()
+	c.Redis.Password = "hunter2"
+
+	var buf bytes.Buffer
+	if err := c.Print(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	if strings.Contains(out, "hunter2") || strings.Contains(out, "dev-secret-change-me") {
+		t.Error("secret leaked:\n", out)
+	}
+	if c.Redis.Password != "hunter2" {
+		t.Error("Print modified the config")
+	}
+}
@@ -0,0 +1,195 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FlagValues collects the settings passed on the command line, keyed by
+// their dotted YAML path.
+type FlagValues map[string]string
+
+// setting is one leaf field of Config.
+type setting struct {
+	path  string
+	field reflect.StructField
+	value reflect.Value
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// walk calls fn for every leaf setting of c in declaration order.
+func walk(c *Config, fn func(setting) error) error {
+	return walkStruct(reflect.ValueOf(c).Elem(), "", fn)
+}
+
+func walkStruct(v reflect.Value, prefix string, fn func(setting) error) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+
+		fv := v.Field(i)
+		if fv.Kind() == reflect.Struct && fv.Type() != durationType {
+			if err := walkStruct(fv, path, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := fn(setting{path: path, field: f, value: fv}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RegisterFlags defines a flag for every setting on fs. The returned map is
+// filled while fs parses and is passed to Load.
+func RegisterFlags(fs *flag.FlagSet) FlagValues {
+	values := FlagValues{}
+
+	walk(Default(), func(s setting) error {
+		usage := "overrides " + s.path
+		if env := s.field.Tag.Get("env"); env != "" {
+			usage += " and $" + env
+		}
+
+		path := s.path
+		fs.Func(path, usage, func(raw string) error {
+			values[path] = raw
+			return nil
+		})
+		return nil
+	})
+
+	return values
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	return walk(c, func(s setting) error {
+		env := s.field.Tag.Get("env")
+		if env == "" {
+			return nil
+		}
+
+		raw, ok := lookup(env)
+		if !ok {
+			return nil
+		}
+
+		if err := setValue(s.value, raw); err != nil {
+			return fmt.Errorf("%s: invalid value in $%s: %w", s.path, env, err)
+		}
+		return nil
+	})
+}
+
+func (c *Config) applyFlags(values FlagValues) error {
+	if len(values) == 0 {
+		return nil
+	}
+
+	seen := map[string]bool{}
+	err := walk(c, func(s setting) error {
+		raw, ok := values[s.path]
+		if !ok {
+			return nil
+		}
+		seen[s.path] = true
+
+		if err := setValue(s.value, raw); err != nil {
+			return fmt.Errorf("%s: invalid value in --%s: %w", s.path, s.path, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var unknown []string
+	for path := range values {
+		if !seen[path] {
+			unknown = append(unknown, path)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown settings: %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// setValue parses raw into v according to v's type. Lists are comma
+// separated, durations use time.ParseDuration syntax.
+func setValue(v reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	if v.Type() == durationType {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(raw, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(raw, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("unsupported list type %s", v.Type())
+		}
+		list := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+
+	return nil
+}
@@ -0,0 +1,104 @@
+// Package filetype detects the type of uploaded files from their bytes and
+// decides which types may be stored.
+package filetype
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// SniffLen is how many leading bytes Detect looks at
+const SniffLen = 512
+
+// Detect returns the media type of a file starting with head, without
+// parameters, e.g. "image/png". Unknown binary data is
+// application/octet-stream.
+func Detect(head []byte) string {
+	t := base(http.DetectContentType(head))
+
+	// SVG sniffs as XML or plain text but runs script when opened
+	if strings.HasPrefix(t, "text/") && bytes.Contains(bytes.ToLower(head), []byte("<svg")) {
+		return "image/svg+xml"
+	}
+	return t
+}
+
+// activeTypes are run by the browser when opened from our origin
+var activeTypes = map[string]bool{
+	"text/html":                     true,
+	"application/xhtml+xml":         true,
+	"image/svg+xml":                 true,
+	"text/xml":                      true,
+	"application/xml":               true,
+	"text/javascript":               true,
+	"application/javascript":        true,
+	"application/x-javascript":      true,
+	"application/ecmascript":        true,
+	"application/x-shockwave-flash": true,
+}
+
+var activeExtensions = map[string]bool{
+	".html": true, ".htm": true, ".shtml": true, ".xhtml": true, ".xht": true,
+	".svg": true, ".svgz": true, ".xml": true, ".xsl": true,
+	".js": true, ".mjs": true, ".swf": true, ".hta": true,
+}
+
+// Active reports whether a file of mediaType, or named filename, could run
+// script in a browser. Either may be empty. Such files are never stored,
+// whatever the allowlist says.
+func Active(mediaType, filename string) bool {
+	return activeTypes[base(mediaType)] || activeExtensions[strings.ToLower(path.Ext(filename))]
+}
+
+// Allowed reports whether mediaType matches one of patterns, which are
+// media types or wildcards such as "image/*"
+func Allowed(patterns []string, mediaType string) bool {
+	mediaType = base(mediaType)
+	for _, p := range patterns {
+		if p == mediaType {
+			return true
+		}
+		if prefix, ok := strings.CutSuffix(p, "/*"); ok && strings.HasPrefix(mediaType, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// extensions are the canonical file extensions of the types we store
+var extensions = map[string]string{
+	"image/png":       ".png",
+	"image/jpeg":      ".jpg",
+	"image/gif":       ".gif",
+	"image/webp":      ".webp",
+	"video/mp4":       ".mp4",
+	"video/webm":      ".webm",
+	"audio/mpeg":      ".mp3",
+	"application/ogg": ".ogg",
+	"audio/wave":      ".wav",
+	"application/pdf": ".pdf",
+	"application/zip": ".zip",
+	"text/plain":      ".txt",
+}
+
+// Extension returns the file extension for mediaType, or "" if unknown
+func Extension(mediaType string) string {
+	if ext, ok := extensions[base(mediaType)]; ok {
+		return ext
+	}
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+func base(mediaType string) string {
+	t, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(mediaType))
+	}
+	return t
+}
@@ -0,0 +1,62 @@
+package filetype
+
+import "testing"
+
+func TestDetect(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		head string
+		want string
+	}{
+		{"png", "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR", "image/png"},
+		{"jpeg", "\xff\xd8\xff\xe0\x00\x10JFIF", "image/jpeg"},
+		{"pdf", "%PDF-1.7\n", "application/pdf"},
+		{"text", "just some notes\n", "text/plain"},
+		{"html", "<!DOCTYPE html><script>alert(1)</script>", "text/html"},
+		{"svg with prolog", `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"><script/></svg>`, "image/svg+xml"},
+		{"bare svg", `<svg onload="alert(1)"></svg>`, "image/svg+xml"},
+		{"binary", "\x00\x01\x02\x03", "application/octet-stream"},
+	} {
+		if got := Detect([]byte(tc.head)); got != tc.want {
+			t.Errorf("%s: Detect = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestActive(t *testing.T) {
+	for _, tc := range []struct {
+		mediaType, filename string
+		want                bool
+	}{
+		{"image/png", "cat.png", false},
+		{"text/plain", "notes.txt", false},
+		{"text/html; charset=utf-8", "", true},
+		{"image/svg+xml", "logo.png", true},
+		{"text/plain", "page.HTML", true},
+		{"", "x.svg", true},
+		{"", "", false},
+	} {
+		if got := Active(tc.mediaType, tc.filename); got != tc.want {
+			t.Errorf("Active(%q, %q) = %t, want %t", tc.mediaType, tc.filename, got, tc.want)
+		}
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	patterns := []string{"image/*", "application/pdf"}
+	for _, tc := range []struct {
+		mediaType string
+		want      bool
+	}{
+		{"image/png", true},
+		{"image/webp", true},
+		{"application/pdf", true},
+		{"text/plain; charset=utf-8", false},
+		{"imagex/png", false},
+		{"application/pdfx", false},
+	} {
+		if got := Allowed(patterns, tc.mediaType); got != tc.want {
+			t.Errorf("Allowed(%q) = %t, want %t", tc.mediaType, got, tc.want)
+		}
+	}
+}
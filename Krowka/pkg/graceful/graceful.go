@@ -0,0 +1,63 @@
+package graceful
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Options control how a server stops once its context is cancelled.
+type Options struct {
+	// Timeout bounds how long in-flight requests may take to finish
+	Timeout time.Duration
+	// DrainDelay keeps accepting connections for a while after the context
+	// is cancelled so load balancers notice the failing readiness probe
+	DrainDelay time.Duration
+	// OnShutdown runs as soon as the context is cancelled
+	OnShutdown func()
+}
+
+// Serve listens on srv.Addr and serves until ctx is cancelled, then stops
+// accepting connections and waits for in-flight requests.
+func Serve(ctx context.Context, srv *http.Server, opts Options) error {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return err
+	}
+
+	return ServeListener(ctx, srv, ln, opts)
+}
+
+// ServeListener is Serve on an existing listener.
+func ServeListener(ctx context.Context, srv *http.Server, ln net.Listener, opts Options) error {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		// the server stopped on its own, e.g. the listener failed
+		return err
+	case <-ctx.Done():
+	}
+
+	if opts.OnShutdown != nil {
+		opts.OnShutdown()
+	}
+	if opts.DrainDelay > 0 {
+		time.Sleep(opts.DrainDelay)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), opts.Timeout)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if serveErr := <-errc; !errors.Is(serveErr, http.ErrServerClosed) {
+		return serveErr
+	}
+
+	return err
+}
@@ -0,0 +1,125 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CheckTimeout bounds every readiness check
+const CheckTimeout = 2 * time.Second
+
+// Check reports whether one dependency is usable
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker serves /healthz and /readyz for a server
+type Checker struct {
+	checks       []namedCheck
+	shuttingDown atomic.Bool
+}
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type report struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+func New() *Checker {
+	return &Checker{}
+}
+
+// Add registers a readiness check. Checks must be added before serving.
+func (c *Checker) Add(name string, check Check) {
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// SetShuttingDown makes readiness fail from now on
+func (c *Checker) SetShuttingDown() {
+	c.shuttingDown.Store(true)
+}
+
+// Liveness answers as long as the process can serve requests
+func (c *Checker) Liveness(w http.ResponseWriter, r *http.Request) {
+	writeReport(w, http.StatusOK, &report{Status: "ok"})
+}
+
+// Readiness runs every check concurrently and fails if any of them does
+// or the server is shutting down.
+func (c *Checker) Readiness(w http.ResponseWriter, r *http.Request) {
+	res := &report{Status: "ok", Checks: make(map[string]checkResult, len(c.checks))}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, nc := range c.checks {
+		wg.Add(1)
+		go func(nc namedCheck) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), CheckTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := nc.check(ctx)
+			cr := checkResult{
+				Status:    "ok",
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				cr.Status = "fail"
+				cr.Error = err.Error()
+			}
+
+			mu.Lock()
+			res.Checks[nc.name] = cr
+			if err != nil {
+				res.Status = "fail"
+			}
+			mu.Unlock()
+		}(nc)
+	}
+	wg.Wait()
+
+	if c.shuttingDown.Load() {
+		res.Status = "shutting_down"
+	}
+
+	status := http.StatusOK
+	if res.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+	writeReport(w, status, res)
+}
+
+func writeReport(w http.ResponseWriter, status int, res *report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
+// DirWritable checks that a file can be created in dir
+func DirWritable(dir string) Check {
+	return func(ctx context.Context) error {
+		f, err := os.CreateTemp(dir, ".readyz-*")
+		if err != nil {
+			return err
+		}
+		name := f.Name()
+		f.Close()
+		return os.Remove(name)
+	}
+}
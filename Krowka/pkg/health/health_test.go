@@ -0,0 +1,60 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func readiness(t *testing.T, c *Checker) (int, report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	c.Readiness(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	var res report
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal("decode", err)
+	}
+	return rec.Code, res
+}
+
+func TestReadiness(t *testing.T) {
+	redisUp := true
+	c := New()
+	c.Add("redis", func(ctx context.Context) error {
+		if !redisUp {
+			return errors.New("connection refused")
+		}
+		return nil
+	})
+	c.Add("upload_dir", DirWritable(t.TempDir()))
+
+	code, res := readiness(t, c)
+	if code != http.StatusOK || res.Status != "ok" || len(res.Checks) != 2 {
+		t.Fatal("expected ready", code, res)
+	}
+
+	redisUp = false
+	code, res = readiness(t, c)
+	if code != http.StatusServiceUnavailable || res.Checks["redis"].Error != "connection refused" {
+		t.Fatal("expected redis failure", code, res)
+	}
+	if res.Checks["upload_dir"].Status != "ok" {
+		t.Error("healthy check reported as failing", res.Checks["upload_dir"])
+	}
+
+	redisUp = true
+	c.SetShuttingDown()
+	if code, res = readiness(t, c); code != http.StatusServiceUnavailable || res.Status != "shutting_down" {
+		t.Fatal("expected readiness to fail during shutdown", code, res)
+	}
+
+	rec := httptest.NewRecorder()
+	c.Liveness(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Error("liveness should not depend on shutdown", rec.Code)
+	}
+}
@@ -0,0 +1,396 @@
+package httpserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/blobstore"
+	"Krowka/pkg/filetype"
+	"Krowka/pkg/redisrepo"
+
+	"github.com/gorilla/mux"
+)
+
+// attachment IDs are 128 random bits, hex encoded
+var attachmentIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// attachmentLinkPattern finds attachment links in message text
+var attachmentLinkPattern = regexp.MustCompile(`/v1/attachments/([0-9a-f]{32})`)
+
+// inlineTypes may be shown by the browser, everything else is downloaded
+var inlineTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+	"video/mp4":  true,
+	"video/webm": true,
+	"audio/mpeg": true,
+	"audio/ogg":  true,
+}
+
+func newAttachmentID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func attachmentPath(id string) string {
+	return "/v1/attachments/" + id
+}
+
+// attachmentRes is an attachment as returned to its participants, URL and
+// ThumbnailURL are signed links valid until ExpiresAt
+type attachmentRes struct {
+	*model.Attachment
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnailUrl,omitempty"`
+	ExpiresAt    int64  `json:"expiresAt"`
+}
+
+func (s *server) newAttachmentRes(a *model.Attachment) *attachmentRes {
+	u, exp := s.signedAttachmentURL(a.ID, time.Now())
+	res := &attachmentRes{Attachment: a, URL: u, ExpiresAt: exp.Unix()}
+	if a.ThumbMIME != "" {
+		// the signature covers the ID, so it is valid for the thumbnail too
+		path, query, _ := strings.Cut(u, "?")
+		res.ThumbnailURL = path + "/thumbnail?" + query
+	}
+	return res
+}
+
+// attachmentUploadHandler stores a file sent to the peer named in the to
+// form field under a random ID, the content is shared with any attachment
+// of the same bytes
+func (s *server) attachmentUploadHandler(w http.ResponseWriter, r *http.Request, user string) {
+	kind, e := s.attachmentKind(r.Context(), user)
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+	id := newAttachmentID()
+	up, e := receiveFile(w, r, kind, func(string, string) string { return id })
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+
+	a := &model.Attachment{
+		ID:        id,
+		Owner:     user,
+		Peer:      up.fields.Get("to"),
+		Name:      up.filename,
+		MIME:      up.contentType,
+		Size:      up.size,
+		CreatedAt: time.Now().Unix(),
+	}
+	if e := checkRecipient(r.Context(), a.Peer); e != nil {
+		discard(r, attachmentStore, id)
+		writeError(w, r, e)
+		return
+	}
+
+	if e := s.storeContent(r.Context(), a, up.key, up.sha256, 0); e != nil {
+		writeError(w, r, e)
+		return
+	}
+	if e := s.saveAttachment(r, a); e != nil {
+		writeError(w, r, e)
+		return
+	}
+	writeJSON(w, http.StatusOK, &response{Status: true, Data: s.newAttachmentRes(a)})
+}
+
+// saveAttachment adds the preview and records a, whose content is stored
+// and charged to the owner, then has it scanned. Both are given back if
+// recording fails.
+func (s *server) saveAttachment(r *http.Request, a *model.Attachment) *apiError {
+	addPreview(r.Context(), a)
+	s.prepareScan(r.Context(), a)
+	if err := redisrepo.SaveAttachment(r.Context(), a); err != nil {
+		if _, err := releaseContent(r.Context(), a); err != nil {
+			slog.WarnContext(r.Context(), "releasing attachment content failed", "attachment_id", a.ID, "error", err)
+		}
+		if a.ThumbMIME != "" {
+			discard(r, attachmentStore, thumbnailKey(a.ID))
+		}
+		return repoError(err, "unable to store attachment")
+	}
+
+	slog.InfoContext(r.Context(), "attachment stored", "attachment_id", a.ID, "size", a.Size, "status", a.Status)
+	s.startScan(r.Context(), a)
+	return nil
+}
+
+// releaseStorage gives back the quota of a file that was not kept
+func releaseStorage(ctx context.Context, user string, size int64) {
+	if err := redisrepo.ReleaseStorage(context.WithoutCancel(ctx), user, size); err != nil {
+		slog.WarnContext(ctx, "releasing storage failed", "error", err)
+	}
+}
+
+// checkRecipient verifies the to field of an upload names a user
+func checkRecipient(ctx context.Context, peer string) *apiError {
+	if peer == "" {
+		return invalidFields(required("to"))
+	}
+	ok, err := redisrepo.IsUserExist(ctx, peer)
+	if err != nil {
+		return repoError(err, "unable to store attachment")
+	}
+	if !ok {
+		return userNotFound("unknown recipient")
+	}
+	return nil
+}
+
+// discard removes an upload whose request failed after it was stored
+func discard(r *http.Request, store blobstore.Store, key string) {
+	if err := store.Delete(context.WithoutCancel(r.Context()), key); err != nil {
+		slog.WarnContext(r.Context(), "removing rejected upload failed", "key", key, "error", err)
+	}
+}
+
+// loadAttachment fetches the attachment named by the {id} path variable
+func loadAttachment(r *http.Request) (*model.Attachment, *apiError) {
+	id := mux.Vars(r)["id"]
+	if !attachmentIDPattern.MatchString(id) {
+		return nil, newError(http.StatusNotFound, codeNotFound, "no such attachment")
+	}
+	a, err := redisrepo.GetAttachment(r.Context(), id)
+	if err != nil {
+		return nil, repoError(err, "unable to load attachment")
+	}
+	return a, nil
+}
+
+// downloadableAttachment loads the attachment for a participant presenting
+// a bearer token, or for anyone holding an unexpired signed link, once the
+// malware scan let it through
+func (s *server) downloadableAttachment(r *http.Request) (*model.Attachment, *apiError) {
+	q := r.URL.Query()
+	signed := q.Has("sig")
+
+	var user string
+	if signed {
+		if !s.validSignature(mux.Vars(r)["id"], q.Get("expires"), q.Get("sig"), time.Now()) {
+			return nil, forbidden("invalid or expired link")
+		}
+	} else {
+		var e *apiError
+		if user, e = s.userFromToken(r); e != nil {
+			return nil, e
+		}
+	}
+
+	a, e := loadAttachment(r)
+	if e != nil {
+		return nil, e
+	}
+	if !signed {
+		if e := attachmentParticipant(a, user); e != nil {
+			return nil, e
+		}
+	}
+	if !a.Downloadable() {
+		return nil, notDownloadable(a)
+	}
+	return a, nil
+}
+
+// downloadAttachmentHandler serves the file, see downloadableAttachment
+// for who may download it
+func (s *server) downloadAttachmentHandler(w http.ResponseWriter, r *http.Request) {
+	a, e := s.downloadableAttachment(r)
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+
+	f, _, err := attachmentStore.Open(r.Context(), fileKey(a))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "attachment file unavailable", "attachment_id", a.ID, "error", err)
+		writeError(w, r, repoError(err, "unable to read attachment"))
+		return
+	}
+	defer f.Close()
+
+	s.extendWriteDeadline(w, r, a.Size)
+	serveAttachment(w, r, a, f)
+}
+
+// attachmentThumbnailHandler serves the thumbnail or video poster of an
+// attachment to whoever may download the attachment itself
+func (s *server) attachmentThumbnailHandler(w http.ResponseWriter, r *http.Request) {
+	a, e := s.downloadableAttachment(r)
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+	if a.ThumbMIME == "" {
+		writeError(w, r, newError(http.StatusNotFound, codeNotFound, "attachment has no thumbnail"))
+		return
+	}
+
+	f, _, err := attachmentStore.Open(r.Context(), thumbnailKey(a.ID))
+	if err != nil {
+		slog.ErrorContext(r.Context(), "thumbnail file unavailable", "attachment_id", a.ID, "error", err)
+		writeError(w, r, repoError(err, "unable to read thumbnail"))
+		return
+	}
+	defer f.Close()
+
+	thumb := *a
+	thumb.MIME = a.ThumbMIME
+	thumb.Name = "thumbnail" + filetype.Extension(a.ThumbMIME)
+	serveAttachment(w, r, &thumb, f)
+}
+
+// serveAttachment writes the file with headers that stop browsers from
+// running uploaded content on our origin
+func serveAttachment(w http.ResponseWriter, r *http.Request, a *model.Attachment, content io.ReadSeeker) {
+	mimeType, _, err := mime.ParseMediaType(a.MIME)
+	if err != nil {
+		mimeType = "application/octet-stream"
+	}
+
+	disposition := "attachment"
+	if inlineTypes[mimeType] {
+		disposition = "inline"
+	}
+	if d := mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}); d != "" {
+		disposition = d
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", mimeType)
+	h.Set("Content-Disposition", disposition)
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	h.Set("Cache-Control", "private, max-age=300")
+
+	http.ServeContent(w, r, "", time.Unix(a.CreatedAt, 0), content)
+}
+
+// attachmentURLHandler issues a fresh signed link to a participant
+func (s *server) attachmentURLHandler(w http.ResponseWriter, r *http.Request, user string) {
+	a, e := loadAttachment(r)
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+	if e := attachmentParticipant(a, user); e != nil {
+		writeError(w, r, e)
+		return
+	}
+
+	res := s.newAttachmentRes(a)
+	data := map[string]interface{}{
+		"url":       res.URL,
+		"expiresAt": res.ExpiresAt,
+	}
+	if res.ThumbnailURL != "" {
+		data["thumbnailUrl"] = res.ThumbnailURL
+	}
+	writeJSON(w, http.StatusOK, &response{Status: true, Data: data})
+}
+
+// chatRes is a message with its attachments, including signed links.
+// Attachments replaces the references of the stored chat in the JSON.
+type chatRes struct {
+	model.Chat
+	Attachments []*attachmentRes `json:"attachments,omitempty"`
+}
+
+// withAttachments looks up the attachments sent with, or linked from the
+// text of, each message of the conversation between user and peer. Links
+// to files of other conversations are left without metadata.
+func (s *server) withAttachments(ctx context.Context, user, peer string, chats []model.Chat) ([]chatRes, error) {
+	res := make([]chatRes, len(chats))
+	links := make([][]string, len(chats))
+	var ids []string
+	seen := map[string]bool{}
+	for i, c := range chats {
+		res[i].Chat = c
+		inMsg := map[string]bool{}
+		refs := make([]string, 0, len(c.Attachments))
+		for _, ref := range c.Attachments {
+			refs = append(refs, ref.ID)
+		}
+		for _, m := range attachmentLinkPattern.FindAllStringSubmatch(c.Msg, -1) {
+			refs = append(refs, m[1])
+		}
+		for _, id := range refs {
+			if !inMsg[id] {
+				inMsg[id] = true
+				links[i] = append(links[i], id)
+				if !seen[id] {
+					seen[id] = true
+					ids = append(ids, id)
+				}
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return res, nil
+	}
+
+	found, err := redisrepo.GetAttachments(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range res {
+		for _, id := range links[i] {
+			a, ok := found[id]
+			if !ok || !a.IsParticipant(user) || !a.IsParticipant(peer) {
+				continue
+			}
+			res[i].Attachments = append(res[i].Attachments, s.newAttachmentRes(a))
+		}
+	}
+	return res, nil
+}
+
+// conversationMediaHandler lists the attachments exchanged with {peer},
+// newest first, optionally between from-ts and to-ts
+func (s *server) conversationMediaHandler(w http.ResponseWriter, r *http.Request, user string) {
+	peer := mux.Vars(r)["peer"]
+	fromTS, toTS, e := timeRange(r)
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+
+	ok, err := redisrepo.IsUserExist(r.Context(), peer)
+	if err != nil {
+		writeError(w, r, repoError(err, "unable to fetch media"))
+		return
+	}
+	if !ok {
+		writeError(w, r, userNotFound("incorrect username"))
+		return
+	}
+
+	media, err := redisrepo.FetchConversationMedia(r.Context(), user, peer, fromTS, toTS)
+	if err != nil {
+		writeError(w, r, repoError(err, "unable to fetch media"))
+		return
+	}
+	res := make([]*attachmentRes, 0, len(media))
+	for _, a := range media {
+		// only files the two sent each other, whatever the index says
+		if a.IsParticipant(user) && a.IsParticipant(peer) {
+			res = append(res, s.newAttachmentRes(a))
+		}
+	}
+	writeJSON(w, http.StatusOK, &response{Status: true, Data: res, Total: len(res)})
+}
@@ -0,0 +1,481 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/config"
+	"Krowka/pkg/redisrepo"
+)
+
+func uploadForm(t *testing.T, to, name, mimeType, content string) (*bytes.Buffer, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("to", to)
+	h := make(map[string][]string)
+	h["Content-Disposition"] = []string{`form-data; name="file"; filename="` + name + `"`}
+	h["Content-Type"] = []string{mimeType}
+	fw, err := mw.CreatePart(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write([]byte(content))
+	mw.Close()
+	return &buf, mw.FormDataContentType()
+}
+
+func authed(t *testing.T, h *server, req *http.Request, user string) *httptest.ResponseRecorder {
+	t.Helper()
+	if user != "" {
+		token, err := h.issueToken(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAttachmentDownload(t *testing.T) {
+	h := newTestServer(t)
+	ctx := context.Background()
+	for _, u := range []string{"alice", "bob", "carol"} {
+		if err := redisrepo.RegisterNewUser(ctx, u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body, ct := uploadForm(t, "bob", "../notes.txt", "text/plain", "hello bob")
+	req := httptest.NewRequest(http.MethodPost, "/v1/attachments", body)
+	req.Header.Set("Content-Type", ct)
+	rec := authed(t, h, req, "alice")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body)
+	}
+	var res struct {
+		Data attachmentRes `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	a := res.Data
+	if !attachmentIDPattern.MatchString(a.ID) || a.Owner != "alice" || a.Peer != "bob" || a.Name != "notes.txt" || a.MIME != "text/plain" || a.Size != 9 {
+		t.Fatalf("unexpected attachment %+v", a.Attachment)
+	}
+
+	get := func(path, user string) *httptest.ResponseRecorder {
+		return authed(t, h, httptest.NewRequest(http.MethodGet, path, nil), user)
+	}
+
+	for _, user := range []string{"alice", "bob"} {
+		rec := get(attachmentPath(a.ID), user)
+		if rec.Code != http.StatusOK || rec.Body.String() != "hello bob" {
+			t.Fatalf("%s: %d %s", user, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("X-Content-Type-Options"); got != "nosniff" {
+			t.Errorf("X-Content-Type-Options = %q", got)
+		}
+		if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename=notes.txt` {
+			t.Errorf("Content-Disposition = %q", got)
+		}
+	}
+
+	if rec := get(attachmentPath(a.ID), "carol"); rec.Code != http.StatusForbidden {
+		t.Errorf("carol: got %d", rec.Code)
+	}
+	if rec := get(attachmentPath(a.ID), ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("no token: got %d", rec.Code)
+	}
+	if rec := get(attachmentPath(strings.Repeat("0", 32)), "alice"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown id: got %d", rec.Code)
+	}
+	if rec := get("/uploads/"+a.ID, ""); rec.Code != http.StatusNotFound {
+		t.Errorf("/uploads/ still served: got %d", rec.Code)
+	}
+
+	// the signed link works without a token, tampering breaks it
+	if rec := get(a.URL, ""); rec.Code != http.StatusOK {
+		t.Errorf("signed url: got %d %s", rec.Code, rec.Body)
+	}
+	u, _ := url.Parse(a.URL)
+	q := u.Query()
+	q.Set("expires", q.Get("expires")+"0")
+	if rec := get(u.Path+"?"+q.Encode(), ""); rec.Code != http.StatusForbidden {
+		t.Errorf("tampered expiry: got %d", rec.Code)
+	}
+	expired, _ := h.signedAttachmentURL(a.ID, time.Now().Add(-time.Hour))
+	if rec := get(expired, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("expired url: got %d", rec.Code)
+	}
+	other, _ := h.signedAttachmentURL(strings.Repeat("0", 32), time.Now())
+	other = attachmentPath(a.ID) + other[strings.Index(other, "?"):]
+	if rec := get(other, ""); rec.Code != http.StatusForbidden {
+		t.Errorf("signature of another id: got %d", rec.Code)
+	}
+
+	if rec := get(attachmentPath(a.ID)+"/url", "bob"); rec.Code != http.StatusOK {
+		t.Errorf("refresh url: got %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestAttachmentUploadNeedsKnownRecipient(t *testing.T) {
+	h := newTestServer(t)
+	if err := redisrepo.RegisterNewUser(context.Background(), "alice", "alice secret password"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		to   string
+		want int
+	}{
+		{"", http.StatusUnprocessableEntity},
+		{"nobody", http.StatusNotFound},
+	} {
+		body, ct := uploadForm(t, tc.to, "a.png", "image/png", "png")
+		req := httptest.NewRequest(http.MethodPost, "/v1/attachments", body)
+		req.Header.Set("Content-Type", ct)
+		if rec := authed(t, h, req, "alice"); rec.Code != tc.want {
+			t.Errorf("to=%q: got %d, want %d", tc.to, rec.Code, tc.want)
+		}
+	}
+}
+
+func TestAttachmentUploadIsStreamed(t *testing.T) {
+	h := newTestServer(t)
+	for _, u := range []string{"alice", "bob"} {
+		if err := redisrepo.RegisterNewUser(context.Background(), u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.cfg.HTTP.MaxAttachmentBytes = 10
+
+	post := func(body *bytes.Buffer, ct string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/attachments", body)
+		req.Header.Set("Content-Type", ct)
+		return authed(t, h, req, "alice")
+	}
+
+	// fields after the file are still read
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("file", "a.txt")
+	fw.Write([]byte("0123456789"))
+	mw.WriteField("to", "bob")
+	mw.Close()
+	if rec := post(&buf, mw.FormDataContentType()); rec.Code != http.StatusOK {
+		t.Fatalf("file before to: %d %s", rec.Code, rec.Body)
+	}
+
+	body, ct := uploadForm(t, "bob", "big.txt", "text/plain", "01234567890")
+	rec := post(body, ct)
+	if rec.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("over the limit: %d %s", rec.Code, rec.Body)
+	}
+
+	// the rejected upload and the one to an unknown user are removed
+	body, ct = uploadForm(t, "nobody", "a.txt", "text/plain", "x")
+	if rec := post(body, ct); rec.Code != http.StatusNotFound {
+		t.Fatalf("unknown recipient: %d", rec.Code)
+	}
+	entries, err := os.ReadDir(h.cfg.HTTP.UploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("want only the accepted upload in the store, got %d files", len(entries))
+	}
+}
+
+func TestAttachmentDeduplication(t *testing.T) {
+	h := newTestServer(t)
+	ctx := context.Background()
+	for _, u := range []string{"alice", "bob", "carol"} {
+		if err := redisrepo.RegisterNewUser(ctx, u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upload := func(from, to, name string) *model.Attachment {
+		t.Helper()
+		body, ct := uploadForm(t, to, name, "text/plain", "forwarded to everyone")
+		req := httptest.NewRequest(http.MethodPost, "/v1/attachments", body)
+		req.Header.Set("Content-Type", ct)
+		rec := authed(t, h, req, from)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("upload by %s: %d %s", from, rec.Code, rec.Body)
+		}
+		var res struct {
+			Data attachmentRes `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return res.Data.Attachment
+	}
+	toBob := upload("alice", "bob", "a.txt")
+	toCarol := upload("alice", "carol", "b.txt")
+	fromBob := upload("bob", "alice", "c.txt")
+	if toBob.ID == toCarol.ID || toBob.ID == fromBob.ID {
+		t.Fatal("copies share an ID")
+	}
+
+	// each copy keeps its name and participants
+	for _, tc := range []struct {
+		a          *model.Attachment
+		user, name string
+	}{{toBob, "bob", "a.txt"}, {toCarol, "carol", "b.txt"}, {fromBob, "alice", "c.txt"}} {
+		rec := authed(t, h, httptest.NewRequest(http.MethodGet, attachmentPath(tc.a.ID), nil), tc.user)
+		if rec.Code != http.StatusOK || rec.Body.String() != "forwarded to everyone" ||
+			rec.Header().Get("Content-Disposition") != "attachment; filename="+tc.name {
+			t.Errorf("%s downloads %s: %d %q", tc.user, tc.name, rec.Code, rec.Header().Get("Content-Disposition"))
+		}
+	}
+	if rec := authed(t, h, httptest.NewRequest(http.MethodGet, attachmentPath(toCarol.ID), nil), "bob"); rec.Code != http.StatusForbidden {
+		t.Errorf("bob downloads the copy sent to carol: %d", rec.Code)
+	}
+
+	var files []string
+	filepath.WalkDir(h.cfg.HTTP.UploadDir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			rel, _ := filepath.Rel(h.cfg.HTTP.UploadDir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	stored, _ := redisrepo.GetAttachment(ctx, toBob.ID)
+	if len(files) != 1 || files[0] != contentKey(stored.Blob) {
+		t.Errorf("stored files %v", files)
+	}
+	if refs, _ := redisrepo.BlobRefs(ctx, stored.Blob); refs != 3 {
+		t.Errorf("content has %d references", refs)
+	}
+	// each sender is charged once for the content
+	for _, u := range []string{"alice", "bob"} {
+		if usage, _ := redisrepo.GetStorageUsage(ctx, u); usage.UsedBytes != 21 || usage.Files != 1 {
+			t.Errorf("%s uses %+v", u, usage)
+		}
+	}
+}
+
+// opaquePNG is a w x h PNG without transparency
+func opaquePNG(t *testing.T, w, h int) string {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestAttachmentPreview(t *testing.T) {
+	h := newTestServer(t)
+	for _, u := range []string{"alice", "bob", "carol"} {
+		if err := redisrepo.RegisterNewUser(context.Background(), u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a stand-in for ffmpeg that prints a 100x200 frame
+	dir := t.TempDir()
+	frame := filepath.Join(dir, "frame.png")
+	os.WriteFile(frame, []byte(opaquePNG(t, 100, 200)), 0644)
+	fake := filepath.Join(dir, "ffmpeg")
+	os.WriteFile(fake, []byte("#!/bin/sh\ncat "+frame+"\n"), 0755)
+	prev := ffmpegPath
+	ffmpegPath = fake
+	t.Cleanup(func() { ffmpegPath = prev })
+
+	upload := func(name, content string) attachmentRes {
+		t.Helper()
+		body, ct := uploadForm(t, "bob", name, "", content)
+		req := httptest.NewRequest(http.MethodPost, "/v1/attachments", body)
+		req.Header.Set("Content-Type", ct)
+		rec := authed(t, h, req, "alice")
+		var res struct {
+			Data attachmentRes `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("upload %s: %d %s", name, rec.Code, rec.Body)
+		}
+		return res.Data
+	}
+	get := func(path, user string) *httptest.ResponseRecorder {
+		return authed(t, h, httptest.NewRequest(http.MethodGet, path, nil), user)
+	}
+
+	photo := upload("wide.png", opaquePNG(t, 640, 320))
+	if photo.Width != 640 || photo.Height != 320 || len(photo.Blurhash) != 28 || photo.ThumbnailURL == "" {
+		t.Fatalf("photo %+v", photo)
+	}
+	rec := get(photo.ThumbnailURL, "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("thumbnail: %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if cfg, err := jpeg.DecodeConfig(rec.Body); err != nil || cfg.Width != thumbnailEdge || cfg.Height != thumbnailEdge/2 {
+		t.Errorf("thumbnail is %dx%d, %v", cfg.Width, cfg.Height, err)
+	}
+	if rec := get(attachmentPath(photo.ID)+"/thumbnail", "bob"); rec.Code != http.StatusOK {
+		t.Errorf("bob: %d", rec.Code)
+	}
+	if rec := get(attachmentPath(photo.ID)+"/thumbnail", "carol"); rec.Code != http.StatusForbidden {
+		t.Errorf("carol: %d", rec.Code)
+	}
+
+	video := upload("clip.webm", "\x1a\x45\xdf\xa3 not really a video")
+	if video.Width != 100 || video.Height != 200 || video.ThumbnailURL == "" {
+		t.Errorf("video %+v", video)
+	}
+	// larger videos aren't copied for a poster
+	prevMax := maxPosterSource
+	maxPosterSource = 10
+	t.Cleanup(func() { maxPosterSource = prevMax })
+	if long := upload("long.webm", "\x1a\x45\xdf\xa3 a longer video"); long.Width != 0 || long.ThumbnailURL != "" {
+		t.Errorf("long video %+v", long)
+	}
+
+	notes := upload("notes.txt", "hello bob")
+	if notes.Width != 0 || notes.ThumbnailURL != "" {
+		t.Errorf("notes %+v", notes)
+	}
+	if rec := get(attachmentPath(notes.ID)+"/thumbnail", "alice"); rec.Code != http.StatusNotFound {
+		t.Errorf("thumbnail of text: %d", rec.Code)
+	}
+}
+
+func TestWithAttachments(t *testing.T) {
+	h := newTestServer(t)
+	ctx := context.Background()
+	ours := &model.Attachment{ID: strings.Repeat("a", 32), Owner: "alice", Peer: "bob", MIME: "image/png", Width: 2, Height: 1, ThumbMIME: "image/jpeg"}
+	theirs := &model.Attachment{ID: strings.Repeat("b", 32), Owner: "carol", Peer: "dave", MIME: "image/png"}
+	for _, a := range []*model.Attachment{ours, theirs} {
+		if err := redisrepo.SaveAttachment(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	link := func(a *model.Attachment) string {
+		u, _ := h.signedAttachmentURL(a.ID, time.Now())
+		return "http://localhost:8080" + u
+	}
+	chats := []model.Chat{
+		{ID: "1", From: "bob", To: "alice", Msg: "hi"},
+		{ID: "2", From: "alice", To: "bob", Msg: link(ours) + "\n" + link(ours) + "\nlook"},
+		{ID: "3", From: "alice", To: "bob", Msg: link(theirs)},
+		{ID: "4", From: "alice", To: "bob", Msg: "/v1/attachments/" + strings.Repeat("c", 32)},
+		{ID: "5", From: "alice", To: "bob", Msg: "typed", Attachments: []model.AttachmentRef{ours.Ref()}},
+	}
+	res, err := h.withAttachments(ctx, "alice", "bob", chats)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 5 || res[1].Msg != chats[1].Msg {
+		t.Fatalf("got %+v", res)
+	}
+	for i, want := range []int{0, 1, 0, 0, 1} {
+		if len(res[i].Attachments) != want {
+			t.Errorf("message %d has %d attachments, want %d", i, len(res[i].Attachments), want)
+		}
+	}
+	if a := res[1].Attachments[0]; a.Width != 2 || a.Height != 1 || a.ThumbnailURL == "" {
+		t.Errorf("attachment %+v", a)
+	}
+}
+
+func TestConversationMedia(t *testing.T) {
+	h := newTestServer(t)
+	ctx := context.Background()
+	for _, u := range []string{"alice", "bob", "carol"} {
+		if err := redisrepo.RegisterNewUser(ctx, u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sent := &model.Attachment{ID: strings.Repeat("a", 32), Owner: "alice", Peer: "bob", Name: "cat.png", MIME: "image/png"}
+	received := &model.Attachment{ID: strings.Repeat("b", 32), Owner: "bob", Peer: "alice", Name: "notes.txt", MIME: "text/plain"}
+	elsewhere := &model.Attachment{ID: strings.Repeat("c", 32), Owner: "alice", Peer: "carol", Name: "dog.png", MIME: "image/png"}
+	for _, a := range []*model.Attachment{sent, received, elsewhere} {
+		if err := redisrepo.SaveAttachment(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	redisrepo.AddConversationMedia(ctx, "alice", "bob", 100, sent.ID)
+	redisrepo.AddConversationMedia(ctx, "bob", "alice", 200, received.ID)
+	redisrepo.AddConversationMedia(ctx, "alice", "carol", 300, elsewhere.ID)
+
+	rec := authed(t, h, httptest.NewRequest(http.MethodGet, "/v1/conversations/bob/media", nil), "alice")
+	var res struct {
+		Data  []attachmentRes `json:"data"`
+		Total int             `json:"total"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("media: %d %s", rec.Code, rec.Body)
+	}
+	if res.Total != 2 || res.Data[0].ID != received.ID || res.Data[1].ID != sent.ID || res.Data[0].URL == "" {
+		t.Errorf("media %+v", res)
+	}
+
+	rec = authed(t, h, httptest.NewRequest(http.MethodGet, "/v1/conversations/alice/media?from-ts=0&to-ts=150", nil), "bob")
+	res.Data, res.Total = nil, 0
+	json.Unmarshal(rec.Body.Bytes(), &res)
+	if res.Total != 1 || res.Data[0].ID != sent.ID {
+		t.Errorf("until 150: %+v", res)
+	}
+	if rec := authed(t, h, httptest.NewRequest(http.MethodGet, "/v1/conversations/nobody/media", nil), "alice"); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown peer: %d", rec.Code)
+	}
+}
+
+func TestExtendWriteDeadline(t *testing.T) {
+	cfg := config.Default()
+	cfg.HTTP.WriteTimeout = 50 * time.Millisecond
+	cfg.HTTP.MinTransferRate = 1 << 20
+	s := &server{cfg: cfg}
+
+	// a slow file of 1 MiB gets a second more than the server's timeout
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("extend") {
+			s.extendWriteDeadline(w, r, 1<<20)
+		}
+		time.Sleep(200 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+	srv.Config.WriteTimeout = cfg.HTTP.WriteTimeout
+	srv.Start()
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		query string
+		ok    bool
+	}{{"", false}, {"?extend", true}} {
+		resp, err := http.Get(srv.URL + tc.query)
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != "done" {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("%q: got %v", tc.query, err)
+		}
+	}
+}
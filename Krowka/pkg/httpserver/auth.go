@@ -3,51 +3,51 @@ package httpserver
 import (
 	"context"
 	"net/http"
-	"os"
 	"strings"
-	"time"
 
-	jwt "github.com/golang-jwt/jwt/v5"
+	"Krowka/pkg/metrics"
+	"Krowka/pkg/token"
 )
 
 type ctxKey string
 
-const userCtxKey ctxKey = "krowkaUser"
+const (
+	userCtxKey ctxKey = "krowkaUser"
+	// legacyErrorsCtxKey is set on requests served with http.legacy_errors
+	legacyErrorsCtxKey ctxKey = "legacyErrors"
+)
 
-func jwtSecret() []byte {
-	if s := os.Getenv("JWT_SECRET"); s != "" {
-		return []byte(s)
-	}
-	return []byte("dev-secret-change-me")
+func (s *server) jwtSecret() []byte {
+	return []byte(s.cfg.Auth.JWTSecret)
+}
+
+func (s *server) issueToken(username string) (string, error) {
+	return token.Issue(s.jwtSecret(), username, s.cfg.Auth.TokenTTL)
 }
 
-func issueToken(username string) (string, error) {
-	claims := jwt.RegisteredClaims{
-		Subject:   username,
-		ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
+// userFromToken returns the subject of the request's bearer token
+func (s *server) userFromToken(r *http.Request) (string, *apiError) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" || !strings.HasPrefix(auth, "Bearer ") {
+		metrics.AuthFailures.WithLabelValues("missing_token").Inc()
+		return "", newError(http.StatusUnauthorized, codeUnauthorized, "missing token")
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret())
+	user, err := token.Verify(s.jwtSecret(), strings.TrimPrefix(auth, "Bearer "))
+	if err != nil {
+		metrics.AuthFailures.WithLabelValues("invalid_token").Inc()
+		return "", newError(http.StatusUnauthorized, codeUnauthorized, "invalid token")
+	}
+	return user, nil
 }
 
-func AuthMiddleware(next http.Handler) http.Handler {
+func (s *server) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		auth := r.Header.Get("Authorization")
-		if auth == "" || !strings.HasPrefix(auth, "Bearer ") {
-			http.Error(w, "missing token", http.StatusUnauthorized)
-			return
-		}
-		tokenStr := strings.TrimPrefix(auth, "Bearer ")
-		claims := &jwt.RegisteredClaims{}
-		token, err := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret(), nil
-		})
-		if err != nil || !token.Valid {
-			http.Error(w, "invalid token", http.StatusUnauthorized)
+		user, e := s.userFromToken(r)
+		if e != nil {
+			writeError(w, r, e)
 			return
 		}
-		ctx := context.WithValue(r.Context(), userCtxKey, claims.Subject)
+		ctx := context.WithValue(r.Context(), userCtxKey, user)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
@@ -0,0 +1,78 @@
+package httpserver
+
+import (
+	"net/http"
+
+	"Krowka/model"
+	"Krowka/pkg/metrics"
+)
+
+const codeForbidden = "forbidden"
+
+// userHandler serves a request on behalf of user, the subject of the
+// verified token. Handlers never read the acting user from the request.
+type userHandler func(w http.ResponseWriter, r *http.Request, user string)
+
+// policy decides whether user may access the resource r addresses
+type policy func(r *http.Request, user string) *apiError
+
+// authorize verifies the token, checks p and calls h with the acting user
+func (s *server) authorize(p policy, h userHandler) http.Handler {
+	return s.AuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := UsernameFromContext(r)
+		if user == "" {
+			writeError(w, r, newError(http.StatusUnauthorized, codeUnauthorized, "missing user in token"))
+			return
+		}
+		if e := p(r, user); e != nil {
+			metrics.AuthFailures.WithLabelValues("forbidden").Inc()
+			writeError(w, r, e)
+			return
+		}
+		h(w, r, user)
+	}))
+}
+
+func forbidden(msg string) *apiError {
+	return newError(http.StatusForbidden, codeForbidden, msg)
+}
+
+// sameUser rejects a request that names another user than the acting one,
+// e.g. a username field left over from the legacy API. Empty means unset.
+func sameUser(claimed, user string) *apiError {
+	if claimed != "" && claimed != user {
+		return forbidden("cannot act on behalf of another user")
+	}
+	return nil
+}
+
+// authenticated lets any signed in user through, for lookups that are not
+// tied to one user such as checking that a contact exists
+func authenticated(r *http.Request, user string) *apiError {
+	return nil
+}
+
+// owner allows access to the acting user's own resources only. Identity
+// query parameters of the legacy routes must match the token.
+func owner(r *http.Request, user string) *apiError {
+	return sameUser(r.URL.Query().Get("username"), user)
+}
+
+// participant allows reading a conversation only to its two participants.
+// The acting user is always one side, the other is the {peer} path
+// variable or the legacy u2 parameter.
+func participant(r *http.Request, user string) *apiError {
+	if e := sameUser(r.URL.Query().Get("u1"), user); e != nil {
+		return e
+	}
+	return owner(r, user)
+}
+
+// attachmentParticipant allows access to an attachment only to the two
+// sides of the conversation it was sent in
+func attachmentParticipant(a *model.Attachment, user string) *apiError {
+	if !a.IsParticipant(user) {
+		return forbidden("not a participant of this conversation")
+	}
+	return nil
+}
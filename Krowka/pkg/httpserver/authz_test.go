@@ -0,0 +1,233 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"Krowka/model"
+	"Krowka/pkg/health"
+	"Krowka/pkg/redisrepo"
+
+	"github.com/alicebob/miniredis/v2"
+	miniserver "github.com/alicebob/miniredis/v2/server"
+	"github.com/gorilla/mux"
+)
+
+// tinyPNG is a valid 1x1 image
+func tinyPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// avatarForm is a multipart upload naming another user in the legacy
+// username field
+func avatarForm(t *testing.T, username string) (string, string) {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("username", username)
+	fw, _ := mw.CreateFormFile("file", "a.png")
+	fw.Write(tinyPNG(t))
+	mw.Close()
+	return buf.String(), mw.FormDataContentType()
+}
+
+func TestCrossUserAccessIsForbidden(t *testing.T) {
+	h := newTestServer(t)
+	ctx := context.Background()
+	for _, u := range []string{"alice", "bob"} {
+		if err := redisrepo.RegisterNewUser(ctx, u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aliceToken, err := h.issueToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a file bob sent to carol
+	const attachmentID = "0123456789abcdef0123456789abcdef"
+	if err := redisrepo.SaveAttachment(ctx, &model.Attachment{ID: attachmentID, Owner: "bob", Peer: "carol", Name: "a.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// and an upload of his under the same ID
+	if err := redisrepo.CreateUpload(ctx, &model.Upload{ID: attachmentID, Owner: "bob", Peer: "carol", Size: 10}); err != nil {
+		t.Fatal(err)
+	}
+
+	form, formType := avatarForm(t, "bob")
+	const jsonType = "application/json"
+
+	// alice tries to reach bob's data on every authenticated route
+	cases := []struct {
+		method, path, body, contentType string
+		want                            int
+	}{
+		{http.MethodGet, "/v1/users/bob", "", "", http.StatusOK},
+		{http.MethodGet, "/v1/contacts?username=bob", "", "", http.StatusForbidden},
+		{http.MethodGet, "/v1/conversations/carol/messages?u1=bob", "", "", http.StatusForbidden},
+		{http.MethodGet, "/v1/conversations/carol/media?u1=bob", "", "", http.StatusForbidden},
+		{http.MethodGet, "/v1/profile?username=bob", "", "", http.StatusForbidden},
+		{http.MethodPut, "/v1/profile", `{"username":"bob","displayName":"pwned"}`, jsonType, http.StatusForbidden},
+		{http.MethodPut, "/v1/profile/password", `{"username":"bob","oldPassword":"x","newPassword":"hijacked password"}`, jsonType, http.StatusForbidden},
+		{http.MethodPut, "/v1/profile/2fa", `{"username":"bob","enabled":false}`, jsonType, http.StatusForbidden},
+		{http.MethodPost, "/v1/profile/avatar", form, formType, http.StatusForbidden},
+		{http.MethodPost, "/v1/attachments?username=bob", form, formType, http.StatusForbidden},
+		{http.MethodGet, "/v1/attachments/" + attachmentID, "", "", http.StatusForbidden},
+		{http.MethodGet, "/v1/attachments/" + attachmentID + "/thumbnail", "", "", http.StatusForbidden},
+		{http.MethodGet, "/v1/attachments/" + attachmentID + "/url", "", "", http.StatusForbidden},
+		{http.MethodPost, "/v1/uploads?username=bob", `{"to":"carol","size":10}`, jsonType, http.StatusForbidden},
+		{http.MethodGet, "/v1/uploads/" + attachmentID, "", "", http.StatusForbidden},
+		{http.MethodPatch, "/v1/uploads/" + attachmentID, "0123456789", "", http.StatusForbidden},
+		{http.MethodPost, "/v1/uploads/" + attachmentID + "/complete", `{"sha256":"` + strings.Repeat("0", 64) + `"}`, jsonType, http.StatusForbidden},
+		{http.MethodGet, "/v1/storage/usage?username=bob", "", "", http.StatusForbidden},
+
+		{http.MethodPost, "/verify-contact", `{"username":"bob"}`, jsonType, http.StatusOK},
+		{http.MethodGet, "/contact-list?username=bob", "", "", http.StatusForbidden},
+		{http.MethodGet, "/chat-history?u1=bob&u2=carol", "", "", http.StatusForbidden},
+		{http.MethodGet, "/profile?username=bob", "", "", http.StatusForbidden},
+		{http.MethodPost, "/profile", `{"username":"bob","displayName":"pwned"}`, jsonType, http.StatusForbidden},
+		{http.MethodPost, "/password/change", `{"username":"bob","oldPassword":"x","newPassword":"hijacked password"}`, jsonType, http.StatusForbidden},
+		{http.MethodPost, "/2fa/toggle", `{"username":"bob","enabled":false}`, jsonType, http.StatusForbidden},
+		{http.MethodPost, "/avatar", form, formType, http.StatusForbidden},
+		{http.MethodPost, "/chat/attachment?username=bob", form, formType, http.StatusForbidden},
+	}
+
+	tested := map[string]bool{}
+	for _, tc := range cases {
+		route := tc.method + " " + strings.SplitN(tc.path, "?", 2)[0]
+		tested[route] = true
+
+		t.Run(route, func(t *testing.T) {
+			for _, token := range []string{"", aliceToken} {
+				req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+				if tc.contentType != "" {
+					req.Header.Set("Content-Type", tc.contentType)
+				}
+				want := http.StatusUnauthorized
+				if token != "" {
+					req.Header.Set("Authorization", "Bearer "+token)
+					want = tc.want
+				}
+
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				if rec.Code != want {
+					t.Errorf("token=%t: got %d, want %d: %s", token != "", rec.Code, want, rec.Body)
+				}
+			}
+		})
+	}
+
+	if err := redisrepo.IsUserAuthentic(ctx, "bob", "bob secret password"); err != nil {
+		t.Error("bob's password changed by alice:", err)
+	}
+
+	// every route behind authorize must have a case above
+	public := map[string]bool{
+		"/status": true, "/healthz": true, "/readyz": true, "/metrics": true,
+		"/v1/openapi.json": true, "/v1/auth/register": true, "/v1/auth/login": true,
+		"/register": true, "/login": true, "/avatars/": true,
+	}
+	r := mux.NewRouter()
+	h.routes(r, health.New())
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil || public[path] {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		for _, m := range methods {
+			key := m + " " + strings.NewReplacer("{username}", "bob", "{peer}", "carol", "{id}", attachmentID).Replace(path)
+			if !tested[key] {
+				t.Errorf("no cross-user case for %s %s", m, path)
+			}
+		}
+		return nil
+	})
+}
+
+func TestInjectedUsernameCannotReadOthers(t *testing.T) {
+	m := miniredis.RunT(t)
+	h := newTestServerOn(t, m)
+	ctx := context.Background()
+
+	// names that mean something to RediSearch can't be registered
+	for _, name := range []string{"bob|carol", "bob}", "*", "@to:{bob}", "bob carol", "bob:carol", strings.Repeat("b", 33)} {
+		body := `{"username":"` + name + `","password":"correct horse battery"}`
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/auth/register", strings.NewReader(body)))
+		if rec.Code != http.StatusUnprocessableEntity {
+			t.Errorf("registered %q: %d %s", name, rec.Code, rec.Body)
+		}
+	}
+
+	// but accounts from before may have one
+	for _, u := range []string{"mallory|bob", "bob", "carol"} {
+		if err := redisrepo.RegisterNewUser(ctx, u, "correct horse battery"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// miniredis has no RediSearch, FT.SEARCH answers as the unescaped
+	// query @from:{mallory|bob|carol} would, with bob and carol's chat
+	queries := make(chan string, 10)
+	m.Server().SetPreHook(func(c *miniserver.Peer, cmd string, args ...string) bool {
+		if !strings.EqualFold(cmd, "FT.SEARCH") {
+			return false
+		}
+		queries <- args[1]
+		c.WriteLen(3)
+		c.WriteInt(1)
+		c.WriteBulk("chat#1")
+		c.WriteLen(2)
+		c.WriteBulk("$")
+		c.WriteBulk(`{"from":"bob","to":"carol","message":"secret","timestamp":1}`)
+		return true
+	})
+	mallory, err := h.issueToken("mallory|bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+mallory)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/v1/conversations/carol/messages")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "secret") {
+		t.Errorf("mallory|bob reads bob and carol: %d %s", rec.Code, rec.Body)
+	}
+	if q := <-queries; !strings.Contains(q, `@from:{mallory\|bob|carol}`) {
+		t.Errorf("query %s", q)
+	}
+
+	// the bounds are numbers, not more query
+	for _, q := range []string{"from-ts=0]%20@from:{bob}", "to-ts=x", "from-ts=NaN"} {
+		if rec := get("/v1/conversations/carol/messages?" + q); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: %d %s", q, rec.Code, rec.Body)
+		}
+		if rec := get("/v1/conversations/carol/media?" + q); rec.Code != http.StatusBadRequest {
+			t.Errorf("media %s: %d %s", q, rec.Code, rec.Body)
+		}
+	}
+	if rec := get("/v1/conversations/carol/messages?from-ts=10&to-ts=%2Binf"); rec.Code != http.StatusOK {
+		t.Errorf("bounds: %d %s", rec.Code, rec.Body)
+	}
+	if q := <-queries; !strings.HasSuffix(q, "@timestamp:[10 +inf]") {
+		t.Errorf("query %s", q)
+	}
+}
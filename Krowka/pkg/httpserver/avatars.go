@@ -0,0 +1,152 @@
+package httpserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	"Krowka/pkg/filetype"
+	"Krowka/pkg/imageproc"
+	"Krowka/pkg/redisrepo"
+)
+
+// avatarSizes are the square sizes in pixels every avatar is stored at,
+// the profile links the avatarSize one
+var avatarSizes = []int{64, 128, 256, 512}
+
+const avatarSize = 256
+
+type avatarRes struct {
+	AvatarURL string `json:"avatarUrl"`
+	// AvatarURLs has every stored size, by edge length
+	AvatarURLs map[int]string `json:"avatarUrls"`
+}
+
+// avatarKey names one size of an avatar. The hash of the uploaded file
+// makes the name change with the content, so the files can be cached
+// forever.
+func avatarKey(username, hash string, size int, ext string) string {
+	return fmt.Sprintf("%s/%s-%d%s", username, hash, size, ext)
+}
+
+// avatarSet finds the keys of every size of the avatar at url, if it is a
+// processed avatar of username. Avatars from before processing are not
+// returned, there is no telling whether another profile links them.
+func avatarSet(username, url string) []string {
+	name, ok := strings.CutPrefix(url, "/avatars/"+username+"/")
+	if !ok || strings.Contains(name, "/") {
+		return nil
+	}
+	ext := path.Ext(name)
+	hash, _, ok := strings.Cut(strings.TrimSuffix(name, ext), "-")
+	if !ok || hash == "" {
+		return nil
+	}
+	keys := make([]string, len(avatarSizes))
+	for i, size := range avatarSizes {
+		keys[i] = avatarKey(username, hash, size, ext)
+	}
+	return keys
+}
+
+func (s *server) avatarUploadHandler(w http.ResponseWriter, r *http.Request, username string) {
+	// the image is decoded and re-encoded in every size, which drops
+	// EXIF data like GPS positions, so it is read into memory first
+	kind := uploadKind{maxBytes: s.cfg.HTTP.MaxAvatarBytes, types: s.cfg.HTTP.AvatarTypes, quotaLeft: -1}
+	up, e := receiveFile(w, r, kind, nil)
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+	if e := sameUser(up.fields.Get("username"), username); e != nil {
+		writeError(w, r, e)
+		return
+	}
+
+	variants, err := imageproc.Square(up.data, avatarSizes)
+	if errors.Is(err, imageproc.ErrTooLarge) {
+		writeError(w, r, invalidFields(fieldError{Field: "file", Code: "too_many_pixels", Message: fmt.Sprintf("image is larger than %d pixels", imageproc.MaxPixels)}))
+		return
+	}
+	if err != nil {
+		writeError(w, r, invalidFields(fieldError{Field: "file", Code: "invalid_image", Message: "file is not a readable image"}))
+		return
+	}
+
+	p, err := redisrepo.GetProfile(r.Context(), username)
+	if err != nil {
+		writeError(w, r, repoError(err, "unable to update avatar url"))
+		return
+	}
+
+	sum := sha256.Sum256(up.data)
+	hash := hex.EncodeToString(sum[:16])
+	res := avatarRes{AvatarURLs: make(map[int]string, len(variants))}
+	var stored []string
+	for _, v := range variants {
+		key := avatarKey(username, hash, v.Size, v.Ext)
+		if _, err := avatarStore.Put(r.Context(), key, bytes.NewReader(v.Data), v.MediaType); err != nil {
+			slog.ErrorContext(r.Context(), "storing avatar failed", "key", key, "error", err)
+			discardAll(r, stored)
+			writeError(w, r, newError(http.StatusInternalServerError, codeInternal, "unable to save file"))
+			return
+		}
+		stored = append(stored, key)
+		res.AvatarURLs[v.Size] = "/avatars/" + key
+	}
+	res.AvatarURL = res.AvatarURLs[avatarSize]
+
+	// Update profile avatar URL, then drop the files of the avatar it
+	// replaces. Uploading the same image again keeps the same files.
+	old := p.AvatarURL
+	p.AvatarURL = res.AvatarURL
+	if err := redisrepo.SaveProfile(r.Context(), p); err != nil {
+		if old != res.AvatarURL {
+			discardAll(r, stored)
+		}
+		writeError(w, r, repoError(err, "unable to update avatar url"))
+		return
+	}
+	if old != res.AvatarURL {
+		discardAll(r, avatarSet(username, old))
+	}
+	writeJSON(w, http.StatusOK, &response{Status: true, Data: res})
+}
+
+// discardAll removes avatar files that are no longer linked
+func discardAll(r *http.Request, keys []string) {
+	for _, key := range keys {
+		discard(r, avatarStore, key)
+	}
+}
+
+// avatarFileHandler serves /avatars/<file> from the avatar store
+func (s *server) avatarFileHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/avatars/")
+	f, info, err := avatarStore.Open(r.Context(), key)
+	if err != nil {
+		writeError(w, r, repoError(err, "unable to read avatar"))
+		return
+	}
+	defer f.Close()
+
+	// files from before uploads were checked may be anything
+	contentType := info.ContentType
+	if !filetype.Allowed(s.cfg.HTTP.AvatarTypes, contentType) || filetype.Active(contentType, info.Key) {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+	if strings.Contains(key, "/") {
+		// processed avatars never change under the same name
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	}
+	http.ServeContent(w, r, info.Key, info.ModTime, f)
+}
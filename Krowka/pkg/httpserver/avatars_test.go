@@ -0,0 +1,74 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"Krowka/pkg/redisrepo"
+)
+
+func TestAvatarSet(t *testing.T) {
+	hash := "0123456789abcdef0123456789abcdef"
+	want := []string{
+		"alice/" + hash + "-64.jpg",
+		"alice/" + hash + "-128.jpg",
+		"alice/" + hash + "-256.jpg",
+		"alice/" + hash + "-512.jpg",
+	}
+	if got := avatarSet("alice", "/avatars/"+avatarKey("alice", hash, 256, ".jpg")); !reflect.DeepEqual(got, want) {
+		t.Errorf("avatarSet = %v", got)
+	}
+
+	// legacy avatars, other users' files and foreign URLs are left alone
+	for _, url := range []string{
+		"",
+		"/avatars/alice-me.png",
+		"/avatars/bob/" + hash + "-256.jpg",
+		"/avatars/alice/x/" + hash + "-256.jpg",
+		"https://example.com/alice/" + hash + "-256.jpg",
+	} {
+		if got := avatarSet("alice", url); got != nil {
+			t.Errorf("avatarSet(%q) = %v", url, got)
+		}
+	}
+}
+
+func TestAvatarUploadRejectsBadImages(t *testing.T) {
+	h := newTestServer(t)
+	if err := redisrepo.RegisterNewUser(context.Background(), "alice", "alice secret password"); err != nil {
+		t.Fatal(err)
+	}
+
+	// GIF magic followed by garbage passes type detection but not decoding,
+	// and the file name never reaches the store
+	body, ct := uploadForm(t, "", "../../evil.gif", "image/gif", "GIF89a not really a gif")
+	req := httptest.NewRequest(http.MethodPost, "/v1/profile/avatar", body)
+	req.Header.Set("Content-Type", ct)
+	rec := authed(t, h, req, "alice")
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d %s", rec.Code, rec.Body)
+	}
+	var res map[string]interface{}
+	json.Unmarshal(rec.Body.Bytes(), &res)
+	if code := errorCode(res); code != codeValidation {
+		t.Errorf("code %q", code)
+	}
+
+	for _, dir := range []string{h.cfg.HTTP.AvatarDir, filepath.Dir(h.cfg.HTTP.AvatarDir)} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if e.Name() == "evil.gif" {
+				t.Errorf("%s written to %s", e.Name(), dir)
+			}
+		}
+	}
+}
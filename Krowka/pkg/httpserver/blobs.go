@@ -0,0 +1,147 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/redisrepo"
+)
+
+// contents are stored once under sha256/<hex digest>, whatever the number
+// of attachments sharing them
+var contentKeyPattern = regexp.MustCompile(`^sha256/([0-9a-f]{64})$`)
+
+const (
+	// blobLockTTL bounds how long a crashed server keeps a content locked.
+	// A live one keeps extending it, renaming a large file on S3 copies it.
+	blobLockTTL = 30 * time.Second
+	// blobLockWait is how long to wait for a content another request
+	// holds, blobLockRetry how often to check
+	blobLockWait  = 10 * time.Second
+	blobLockRetry = 20 * time.Millisecond
+)
+
+func contentKey(hash string) string {
+	return "sha256/" + hash
+}
+
+// fileKey is where the bytes of a are stored, attachments from before
+// deduplication keep them under their ID
+func fileKey(a *model.Attachment) string {
+	if a.Blob == "" {
+		return a.ID
+	}
+	return contentKey(a.Blob)
+}
+
+// lockContent serialises adding and dropping references to one content,
+// so that the last attachment going away never deletes a file another
+// upload has just counted on
+func lockContent(ctx context.Context, hash string) (unlock func(), err error) {
+	ctx, cancel := context.WithTimeout(ctx, blobLockWait)
+	defer cancel()
+	for {
+		unlock, err := redisrepo.HoldLock(ctx, "blob:"+hash, blobLockTTL)
+		if !errors.Is(err, redisrepo.ErrConflict) {
+			return unlock, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("content %s stays locked: %w", hash, ctx.Err())
+		case <-time.After(blobLockRetry):
+		}
+	}
+}
+
+// storeContent makes the upload at key a's content: the owner is charged
+// unless they already store the same bytes, and the file is moved to its
+// content key unless another attachment put it there first, in which case
+// the upload is deleted. The upload is gone either way. reserved is what
+// the owner holds for the upload already, it does not count against the
+// quota.
+func (s *server) storeContent(ctx context.Context, a *model.Attachment, key, hash string, reserved int64) *apiError {
+	ctx = context.WithoutCancel(ctx)
+	drop := func() {
+		if err := attachmentStore.Delete(ctx, key); err != nil {
+			slog.WarnContext(ctx, "removing upload failed", "key", key, "error", err)
+		}
+	}
+	fail := func(err error) *apiError {
+		drop()
+		return repoError(err, "unable to store attachment")
+	}
+
+	// the quota is checked again, other uploads may have finished meanwhile
+	quota := s.cfg.HTTP.UserQuotaBytes
+	if quota > 0 {
+		quota += reserved
+	}
+	if err := redisrepo.ChargeBlob(ctx, a.Owner, hash, a.Size, quota); err != nil {
+		return fail(err)
+	}
+	uncharge := func() {
+		if err := redisrepo.UnchargeBlob(ctx, a.Owner, hash, a.Size); err != nil {
+			slog.WarnContext(ctx, "releasing storage failed", "error", err)
+		}
+	}
+
+	unlock, err := lockContent(ctx, hash)
+	if err != nil {
+		uncharge()
+		return fail(err)
+	}
+	defer unlock()
+
+	refs, err := redisrepo.AddBlobRef(ctx, hash, a.Size)
+	if err != nil {
+		uncharge()
+		return fail(err)
+	}
+	if refs > 1 {
+		drop()
+		slog.InfoContext(ctx, "attachment content already stored", "attachment_id", a.ID, "blob", hash, "refs", refs)
+	} else if err := attachmentStore.Rename(ctx, key, contentKey(hash)); err != nil {
+		slog.ErrorContext(ctx, "storing attachment content failed", "attachment_id", a.ID, "blob", hash, "error", err)
+		if _, err := redisrepo.ReleaseBlobRef(ctx, hash); err != nil {
+			slog.WarnContext(ctx, "releasing content failed", "blob", hash, "error", err)
+		}
+		uncharge()
+		drop()
+		return newError(http.StatusInternalServerError, codeInternal, "unable to save file")
+	}
+	a.Blob = hash
+	return nil
+}
+
+// releaseContent gives back what storeContent took for an attachment that
+// is gone, deleting the file with the last attachment sharing it.
+// Attachments from before deduplication give back their size and lose
+// their file. It reports how many bytes were freed.
+func releaseContent(ctx context.Context, a *model.Attachment) (int64, error) {
+	ctx = context.WithoutCancel(ctx)
+	if a.Blob == "" {
+		releaseStorage(ctx, a.Owner, a.Size)
+		return a.Size, attachmentStore.Delete(ctx, a.ID)
+	}
+
+	if err := redisrepo.UnchargeBlob(ctx, a.Owner, a.Blob, a.Size); err != nil {
+		slog.WarnContext(ctx, "releasing storage failed", "error", err)
+	}
+	unlock, err := lockContent(ctx, a.Blob)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	refs, err := redisrepo.ReleaseBlobRef(ctx, a.Blob)
+	if err != nil || refs > 0 {
+		return 0, err
+	}
+	return a.Size, attachmentStore.Delete(ctx, contentKey(a.Blob))
+}
@@ -1,19 +1,29 @@
 package httpserver
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"log"
+	"context"
+	"errors"
+	"log/slog"
+	"math"
 	"net/http"
-	"os"
-	"path/filepath"
-	"time"
+	"regexp"
+	"strconv"
 
 	"Krowka/model"
+	"Krowka/pkg/metrics"
+	"Krowka/pkg/password"
 	"Krowka/pkg/redisrepo"
+
+	"github.com/gorilla/mux"
 )
 
+// passwordPolicy is checked on register and password change
+var passwordPolicy = password.DefaultPolicy()
+
+// usernamePattern is what new usernames may look like. Names end up in
+// Redis keys and search queries, which have no business with anything else.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
 type userReq struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
@@ -46,364 +56,288 @@ type twoFAReq struct {
 	Enabled  bool   `json:"enabled"`
 }
 
-func registerHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+// reply writes res, or the error envelope if the request failed
+func reply(w http.ResponseWriter, r *http.Request, res *response, e *apiError) {
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
 
+func registerHandler(w http.ResponseWriter, r *http.Request) {
 	u := &userReq{}
-	if err := json.NewDecoder(r.Body).Decode(u); err != nil {
-		http.Error(w, "error decoidng request object", http.StatusBadRequest)
+	if !decodeJSON(w, r, u) {
 		return
 	}
 
-	res := register(u)
-	json.NewEncoder(w).Encode(res)
+	res, e := register(r.Context(), u)
+	reply(w, r, res, e)
 }
 
-func loginHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
+func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
 	u := &userReq{}
-	if err := json.NewDecoder(r.Body).Decode(u); err != nil {
-		http.Error(w, "error decoidng request object", http.StatusBadRequest)
+	if !decodeJSON(w, r, u) {
 		return
 	}
 
-	res := login(u)
-	json.NewEncoder(w).Encode(res)
+	res, e := s.login(r.Context(), u)
+	reply(w, r, res, e)
 }
 
-func verifyContactHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
+func verifyContactHandler(w http.ResponseWriter, r *http.Request, user string) {
 	u := &userReq{}
-	if err := json.NewDecoder(r.Body).Decode(u); err != nil {
-		http.Error(w, "error decoidng request object", http.StatusBadRequest)
+	if !decodeJSON(w, r, u) {
 		return
 	}
 
-	res := verifyContact(u.Username)
-	json.NewEncoder(w).Encode(res)
+	res, e := verifyContact(r.Context(), u.Username)
+	reply(w, r, res, e)
 }
 
-func chatHistoryHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	// user1 user2
-	u1 := UsernameFromContext(r)
-	if u1 == "" { // legacy fallback
-		u1 = r.URL.Query().Get("u1")
+// getUserHandler answers 200 if the user exists, 404 otherwise
+func getUserHandler(w http.ResponseWriter, r *http.Request, user string) {
+	username := mux.Vars(r)["username"]
+	res, e := verifyContact(r.Context(), username)
+	if res != nil {
+		res.Data = map[string]string{"username": username}
 	}
-	u2 := r.URL.Query().Get("u2")
-
-	// chat between timerange fromTS toTS
-	// where TS is timestamp
-	// 0 to positive infinity
-	fromTS, toTS := "0", "+inf"
+	reply(w, r, res, e)
+}
 
-	if r.URL.Query().Get("from-ts") != "" && r.URL.Query().Get("to-ts") != "" {
-		fromTS = r.URL.Query().Get("from-ts")
-		toTS = r.URL.Query().Get("to-ts")
+func (s *server) chatHistoryHandler(w http.ResponseWriter, r *http.Request, user string) {
+	// user1 is always the acting user, user2 the peer
+	u1 := user
+	u2 := mux.Vars(r)["peer"]
+	if u2 == "" { // legacy /chat-history?u2=
+		u2 = r.URL.Query().Get("u2")
 	}
 
-	res := chatHistory(u1, u2, fromTS, toTS)
-	json.NewEncoder(w).Encode(res)
+	fromTS, toTS, e := timeRange(r)
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+	res, e := s.chatHistory(r.Context(), u1, u2, fromTS, toTS)
+	reply(w, r, res, e)
 }
 
-func contactListHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	u := UsernameFromContext(r)
-	if u == "" { // legacy fallback
-		u = r.URL.Query().Get("username")
-	}
+// timeRange reads the from-ts and to-ts bounds of a history request, unix
+// seconds or +inf, 0 to +inf when left out
+func timeRange(r *http.Request) (string, string, *apiError) {
+	q := r.URL.Query()
+	bound := func(name, def string) (string, *apiError) {
+		v := q.Get(name)
+		if v == "" {
+			return def, nil
+		}
+		ts, err := strconv.ParseFloat(v, 64)
+		switch {
+		case err != nil || math.IsNaN(ts):
+			return "", badRequest(name + " must be a number of seconds or +inf")
+		case math.IsInf(ts, 1):
+			return "+inf", nil
+		case math.IsInf(ts, -1):
+			return "-inf", nil
+		}
+		return strconv.FormatFloat(ts, 'f', -1, 64), nil
+	}
+	fromTS, e := bound("from-ts", "0")
+	if e != nil {
+		return "", "", e
+	}
+	toTS, e := bound("to-ts", "+inf")
+	if e != nil {
+		return "", "", e
+	}
+	return fromTS, toTS, nil
+}
 
-	res := contactList(u)
-	json.NewEncoder(w).Encode(res)
+func contactListHandler(w http.ResponseWriter, r *http.Request, user string) {
+	res, e := contactList(r.Context(), user)
+	reply(w, r, res, e)
 }
 
-func getProfileHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	username := UsernameFromContext(r)
-	if username == "" { // legacy fallback
-		username = r.URL.Query().Get("username")
-	}
-	res := &response{Status: true}
-	if username == "" {
-		res.Status = false
-		res.Message = "missing username"
-		json.NewEncoder(w).Encode(res)
-		return
-	}
-	p, err := redisrepo.GetProfile(username)
+func getProfileHandler(w http.ResponseWriter, r *http.Request, user string) {
+	p, err := redisrepo.GetProfile(r.Context(), user)
 	if err != nil {
-		res.Status = false
-		res.Message = "unable to fetch profile"
-		json.NewEncoder(w).Encode(res)
+		writeError(w, r, repoError(err, "unable to fetch profile"))
 		return
 	}
-	res.Data = p
-	json.NewEncoder(w).Encode(res)
+	writeJSON(w, http.StatusOK, &response{Status: true, Data: p})
 }
 
-func updateProfileHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func updateProfileHandler(w http.ResponseWriter, r *http.Request, user string) {
 	pr := &profileReq{}
-	if err := json.NewDecoder(r.Body).Decode(pr); err != nil {
-		http.Error(w, "error decoding request object", http.StatusBadRequest)
+	if !decodeJSON(w, r, pr) {
 		return
 	}
-	res := &response{Status: true}
-	if uname := UsernameFromContext(r); uname != "" {
-		pr.Username = uname
+	if e := sameUser(pr.Username, user); e != nil {
+		writeError(w, r, e)
+		return
 	}
 	p := &model.Profile{
-		Username:    pr.Username,
+		Username:    user,
 		DisplayName: pr.DisplayName,
 		Email:       pr.Email,
 		Phone:       pr.Phone,
 		AvatarURL:   pr.AvatarURL,
 	}
-	if err := redisrepo.SaveProfile(p); err != nil {
-		res.Status = false
-		res.Message = "unable to save profile"
+	if err := redisrepo.SaveProfile(r.Context(), p); err != nil {
+		writeError(w, r, repoError(err, "unable to save profile"))
+		return
 	}
-	json.NewEncoder(w).Encode(res)
+	writeJSON(w, http.StatusOK, &response{Status: true})
 }
 
-func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
+func changePasswordHandler(w http.ResponseWriter, r *http.Request, user string) {
 	pr := &passwordChangeReq{}
-	if err := json.NewDecoder(r.Body).Decode(pr); err != nil {
-		http.Error(w, "error decoding request object", http.StatusBadRequest)
+	if !decodeJSON(w, r, pr) {
 		return
 	}
-	res := &response{Status: true}
-	if uname := UsernameFromContext(r); uname != "" {
-		pr.Username = uname
-	}
-	if err := redisrepo.ChangePassword(pr.Username, pr.OldPassword, pr.NewPassword); err != nil {
-		res.Status = false
-		res.Message = err.Error()
-	}
-	json.NewEncoder(w).Encode(res)
-}
-
-func toggle2FAHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	tr := &twoFAReq{}
-	if err := json.NewDecoder(r.Body).Decode(tr); err != nil {
-		http.Error(w, "error decoding request object", http.StatusBadRequest)
+	if e := sameUser(pr.Username, user); e != nil {
+		writeError(w, r, e)
 		return
 	}
-	res := &response{Status: true}
-	if uname := UsernameFromContext(r); uname != "" {
-		tr.Username = uname
-	}
-	if err := redisrepo.SetTwoFA(tr.Username, tr.Enabled); err != nil {
-		res.Status = false
-		res.Message = "unable to update 2FA setting"
-	}
-	json.NewEncoder(w).Encode(res)
-}
-
-func avatarUploadHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	res := &response{Status: true}
-
-	// Parse up to 5MB files
-	if err := r.ParseMultipartForm(5 << 20); err != nil {
-		http.Error(w, "could not parse form", http.StatusBadRequest)
+	if err := passwordPolicy.Validate(user, pr.NewPassword); err != nil {
+		writeError(w, r, invalidFields(passwordField("newPassword", err)))
 		return
 	}
-	username := UsernameFromContext(r)
-	if username == "" { // legacy fallback
-		username = r.FormValue("username")
-	}
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "file missing", http.StatusBadRequest)
+	if err := redisrepo.ChangePassword(r.Context(), user, pr.OldPassword, pr.NewPassword); err != nil {
+		writeError(w, r, repoError(err, "unable to change password"))
 		return
 	}
-	defer file.Close()
+	writeJSON(w, http.StatusOK, &response{Status: true})
+}
 
-	// Save file under avatars/<username>-<filename>
-	fname := fmt.Sprintf("%s-%s", username, header.Filename)
-	path := fmt.Sprintf("avatars/%s", fname)
-	out, err := os.Create(path)
-	if err != nil {
-		http.Error(w, "unable to save file", http.StatusInternalServerError)
+func toggle2FAHandler(w http.ResponseWriter, r *http.Request, user string) {
+	tr := &twoFAReq{}
+	if !decodeJSON(w, r, tr) {
 		return
 	}
-	defer out.Close()
-	if _, err := io.Copy(out, file); err != nil {
-		http.Error(w, "unable to write file", http.StatusInternalServerError)
+	if e := sameUser(tr.Username, user); e != nil {
+		writeError(w, r, e)
 		return
 	}
-
-	// Update profile avatar URL
-	p, _ := redisrepo.GetProfile(username)
-	p.AvatarURL = "/avatars/" + fname
-	if err := redisrepo.SaveProfile(p); err != nil {
-		res.Status = false
-		res.Message = "unable to update avatar url"
-		json.NewEncoder(w).Encode(res)
+	if err := redisrepo.SetTwoFA(r.Context(), user, tr.Enabled); err != nil {
+		writeError(w, r, repoError(err, "unable to update 2FA setting"))
 		return
 	}
-	res.Data = map[string]string{"avatarUrl": p.AvatarURL}
-	json.NewEncoder(w).Encode(res)
+	writeJSON(w, http.StatusOK, &response{Status: true})
 }
 
-// attachmentUploadHandler handles chat attachment uploads and returns a public URL
-func attachmentUploadHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	res := &response{Status: true}
-
-	// Parse up to 20MB files
-	if err := r.ParseMultipartForm(20 << 20); err != nil {
-		http.Error(w, "could not parse form", http.StatusBadRequest)
-		return
-	}
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "file missing", http.StatusBadRequest)
-		return
-	}
-	defer file.Close()
-
-	// Ensure uploads dir exists
-	os.MkdirAll("uploads", 0755)
-
-	// Create a unique filename: epoch-filename
-	safeName := filepath.Base(header.Filename)
-	fname := fmt.Sprintf("%d-%s", time.Now().UnixNano(), safeName)
-	path := filepath.Join("uploads", fname)
-
-	out, err := os.Create(path)
-	if err != nil {
-		http.Error(w, "unable to save file", http.StatusInternalServerError)
-		return
+func register(ctx context.Context, u *userReq) (*response, *apiError) {
+	// validate the request
+	// create new user, fails if the username is taken
+	var fields []fieldError
+	if u.Username == "" {
+		fields = append(fields, required("username"))
+	} else if !usernamePattern.MatchString(u.Username) {
+		fields = append(fields, fieldError{Field: "username", Code: "invalid",
+			Message: "username may only have letters, digits, '.', '-' and '_', at most 32 of them"})
 	}
-	defer out.Close()
-	if _, err := io.Copy(out, file); err != nil {
-		http.Error(w, "unable to write file", http.StatusInternalServerError)
-		return
+	if err := passwordPolicy.Validate(u.Username, u.Password); err != nil {
+		fields = append(fields, passwordField("password", err))
 	}
-
-	// Return the public URL
-	url := "/uploads/" + fname
-	res.Data = map[string]string{
-		"url":  url,
-		"name": header.Filename,
-		"mime": header.Header.Get("Content-Type"),
+	if len(fields) > 0 {
+		return nil, invalidFields(fields...)
 	}
-	json.NewEncoder(w).Encode(res)
-}
 
-func register(u *userReq) *response {
-	// check if username in userset
-	// return error if exist
-	// create new user
-	// create response for error
-	res := &response{Status: true}
-
-	status := redisrepo.IsUserExist(u.Username)
-	if status {
-		res.Status = false
-		res.Message = "username already taken. try something else."
-		return res
+	err := redisrepo.RegisterNewUser(ctx, u.Username, u.Password)
+	if errors.Is(err, redisrepo.ErrConflict) {
+		return nil, newError(http.StatusConflict, codeUsernameTaken, "username already taken. try something else.")
 	}
-
-	err := redisrepo.RegisterNewUser(u.Username, u.Password)
 	if err != nil {
-		res.Status = false
-		res.Message = "something went wrong while registering the user. please try again after sometime."
-		return res
+		return nil, repoError(err, "something went wrong while registering the user. please try again after sometime.")
 	}
 
-	return res
+	return &response{Status: true}, nil
 }
 
-func login(u *userReq) *response {
+func (s *server) login(ctx context.Context, u *userReq) (*response, *apiError) {
 	// if invalid username and password return error
-	// if valid user create new session
-	res := &response{Status: true}
-
-	err := redisrepo.IsUserAuthentic(u.Username, u.Password)
+	// if valid user issue a token
+	err := redisrepo.IsUserAuthentic(ctx, u.Username, u.Password)
+	if errors.Is(err, redisrepo.ErrInvalidCredentials) {
+		metrics.AuthFailures.WithLabelValues("invalid_credentials").Inc()
+		return nil, repoError(err, "")
+	}
 	if err != nil {
-		res.Status = false
-		res.Message = err.Error()
-		return res
+		slog.ErrorContext(ctx, "error while checking credentials", "username", u.Username, "error", err)
+		return nil, repoError(err, "unable to log in. please try again later.")
 	}
 	// Issue JWT token
-	token, errTok := issueToken(u.Username)
+	token, errTok := s.issueToken(u.Username)
 	if errTok != nil {
-		res.Status = false
-		res.Message = "unable to issue token"
-		return res
+		return nil, newError(http.StatusInternalServerError, codeInternal, "unable to issue token")
 	}
-	res.Data = map[string]string{"token": token}
-	return res
+	return &response{Status: true, Data: map[string]string{"token": token}}, nil
 }
 
-func verifyContact(username string) *response {
-	// if invalid username and password return error
-	// if valid user create new session
-	res := &response{Status: true}
+// userNotFound is returned when a request names a user that doesn't exist
+func userNotFound(msg string) *apiError {
+	return newError(http.StatusNotFound, codeUserNotFound, msg)
+}
 
-	status := redisrepo.IsUserExist(username)
+func verifyContact(ctx context.Context, username string) (*response, *apiError) {
+	// if the contact is unknown return error
+	status, err := redisrepo.IsUserExist(ctx, username)
+	if err != nil {
+		return nil, repoError(err, "unable to verify contact. please try again later.")
+	}
 	if !status {
-		res.Status = false
-		res.Message = "invalid username"
+		return nil, userNotFound("invalid username")
 	}
 
-	return res
+	return &response{Status: true}, nil
 }
 
-func chatHistory(username1, username2, fromTS, toTS string) *response {
+func (s *server) chatHistory(ctx context.Context, username1, username2, fromTS, toTS string) (*response, *apiError) {
 	// if invalid usernames return error
 	// if valid users fetch chats
-	res := &response{}
 
-	fmt.Println(username1, username2)
 	// check if user exists
-	if !redisrepo.IsUserExist(username1) || !redisrepo.IsUserExist(username2) {
-		res.Message = "incorrect username"
-		return res
+	for _, u := range []string{username1, username2} {
+		ok, err := redisrepo.IsUserExist(ctx, u)
+		if err != nil {
+			return nil, repoError(err, "unable to fetch chat history. please try again later.")
+		}
+		if !ok {
+			return nil, userNotFound("incorrect username")
+		}
 	}
 
-	chats, err := redisrepo.FetchChatBetween(username1, username2, fromTS, toTS)
+	chats, err := redisrepo.FetchChatBetween(ctx, username1, username2, fromTS, toTS)
 	if err != nil {
-		log.Println("error in fetch chat between", err)
-		res.Message = "unable to fetch chat history. please try again later."
-		return res
+		slog.ErrorContext(ctx, "error in fetch chat between", "username1", username1, "username2", username2, "error", err)
+		return nil, repoError(err, "unable to fetch chat history. please try again later.")
+	}
+	res, err := s.withAttachments(ctx, username1, username2, chats)
+	if err != nil {
+		return nil, repoError(err, "unable to fetch chat history. please try again later.")
 	}
 
-	res.Status = true
-	res.Data = chats
-	res.Total = len(chats)
-	return res
+	return &response{Status: true, Data: res, Total: len(res)}, nil
 }
 
-func contactList(username string) *response {
+func contactList(ctx context.Context, username string) (*response, *apiError) {
 	// if invalid username return error
 	// if valid users fetch chats
-	res := &response{}
 
 	// check if user exists
-	if !redisrepo.IsUserExist(username) {
-		res.Message = "incorrect username"
-		return res
+	ok, err := redisrepo.IsUserExist(ctx, username)
+	if err != nil {
+		return nil, repoError(err, "unable to fetch contact list. please try again later.")
+	}
+	if !ok {
+		return nil, userNotFound("incorrect username")
 	}
 
-	contactList, err := redisrepo.FetchContactList(username)
+	contactList, err := redisrepo.FetchContactList(ctx, username)
 	if err != nil {
-		log.Println("error in fetch contact list of username: ", username, err)
-		res.Message = "unable to fetch contact list. please try again later."
-		return res
+		slog.ErrorContext(ctx, "error in fetch contact list", "username", username, "error", err)
+		return nil, repoError(err, "unable to fetch contact list. please try again later.")
 	}
 
-	res.Status = true
-	res.Data = contactList
-	res.Total = len(contactList)
-	return res
+	return &response{Status: true, Data: contactList, Total: len(contactList)}, nil
 }
@@ -0,0 +1,198 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"Krowka/pkg/blobstore"
+	"Krowka/pkg/logging"
+	"Krowka/pkg/password"
+	"Krowka/pkg/redisrepo"
+)
+
+// Error codes returned in the error envelope. Clients switch on these,
+// never on the message.
+const (
+	codeBadRequest         = "bad_request"
+	codeValidation         = "validation_failed"
+	codeUnauthorized       = "unauthorized"
+	codeInvalidCredentials = "invalid_credentials"
+	codeNotFound           = "not_found"
+	codeUserNotFound       = "user_not_found"
+	codeMethodNotAllowed   = "method_not_allowed"
+	codeConflict           = "conflict"
+	codeUsernameTaken      = "username_taken"
+	codeTimeout            = "upstream_timeout"
+	codeClientClosed       = "client_closed_request"
+	codeInternal           = "internal_error"
+)
+
+// statusClientClosedRequest is logged when the client went away before
+// the repository answered, nobody reads the response
+const statusClientClosedRequest = 499
+
+// apiError is the body of every failed request:
+//
+//	{"status": false, "message": "...", "error": {"code": "...", "message": "...", "fields": [...]}}
+//
+// status and message repeat the legacy response fields so older clients
+// keep working.
+type apiError struct {
+	status  int
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []fieldError `json:"fields,omitempty"`
+}
+
+// fieldError explains why a single request field was rejected
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorEnvelope struct {
+	Status    bool      `json:"status"`
+	Message   string    `json:"message"`
+	Error     *apiError `json:"error"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+func (e *apiError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newError(status int, code, msg string) *apiError {
+	return &apiError{status: status, Code: code, Message: msg}
+}
+
+func badRequest(msg string) *apiError {
+	return newError(http.StatusBadRequest, codeBadRequest, msg)
+}
+
+// invalidFields is a 422 listing every rejected field
+func invalidFields(fields ...fieldError) *apiError {
+	e := newError(http.StatusUnprocessableEntity, codeValidation, "request validation failed")
+	e.Fields = fields
+	if len(fields) == 1 {
+		e.Message = fields[0].Message
+	}
+	return e
+}
+
+func required(field string) fieldError {
+	return fieldError{Field: field, Code: "required", Message: field + " is required"}
+}
+
+// passwordField reports a password policy violation on field
+func passwordField(field string, err error) fieldError {
+	code := "invalid"
+	switch {
+	case errors.Is(err, password.ErrTooShort):
+		code = "too_short"
+	case errors.Is(err, password.ErrTooLong):
+		code = "too_long"
+	case errors.Is(err, password.ErrSameAsUsername):
+		code = "same_as_username"
+	case errors.Is(err, password.ErrBreached):
+		code = "breached"
+	}
+	return fieldError{Field: field, Code: code, Message: err.Error()}
+}
+
+// statusFor maps repository and blob store errors to HTTP status codes
+func statusFor(err error) int {
+	switch {
+	case errors.Is(err, redisrepo.ErrNotFound), errors.Is(err, blobstore.ErrNotFound), errors.Is(err, blobstore.ErrInvalidKey):
+		return http.StatusNotFound
+	case errors.Is(err, redisrepo.ErrConflict), errors.Is(err, redisrepo.ErrUploadChanged):
+		return http.StatusConflict
+	case errors.Is(err, redisrepo.ErrQuotaExceeded):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, redisrepo.ErrInvalidCredentials):
+		return http.StatusUnauthorized
+	case errors.Is(err, redisrepo.ErrTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// repoError wraps a repository error, msg is shown for failures that are
+// not the client's fault
+func repoError(err error, msg string) *apiError {
+	status := statusFor(err)
+	switch status {
+	case http.StatusNotFound:
+		return newError(status, codeNotFound, "not found")
+	case http.StatusConflict:
+		return newError(status, codeConflict, err.Error())
+	case http.StatusUnauthorized:
+		return newError(status, codeInvalidCredentials, err.Error())
+	case http.StatusRequestEntityTooLarge:
+		return quotaExceeded()
+	case http.StatusGatewayTimeout:
+		return newError(status, codeTimeout, msg)
+	case statusClientClosedRequest:
+		return newError(status, codeClientClosed, msg)
+	default:
+		return newError(status, codeInternal, msg)
+	}
+}
+
+// writeJSON encodes v with the given status
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("writing response failed", "error", err)
+	}
+}
+
+// writeError writes the error envelope. With http.legacy_errors set it
+// writes the old {status:false, message} body instead, with status 200
+// except for 401, 403 and 404, which proxies and clients must still see.
+func writeError(w http.ResponseWriter, r *http.Request, e *apiError) {
+	if legacy, _ := r.Context().Value(legacyErrorsCtxKey).(bool); legacy {
+		status := http.StatusOK
+		switch e.status {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			status = e.status
+		}
+		writeJSON(w, status, &response{Status: false, Message: e.Message})
+		return
+	}
+
+	if e.status >= http.StatusInternalServerError {
+		slog.WarnContext(r.Context(), "request failed", "code", e.Code, "status", e.status)
+	}
+
+	writeJSON(w, e.status, &errorEnvelope{
+		Status:    false,
+		Message:   e.Message,
+		Error:     e,
+		RequestID: logging.RequestID(r.Context()),
+	})
+}
+
+// decodeJSON reads the request body into v, answering 400 on failure
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeError(w, r, badRequest("error decoding request object"))
+		return false
+	}
+	return true
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, newError(http.StatusNotFound, codeNotFound, "no route for "+r.URL.Path))
+}
+
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, newError(http.StatusMethodNotAllowed, codeMethodNotAllowed, r.Method+" not allowed on "+r.URL.Path))
+}
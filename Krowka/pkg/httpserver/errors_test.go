@@ -0,0 +1,134 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"Krowka/pkg/config"
+	"Krowka/pkg/health"
+	"Krowka/pkg/redisrepo"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestStatusFor(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{redisrepo.ErrNotFound, http.StatusNotFound},
+		{redisrepo.ErrConflict, http.StatusConflict},
+		{redisrepo.ErrInvalidCredentials, http.StatusUnauthorized},
+		{redisrepo.ErrQuotaExceeded, http.StatusRequestEntityTooLarge},
+		{fmt.Errorf("%w: %w", redisrepo.ErrTimeout, context.DeadlineExceeded), http.StatusGatewayTimeout},
+		{context.Canceled, statusClientClosedRequest},
+		{errors.New("boom"), http.StatusInternalServerError},
+	} {
+		if got := statusFor(tc.err); got != tc.want {
+			t.Errorf("statusFor(%v) = %d, want %d", tc.err, got, tc.want)
+		}
+	}
+}
+
+// newTestServer serves the full router against an in-memory redis
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	return newTestServerOn(t, miniredis.RunT(t))
+}
+
+// newTestServerOn is newTestServer on a miniredis the test gets to hook
+func newTestServerOn(t *testing.T, m *miniredis.Miniredis) *server {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Redis.Addr = m.Addr()
+	cfg.HTTP.AvatarDir = t.TempDir()
+	cfg.HTTP.UploadDir = t.TempDir()
+
+	client, err := redisrepo.InitialiseRedis(context.Background(), cfg.Redis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	if err := openStores(context.Background(), cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	return newServer(cfg, health.New())
+}
+
+func do(t *testing.T, h http.Handler, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("%s %s: content type %q, body %s", method, path, ct, rec.Body)
+	}
+	var res map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("%s %s: %v, body %s", method, path, err, rec.Body)
+	}
+	return rec.Code, res
+}
+
+func errorCode(res map[string]interface{}) string {
+	e, _ := res["error"].(map[string]interface{})
+	code, _ := e["code"].(string)
+	return code
+}
+
+func TestErrorEnvelope(t *testing.T) {
+	h := newTestServer(t)
+
+	code, res := do(t, h, http.MethodPost, "/register", `{"username":"alice","password":"short"}`)
+	if code != http.StatusUnprocessableEntity || errorCode(res) != codeValidation {
+		t.Fatal("expected validation error", code, res)
+	}
+	fields := res["error"].(map[string]interface{})["fields"].([]interface{})
+	if f := fields[0].(map[string]interface{}); f["field"] != "password" || f["code"] != "too_short" {
+		t.Error("unexpected field error", f)
+	}
+	if res["status"] != false || res["message"] == "" {
+		t.Error("legacy fields missing from envelope", res)
+	}
+
+	if code, res = do(t, h, http.MethodPost, "/register", `{"username":"alice","password":"correct horse"}`); code != http.StatusOK {
+		t.Fatal("register", code, res)
+	}
+	if code, res = do(t, h, http.MethodPost, "/register", `{"username":"alice","password":"correct horse"}`); code != http.StatusConflict || errorCode(res) != codeUsernameTaken {
+		t.Error("expected username_taken", code, res)
+	}
+	if code, res = do(t, h, http.MethodPost, "/login", `{"username":"alice","password":"wrong password"}`); code != http.StatusUnauthorized || errorCode(res) != codeInvalidCredentials {
+		t.Error("expected invalid_credentials", code, res)
+	}
+	if code, res = do(t, h, http.MethodPost, "/login", `{"username":`); code != http.StatusBadRequest || errorCode(res) != codeBadRequest {
+		t.Error("expected bad_request", code, res)
+	}
+	if code, res = do(t, h, http.MethodGet, "/contact-list", ""); code != http.StatusUnauthorized || errorCode(res) != codeUnauthorized {
+		t.Error("expected unauthorized", code, res)
+	}
+	if code, res = do(t, h, http.MethodGet, "/no-such-route", ""); code != http.StatusNotFound || errorCode(res) != codeNotFound {
+		t.Error("expected not_found", code, res)
+	}
+
+	h.cfg.HTTP.LegacyErrors = true
+	code, res = do(t, h, http.MethodPost, "/login", `{"username":`)
+	if code != http.StatusOK || res["status"] != false || res["error"] != nil {
+		t.Error("expected legacy 200 body", code, res)
+	}
+	// authentication and missing resources keep their status
+	code, res = do(t, h, http.MethodPost, "/login", `{"username":"alice","password":"wrong password"}`)
+	if code != http.StatusUnauthorized || res["status"] != false || res["error"] != nil {
+		t.Error("expected legacy body with 401", code, res)
+	}
+	if code, res = do(t, h, http.MethodGet, "/no-such-route", ""); code != http.StatusNotFound || res["error"] != nil {
+		t.Error("expected legacy body with 404", code, res)
+	}
+}
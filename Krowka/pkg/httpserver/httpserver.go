@@ -1,57 +1,188 @@
 package httpserver
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
-	"os"
+	"time"
 
+	"Krowka/pkg/config"
+	"Krowka/pkg/graceful"
+	"Krowka/pkg/health"
+	"Krowka/pkg/logging"
+	"Krowka/pkg/metrics"
 	"Krowka/pkg/redisrepo"
+	"Krowka/pkg/scan"
+	"Krowka/pkg/tracing"
 
 	"github.com/gorilla/mux"
 	"github.com/rs/cors"
 )
 
-func StartHTTPServer() {
-	// initialise redis
-	redisClient := redisrepo.InitialiseRedis()
-	defer redisClient.Close()
+// server holds the configuration the handlers run with and the router
+// that serves them
+type server struct {
+	cfg    *config.Config
+	router http.Handler
+}
 
+// StartHTTPServer serves until ctx is cancelled. Redis must already be
+// initialised.
+func StartHTTPServer(ctx context.Context, cfg *config.Config) error {
 	// create indexes
-	redisrepo.CreateFetchChatBetweenIndex()
+	redisrepo.CreateFetchChatBetweenIndex(ctx)
 
-	r := mux.NewRouter()
-	// ensure avatars directory exists
-	os.MkdirAll("avatars", 0755)
-	// ensure uploads directory exists
-	os.MkdirAll("uploads", 0755)
-	r.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "Simple Server")
-	}).Methods(http.MethodGet)
+	// move legacy <username> password keys to user:<username>
+	if err := redisrepo.MigrateCredentials(ctx); err != nil {
+		return fmt.Errorf("credentials migration failed: %w", err)
+	}
+
+	// optional list of breached passwords rejected on register and change
+	passwordPolicy.MinLength = cfg.Auth.PasswordMinLength
+	if path := cfg.Auth.PasswordBlocklistFile; path != "" {
+		if err := passwordPolicy.LoadBlocklist(path); err != nil {
+			return fmt.Errorf("unable to load password blocklist: %w", err)
+		}
+	}
+
+	// local directories or bucket for avatars and attachments
+	if err := openStores(ctx, cfg); err != nil {
+		return fmt.Errorf("unable to open blob storage: %w", err)
+	}
+	ffmpegPath = findFFmpeg(ctx, cfg.HTTP.FFmpegPath)
+	sc, err := scan.Open(cfg.Storage.Scan)
+	if err != nil {
+		return err
+	}
+	scanner = sc
+	if scanner != nil {
+		// a scanner that is down holds back downloads, not the server
+		if err := scanner.Check(ctx); err != nil {
+			slog.WarnContext(ctx, "malware scanner unavailable, attachments stay pending", "error", err)
+		}
+	}
+	checker := health.New()
+	checker.Add("redis", redisrepo.Ping)
+	checker.Add("redis_modules", redisrepo.CheckModules)
+	checker.Add("chat_index", redisrepo.CheckChatIndex)
+	checker.Add("avatar_store", avatarStore.Check)
+	checker.Add("attachment_store", attachmentStore.Check)
+
+	s := newServer(cfg, checker)
+	go expireUploads(ctx)
+	go runJanitor(ctx, cfg.Storage.GC)
+	go s.retryScans(ctx)
+
+	srv := &http.Server{
+		Addr:              cfg.HTTP.Addr,
+		Handler:           s,
+		ReadHeaderTimeout: cfg.HTTP.ReadTimeout,
+		ReadTimeout:       cfg.HTTP.ReadTimeout,
+		WriteTimeout:      cfg.HTTP.WriteTimeout,
+		IdleTimeout:       cfg.HTTP.IdleTimeout,
+	}
+
+	return graceful.Serve(ctx, srv, graceful.Options{
+		Timeout:    cfg.ShutdownTimeout,
+		DrainDelay: cfg.ShutdownDelay,
+		OnShutdown: checker.SetShuttingDown,
+	})
+}
+
+// deprecated marks a legacy route as an alias of its /v1 successor
+func deprecated(successor string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+">; rel=\"successor-version\"")
+		next.ServeHTTP(w, r)
+	})
+}
 
-	r.HandleFunc("/register", registerHandler).Methods(http.MethodPost)
-	r.HandleFunc("/login", loginHandler).Methods(http.MethodPost)
-	r.Handle("/verify-contact", AuthMiddleware(http.HandlerFunc(verifyContactHandler))).Methods(http.MethodPost)
-	r.Handle("/chat-history", AuthMiddleware(http.HandlerFunc(chatHistoryHandler))).Methods(http.MethodGet)
-	r.Handle("/contact-list", AuthMiddleware(http.HandlerFunc(contactListHandler))).Methods(http.MethodGet)
-	// profile routes
-	r.Handle("/profile", AuthMiddleware(http.HandlerFunc(getProfileHandler))).Methods(http.MethodGet)
-	r.Handle("/profile", AuthMiddleware(http.HandlerFunc(updateProfileHandler))).Methods(http.MethodPost)
-	r.Handle("/password/change", AuthMiddleware(http.HandlerFunc(changePasswordHandler))).Methods(http.MethodPost)
-	r.Handle("/2fa/toggle", AuthMiddleware(http.HandlerFunc(toggle2FAHandler))).Methods(http.MethodPost)
-	r.Handle("/avatar", AuthMiddleware(http.HandlerFunc(avatarUploadHandler))).Methods(http.MethodPost)
-	r.Handle("/chat/attachment", AuthMiddleware(http.HandlerFunc(attachmentUploadHandler))).Methods(http.MethodPost)
-	// serve avatars statically
-	r.PathPrefix("/avatars/").Handler(http.StripPrefix("/avatars/", http.FileServer(http.Dir("avatars"))))
-	// serve uploads statically
-	r.PathPrefix("/uploads/").Handler(http.StripPrefix("/uploads/", http.FileServer(http.Dir("uploads"))))
+func newServer(cfg *config.Config, checker *health.Checker) *server {
+	s := &server{cfg: cfg}
+	r := mux.NewRouter()
+	r.Use(tracing.Middleware, logging.Middleware, metrics.Middleware)
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	r.MethodNotAllowedHandler = http.HandlerFunc(methodNotAllowedHandler)
+	s.routes(r, checker)
 
 	// CORS with explicit Authorization header support
 	c := cors.New(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:3000", "http://localhost:3001", "*"},
-		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions},
-		AllowedHeaders:   []string{"Authorization", "Content-Type", "Accept", "Origin", "X-Requested-With"},
+		AllowedOrigins:   cfg.HTTP.CORSOrigins,
+		AllowedMethods:   []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "Accept", "Origin", "X-Requested-With", offsetHeader},
 		AllowCredentials: true,
 	})
-	handler := c.Handler(r)
-	http.ListenAndServe(":8080", handler)
+	s.router = c.Handler(r)
+	return s
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.HTTP.LegacyErrors {
+		r = r.WithContext(context.WithValue(r.Context(), legacyErrorsCtxKey, true))
+	}
+	s.router.ServeHTTP(w, r)
+}
+
+// extendWriteDeadline gives a response about a file of size bytes the
+// write timeout plus the time it takes at the minimum transfer rate, the
+// server-wide timeout would cut large files off
+func (s *server) extendWriteDeadline(w http.ResponseWriter, r *http.Request, size int64) {
+	d := s.cfg.HTTP.WriteTimeout + time.Duration(size/s.cfg.HTTP.MinTransferRate)*time.Second
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.DebugContext(r.Context(), "extending write deadline failed", "error", err)
+	}
+}
+
+// routes registers every endpoint, each one must be described in
+// openapi.json
+func (s *server) routes(r *mux.Router, checker *health.Checker) {
+	r.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Simple Server")
+	}).Methods(http.MethodGet)
+	r.HandleFunc("/healthz", checker.Liveness).Methods(http.MethodGet)
+	r.HandleFunc("/readyz", checker.Readiness).Methods(http.MethodGet)
+	r.Handle("/metrics", metrics.Handler()).Methods(http.MethodGet)
+
+	// versioned API
+	v1 := r.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/openapi.json", openAPIHandler).Methods(http.MethodGet)
+	v1.HandleFunc("/auth/register", registerHandler).Methods(http.MethodPost)
+	v1.HandleFunc("/auth/login", s.loginHandler).Methods(http.MethodPost)
+	v1.Handle("/users/{username}", s.authorize(authenticated, getUserHandler)).Methods(http.MethodGet)
+	v1.Handle("/contacts", s.authorize(owner, contactListHandler)).Methods(http.MethodGet)
+	v1.Handle("/conversations/{peer}/messages", s.authorize(participant, s.chatHistoryHandler)).Methods(http.MethodGet)
+	v1.Handle("/conversations/{peer}/media", s.authorize(participant, s.conversationMediaHandler)).Methods(http.MethodGet)
+	v1.Handle("/profile", s.authorize(owner, getProfileHandler)).Methods(http.MethodGet)
+	v1.Handle("/profile", s.authorize(owner, updateProfileHandler)).Methods(http.MethodPut)
+	v1.Handle("/profile/password", s.authorize(owner, changePasswordHandler)).Methods(http.MethodPut)
+	v1.Handle("/profile/2fa", s.authorize(owner, toggle2FAHandler)).Methods(http.MethodPut)
+	v1.Handle("/profile/avatar", s.authorize(owner, s.avatarUploadHandler)).Methods(http.MethodPost)
+	v1.Handle("/attachments", s.authorize(owner, s.attachmentUploadHandler)).Methods(http.MethodPost)
+	v1.HandleFunc("/attachments/{id}", s.downloadAttachmentHandler).Methods(http.MethodGet)
+	v1.HandleFunc("/attachments/{id}/thumbnail", s.attachmentThumbnailHandler).Methods(http.MethodGet)
+	v1.Handle("/attachments/{id}/url", s.authorize(authenticated, s.attachmentURLHandler)).Methods(http.MethodGet)
+	v1.Handle("/uploads", s.authorize(owner, s.createUploadHandler)).Methods(http.MethodPost)
+	v1.Handle("/uploads/{id}", s.authorize(owner, getUploadHandler)).Methods(http.MethodGet)
+	v1.Handle("/uploads/{id}", s.authorize(owner, s.uploadChunkHandler)).Methods(http.MethodPatch)
+	v1.Handle("/uploads/{id}/complete", s.authorize(owner, s.completeUploadHandler)).Methods(http.MethodPost)
+	v1.Handle("/storage/usage", s.authorize(owner, s.storageUsageHandler)).Methods(http.MethodGet)
+
+	// deprecated unversioned aliases, kept until clients moved to /v1
+	r.Handle("/register", deprecated("/v1/auth/register", http.HandlerFunc(registerHandler))).Methods(http.MethodPost)
+	r.Handle("/login", deprecated("/v1/auth/login", http.HandlerFunc(s.loginHandler))).Methods(http.MethodPost)
+	r.Handle("/verify-contact", deprecated("/v1/users/{username}", s.authorize(authenticated, verifyContactHandler))).Methods(http.MethodPost)
+	r.Handle("/chat-history", deprecated("/v1/conversations/{peer}/messages", s.authorize(participant, s.chatHistoryHandler))).Methods(http.MethodGet)
+	r.Handle("/contact-list", deprecated("/v1/contacts", s.authorize(owner, contactListHandler))).Methods(http.MethodGet)
+	r.Handle("/profile", deprecated("/v1/profile", s.authorize(owner, getProfileHandler))).Methods(http.MethodGet)
+	r.Handle("/profile", deprecated("/v1/profile", s.authorize(owner, updateProfileHandler))).Methods(http.MethodPost)
+	r.Handle("/password/change", deprecated("/v1/profile/password", s.authorize(owner, changePasswordHandler))).Methods(http.MethodPost)
+	r.Handle("/2fa/toggle", deprecated("/v1/profile/2fa", s.authorize(owner, toggle2FAHandler))).Methods(http.MethodPost)
+	r.Handle("/avatar", deprecated("/v1/profile/avatar", s.authorize(owner, s.avatarUploadHandler))).Methods(http.MethodPost)
+	r.Handle("/chat/attachment", deprecated("/v1/attachments", s.authorize(owner, s.attachmentUploadHandler))).Methods(http.MethodPost)
+
+	// avatars are public, attachments only go through /v1/attachments
+	r.PathPrefix("/avatars/").HandlerFunc(s.avatarFileHandler).Methods(http.MethodGet)
 }
@@ -0,0 +1,283 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/blobstore"
+	"Krowka/pkg/config"
+	"Krowka/pkg/metrics"
+	"Krowka/pkg/redisrepo"
+)
+
+// besides attachment contents the store holds thumbnails, the chunks of
+// resumable uploads and files named by attachment ID, from before
+// deduplication or of uploads in progress. Other keys predate random IDs
+// and are left alone.
+var (
+	thumbnailKeyPattern = regexp.MustCompile(`^([0-9a-f]{32})-thumb$`)
+	chunkKeyPattern     = regexp.MustCompile(`^partial/([0-9a-f]{32})/`)
+)
+
+const (
+	// gcLock keeps a janitor pass to one server at a time
+	gcLock = "gc"
+	// gcLockTTL bounds a pass that never gives the lock back
+	gcLockTTL = time.Hour
+)
+
+// eachChat walks every stored chat, tests replace it as miniredis has no
+// RedisJSON
+var eachChat = redisrepo.EachChat
+
+// GCReport is what one janitor pass found, and deleted unless it was a
+// dry run
+type GCReport struct {
+	// Files were listed in the attachment store
+	Files int
+	// Orphans are attachments referenced by no chat and files belonging
+	// to nothing, older than the grace period, of Bytes in total
+	Orphans int
+	Bytes   int64
+	// Deleted orphans freed Reclaimed bytes, less than their size when
+	// other attachments share the content
+	Deleted   int
+	Reclaimed int64
+}
+
+// runJanitor makes a pass every gc.Interval until ctx is done
+func runJanitor(ctx context.Context, gc config.GC) {
+	if gc.Interval == 0 {
+		return
+	}
+	t := time.NewTicker(gc.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		if _, err := lockedCollect(ctx, gc); err != nil && !errors.Is(err, redisrepo.ErrConflict) {
+			slog.WarnContext(ctx, "janitor pass failed", "error", err)
+		}
+	}
+}
+
+// CollectGarbage makes a single janitor pass with the configured grace
+// period and dry run setting, for the --gc flag. Redis must already be
+// initialised.
+func CollectGarbage(ctx context.Context, cfg *config.Config) (GCReport, error) {
+	if err := openStores(ctx, cfg); err != nil {
+		return GCReport{}, fmt.Errorf("unable to open blob storage: %w", err)
+	}
+	return lockedCollect(ctx, cfg.Storage.GC)
+}
+
+// lockedCollect makes a pass unless another server is making one, then it
+// returns ErrConflict
+func lockedCollect(ctx context.Context, gc config.GC) (GCReport, error) {
+	unlock, err := redisrepo.TryLock(ctx, gcLock, gcLockTTL)
+	if errors.Is(err, redisrepo.ErrConflict) {
+		metrics.GCRuns.WithLabelValues("skipped").Inc()
+		return GCReport{}, err
+	}
+	if err != nil {
+		metrics.GCRuns.WithLabelValues("error").Inc()
+		return GCReport{}, err
+	}
+	defer unlock()
+
+	rep, err := collectGarbage(ctx, time.Now(), gc.GracePeriod, gc.DryRun)
+	if err != nil {
+		metrics.GCRuns.WithLabelValues("error").Inc()
+		return rep, err
+	}
+	metrics.GCRuns.WithLabelValues("ok").Inc()
+	return rep, nil
+}
+
+// collectGarbage deletes the attachments no chat refers to, by typed
+// reference or link, with their thumbnails and their content unless other
+// attachments share it. Files belonging to nothing are deleted too:
+// contents without attachments, the chunks of uploads that are gone and
+// whatever a crashed upload left. Anything younger than grace is kept, its
+// chat may not be sent yet. With dryRun nothing is deleted, orphans are
+// only logged.
+func collectGarbage(ctx context.Context, now time.Time, grace time.Duration, dryRun bool) (GCReport, error) {
+	var rep GCReport
+
+	// files and attachments are listed before the references are read, so
+	// that a chat sent meanwhile refers to something that is either in the
+	// references or not among the candidates at all
+	files := map[string]blobstore.Info{}
+	thumbs := map[string]blobstore.Info{}
+	chunks := map[string][]blobstore.Info{}
+	contents := map[string]blobstore.Info{}
+	err := attachmentStore.List(ctx, func(info blobstore.Info) error {
+		rep.Files++
+		if attachmentIDPattern.MatchString(info.Key) {
+			files[info.Key] = info
+		} else if m := thumbnailKeyPattern.FindStringSubmatch(info.Key); m != nil {
+			thumbs[m[1]] = info
+		} else if m := chunkKeyPattern.FindStringSubmatch(info.Key); m != nil {
+			chunks[m[1]] = append(chunks[m[1]], info)
+		} else if m := contentKeyPattern.FindStringSubmatch(info.Key); m != nil {
+			contents[m[1]] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return rep, fmt.Errorf("listing attachments: %w", err)
+	}
+	var attachments []*model.Attachment
+	err = redisrepo.EachAttachment(ctx, func(a *model.Attachment) error {
+		attachments = append(attachments, a)
+		return nil
+	})
+	if err != nil {
+		return rep, fmt.Errorf("reading attachments: %w", err)
+	}
+
+	refs := map[string]bool{}
+	err = eachChat(ctx, func(c *model.Chat) error {
+		for _, a := range c.Attachments {
+			refs[a.ID] = true
+		}
+		for _, m := range attachmentLinkPattern.FindAllStringSubmatch(c.Msg, -1) {
+			refs[m[1]] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return rep, fmt.Errorf("reading chats: %w", err)
+	}
+
+	expired := func(info blobstore.Info) bool {
+		return now.Sub(info.ModTime) > grace
+	}
+	// an upload being completed has its file before it has metadata
+	uploading := func(id string) bool {
+		_, err := redisrepo.GetUpload(ctx, id)
+		return !errors.Is(err, redisrepo.ErrNotFound)
+	}
+	deleted := func(kind string, freed int64) {
+		rep.Deleted++
+		rep.Reclaimed += freed
+		metrics.GCDeletedFiles.WithLabelValues(kind).Inc()
+		metrics.GCReclaimedBytes.Add(float64(freed))
+	}
+	remove := func(kind string, info blobstore.Info) {
+		rep.Orphans++
+		rep.Bytes += info.Size
+		if dryRun {
+			slog.InfoContext(ctx, "orphaned file", "kind", kind, "key", info.Key, "size", info.Size, "modified", info.ModTime)
+			return
+		}
+		if err := attachmentStore.Delete(ctx, info.Key); err != nil {
+			slog.WarnContext(ctx, "deleting orphaned file failed", "key", info.Key, "error", err)
+			return
+		}
+		slog.InfoContext(ctx, "orphaned file deleted", "kind", kind, "key", info.Key, "size", info.Size)
+		deleted(kind, info.Size)
+	}
+
+	// the files of attachments with metadata go with them
+	for _, a := range attachments {
+		thumb, hasThumb := thumbs[a.ID]
+		delete(files, a.ID)
+		delete(thumbs, a.ID)
+		delete(contents, a.Blob)
+		if refs[a.ID] || now.Sub(time.Unix(a.CreatedAt, 0)) <= grace {
+			continue
+		}
+		rep.Orphans++
+		rep.Bytes += a.Size
+		if dryRun {
+			slog.InfoContext(ctx, "orphaned attachment", "attachment_id", a.ID, "blob", a.Blob, "size", a.Size, "created", time.Unix(a.CreatedAt, 0))
+		} else if freed, ok := forgetAttachment(ctx, a); ok {
+			slog.InfoContext(ctx, "orphaned attachment deleted", "attachment_id", a.ID, "blob", a.Blob, "size", a.Size, "freed", freed)
+			deleted("attachment", freed)
+		} else {
+			continue
+		}
+		if hasThumb {
+			remove("thumbnail", thumb)
+		}
+	}
+
+	for id, info := range files {
+		if !refs[id] && expired(info) && !uploading(id) {
+			remove("attachment", info)
+		}
+	}
+	for _, info := range thumbs {
+		if expired(info) {
+			remove("thumbnail", info)
+		}
+	}
+	for id, list := range chunks {
+		if uploading(id) {
+			continue
+		}
+		for _, info := range list {
+			if expired(info) {
+				remove("chunk", info)
+			}
+		}
+	}
+	for hash, info := range contents {
+		if expired(info) {
+			removeContent(ctx, hash, info, remove)
+		}
+	}
+
+	metrics.GCOrphanedBytes.Set(float64(rep.Bytes))
+	slog.InfoContext(ctx, "janitor pass finished", "dry_run", dryRun, "files", rep.Files,
+		"orphans", rep.Orphans, "orphaned_bytes", rep.Bytes, "deleted", rep.Deleted, "reclaimed_bytes", rep.Reclaimed)
+	return rep, nil
+}
+
+// forgetAttachment deletes the metadata of an orphaned attachment and
+// releases its content. It reports the bytes freed and whether the
+// attachment was still there to delete.
+func forgetAttachment(ctx context.Context, a *model.Attachment) (int64, bool) {
+	if err := redisrepo.DeleteAttachment(ctx, a.ID); err != nil {
+		// ErrNotFound: another pass got there first and released the content
+		if !errors.Is(err, redisrepo.ErrNotFound) {
+			slog.WarnContext(ctx, "deleting orphaned attachment failed", "attachment_id", a.ID, "error", err)
+		}
+		return 0, false
+	}
+	freed, err := releaseContent(ctx, a)
+	if err != nil {
+		slog.WarnContext(ctx, "releasing orphaned attachment failed", "attachment_id", a.ID, "blob", a.Blob, "error", err)
+	}
+	return freed, true
+}
+
+// removeContent deletes the file of a content no attachment refers to,
+// e.g. after a server died between storing it and counting it. The lock
+// keeps an upload of the same bytes from counting on it meanwhile.
+func removeContent(ctx context.Context, hash string, info blobstore.Info, remove func(string, blobstore.Info)) {
+	unlock, err := lockContent(ctx, hash)
+	if err != nil {
+		slog.WarnContext(ctx, "locking orphaned content failed", "blob", hash, "error", err)
+		return
+	}
+	defer unlock()
+
+	refs, err := redisrepo.BlobRefs(ctx, hash)
+	if err != nil {
+		slog.WarnContext(ctx, "counting content references failed", "blob", hash, "error", err)
+		return
+	}
+	if refs == 0 {
+		remove("content", info)
+	}
+}
@@ -0,0 +1,190 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/blobstore"
+	"Krowka/pkg/redisrepo"
+)
+
+func TestCollectGarbage(t *testing.T) {
+	h := newTestServer(t)
+	ctx := context.Background()
+	id := func(c string) string { return strings.Repeat(c, 32) }
+
+	chats := []model.Chat{
+		{From: "alice", To: "bob", Attachments: []model.AttachmentRef{{ID: id("a")}, {ID: id("5")}}},
+		{From: "bob", To: "alice", Msg: "see /v1/attachments/" + id("b") + "?expires=1&sig=x"},
+	}
+	prev := eachChat
+	eachChat = func(ctx context.Context, fn func(*model.Chat) error) error {
+		for i := range chats {
+			if err := fn(&chats[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	t.Cleanup(func() { eachChat = prev })
+
+	// c is an orphan with metadata and a thumbnail, d a fresh orphan, e
+	// an upload being completed and f an upload that went away
+	if err := redisrepo.ReserveStorage(ctx, "alice", 5, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := redisrepo.SaveAttachment(ctx, &model.Attachment{ID: id("c"), Owner: "alice", Peer: "bob", Size: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if err := redisrepo.CreateUpload(ctx, &model.Upload{ID: id("e"), Owner: "alice", Size: 5}); err != nil {
+		t.Fatal(err)
+	}
+	// 5 is referenced and shares its content with the orphan 6, the
+	// orphan 7 is the only one with its content and nothing refers to the
+	// content z
+	hash := func(c string) string { return strings.Repeat(c, 64) }
+	for _, a := range []*model.Attachment{
+		{ID: id("5"), Owner: "alice", Peer: "bob", Size: 5, Blob: hash("5")},
+		{ID: id("6"), Owner: "alice", Peer: "bob", Size: 5, Blob: hash("5")},
+		{ID: id("7"), Owner: "bob", Peer: "alice", Size: 5, Blob: hash("7")},
+	} {
+		if err := redisrepo.ChargeBlob(ctx, a.Owner, a.Blob, a.Size, 0); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := redisrepo.AddBlobRef(ctx, a.Blob, a.Size); err != nil {
+			t.Fatal(err)
+		}
+		if err := redisrepo.SaveAttachment(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	keys := []string{
+		id("a"), id("b"), id("c"), thumbnailKey(id("c")), id("d"), id("e"),
+		thumbnailKey(id("9")), "partial/" + id("e") + "/0-1234", "partial/" + id("f") + "/0-5678",
+		"legacy-photo.jpg", contentKey(hash("5")), contentKey(hash("7")), contentKey(hash("f")),
+	}
+	for _, key := range keys {
+		if _, err := attachmentStore.Put(ctx, key, strings.NewReader("12345"), ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now().Add(48 * time.Hour)
+	if err := os.Chtimes(filepath.Join(h.cfg.HTTP.UploadDir, id("d")), now, now); err != nil {
+		t.Fatal(err)
+	}
+
+	orphans := []string{id("c"), thumbnailKey(id("c")), thumbnailKey(id("9")), "partial/" + id("f") + "/0-5678",
+		contentKey(hash("7")), contentKey(hash("f"))}
+	exists := func(key string) bool {
+		_, err := attachmentStore.Stat(ctx, key)
+		return !errors.Is(err, blobstore.ErrNotFound)
+	}
+
+	rep, err := collectGarbage(ctx, now, 24*time.Hour, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the orphans 6 and 7 stand for their content, z has none
+	if rep.Files != len(keys) || rep.Orphans != 7 || rep.Bytes != 35 || rep.Deleted != 0 {
+		t.Errorf("dry run: %+v", rep)
+	}
+	for _, key := range keys {
+		if !exists(key) {
+			t.Errorf("dry run deleted %s", key)
+		}
+	}
+
+	rep, err = collectGarbage(ctx, now, 24*time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 6 frees nothing, 5 still needs the content
+	if rep.Orphans != 7 || rep.Deleted != 7 || rep.Reclaimed != 30 {
+		t.Errorf("report: %+v", rep)
+	}
+	gone := map[string]bool{}
+	for _, key := range orphans {
+		gone[key] = true
+	}
+	for _, key := range keys {
+		if exists(key) == gone[key] {
+			t.Errorf("%s: exists=%t", key, !gone[key])
+		}
+	}
+	for _, orphan := range []string{id("c"), id("6"), id("7")} {
+		if _, err := redisrepo.GetAttachment(ctx, orphan); !errors.Is(err, redisrepo.ErrNotFound) {
+			t.Errorf("metadata of %s kept: %v", orphan, err)
+		}
+	}
+	if refs, _ := redisrepo.BlobRefs(ctx, hash("5")); refs != 1 {
+		t.Errorf("shared content has %d references", refs)
+	}
+	// alice keeps 5, whose content she was charged for once
+	if usage, _ := redisrepo.GetStorageUsage(ctx, "alice"); usage.UsedBytes != 5 || usage.Files != 1 {
+		t.Errorf("alice's quota: %+v", usage)
+	}
+	if usage, _ := redisrepo.GetStorageUsage(ctx, "bob"); usage.UsedBytes != 0 || usage.Files != 0 {
+		t.Errorf("bob's quota not given back: %+v", usage)
+	}
+
+	// a failing chat scan deletes nothing
+	eachChat = func(context.Context, func(*model.Chat) error) error { return errors.New("no RedisJSON") }
+	if _, err := collectGarbage(ctx, now.Add(time.Hour), time.Nanosecond, false); err == nil {
+		t.Error("pass without references succeeded")
+	}
+	if !exists(id("a")) {
+		t.Error("referenced file deleted")
+	}
+}
+
+func TestJanitorRunsOnOneServer(t *testing.T) {
+	h := newTestServer(t)
+	ctx := context.Background()
+
+	unlock, err := redisrepo.TryLock(ctx, gcLock, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockedCollect(ctx, h.cfg.Storage.GC); !errors.Is(err, redisrepo.ErrConflict) {
+		t.Errorf("second pass: %v", err)
+	}
+	unlock()
+	if _, err := redisrepo.TryLock(ctx, gcLock, time.Minute); err != nil {
+		t.Errorf("lock not given back: %v", err)
+	}
+}
+
+func TestCollectGarbageDuringUpload(t *testing.T) {
+	h := newTestServer(t)
+	ctx := context.Background()
+	id := strings.Repeat("a", 32)
+
+	// the file is stored, and its chat sent past where the walk already
+	// is, while the chats are read
+	prev := eachChat
+	eachChat = func(ctx context.Context, fn func(*model.Chat) error) error {
+		if _, err := attachmentStore.Put(ctx, id, strings.NewReader("12345"), ""); err != nil {
+			return err
+		}
+		old := time.Now().Add(-48 * time.Hour)
+		return os.Chtimes(filepath.Join(h.cfg.HTTP.UploadDir, id), old, old)
+	}
+	t.Cleanup(func() { eachChat = prev })
+
+	rep, err := collectGarbage(ctx, time.Now(), 24*time.Hour, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Orphans != 0 {
+		t.Errorf("report: %+v", rep)
+	}
+	if _, err := attachmentStore.Stat(ctx, id); err != nil {
+		t.Errorf("file sent during the pass deleted: %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+package httpserver
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes every route the router serves, the route test
+// fails if a new route is added without documenting it here
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
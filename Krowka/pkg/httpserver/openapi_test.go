@@ -0,0 +1,97 @@
+package httpserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"Krowka/pkg/config"
+	"Krowka/pkg/health"
+
+	"github.com/gorilla/mux"
+)
+
+type openAPIDoc struct {
+	OpenAPI string                                `json:"openapi"`
+	Paths   map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+func TestEveryRouteIsInOpenAPISpec(t *testing.T) {
+	var spec openAPIDoc
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal("openapi.json is not valid JSON:", err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Fatal("expected an OpenAPI 3 document, got", spec.OpenAPI)
+	}
+
+	// newServer wraps the router in CORS, build the router directly
+	r := mux.NewRouter()
+	(&server{cfg: config.Default()}).routes(r, health.New())
+
+	documented := func(path, method string) bool {
+		if ops, ok := spec.Paths[path]; ok {
+			_, ok = ops[method]
+			return ok
+		}
+		// file servers are mounted on a prefix, e.g. /avatars/ is /avatars/{file}
+		if strings.HasSuffix(path, "/") {
+			for p, ops := range spec.Paths {
+				if _, ok := ops[method]; ok && strings.HasPrefix(p, path) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	count := 0
+	err := r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		path, err := route.GetPathTemplate()
+		if err != nil || route.GetHandler() == nil {
+			// subrouter prefixes have no handler of their own
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = []string{http.MethodGet}
+		}
+		for _, m := range methods {
+			count++
+			if !documented(path, strings.ToLower(m)) {
+				t.Errorf("%s %s is not described in openapi.json", m, path)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count < 20 {
+		t.Fatal("walked suspiciously few routes:", count)
+	}
+}
+
+func TestDeprecatedAliases(t *testing.T) {
+	h := newTestServer(t)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(`{}`)))
+	if rec.Header().Get("Deprecation") != "true" || !strings.Contains(rec.Header().Get("Link"), "/v1/auth/login") {
+		t.Error("legacy route without deprecation headers", rec.Header())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/auth/login", strings.NewReader(`{}`)))
+	if rec.Header().Get("Deprecation") != "" {
+		t.Error("v1 route marked deprecated")
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/openapi.json", nil))
+	if rec.Code != http.StatusOK || !json.Valid(rec.Body.Bytes()) {
+		t.Error("spec not served", rec.Code)
+	}
+}
@@ -0,0 +1,139 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/imageproc"
+)
+
+const (
+	// thumbnailEdge bounds the longer side of attachment thumbnails
+	thumbnailEdge = 320
+	// maxPreviewSource is the largest image read into memory for a
+	// thumbnail, larger ones get none
+	maxPreviewSource = 32 << 20
+	// posterTimeout bounds copying a video for ffmpeg and running it
+	posterTimeout = 30 * time.Second
+)
+
+// ffmpegPath is the resolved ffmpeg binary, empty when video posters are
+// off
+var ffmpegPath string
+
+// maxPosterSource is the largest video copied to disk for a poster, larger
+// ones get none. A variable for tests.
+var maxPosterSource int64 = 256 << 20
+
+// thumbnailTypes can be decoded by imageproc
+var thumbnailTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// findFFmpeg resolves the configured ffmpeg binary, or returns "" when it
+// is not configured or not installed
+func findFFmpeg(ctx context.Context, name string) string {
+	if name == "" {
+		return ""
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		slog.InfoContext(ctx, "ffmpeg not found, video attachments get no poster", "ffmpeg_path", name)
+		return ""
+	}
+	return path
+}
+
+func thumbnailKey(id string) string {
+	return id + "-thumb"
+}
+
+// addPreview stores a thumbnail of an image attachment, or of the first
+// frame of a video when ffmpeg is available, and records the dimensions
+// and blurhash on a. Files that can't be decoded simply get no preview.
+func addPreview(ctx context.Context, a *model.Attachment) {
+	var src []byte
+	var err error
+	switch {
+	case thumbnailTypes[a.MIME] && a.Size <= maxPreviewSource:
+		src, err = readAttachment(ctx, fileKey(a))
+	case strings.HasPrefix(a.MIME, "video/") && ffmpegPath != "" && a.Size <= maxPosterSource:
+		src, err = videoPoster(ctx, fileKey(a))
+	default:
+		return
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "reading attachment for preview failed", "attachment_id", a.ID, "error", err)
+		return
+	}
+
+	p, err := imageproc.Thumbnail(src, thumbnailEdge)
+	if err != nil {
+		slog.InfoContext(ctx, "no preview for attachment", "attachment_id", a.ID, "mime", a.MIME, "error", err)
+		return
+	}
+	if _, err := attachmentStore.Put(ctx, thumbnailKey(a.ID), bytes.NewReader(p.Data), p.MediaType); err != nil {
+		slog.WarnContext(ctx, "storing thumbnail failed", "attachment_id", a.ID, "error", err)
+		return
+	}
+	a.Width, a.Height, a.Blurhash, a.ThumbMIME = p.Width, p.Height, p.Blurhash, p.MediaType
+}
+
+func readAttachment(ctx context.Context, key string) ([]byte, error) {
+	f, _, err := attachmentStore.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, maxPreviewSource))
+}
+
+// videoPoster copies the video to a temporary file, ffmpeg needs to seek
+// in it, and extracts the first frame, all within posterTimeout
+func videoPoster(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, posterTimeout)
+	defer cancel()
+
+	f, _, err := attachmentStore.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tmp, err := os.CreateTemp("", "poster-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(tmp, ctxReader{ctx, io.LimitReader(f, maxPosterSource)})
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return imageproc.VideoFrame(ctx, ffmpegPath, tmp.Name())
+}
+
+// ctxReader stops reading once ctx is done, local files don't
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
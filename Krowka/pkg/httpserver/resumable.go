@@ -0,0 +1,450 @@
+package httpserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/filetype"
+	"Krowka/pkg/redisrepo"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	codeOffsetMismatch = "offset_mismatch"
+	codeIncomplete     = "upload_incomplete"
+)
+
+// uploadSweepInterval is how often expired uploads are looked for
+const uploadSweepInterval = 10 * time.Minute
+
+// offsetHeader carries the offset a chunk starts at
+const offsetHeader = "Upload-Offset"
+
+// sha256Pattern is a hex encoded SHA-256 digest
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// chunkKey stores the chunk sent at offset under a random suffix, a chunk
+// that lost a race for the same offset never replaces the winner's
+func chunkKey(id string, offset int64) string {
+	return fmt.Sprintf("partial/%s/%d-%s", id, offset, newAttachmentID()[:8])
+}
+
+type createUploadReq struct {
+	To   string `json:"to"`
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// createUploadHandler starts a resumable upload of a file of size bytes
+// for the peer named in to. The size is reserved in the user's quota
+// until the upload completes or expires.
+func (s *server) createUploadHandler(w http.ResponseWriter, r *http.Request, user string) {
+	req := &createUploadReq{}
+	if !decodeJSON(w, r, req) {
+		return
+	}
+	if req.Size <= 0 {
+		writeError(w, r, invalidFields(fieldError{Field: "size", Code: "invalid", Message: "size must be positive"}))
+		return
+	}
+	if req.Size > s.cfg.HTTP.MaxUploadBytes {
+		writeError(w, r, newError(http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("file is larger than %d bytes", s.cfg.HTTP.MaxUploadBytes)))
+		return
+	}
+	// a file the scanner won't take could never be downloaded
+	if max := s.cfg.Storage.Scan.MaxBytes; scanner != nil && max > 0 && req.Size > max {
+		writeError(w, r, newError(http.StatusRequestEntityTooLarge, codeTooLargeToScan, fmt.Sprintf("file is larger than %d bytes, the most the malware scan takes", max)))
+		return
+	}
+	if len(req.Name) > maxFieldBytes {
+		writeError(w, r, invalidFields(fieldError{Field: "name", Code: "too_long", Message: "name is too long"}))
+		return
+	}
+	if req.Name != "" {
+		req.Name = filepath.Base(req.Name)
+	}
+	if e := checkRecipient(r.Context(), req.To); e != nil {
+		writeError(w, r, e)
+		return
+	}
+	if err := redisrepo.ReserveStorage(r.Context(), user, req.Size, s.cfg.HTTP.UserQuotaBytes); err != nil {
+		writeError(w, r, repoError(err, "unable to start upload"))
+		return
+	}
+
+	now := time.Now()
+	u := &model.Upload{
+		ID:        newAttachmentID(),
+		Owner:     user,
+		Peer:      req.To,
+		Name:      req.Name,
+		Size:      req.Size,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(s.cfg.HTTP.UploadExpiry).Unix(),
+	}
+	if err := redisrepo.CreateUpload(r.Context(), u); err != nil {
+		releaseStorage(r.Context(), user, u.Size)
+		writeError(w, r, repoError(err, "unable to start upload"))
+		return
+	}
+
+	w.Header().Set("Location", "/v1/uploads/"+u.ID)
+	writeJSON(w, http.StatusCreated, &response{Status: true, Data: u})
+}
+
+// loadUpload fetches the acting user's upload named by the {id} path
+// variable
+func loadUpload(r *http.Request, user string) (*model.Upload, *apiError) {
+	id := mux.Vars(r)["id"]
+	if !attachmentIDPattern.MatchString(id) {
+		return nil, newError(http.StatusNotFound, codeNotFound, "no such upload")
+	}
+	u, err := redisrepo.GetUpload(r.Context(), id)
+	if err != nil {
+		return nil, repoError(err, "unable to load upload")
+	}
+	if u.Owner != user {
+		return nil, forbidden("not your upload")
+	}
+	return u, nil
+}
+
+// getUploadHandler reports how far an upload got, to resume it after a
+// failed chunk
+func getUploadHandler(w http.ResponseWriter, r *http.Request, user string) {
+	u, e := loadUpload(r, user)
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+	writeJSON(w, http.StatusOK, &response{Status: true, Data: u})
+}
+
+// uploadChunkHandler appends the request body to the upload. The
+// Upload-Offset header must match the bytes received so far. A chunk that
+// fails midway is dropped whole, the client sends it again.
+func (s *server) uploadChunkHandler(w http.ResponseWriter, r *http.Request, user string) {
+	u, e := loadUpload(r, user)
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get(offsetHeader), 10, 64)
+	if err != nil {
+		writeError(w, r, badRequest(offsetHeader+" header is required"))
+		return
+	}
+	if offset != u.Offset {
+		writeError(w, r, newError(http.StatusConflict, codeOffsetMismatch, fmt.Sprintf("upload is at offset %d", u.Offset)))
+		return
+	}
+	if u.Offset == u.Size {
+		writeError(w, r, newError(http.StatusConflict, codeOffsetMismatch, "upload is complete"))
+		return
+	}
+
+	maxChunk := min(s.cfg.HTTP.MaxChunkBytes, u.Size-u.Offset)
+	br := bufio.NewReaderSize(http.MaxBytesReader(w, r.Body, maxChunk), filetype.SniffLen)
+
+	// the type is detected from the first chunk, which must hold enough
+	// bytes to tell
+	var mediaType string
+	if offset == 0 {
+		head, err := br.Peek(filetype.SniffLen)
+		if err != nil && err != io.EOF {
+			writeError(w, r, chunkError(err, maxChunk))
+			return
+		}
+		if int64(len(head)) < min(filetype.SniffLen, u.Size) {
+			writeError(w, r, badRequest(fmt.Sprintf("the first chunk must have at least %d bytes", filetype.SniffLen)))
+			return
+		}
+		mediaType = filetype.Detect(head)
+		if filetype.Active(mediaType, u.Name) || filetype.Active(r.Header.Get("Content-Type"), "") {
+			writeError(w, r, unsupportedType("HTML, SVG and script files are not allowed"))
+			return
+		}
+		if !filetype.Allowed(s.cfg.HTTP.AttachmentTypes, mediaType) {
+			writeError(w, r, unsupportedType(mediaType+" files are not allowed here"))
+			return
+		}
+	}
+
+	key := chunkKey(u.ID, offset)
+	body := &bodyReader{r: br}
+	n, err := attachmentStore.Put(r.Context(), key, body, "application/octet-stream")
+	if err != nil {
+		if body.err != nil {
+			writeError(w, r, chunkError(body.err, maxChunk))
+			return
+		}
+		slog.ErrorContext(r.Context(), "storing chunk failed", "key", key, "error", err)
+		writeError(w, r, newError(http.StatusInternalServerError, codeInternal, "unable to save chunk"))
+		return
+	}
+	if n == 0 {
+		discard(r, attachmentStore, key)
+		writeError(w, r, badRequest("chunk is empty"))
+		return
+	}
+
+	expires := time.Now().Add(s.cfg.HTTP.UploadExpiry).Unix()
+	if err := redisrepo.AppendChunk(r.Context(), u.ID, offset, n, key, mediaType, expires); err != nil {
+		discard(r, attachmentStore, key)
+		writeError(w, r, repoError(err, "unable to save chunk"))
+		return
+	}
+
+	u.Offset += n
+	u.ExpiresAt = expires
+	if mediaType != "" {
+		u.MIME = mediaType
+	}
+	writeJSON(w, http.StatusOK, &response{Status: true, Data: u})
+}
+
+// chunkError explains a failure to read a chunk
+func chunkError(err error, maxChunk int64) *apiError {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return newError(http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("chunk is larger than %d bytes", maxChunk))
+	}
+	return badRequest("could not read chunk")
+}
+
+type completeUploadReq struct {
+	SHA256 string `json:"sha256"`
+}
+
+// completeUploadHandler joins the chunks of a fully received upload into
+// an attachment, once their SHA-256 matches the client's. The response is
+// the same as for a single request upload to /v1/attachments. A mismatch
+// discards the upload.
+func (s *server) completeUploadHandler(w http.ResponseWriter, r *http.Request, user string) {
+	req := &completeUploadReq{}
+	if !decodeJSON(w, r, req) {
+		return
+	}
+	if req.SHA256 == "" {
+		writeError(w, r, invalidFields(required("sha256")))
+		return
+	}
+	if !sha256Pattern.MatchString(req.SHA256) {
+		writeError(w, r, invalidFields(fieldError{Field: "sha256", Code: "invalid", Message: "sha256 must be 64 lowercase hex digits"}))
+		return
+	}
+
+	// a retry of a completion that went through gets the same answer
+	if a := completedUpload(r, user, req.SHA256); a != nil {
+		writeJSON(w, http.StatusOK, &response{Status: true, Data: s.newAttachmentRes(a)})
+		return
+	}
+
+	u, e := loadUpload(r, user)
+	if e != nil {
+		writeError(w, r, e)
+		return
+	}
+	if u.Offset != u.Size {
+		writeError(w, r, newError(http.StatusConflict, codeIncomplete, fmt.Sprintf("%d of %d bytes received", u.Offset, u.Size)))
+		return
+	}
+	// only one request joins the chunks, a retry after a failure may again
+	if err := redisrepo.ClaimUpload(r.Context(), u.ID, time.Now().Add(s.cfg.HTTP.UploadExpiry).Unix()); err != nil {
+		writeError(w, r, repoError(err, "unable to complete upload"))
+		return
+	}
+	unclaim := func() {
+		if err := redisrepo.UnclaimUpload(context.WithoutCancel(r.Context()), u.ID); err != nil {
+			slog.WarnContext(r.Context(), "releasing upload failed", "upload_id", u.ID, "error", err)
+		}
+	}
+	s.extendWriteDeadline(w, r, u.Size)
+
+	chunks, err := redisrepo.UploadChunks(r.Context(), u.ID)
+	if err != nil {
+		unclaim()
+		writeError(w, r, repoError(err, "unable to complete upload"))
+		return
+	}
+	sum := sha256.New()
+	joined := &chunkReader{ctx: r.Context(), keys: chunks}
+	n, err := attachmentStore.Put(r.Context(), u.ID, io.TeeReader(joined, sum), u.MIME)
+	joined.Close()
+	if err == nil && n != u.Size {
+		discard(r, attachmentStore, u.ID)
+		err = fmt.Errorf("joined %d of %d bytes", n, u.Size)
+	}
+	if err != nil {
+		unclaim()
+		slog.ErrorContext(r.Context(), "joining chunks failed", "upload_id", u.ID, "error", err)
+		writeError(w, r, newError(http.StatusInternalServerError, codeInternal, "unable to save file"))
+		return
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); got != req.SHA256 {
+		discard(r, attachmentStore, u.ID)
+		removeUpload(r.Context(), u.ID)
+		writeError(w, r, invalidFields(fieldError{Field: "sha256", Code: "mismatch", Message: "checksum does not match, the upload was discarded"}))
+		return
+	}
+
+	a := &model.Attachment{
+		ID:        u.ID,
+		Owner:     u.Owner,
+		Peer:      u.Peer,
+		Name:      u.Name,
+		MIME:      u.MIME,
+		Size:      u.Size,
+		CreatedAt: time.Now().Unix(),
+	}
+	// the size reserved while uploading is still held, it makes room for
+	// the content until the upload is removed
+	if e := s.storeContent(r.Context(), a, u.ID, req.SHA256, u.Size); e != nil {
+		unclaim()
+		writeError(w, r, e)
+		return
+	}
+	if e := s.saveAttachment(r, a); e != nil {
+		unclaim()
+		writeError(w, r, e)
+		return
+	}
+	// the upload is kept until the attachment is recorded, so that a retry
+	// finds one or the other
+	removeUpload(r.Context(), u.ID)
+	writeJSON(w, http.StatusOK, &response{Status: true, Data: s.newAttachmentRes(a)})
+}
+
+// completedUpload returns the attachment an earlier request made of the
+// user's upload with the same content, nil if there is none
+func completedUpload(r *http.Request, user, hash string) *model.Attachment {
+	id := mux.Vars(r)["id"]
+	if !attachmentIDPattern.MatchString(id) {
+		return nil
+	}
+	a, err := redisrepo.GetAttachment(r.Context(), id)
+	if err != nil || a.Owner != user || a.Blob != hash {
+		return nil
+	}
+	return a
+}
+
+// removeUpload deletes a completed or discarded upload with its chunks and
+// gives back the size it reserved. An upload the sweep took meanwhile was
+// given back already.
+func removeUpload(ctx context.Context, id string) {
+	ctx = context.WithoutCancel(ctx)
+	u, chunks, err := redisrepo.TakeUpload(ctx, id, 0)
+	if err != nil {
+		if !errors.Is(err, redisrepo.ErrNotFound) {
+			slog.WarnContext(ctx, "removing upload failed, it is left to expire", "upload_id", id, "error", err)
+		}
+		return
+	}
+	removeChunks(ctx, chunks)
+	releaseStorage(ctx, u.Owner, u.Size)
+}
+
+// chunkReader reads the chunks of an upload one after the other, opening
+// each only once the previous one is done
+type chunkReader struct {
+	ctx  context.Context
+	keys []string
+	cur  io.ReadCloser
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if c.cur == nil {
+			if len(c.keys) == 0 {
+				return 0, io.EOF
+			}
+			f, _, err := attachmentStore.Open(c.ctx, c.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			c.cur, c.keys = f, c.keys[1:]
+		}
+		n, err := c.cur.Read(p)
+		if err == io.EOF {
+			c.cur.Close()
+			c.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (c *chunkReader) Close() error {
+	if c.cur == nil {
+		return nil
+	}
+	return c.cur.Close()
+}
+
+// removeChunks deletes the chunk files of an upload that was taken
+func removeChunks(ctx context.Context, chunks []string) {
+	ctx = context.WithoutCancel(ctx)
+	for _, key := range chunks {
+		if err := attachmentStore.Delete(ctx, key); err != nil {
+			slog.WarnContext(ctx, "removing chunk failed", "key", key, "error", err)
+		}
+	}
+}
+
+// expireUploads deletes abandoned uploads until ctx is done
+func expireUploads(ctx context.Context) {
+	t := time.NewTicker(uploadSweepInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			sweepUploads(ctx, now)
+		}
+	}
+}
+
+// sweepUploads deletes the chunks of every upload that expired by now and
+// gives back the quota it reserved. Several servers may sweep at once,
+// each upload is taken by one of them.
+func sweepUploads(ctx context.Context, now time.Time) int {
+	ids, err := redisrepo.ExpiredUploads(ctx, now.Unix())
+	if err != nil {
+		slog.WarnContext(ctx, "listing expired uploads failed", "error", err)
+		return 0
+	}
+	swept := 0
+	for _, id := range ids {
+		u, chunks, err := redisrepo.TakeUpload(ctx, id, now.Unix())
+		if errors.Is(err, redisrepo.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "taking expired upload failed", "upload_id", id, "error", err)
+			continue
+		}
+		removeChunks(ctx, chunks)
+		releaseStorage(ctx, u.Owner, u.Size)
+		slog.InfoContext(ctx, "expired upload removed", "upload_id", id, "received", u.Offset, "size", u.Size)
+		swept++
+	}
+	return swept
+}
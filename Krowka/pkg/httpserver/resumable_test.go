@@ -0,0 +1,260 @@
+package httpserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/blobstore"
+	"Krowka/pkg/redisrepo"
+)
+
+func TestResumableUpload(t *testing.T) {
+	h := newTestServer(t)
+	ctx := context.Background()
+	for _, u := range []string{"alice", "bob"} {
+		if err := redisrepo.RegisterNewUser(ctx, u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.cfg.HTTP.MaxChunkBytes = 1024
+	content := bytes.Repeat([]byte("0123456789abcdef"), 160) // 2560 bytes, text/plain
+	digest := sha256.Sum256(content)
+
+	call := func(method, path, body, user string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		return authed(t, h, req, user)
+	}
+	var up struct {
+		Data model.Upload `json:"data"`
+	}
+	decode := func(rec *httptest.ResponseRecorder, v interface{}) {
+		t.Helper()
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := call(http.MethodPost, "/v1/uploads", `{"to":"bob","name":"../big.txt","size":2560}`, "alice")
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+	decode(rec, &up)
+	id := up.Data.ID
+	if rec.Header().Get("Location") != "/v1/uploads/"+id || up.Data.Name != "big.txt" || up.Data.Offset != 0 {
+		t.Fatalf("created %+v at %q", up.Data, rec.Header().Get("Location"))
+	}
+	// the whole size counts against the quota while uploading
+	if usage, _ := redisrepo.GetStorageUsage(ctx, "alice"); usage.UsedBytes != 2560 {
+		t.Errorf("reserved %d bytes", usage.UsedBytes)
+	}
+
+	path := "/v1/uploads/" + id
+	chunk := func(offset int, data []byte) *httptest.ResponseRecorder {
+		return call(http.MethodPatch, path, string(data), "alice", offsetHeader, fmt.Sprint(offset))
+	}
+	if rec := chunk(0, content[:1024]); rec.Code != http.StatusOK {
+		t.Fatalf("chunk 0: %d %s", rec.Code, rec.Body)
+	}
+	// a retried chunk is refused, the offset tells where to go on
+	if rec := chunk(0, content[:1024]); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), codeOffsetMismatch) {
+		t.Errorf("repeated chunk: %d %s", rec.Code, rec.Body)
+	}
+	if rec := chunk(1024, content[1024:2560]); rec.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized chunk: %d %s", rec.Code, rec.Body)
+	}
+	if rec := call(http.MethodGet, path, "", "bob"); rec.Code != http.StatusForbidden {
+		t.Errorf("bob reads alice's upload: %d", rec.Code)
+	}
+	rec = call(http.MethodGet, path, "", "alice")
+	decode(rec, &up)
+	if up.Data.Offset != 1024 || up.Data.MIME != "text/plain" {
+		t.Fatalf("resumed at %+v", up.Data)
+	}
+
+	sum := `{"sha256":"` + hex.EncodeToString(digest[:]) + `"}`
+	if rec := call(http.MethodPost, path+"/complete", sum, "alice"); rec.Code != http.StatusConflict {
+		t.Errorf("completing early: %d %s", rec.Code, rec.Body)
+	}
+	for off := 1024; off < len(content); off += 1024 {
+		if rec := chunk(off, content[off:min(off+1024, len(content))]); rec.Code != http.StatusOK {
+			t.Fatalf("chunk at %d: %d %s", off, rec.Code, rec.Body)
+		}
+	}
+
+	rec = call(http.MethodPost, path+"/complete", sum, "alice")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("complete: %d %s", rec.Code, rec.Body)
+	}
+	var res struct {
+		Data attachmentRes `json:"data"`
+	}
+	decode(rec, &res)
+	if res.Data.ID != id || res.Data.Peer != "bob" || res.Data.Size != 2560 || res.Data.MIME != "text/plain" || res.Data.URL == "" {
+		t.Fatalf("attachment %+v", res.Data)
+	}
+	if rec := call(http.MethodGet, attachmentPath(id), "", "bob"); rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), content) {
+		t.Errorf("download: %d, %d bytes", rec.Code, rec.Body.Len())
+	}
+	if usage, _ := redisrepo.GetStorageUsage(ctx, "alice"); usage.UsedBytes != 2560 || usage.Files != 1 {
+		t.Errorf("usage after completing: %+v", usage)
+	}
+	// the joined file is stored by content like any other
+	if _, err := attachmentStore.Stat(ctx, contentKey(hex.EncodeToString(digest[:]))); err != nil {
+		t.Errorf("content not stored: %v", err)
+	}
+	if _, err := attachmentStore.Stat(ctx, id); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("joined file left under the ID: %v", err)
+	}
+	if rec := call(http.MethodGet, path, "", "alice"); rec.Code != http.StatusNotFound {
+		t.Errorf("upload left behind: %d", rec.Code)
+	}
+
+	// a client that missed the answer completes again and gets the same
+	// attachment, only its owner and only for the same content
+	rec = call(http.MethodPost, path+"/complete", sum, "alice")
+	var again struct {
+		Data attachmentRes `json:"data"`
+	}
+	decode(rec, &again)
+	if rec.Code != http.StatusOK || again.Data.ID != id || again.Data.Size != 2560 {
+		t.Errorf("completing again: %d %s", rec.Code, rec.Body)
+	}
+	if rec := call(http.MethodPost, path+"/complete", sum, "bob"); rec.Code != http.StatusNotFound {
+		t.Errorf("bob completes alice's upload: %d", rec.Code)
+	}
+	other := `{"sha256":"` + strings.Repeat("0", 64) + `"}`
+	if rec := call(http.MethodPost, path+"/complete", other, "alice"); rec.Code != http.StatusNotFound {
+		t.Errorf("completing with other content: %d", rec.Code)
+	}
+	if usage, _ := redisrepo.GetStorageUsage(ctx, "alice"); usage.UsedBytes != 2560 || usage.Files != 1 {
+		t.Errorf("usage after completing again: %+v", usage)
+	}
+}
+
+func TestResumableUploadRejects(t *testing.T) {
+	h := newTestServer(t)
+	ctx := context.Background()
+	for _, u := range []string{"alice", "bob"} {
+		if err := redisrepo.RegisterNewUser(ctx, u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.cfg.HTTP.MaxUploadBytes = 1 << 20
+	h.cfg.HTTP.UserQuotaBytes = 1 << 10
+
+	create := func(body string) *httptest.ResponseRecorder {
+		return authed(t, h, httptest.NewRequest(http.MethodPost, "/v1/uploads", strings.NewReader(body)), "alice")
+	}
+	for _, tc := range []struct {
+		body string
+		want int
+	}{
+		{`{"to":"bob","size":0}`, http.StatusUnprocessableEntity},
+		{`{"to":"bob","size":2000000}`, http.StatusRequestEntityTooLarge},
+		{`{"to":"bob","size":2000}`, http.StatusRequestEntityTooLarge}, // over quota
+		{`{"to":"nobody","size":10}`, http.StatusNotFound},
+		{`{"size":10}`, http.StatusUnprocessableEntity},
+	} {
+		if rec := create(tc.body); rec.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.body, rec.Code, tc.want, rec.Body)
+		}
+	}
+
+	rec := create(`{"to":"bob","name":"page.txt","size":100}`)
+	var up struct {
+		Data model.Upload `json:"data"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &up)
+	path := "/v1/uploads/" + up.Data.ID
+	patch := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPatch, path, strings.NewReader(body))
+		req.Header.Set(offsetHeader, "0")
+		return authed(t, h, req, "alice")
+	}
+
+	// the type comes from the first chunk, which must be long enough
+	if rec := patch("<html>"); rec.Code != http.StatusBadRequest {
+		t.Errorf("short first chunk: %d %s", rec.Code, rec.Body)
+	}
+	if rec := patch("<!DOCTYPE html><html><script>alert(1)</script>" + strings.Repeat(" ", 54)); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("html: %d %s", rec.Code, rec.Body)
+	}
+
+	content := strings.Repeat("x", 100)
+	if rec := patch(content); rec.Code != http.StatusOK {
+		t.Fatalf("chunk: %d %s", rec.Code, rec.Body)
+	}
+	bad := `{"sha256":"` + strings.Repeat("0", 64) + `"}`
+	req := httptest.NewRequest(http.MethodPost, path+"/complete", strings.NewReader(bad))
+	if rec := authed(t, h, req, "alice"); rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "mismatch") {
+		t.Errorf("wrong checksum: %d %s", rec.Code, rec.Body)
+	}
+	// a mismatch discards the upload and its file
+	if _, err := redisrepo.GetUpload(ctx, up.Data.ID); !errors.Is(err, redisrepo.ErrNotFound) {
+		t.Errorf("upload kept: %v", err)
+	}
+	if _, err := attachmentStore.Stat(ctx, up.Data.ID); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("file kept: %v", err)
+	}
+	if usage, _ := redisrepo.GetStorageUsage(ctx, "alice"); usage.UsedBytes != 0 {
+		t.Errorf("quota not given back: %+v", usage)
+	}
+
+	// with scanning on, files the scanner won't take are refused up front
+	useScanner(t, h, &fakeScanner{release: make(chan struct{})})
+	h.cfg.Storage.Scan.MaxBytes = 50
+	if rec := create(`{"to":"bob","size":100}`); rec.Code != http.StatusRequestEntityTooLarge || !strings.Contains(rec.Body.String(), codeTooLargeToScan) {
+		t.Errorf("over the scan limit: %d %s", rec.Code, rec.Body)
+	}
+	if usage, _ := redisrepo.GetStorageUsage(ctx, "alice"); usage.UsedBytes != 0 {
+		t.Errorf("refused upload charged: %+v", usage)
+	}
+}
+
+func TestSweepUploads(t *testing.T) {
+	newTestServer(t)
+	ctx := context.Background()
+
+	now := time.Now()
+	u := &model.Upload{ID: strings.Repeat("a", 32), Owner: "alice", Peer: "bob", Size: 10, ExpiresAt: now.Unix()}
+	if err := redisrepo.ReserveStorage(ctx, "alice", u.Size, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := redisrepo.CreateUpload(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	key := chunkKey(u.ID, 0)
+	if _, err := attachmentStore.Put(ctx, key, strings.NewReader("half"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := redisrepo.AppendChunk(ctx, u.ID, 0, 4, key, "text/plain", now.Unix()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := sweepUploads(ctx, now.Add(-time.Minute)); n != 0 {
+		t.Errorf("swept %d uploads before they expired", n)
+	}
+	if n := sweepUploads(ctx, now); n != 1 {
+		t.Errorf("swept %d uploads", n)
+	}
+	if _, err := attachmentStore.Stat(ctx, key); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("chunk kept: %v", err)
+	}
+	if usage, _ := redisrepo.GetStorageUsage(ctx, "alice"); usage.UsedBytes != 0 || usage.Files != 0 {
+		t.Errorf("quota not given back: %+v", usage)
+	}
+}
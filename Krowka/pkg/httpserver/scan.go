@@ -0,0 +1,225 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/metrics"
+	"Krowka/pkg/redisrepo"
+	"Krowka/pkg/scan"
+)
+
+const (
+	codeScanPending    = "scan_pending"
+	codeQuarantined    = "quarantined"
+	codeTooLargeToScan = "too_large_to_scan"
+)
+
+// scanner checks attachments before they can be downloaded, nil when
+// scanning is turned off
+var scanner scan.Scanner
+
+// attachmentRejectedFrame tells the sender over the WebSocket that an
+// attachment was found infected, or could not be scanned, and will not be
+// delivered
+type attachmentRejectedFrame struct {
+	Type       string            `json:"type"` // always "attachment_rejected"
+	Attachment *model.Attachment `json:"attachment"`
+	// Reason names the signature found, when known, or says the file was
+	// too large to scan
+	Reason string `json:"reason,omitempty"`
+}
+
+// reasonTooLarge is the rejection reason of files the scanner won't take
+const reasonTooLarge = "too large to scan"
+
+// prepareScan sets the scan state of a new attachment before it is saved.
+// A content that was scanned before keeps its verdict, files too large to
+// scan are refused and other files wait for a scan, unless scanning is off.
+func (s *server) prepareScan(ctx context.Context, a *model.Attachment) {
+	if scanner == nil {
+		return
+	}
+	if max := s.cfg.Storage.Scan.MaxBytes; max > 0 && a.Size > max {
+		slog.InfoContext(ctx, "attachment too large to scan", "attachment_id", a.ID, "size", a.Size)
+		metrics.Scans.WithLabelValues("too_large").Inc()
+		a.Status = model.ScanTooLarge
+		return
+	}
+	if a.Blob != "" {
+		status, err := redisrepo.BlobStatus(ctx, a.Blob)
+		if err != nil {
+			slog.WarnContext(ctx, "reading content verdict failed", "blob", a.Blob, "error", err)
+		}
+		if status != "" {
+			a.Status = status
+			metrics.Scans.WithLabelValues("cached").Inc()
+			return
+		}
+	}
+	a.Status = model.ScanPending
+}
+
+// startScan scans a saved attachment that waits for it in the background,
+// or tells the sender that a file too large to scan, or a copy of a known
+// infected one, was rejected
+func (s *server) startScan(ctx context.Context, a *model.Attachment) {
+	switch a.Status {
+	case model.ScanPending:
+		// queued first, so that retryScans picks it up should this server
+		// go away
+		if err := redisrepo.QueueScan(ctx, a.ID, time.Now().Unix()); err != nil {
+			slog.WarnContext(ctx, "queueing scan failed", "attachment_id", a.ID, "error", err)
+		}
+		go s.scanAttachment(context.WithoutCancel(ctx), a.ID)
+	case model.ScanQuarantined:
+		slog.WarnContext(ctx, "copy of an infected file rejected", "attachment_id", a.ID, "blob", a.Blob, "owner", a.Owner)
+		notifyRejected(ctx, a, "")
+	case model.ScanTooLarge:
+		notifyRejected(ctx, a, reasonTooLarge)
+	}
+}
+
+// scanAttachment scans a pending attachment and records the verdict. A
+// scan that fails leaves it pending for retryScans. The lock keeps
+// servers from scanning the same attachment at once.
+func (s *server) scanAttachment(ctx context.Context, id string) {
+	unlock, err := redisrepo.TryLock(ctx, "scan:"+id, s.cfg.Storage.Scan.Timeout+time.Minute)
+	if errors.Is(err, redisrepo.ErrConflict) {
+		return
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "locking scan failed", "attachment_id", id, "error", err)
+		return
+	}
+	defer unlock()
+
+	a, err := redisrepo.GetAttachment(ctx, id)
+	if errors.Is(err, redisrepo.ErrNotFound) || (err == nil && a.Status != model.ScanPending) {
+		// deleted, or scanned by another server meanwhile
+		doneScan(ctx, id)
+		return
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "loading attachment to scan failed", "attachment_id", id, "error", err)
+		return
+	}
+
+	verdict, err := s.scanFile(ctx, a)
+	status := model.ScanClean
+	switch {
+	case errors.Is(err, scan.ErrTooLarge):
+		// over clamd's StreamMaxLength, refused like files over
+		// storage.scan.max_bytes
+		slog.WarnContext(ctx, "attachment too large for the scanner", "attachment_id", id, "size", a.Size)
+		metrics.Scans.WithLabelValues("too_large").Inc()
+		status = model.ScanTooLarge
+	case err != nil:
+		slog.WarnContext(ctx, "scanning attachment failed", "attachment_id", id, "error", err)
+		metrics.Scans.WithLabelValues("error").Inc()
+		return
+	case verdict.Infected:
+		status = model.ScanQuarantined
+		metrics.Scans.WithLabelValues("infected").Inc()
+	default:
+		metrics.Scans.WithLabelValues("clean").Inc()
+	}
+
+	if err := redisrepo.SetAttachmentStatus(ctx, id, status); err != nil {
+		if errors.Is(err, redisrepo.ErrNotFound) {
+			doneScan(ctx, id)
+		} else {
+			slog.WarnContext(ctx, "recording scan verdict failed", "attachment_id", id, "error", err)
+		}
+		return
+	}
+	// too large is no verdict on the content, a larger limit may scan it
+	if a.Blob != "" && status != model.ScanTooLarge {
+		if err := redisrepo.SetBlobStatus(ctx, a.Blob, status); err != nil {
+			slog.WarnContext(ctx, "recording content verdict failed", "blob", a.Blob, "error", err)
+		}
+	}
+	doneScan(ctx, id)
+
+	a.Status = status
+	switch {
+	case verdict.Infected:
+		slog.WarnContext(ctx, "infected attachment quarantined", "attachment_id", id, "owner", a.Owner, "signature", verdict.Signature)
+		notifyRejected(ctx, a, verdict.Signature)
+		return
+	case status == model.ScanTooLarge:
+		notifyRejected(ctx, a, reasonTooLarge)
+		return
+	}
+	slog.InfoContext(ctx, "attachment scanned", "attachment_id", id, "status", status)
+}
+
+// scanFile streams the attachment's content to the scanner
+func (s *server) scanFile(ctx context.Context, a *model.Attachment) (scan.Verdict, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Storage.Scan.Timeout)
+	defer cancel()
+
+	f, _, err := attachmentStore.Open(ctx, fileKey(a))
+	if err != nil {
+		return scan.Verdict{}, err
+	}
+	defer f.Close()
+	return scanner.Scan(ctx, f)
+}
+
+func doneScan(ctx context.Context, id string) {
+	if err := redisrepo.DoneScan(ctx, id); err != nil {
+		slog.WarnContext(ctx, "removing scan from the queue failed", "attachment_id", id, "error", err)
+	}
+}
+
+// notifyRejected sends an attachment_rejected frame to the owner's
+// WebSocket connections
+func notifyRejected(ctx context.Context, a *model.Attachment, reason string) {
+	frame := attachmentRejectedFrame{Type: "attachment_rejected", Attachment: a, Reason: reason}
+	if err := redisrepo.PublishEvent(ctx, a.Owner, frame); err != nil {
+		slog.WarnContext(ctx, "notifying sender of rejected attachment failed", "attachment_id", a.ID, "error", err)
+	}
+}
+
+// retryScans scans again, every retry interval until ctx is done, the
+// attachments whose scan failed or whose server went away
+func (s *server) retryScans(ctx context.Context) {
+	if scanner == nil {
+		return
+	}
+	interval := s.cfg.Storage.Scan.RetryInterval
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		ids, err := redisrepo.DueScans(ctx, time.Now().Add(-interval).Unix())
+		if err != nil {
+			slog.WarnContext(ctx, "listing pending scans failed", "error", err)
+			continue
+		}
+		for _, id := range ids {
+			s.scanAttachment(ctx, id)
+		}
+	}
+}
+
+// notDownloadable explains why an attachment can't be downloaded yet, or
+// at all
+func notDownloadable(a *model.Attachment) *apiError {
+	switch a.Status {
+	case model.ScanQuarantined:
+		return newError(http.StatusForbidden, codeQuarantined, "attachment was rejected by the malware scan")
+	case model.ScanTooLarge:
+		return newError(http.StatusForbidden, codeTooLargeToScan, "attachment is too large to be scanned")
+	}
+	return newError(http.StatusConflict, codeScanPending, "attachment is being scanned, try again shortly")
+}
@@ -0,0 +1,281 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/redisrepo"
+	"Krowka/pkg/scan"
+)
+
+// fakeScanner finds "EICAR" in files once release is closed, and fails
+// while broken is set. Files over maxBytes, when set, are too large.
+type fakeScanner struct {
+	release  chan struct{}
+	maxBytes int
+
+	mu     sync.Mutex
+	scans  int
+	broken bool
+}
+
+func (s *fakeScanner) Scan(ctx context.Context, r io.Reader) (scan.Verdict, error) {
+	select {
+	case <-s.release:
+	case <-ctx.Done():
+		return scan.Verdict{}, ctx.Err()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scans++
+	if s.broken {
+		return scan.Verdict{}, errors.New("clamd: connection refused")
+	}
+	by, err := io.ReadAll(r)
+	if err != nil {
+		return scan.Verdict{}, err
+	}
+	if s.maxBytes > 0 && len(by) > s.maxBytes {
+		return scan.Verdict{}, scan.ErrTooLarge
+	}
+	if strings.Contains(string(by), "EICAR") {
+		return scan.Verdict{Infected: true, Signature: "Eicar-Signature"}, nil
+	}
+	return scan.Verdict{}, nil
+}
+
+func (s *fakeScanner) Check(ctx context.Context) error { return nil }
+
+func (s *fakeScanner) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.scans
+}
+
+func useScanner(t *testing.T, h *server, s scan.Scanner) {
+	prev := scanner
+	scanner = s
+	t.Cleanup(func() { scanner = prev })
+	h.cfg.Storage.Scan.Timeout = 5 * time.Second
+}
+
+func waitForStatus(t *testing.T, id, status string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		a, err := redisrepo.GetAttachment(context.Background(), id)
+		if err == nil && a.Status == status {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("attachment %s never became %q: %+v, %v", id, status, a, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAttachmentScan(t *testing.T) {
+	h := newTestServer(t)
+	s := &fakeScanner{release: make(chan struct{})}
+	useScanner(t, h, s)
+	ctx := context.Background()
+	for _, u := range []string{"alice", "bob"} {
+		if err := redisrepo.RegisterNewUser(ctx, u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	var events []string
+	subCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	err := redisrepo.SubscribeEvents(subCtx, func(user string, frame []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, user+" "+string(frame))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(name, content string) *model.Attachment {
+		t.Helper()
+		body, ct := uploadForm(t, "bob", name, "text/plain", content)
+		req := httptest.NewRequest(http.MethodPost, "/v1/attachments", body)
+		req.Header.Set("Content-Type", ct)
+		rec := authed(t, h, req, "alice")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("upload %s: %d %s", name, rec.Code, rec.Body)
+		}
+		var res struct {
+			Data attachmentRes `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return res.Data.Attachment
+	}
+	download := func(a *model.Attachment) *httptest.ResponseRecorder {
+		return authed(t, h, httptest.NewRequest(http.MethodGet, attachmentPath(a.ID), nil), "bob")
+	}
+
+	clean := upload("notes.txt", "hello bob")
+	infected := upload("setup.exe", "X5O!P%@AP EICAR test")
+	if clean.Status != model.ScanPending || infected.Status != model.ScanPending {
+		t.Fatalf("statuses %q %q", clean.Status, infected.Status)
+	}
+	if rec := download(clean); rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), codeScanPending) {
+		t.Errorf("pending download: %d %s", rec.Code, rec.Body)
+	}
+
+	close(s.release)
+	waitForStatus(t, clean.ID, model.ScanClean)
+	waitForStatus(t, infected.ID, model.ScanQuarantined)
+	if rec := download(clean); rec.Code != http.StatusOK || rec.Body.String() != "hello bob" {
+		t.Errorf("clean download: %d %s", rec.Code, rec.Body)
+	}
+	if rec := download(infected); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), codeQuarantined) {
+		t.Errorf("quarantined download: %d %s", rec.Code, rec.Body)
+	}
+	if due, _ := redisrepo.DueScans(ctx, time.Now().Unix()+1); len(due) != 0 {
+		t.Errorf("scans still queued: %v", due)
+	}
+
+	// copies take the verdict of their content without a second scan
+	scans := s.count()
+	if again := upload("again.exe", "X5O!P%@AP EICAR test"); again.Status != model.ScanQuarantined {
+		t.Errorf("copy of infected file is %q", again.Status)
+	}
+	if again := upload("again.txt", "hello bob"); again.Status != model.ScanClean {
+		t.Errorf("copy of clean file is %q", again.Status)
+	}
+	if s.count() != scans {
+		t.Errorf("copies were scanned again")
+	}
+
+	// the sender hears about both rejections
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(events)
+		mu.Unlock()
+		if n >= 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(events) != 2 {
+		t.Fatalf("events %v", events)
+	}
+	for _, e := range events {
+		if !strings.HasPrefix(e, `alice {"type":"attachment_rejected"`) {
+			t.Errorf("event %s", e)
+		}
+	}
+	if !strings.Contains(events[0], `"reason":"Eicar-Signature"`) {
+		t.Errorf("event without the signature: %s", events[0])
+	}
+}
+
+func TestAttachmentScanRetry(t *testing.T) {
+	h := newTestServer(t)
+	s := &fakeScanner{release: make(chan struct{}), broken: true}
+	close(s.release)
+	useScanner(t, h, s)
+	ctx := context.Background()
+	for _, u := range []string{"alice", "bob"} {
+		if err := redisrepo.RegisterNewUser(ctx, u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	body, ct := uploadForm(t, "bob", "notes.txt", "text/plain", "hello bob")
+	req := httptest.NewRequest(http.MethodPost, "/v1/attachments", body)
+	req.Header.Set("Content-Type", ct)
+	if rec := authed(t, h, req, "alice"); rec.Code != http.StatusOK {
+		t.Fatalf("upload: %d %s", rec.Code, rec.Body)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for s.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	due, err := redisrepo.DueScans(ctx, time.Now().Unix()+1)
+	if err != nil || len(due) != 1 {
+		t.Fatalf("failed scan not queued: %v %v", due, err)
+	}
+	id := due[0]
+	waitForStatus(t, id, model.ScanPending)
+
+	// once the scanner is back the queued attachment gets its verdict
+	s.mu.Lock()
+	s.broken = false
+	s.mu.Unlock()
+	h.cfg.Storage.Scan.RetryInterval = 10 * time.Millisecond
+	retryCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go h.retryScans(retryCtx)
+	waitForStatus(t, id, model.ScanClean)
+}
+
+func TestAttachmentTooLargeToScan(t *testing.T) {
+	h := newTestServer(t)
+	s := &fakeScanner{release: make(chan struct{}), maxBytes: 10}
+	close(s.release)
+	useScanner(t, h, s)
+	h.cfg.Storage.Scan.MaxBytes = 20
+	ctx := context.Background()
+	for _, u := range []string{"alice", "bob"} {
+		if err := redisrepo.RegisterNewUser(ctx, u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	upload := func(content string) *model.Attachment {
+		t.Helper()
+		body, ct := uploadForm(t, "bob", "big.txt", "text/plain", content)
+		req := httptest.NewRequest(http.MethodPost, "/v1/attachments", body)
+		req.Header.Set("Content-Type", ct)
+		rec := authed(t, h, req, "alice")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("upload: %d %s", rec.Code, rec.Body)
+		}
+		var res struct {
+			Data attachmentRes `json:"data"`
+		}
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return res.Data.Attachment
+	}
+	refused := func(a *model.Attachment) {
+		t.Helper()
+		for _, user := range []string{"alice", "bob"} {
+			rec := authed(t, h, httptest.NewRequest(http.MethodGet, attachmentPath(a.ID), nil), user)
+			if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), codeTooLargeToScan) {
+				t.Errorf("%s downloads %s: %d %s", user, a.ID, rec.Code, rec.Body)
+			}
+		}
+	}
+
+	// over storage.scan.max_bytes nothing is scanned, nor handed out
+	over := upload(strings.Repeat("x", 21))
+	if over.Status != model.ScanTooLarge {
+		t.Errorf("oversized file is %q", over.Status)
+	}
+	refused(over)
+
+	// over the scanner's own limit
+	big := upload(strings.Repeat("y", 15))
+	waitForStatus(t, big.ID, model.ScanTooLarge)
+	refused(big)
+	if s.count() != 1 {
+		t.Errorf("%d scans", s.count())
+	}
+}
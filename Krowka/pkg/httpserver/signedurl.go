@@ -0,0 +1,48 @@
+package httpserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+func (s *server) urlSigningKey() []byte {
+	if k := s.cfg.Auth.URLSigningKey; k != "" {
+		return []byte(k)
+	}
+	return s.jwtSecret()
+}
+
+func (s *server) signature(id string, expires int64) []byte {
+	mac := hmac.New(sha256.New, s.urlSigningKey())
+	fmt.Fprintf(mac, "attachment\n%s\n%d", id, expires)
+	return mac.Sum(nil)
+}
+
+// signedAttachmentURL returns a download link for id that works without a
+// token until it expires
+func (s *server) signedAttachmentURL(id string, now time.Time) (string, time.Time) {
+	expires := now.Add(s.cfg.Auth.SignedURLTTL).Truncate(time.Second)
+	q := url.Values{
+		"expires": {strconv.FormatInt(expires.Unix(), 10)},
+		"sig":     {base64.RawURLEncoding.EncodeToString(s.signature(id, expires.Unix()))},
+	}
+	return attachmentPath(id) + "?" + q.Encode(), expires
+}
+
+// validSignature checks the expires and sig query values of a signed link
+func (s *server) validSignature(id, expires, sig string, now time.Time) bool {
+	exp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || now.Unix() > exp {
+		return false
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(got, s.signature(id, exp))
+}
@@ -0,0 +1,260 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"Krowka/pkg/blobstore"
+	"Krowka/pkg/config"
+	"Krowka/pkg/filetype"
+	"Krowka/pkg/redisrepo"
+)
+
+const (
+	codeTooLarge        = "payload_too_large"
+	codeQuotaExceeded   = "quota_exceeded"
+	codeUnsupportedType = "unsupported_media_type"
+)
+
+// maxFieldBytes bounds each text field of a multipart upload, formOverhead
+// the part headers and fields around the file
+const (
+	maxFieldBytes = 1 << 10
+	formOverhead  = 64 << 10
+)
+
+// stores for uploaded files, set up by StartHTTPServer
+var (
+	avatarStore     blobstore.Store
+	attachmentStore blobstore.Store
+)
+
+// openStores connects the avatar and attachment stores of the configured
+// backend
+func openStores(ctx context.Context, cfg *config.Config) error {
+	var err error
+	if avatarStore, err = blobstore.Open(ctx, cfg.Storage, blobstore.Avatars, cfg.HTTP.AvatarDir); err != nil {
+		return err
+	}
+	attachmentStore, err = blobstore.Open(ctx, cfg.Storage, blobstore.Attachments, cfg.HTTP.UploadDir)
+	return err
+}
+
+// uploadKind says what receiveFile accepts for avatars or attachments
+type uploadKind struct {
+	// store receives the file, when nil it is kept in memory instead
+	store    blobstore.Store
+	maxBytes int64
+	// types is the allowlist of media types detected from the bytes
+	types []string
+	// quotaLeft is the room left in the user's quota, -1 for no quota
+	quotaLeft int64
+}
+
+// limit is the most bytes the file may have
+func (k uploadKind) limit() int64 {
+	if k.quotaLeft >= 0 && k.quotaLeft < k.maxBytes {
+		return k.quotaLeft
+	}
+	return k.maxBytes
+}
+
+// tooLarge explains why a file of more than limit() bytes is rejected
+func (k uploadKind) tooLarge() *apiError {
+	if k.limit() < k.maxBytes {
+		return quotaExceeded()
+	}
+	return newError(http.StatusRequestEntityTooLarge, codeTooLarge, fmt.Sprintf("file is larger than %d bytes", k.maxBytes))
+}
+
+func quotaExceeded() *apiError {
+	return newError(http.StatusRequestEntityTooLarge, codeQuotaExceeded, "storage quota exceeded, delete some files first")
+}
+
+func unsupportedType(msg string) *apiError {
+	return newError(http.StatusUnsupportedMediaType, codeUnsupportedType, msg)
+}
+
+// upload is the file part of a multipart request, already in the store or
+// in data
+type upload struct {
+	fields      url.Values
+	key         string
+	data        []byte
+	filename    string
+	contentType string
+	size        int64
+	// sha256 is the hex digest of a file in the store
+	sha256 string
+}
+
+// bodyReader remembers why reading the request failed, to tell client
+// errors from store errors
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// receiveFile streams the part named file of a multipart body into the
+// kind's store under keyFor(filename, mediaType) as it is read, without
+// holding the whole file in memory or on disk. Kinds without a store read
+// the file into memory and ignore keyFor, for small files that are
+// processed before being stored. The media type is detected from the first
+// bytes, the client's Content-Type is not trusted. Text fields before and
+// after the file are collected. Stored files are hashed on the way. On
+// success the caller owns the stored file and must delete it if the
+// request fails later.
+func receiveFile(w http.ResponseWriter, r *http.Request, kind uploadKind, keyFor func(filename, mediaType string) string) (*upload, *apiError) {
+	r.Body = http.MaxBytesReader(w, r.Body, kind.maxBytes+formOverhead)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, badRequest("could not parse form")
+	}
+
+	up := &upload{fields: url.Values{}}
+	received := false
+	fail := func(e *apiError) (*upload, *apiError) {
+		if up.key != "" {
+			discard(r, kind.store, up.key)
+		}
+		return nil, e
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(bodyError(err, kind))
+		}
+
+		name := part.FormName()
+		if name != "file" {
+			by, err := io.ReadAll(io.LimitReader(part, maxFieldBytes+1))
+			if err != nil {
+				return fail(bodyError(err, kind))
+			}
+			if len(by) > maxFieldBytes {
+				return fail(badRequest(name + " is too long"))
+			}
+			up.fields.Add(name, string(by))
+			continue
+		}
+
+		if received {
+			return fail(badRequest("only one file may be uploaded"))
+		}
+		received = true
+		up.filename = part.FileName()
+
+		br := bufio.NewReaderSize(part, filetype.SniffLen)
+		head, err := br.Peek(filetype.SniffLen)
+		if err != nil && err != io.EOF {
+			return fail(bodyError(err, kind))
+		}
+		up.contentType = filetype.Detect(head)
+		if filetype.Active(up.contentType, up.filename) || filetype.Active(part.Header.Get("Content-Type"), "") {
+			return fail(unsupportedType("HTML, SVG and script files are not allowed"))
+		}
+		if !filetype.Allowed(kind.types, up.contentType) {
+			return fail(unsupportedType(up.contentType + " files are not allowed here"))
+		}
+
+		// one byte more than allowed tells a file at the limit from a
+		// larger one
+		limit := kind.limit()
+		body := &bodyReader{r: io.LimitReader(br, limit+1)}
+		if kind.store == nil {
+			var buf bytes.Buffer
+			if up.size, err = buf.ReadFrom(body); err != nil {
+				return fail(bodyError(err, kind))
+			}
+			if up.size > limit {
+				return fail(kind.tooLarge())
+			}
+			up.data = buf.Bytes()
+			continue
+		}
+
+		up.key = keyFor(up.filename, up.contentType)
+		sum := sha256.New()
+		up.size, err = kind.store.Put(r.Context(), up.key, io.TeeReader(body, sum), up.contentType)
+		if err != nil {
+			failed := up.key
+			up.key = "" // Put leaves nothing behind
+			if body.err != nil {
+				return fail(bodyError(body.err, kind))
+			}
+			slog.ErrorContext(r.Context(), "storing upload failed", "key", failed, "error", err)
+			return fail(newError(http.StatusInternalServerError, codeInternal, "unable to save file"))
+		}
+		if up.size > limit {
+			return fail(kind.tooLarge())
+		}
+		up.sha256 = hex.EncodeToString(sum.Sum(nil))
+	}
+
+	if !received {
+		return nil, invalidFields(required("file"))
+	}
+	return up, nil
+}
+
+// bodyError explains a failure to read the request body
+func bodyError(err error, kind uploadKind) *apiError {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return kind.tooLarge()
+	}
+	return badRequest("could not parse form")
+}
+
+// attachmentKind applies the user's remaining quota to attachment uploads
+func (s *server) attachmentKind(ctx context.Context, user string) (uploadKind, *apiError) {
+	kind := uploadKind{
+		store:     attachmentStore,
+		maxBytes:  s.cfg.HTTP.MaxAttachmentBytes,
+		types:     s.cfg.HTTP.AttachmentTypes,
+		quotaLeft: -1,
+	}
+	if s.cfg.HTTP.UserQuotaBytes > 0 {
+		usage, err := redisrepo.GetStorageUsage(ctx, user)
+		if err != nil {
+			return kind, repoError(err, "unable to check storage quota")
+		}
+		kind.quotaLeft = max(s.cfg.HTTP.UserQuotaBytes-usage.UsedBytes, 0)
+		if kind.quotaLeft == 0 {
+			return kind, quotaExceeded()
+		}
+	}
+	return kind, nil
+}
+
+// storageUsageHandler reports the acting user's attachment storage
+func (s *server) storageUsageHandler(w http.ResponseWriter, r *http.Request, user string) {
+	usage, err := redisrepo.GetStorageUsage(r.Context(), user)
+	if err != nil {
+		writeError(w, r, repoError(err, "unable to fetch storage usage"))
+		return
+	}
+	usage.QuotaBytes = s.cfg.HTTP.UserQuotaBytes
+	writeJSON(w, http.StatusOK, &response{Status: true, Data: usage})
+}
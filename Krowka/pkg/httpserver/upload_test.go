@@ -0,0 +1,98 @@
+package httpserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"Krowka/pkg/redisrepo"
+)
+
+func TestUploadValidation(t *testing.T) {
+	h := newTestServer(t)
+	for _, u := range []string{"alice", "bob"} {
+		if err := redisrepo.RegisterNewUser(context.Background(), u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	png := string(tinyPNG(t))
+
+	for _, tc := range []struct {
+		name, path, filename, declared, content string
+		want                                    int
+		code                                    string
+	}{
+		{"html", "/v1/attachments", "a.txt", "text/plain", "<html><script>alert(1)</script>", http.StatusUnsupportedMediaType, codeUnsupportedType},
+		{"svg", "/v1/attachments", "a.png", "image/png", `<svg onload="alert(1)"/>`, http.StatusUnsupportedMediaType, codeUnsupportedType},
+		{"html extension", "/v1/attachments", "a.html", "image/png", png, http.StatusUnsupportedMediaType, codeUnsupportedType},
+		{"declared html", "/v1/attachments", "a.png", "text/html", png, http.StatusUnsupportedMediaType, codeUnsupportedType},
+		{"unknown binary", "/v1/attachments", "a.exe", "image/png", "MZ\x00\x01\x02\x03", http.StatusUnsupportedMediaType, codeUnsupportedType},
+		{"png attachment", "/v1/attachments", "cat.png", "", png, http.StatusOK, ""},
+		{"text avatar", "/v1/profile/avatar", "me.png", "image/png", "not an image", http.StatusUnsupportedMediaType, codeUnsupportedType},
+	} {
+		body, ct := uploadForm(t, "bob", tc.filename, tc.declared, tc.content)
+		req := httptest.NewRequest(http.MethodPost, tc.path, body)
+		req.Header.Set("Content-Type", ct)
+		rec := authed(t, h, req, "alice")
+		if rec.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, rec.Code, tc.want, rec.Body)
+			continue
+		}
+		var res map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		if code := errorCode(res); code != tc.code {
+			t.Errorf("%s: code %q, want %q", tc.name, code, tc.code)
+		}
+	}
+
+}
+
+func TestStorageQuota(t *testing.T) {
+	h := newTestServer(t)
+	for _, u := range []string{"alice", "bob"} {
+		if err := redisrepo.RegisterNewUser(context.Background(), u, u+" secret password"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.cfg.HTTP.UserQuotaBytes = 15
+
+	upload := func(content string) (int, string) {
+		body, ct := uploadForm(t, "bob", "a.txt", "text/plain", content)
+		req := httptest.NewRequest(http.MethodPost, "/v1/attachments", body)
+		req.Header.Set("Content-Type", ct)
+		rec := authed(t, h, req, "alice")
+		var res map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &res)
+		return rec.Code, errorCode(res)
+	}
+
+	if status, _ := upload("0123456789"); status != http.StatusOK {
+		t.Fatalf("first upload: %d", status)
+	}
+	if status, code := upload("0123456789"); status != http.StatusRequestEntityTooLarge || code != codeQuotaExceeded {
+		t.Errorf("over quota: %d %s", status, code)
+	}
+	if status, _ := upload("01234"); status != http.StatusOK {
+		t.Errorf("filling the quota exactly: %d", status)
+	}
+	if status, code := upload("x"); status != http.StatusRequestEntityTooLarge || code != codeQuotaExceeded {
+		t.Errorf("quota used up: %d %s", status, code)
+	}
+
+	rec := authed(t, h, httptest.NewRequest(http.MethodGet, "/v1/storage/usage", nil), "alice")
+	var res struct {
+		Data struct {
+			UsedBytes  int64 `json:"usedBytes"`
+			Files      int64 `json:"files"`
+			QuotaBytes int64 `json:"quotaBytes"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("usage: %d %s", rec.Code, rec.Body)
+	}
+	if res.Data.UsedBytes != 15 || res.Data.Files != 2 || res.Data.QuotaBytes != 15 {
+		t.Errorf("usage %+v", res.Data)
+	}
+}
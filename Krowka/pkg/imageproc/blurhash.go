@@ -0,0 +1,100 @@
+package imageproc
+
+import (
+	"image"
+	"math"
+	"strings"
+)
+
+const base83 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// Blurhash encodes img as a BlurHash (https://blurha.sh) with 4x3
+// components, 3x4 for portrait images. It is meant for thumbnails, every
+// pixel is visited once per component.
+func Blurhash(img *image.NRGBA) string {
+	xc, yc := 4, 3
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if h > w {
+		xc, yc = 3, 4
+	}
+
+	// the linear colour of every pixel, computed once
+	linear := make([][3]float64, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := img.NRGBAAt(b.Min.X+x, b.Min.Y+y)
+			linear[y*w+x] = [3]float64{srgbToLinear(c.R), srgbToLinear(c.G), srgbToLinear(c.B)}
+		}
+	}
+
+	factors := make([][3]float64, 0, xc*yc)
+	for j := 0; j < yc; j++ {
+		for i := 0; i < xc; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i*x)/float64(w)) * math.Cos(math.Pi*float64(j*y)/float64(h))
+					px := linear[y*w+x]
+					f[0] += basis * px[0]
+					f[1] += basis * px[1]
+					f[2] += basis * px[2]
+				}
+			}
+			scale := norm / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	var sb strings.Builder
+	encode83(&sb, (xc-1)+(yc-1)*9, 1)
+
+	dc, ac := factors[0], factors[1:]
+	maxAC := 0.0
+	for _, f := range ac {
+		maxAC = max(maxAC, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+	}
+	quantisedMax := int(math.Max(0, math.Min(82, math.Floor(maxAC*166-0.5))))
+	maxValue := float64(quantisedMax+1) / 166
+	encode83(&sb, quantisedMax, 1)
+
+	encode83(&sb, linearToSRGB(dc[0])<<16|linearToSRGB(dc[1])<<8|linearToSRGB(dc[2]), 4)
+	for _, f := range ac {
+		q := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		encode83(&sb, q(f[0])*19*19+q(f[1])*19+q(f[2]), 2)
+	}
+	return sb.String()
+}
+
+func encode83(sb *strings.Builder, value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		digit := value / int(math.Pow(83, float64(i))) % 83
+		sb.WriteByte(base83[digit])
+	}
+}
+
+func srgbToLinear(c uint8) float64 {
+	v := float64(c) / 255
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
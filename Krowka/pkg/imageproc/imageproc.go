@@ -0,0 +1,155 @@
+// Package imageproc normalises uploaded images: it decodes them, applies
+// the EXIF orientation, crops and resizes, and encodes fresh files that
+// carry none of the original metadata such as GPS positions.
+package imageproc
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif" // register the gif decoder
+	"image/jpeg"
+	"image/png"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register the webp decoder
+)
+
+// MaxPixels bounds width*height of images we decode, a small file can
+// otherwise expand to gigabytes of pixels
+const MaxPixels = 4096 * 4096
+
+// jpegQuality is used for images without transparency
+const jpegQuality = 85
+
+var (
+	// ErrInvalid is returned for data that is not a supported image
+	ErrInvalid = errors.New("not a png, jpeg, gif or webp image")
+	// ErrTooLarge is returned for images over MaxPixels
+	ErrTooLarge = errors.New("image dimensions are too large")
+)
+
+// Variant is one encoded size of a processed image
+type Variant struct {
+	Size      int
+	MediaType string
+	Ext       string
+	Data      []byte
+}
+
+// Preview is a downscaled copy of an image for showing it before the
+// original is downloaded
+type Preview struct {
+	Variant
+	// Width and Height are the size of the upright original
+	Width, Height int
+	// Blurhash is a short string clients can render as a blurred
+	// placeholder while the thumbnail loads
+	Blurhash string
+}
+
+// Square decodes src, center-crops it to a square and encodes one variant
+// per size, sizes are the edge length in pixels. Images with transparency
+// become PNG, everything else JPEG. Animated GIFs keep their first frame.
+func Square(src []byte, sizes []int) ([]Variant, error) {
+	img, orientation, err := decode(src)
+	if err != nil {
+		return nil, err
+	}
+
+	crop := centerSquare(img.Bounds())
+	transparent := hasAlpha(img)
+
+	variants := make([]Variant, 0, len(sizes))
+	for _, size := range sizes {
+		dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, crop, draw.Src, nil)
+
+		v, err := encode(orient(dst, orientation), transparent)
+		if err != nil {
+			return nil, err
+		}
+		v.Size = size
+		variants = append(variants, v)
+	}
+	return variants, nil
+}
+
+// Thumbnail decodes src and scales it down to fit in a square of maxEdge
+// pixels, keeping the aspect ratio. Smaller images keep their size but are
+// still re-encoded. Size is set to the longer edge of the thumbnail.
+func Thumbnail(src []byte, maxEdge int) (*Preview, error) {
+	img, orientation, err := decode(src)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if long := max(w, h); long > maxEdge {
+		w = max(w*maxEdge/long, 1)
+		h = max(h*maxEdge/long, 1)
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, b, draw.Src, nil)
+	thumb := orient(dst, orientation)
+
+	v, err := encode(thumb, hasAlpha(img))
+	if err != nil {
+		return nil, err
+	}
+	v.Size = max(w, h)
+	p := &Preview{Variant: v, Width: b.Dx(), Height: b.Dy()}
+	if orientation >= 5 {
+		p.Width, p.Height = p.Height, p.Width
+	}
+	p.Blurhash = Blurhash(thumb)
+	return p, nil
+}
+
+// decode checks the dimensions of src before decoding it and returns its
+// EXIF orientation
+func decode(src []byte) (image.Image, int, error) {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(src))
+	if err != nil {
+		return nil, 0, ErrInvalid
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > MaxPixels {
+		return nil, 0, ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(src))
+	if err != nil {
+		return nil, 0, ErrInvalid
+	}
+	return img, exifOrientation(src), nil
+}
+
+// centerSquare is the largest square in the middle of r
+func centerSquare(r image.Rectangle) image.Rectangle {
+	side := min(r.Dx(), r.Dy())
+	x := r.Min.X + (r.Dx()-side)/2
+	y := r.Min.Y + (r.Dy()-side)/2
+	return image.Rect(x, y, x+side, y+side)
+}
+
+func hasAlpha(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+	return true
+}
+
+func encode(img image.Image, transparent bool) (Variant, error) {
+	var buf bytes.Buffer
+	if transparent {
+		if err := png.Encode(&buf, img); err != nil {
+			return Variant{}, err
+		}
+		return Variant{MediaType: "image/png", Ext: ".png", Data: buf.Bytes()}, nil
+	}
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality}); err != nil {
+		return Variant{}, err
+	}
+	return Variant{MediaType: "image/jpeg", Ext: ".jpg", Data: buf.Bytes()}, nil
+}
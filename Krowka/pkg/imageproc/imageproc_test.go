@@ -0,0 +1,245 @@
+package imageproc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// halves is w x h, red on the left half and blue on the right
+func halves(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{255, 0, 0, 255}
+			if x >= w/2 {
+				c = color.RGBA{0, 0, 255, 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// withOrientation inserts an EXIF segment with the orientation tag (and a
+// GPS-looking marker) right after the JPEG start of image
+func withOrientation(t *testing.T, jpg []byte, orientation uint16) []byte {
+	t.Helper()
+	var tiff bytes.Buffer
+	tiff.WriteString("MM\x00\x2a")
+	binary.Write(&tiff, binary.BigEndian, uint32(8))
+	binary.Write(&tiff, binary.BigEndian, uint16(1))
+	binary.Write(&tiff, binary.BigEndian, []uint16{0x0112, 3})
+	binary.Write(&tiff, binary.BigEndian, uint32(1))
+	binary.Write(&tiff, binary.BigEndian, []uint16{orientation, 0})
+	binary.Write(&tiff, binary.BigEndian, uint32(0))
+	tiff.WriteString("GPSLatitude")
+
+	seg := append([]byte("Exif\x00\x00"), tiff.Bytes()...)
+	var out bytes.Buffer
+	out.Write(jpg[:2])
+	out.Write([]byte{0xff, 0xe1})
+	binary.Write(&out, binary.BigEndian, uint16(len(seg)+2))
+	out.Write(seg)
+	out.Write(jpg[2:])
+	return out.Bytes()
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func decodeVariant(t *testing.T, v Variant) image.Image {
+	t.Helper()
+	img, _, err := image.Decode(bytes.NewReader(v.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func isRed(c color.Color) bool {
+	r, _, b, _ := c.RGBA()
+	return r > 0xc000 && b < 0x4000
+}
+
+func TestSquare(t *testing.T) {
+	// 300x100 crops to the middle 100x100, which is still split in half
+	src := encodeJPEG(t, halves(300, 100))
+	variants, err := Square(src, []int{16, 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(variants) != 2 {
+		t.Fatalf("got %d variants", len(variants))
+	}
+	for i, size := range []int{16, 64} {
+		v := variants[i]
+		if v.Size != size || v.MediaType != "image/jpeg" || v.Ext != ".jpg" {
+			t.Errorf("variant %d: %d %s %s", i, v.Size, v.MediaType, v.Ext)
+		}
+		img := decodeVariant(t, v)
+		if b := img.Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Errorf("variant %d is %v", i, b)
+		}
+		if !isRed(img.At(1, size/2)) || isRed(img.At(size-2, size/2)) {
+			t.Errorf("variant %d: crop is not centered", i)
+		}
+	}
+}
+
+func TestSquareOrientationAndMetadata(t *testing.T) {
+	// rotated 90° clockwise the red left half ends up on top
+	src := withOrientation(t, encodeJPEG(t, halves(64, 64)), 6)
+	if o := exifOrientation(src); o != 6 {
+		t.Fatalf("orientation = %d", o)
+	}
+	variants, err := Square(src, []int{32})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := decodeVariant(t, variants[0])
+	if !isRed(img.At(16, 1)) || isRed(img.At(16, 30)) {
+		t.Error("orientation was not applied")
+	}
+	for _, marker := range []string{"Exif", "GPS"} {
+		if bytes.Contains(variants[0].Data, []byte(marker)) {
+			t.Errorf("output still contains %s", marker)
+		}
+	}
+}
+
+func TestSquareKeepsTransparency(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	variants, err := Square(buf.Bytes(), []int{4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if variants[0].MediaType != "image/png" {
+		t.Errorf("transparent image encoded as %s", variants[0].MediaType)
+	}
+}
+
+func TestSquareRejects(t *testing.T) {
+	if _, err := Square([]byte("not an image"), []int{16}); !errors.Is(err, ErrInvalid) {
+		t.Errorf("text: %v", err)
+	}
+
+	// a tiny PNG claiming to be 100000x100000 pixels
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 1, 1)))
+	bomb := buf.Bytes()
+	ihdr := bomb[12:29] // chunk type and data
+	binary.BigEndian.PutUint32(ihdr[4:], 100000)
+	binary.BigEndian.PutUint32(ihdr[8:], 100000)
+	binary.BigEndian.PutUint32(bomb[29:], crc32.ChecksumIEEE(ihdr))
+	if _, err := Square(bomb, []int{16}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("bomb: %v", err)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	// a 2x2 image with one red pixel in the top left corner
+	img := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	img.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	for o, want := range map[int]image.Point{
+		1: {0, 0}, 2: {1, 0}, 3: {1, 1}, 4: {0, 1},
+		5: {0, 0}, 6: {1, 0}, 7: {1, 1}, 8: {0, 1},
+	} {
+		got := orient(img, o)
+		if got.NRGBAAt(want.X, want.Y).R != 255 {
+			t.Errorf("orientation %d: red pixel not at %v", o, want)
+		}
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	// 400x200 stored sideways is a 200x400 portrait
+	src := withOrientation(t, encodeJPEG(t, halves(400, 200)), 6)
+	p, err := Thumbnail(src, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Width != 200 || p.Height != 400 || p.Size != 100 || p.MediaType != "image/jpeg" {
+		t.Errorf("got %dx%d size %d %s", p.Width, p.Height, p.Size, p.MediaType)
+	}
+	img := decodeVariant(t, p.Variant)
+	if b := img.Bounds(); b.Dx() != 50 || b.Dy() != 100 {
+		t.Errorf("thumbnail is %v", b)
+	}
+	if len(p.Blurhash) != 28 {
+		t.Errorf("blurhash %q", p.Blurhash)
+	}
+
+	// small images are not scaled up
+	p, err = Thumbnail(encodeJPEG(t, halves(20, 10)), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := decodeVariant(t, p.Variant).Bounds(); b.Dx() != 20 || b.Dy() != 10 {
+		t.Errorf("small thumbnail is %v", b)
+	}
+}
+
+func TestBlurhash(t *testing.T) {
+	white := image.NewNRGBA(image.Rect(0, 0, 8, 6))
+	for i := range white.Pix {
+		white.Pix[i] = 0xff
+	}
+	// 4x3 components, 28 characters, the average colour #ffffff is
+	// encoded in characters 2-5
+	if got := Blurhash(white); len(got) != 28 || got[0] != 'L' || got[2:6] != "TSUA" {
+		t.Errorf("Blurhash = %q", got)
+	}
+
+	portrait := image.NewNRGBA(image.Rect(0, 0, 6, 8))
+	if got := Blurhash(portrait); got[0] != 'T' { // 3x4 components
+		t.Errorf("portrait Blurhash = %q", got)
+	}
+}
+
+func TestVideoFrame(t *testing.T) {
+	// a stand-in for ffmpeg that prints a PNG
+	dir := t.TempDir()
+	var buf bytes.Buffer
+	png.Encode(&buf, halves(4, 4))
+	frame := filepath.Join(dir, "frame.png")
+	if err := os.WriteFile(frame, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ffmpeg := filepath.Join(dir, "ffmpeg")
+	if err := os.WriteFile(ffmpeg, []byte("#!/bin/sh\ncat "+frame+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := VideoFrame(context.Background(), ffmpeg, "clip.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, buf.Bytes()) {
+		t.Error("frame differs")
+	}
+
+	failing := filepath.Join(dir, "broken")
+	os.WriteFile(failing, []byte("#!/bin/sh\necho 'clip.mp4: Invalid data' >&2\nexit 1\n"), 0755)
+	if _, err := VideoFrame(context.Background(), failing, "clip.mp4"); err == nil || !strings.Contains(err.Error(), "Invalid data") {
+		t.Errorf("broken ffmpeg: %v", err)
+	}
+}
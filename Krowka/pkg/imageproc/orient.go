@@ -0,0 +1,107 @@
+package imageproc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+// exifOrientation returns the EXIF orientation tag (1-8) of a JPEG, or 1
+// when there is none. Phones store pictures sideways and rely on the tag,
+// which is gone once we re-encode.
+func exifOrientation(src []byte) int {
+	if len(src) < 4 || src[0] != 0xff || src[1] != 0xd8 {
+		return 1
+	}
+	for i := 2; i+4 <= len(src); {
+		if src[i] != 0xff {
+			return 1
+		}
+		marker := src[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			// start of scan, metadata comes before it
+			return 1
+		}
+		n := int(binary.BigEndian.Uint16(src[i+2:]))
+		if n < 2 || i+2+n > len(src) {
+			return 1
+		}
+		seg := src[i+4 : i+2+n]
+		if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+			return tiffOrientation(seg[6:])
+		}
+		i += 2 + n
+	}
+	return 1
+}
+
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		e := ifd + 2 + i*12
+		if e+12 > len(tiff) {
+			return 1
+		}
+		// tag 0x0112 Orientation, type SHORT, value stored inline
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			if o := int(order.Uint16(tiff[e+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orient turns img upright for the given EXIF orientation. Orientations 5
+// to 8 swap width and height.
+func orient(img *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored upside down
+				sx, sy = x, h-1-y
+			case 5: // mirrored, rotated 90° counter-clockwise
+				sx, sy = y, x
+			case 6: // rotated 90° counter-clockwise
+				sx, sy = y, h-1-x
+			case 7: // mirrored, rotated 90° clockwise
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotated 90° clockwise
+				sx, sy = w-1-y, x
+			}
+			dst.SetNRGBA(x, y, img.NRGBAAt(img.Rect.Min.X+sx, img.Rect.Min.Y+sy))
+		}
+	}
+	return dst
+}
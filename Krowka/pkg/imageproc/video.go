@@ -0,0 +1,29 @@
+package imageproc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// VideoFrame returns the first frame of the video file at path as a PNG,
+// decoded by the ffmpeg binary. The caller bounds the run time with ctx.
+func VideoFrame(ctx context.Context, ffmpeg, path string) ([]byte, error) {
+	var out, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ffmpeg,
+		"-nostdin", "-v", "error",
+		"-i", path,
+		"-frames:v", "1", "-f", "image2pipe", "-c:v", "png", "-",
+	)
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	if out.Len() == 0 {
+		return nil, fmt.Errorf("ffmpeg: no frame in %s", path)
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,190 @@
+// Package linkpreview finds the URLs in chat messages and summarises the
+// pages behind them from their Open Graph and Twitter card tags.
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+
+	"Krowka/model"
+
+	"golang.org/x/net/html/charset"
+)
+
+const (
+	// MaxURLs bounds the links previewed for one message
+	MaxURLs = 3
+	// maxRedirects bounds the redirects followed for one page
+	maxRedirects = 3
+	// maxURLLength skips links nobody would want a preview of
+	maxURLLength = 2048
+
+	userAgent = "KrowkaBot/1.0 (link preview)"
+)
+
+var (
+	// ErrBlocked is returned for pages on addresses the server must not
+	// reach, such as loopback, private networks and cloud metadata
+	ErrBlocked = errors.New("address not allowed")
+	// ErrNoPreview is returned for pages that are not HTML or have no
+	// title
+	ErrNoPreview = errors.New("no preview")
+)
+
+// urlPattern finds http and https links, trailing punctuation is trimmed
+// by ExtractURLs
+var urlPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"'` + "`" + `]+`)
+
+// ExtractURLs returns the distinct http and https links of msg, at most
+// MaxURLs, in the order they appear
+func ExtractURLs(msg string) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, m := range urlPattern.FindAllString(msg, -1) {
+		m = trimPunctuation(m)
+		if len(m) > maxURLLength || seen[m] {
+			continue
+		}
+		u, err := url.Parse(m)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		seen[m] = true
+		urls = append(urls, m)
+		if len(urls) == MaxURLs {
+			break
+		}
+	}
+	return urls
+}
+
+// trimPunctuation drops what ends the sentence around a link, keeping a
+// closing parenthesis the link opened itself, as in Wikipedia titles
+func trimPunctuation(s string) string {
+	for s != "" {
+		last := s[len(s)-1]
+		switch {
+		case strings.IndexByte(".,;:!?'\"]}", last) >= 0:
+		case last == ')' && strings.Count(s, "(") < strings.Count(s, ")"):
+		default:
+			return s
+		}
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// Fetcher downloads pages with bounded time and size, refusing to connect
+// to anything but public addresses
+type Fetcher struct {
+	client   *http.Client
+	maxBytes int64
+
+	// blocked reports addresses that must not be dialled, tests let their
+	// local server through
+	blocked func(netip.Addr) bool
+}
+
+// NewFetcher gives up on a page after timeout, redirects included, and
+// reads at most maxBytes of it
+func NewFetcher(timeout time.Duration, maxBytes int64) *Fetcher {
+	f := &Fetcher{maxBytes: maxBytes, blocked: blockedAddr}
+	dialer := &net.Dialer{Timeout: timeout, Control: f.control}
+	f.client = &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			// no proxy from the environment, it would connect on our
+			// behalf past the address check
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   timeout,
+			ResponseHeaderTimeout: timeout,
+			MaxIdleConns:          16,
+			IdleConnTimeout:       30 * time.Second,
+			ForceAttemptHTTP2:     true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("more than %d redirects", maxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to %s scheme", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+	return f
+}
+
+// control runs once the host name is resolved, right before connecting,
+// so that neither redirects nor DNS answers can lead to internal services
+func (f *Fetcher) control(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrBlocked, address)
+	}
+	if f.blocked(ap.Addr().Unmap()) {
+		return fmt.Errorf("%w: %s", ErrBlocked, address)
+	}
+	return nil
+}
+
+// Fetch downloads the page at rawURL and summarises it
+func (f *Fetcher) Fetch(ctx context.Context, rawURL string) (*model.LinkPreview, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%w: %s scheme", ErrNoPreview, u.Scheme)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	resp, err := f.client.Do(req)
+	var uerr *url.Error
+	if errors.As(err, &uerr) {
+		// without the URL, which comes from a chat and is logged apart
+		err = uerr.Err
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching page: %s", resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("%w: page is %q", ErrNoPreview, contentType)
+	}
+
+	// the body is cut at maxBytes, the tags are near the top anyway
+	body, err := charset.NewReader(io.LimitReader(resp.Body, f.maxBytes), contentType)
+	if err != nil {
+		return nil, err
+	}
+	p := parse(body, resp.Request.URL)
+	if p.Title == "" {
+		return nil, fmt.Errorf("%w: page has no title", ErrNoPreview)
+	}
+	p.URL = rawURL
+	return p, nil
+}
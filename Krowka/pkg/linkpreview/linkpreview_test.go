@@ -0,0 +1,183 @@
+package linkpreview
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"Krowka/model"
+)
+
+func TestExtractURLs(t *testing.T) {
+	for _, tc := range []struct {
+		msg  string
+		want []string
+	}{
+		{"no links here", nil},
+		{"see https://example.com/a?b=c.", []string{"https://example.com/a?b=c"}},
+		{"(http://example.com/x), and HTTPS://Example.org!", []string{"http://example.com/x", "HTTPS://Example.org"}},
+		{"https://en.wikipedia.org/wiki/Go_(programming_language)", []string{"https://en.wikipedia.org/wiki/Go_(programming_language)"}},
+		{"twice https://a.example https://a.example", []string{"https://a.example"}},
+		{"ftp://example.com javascript:alert(1) https://", nil},
+		{"https://1.example https://2.example https://3.example https://4.example", []string{"https://1.example", "https://2.example", "https://3.example"}},
+		{`<a href="https://example.com/q">`, []string{"https://example.com/q"}},
+	} {
+		if got := ExtractURLs(tc.msg); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %q, want %q", tc.msg, got, tc.want)
+		}
+	}
+}
+
+func TestBlockedAddr(t *testing.T) {
+	for addr, blocked := range map[string]bool{
+		"127.0.0.1":       true,
+		"10.1.2.3":        true,
+		"172.16.0.1":      true,
+		"192.168.1.1":     true,
+		"169.254.169.254": true,
+		"100.64.0.1":      true,
+		"0.0.0.0":         true,
+		"224.0.0.1":       true,
+		"255.255.255.255": true,
+		"::1":             true,
+		"fd00::1":         true,
+		"fe80::1":         true,
+		"64:ff9b::a00:1":  true,
+		"93.184.216.34":   false,
+		"2606:4700::1111": false,
+	} {
+		if got := blockedAddr(netip.MustParseAddr(addr)); got != blocked {
+			t.Errorf("%s: blocked = %v", addr, got)
+		}
+	}
+}
+
+// localFetcher may reach the httptest server on 127.0.0.1 and nothing
+// else that is private
+func localFetcher(maxBytes int64) *Fetcher {
+	f := NewFetcher(2*time.Second, maxBytes)
+	local := netip.MustParseAddr("127.0.0.1")
+	f.blocked = func(a netip.Addr) bool { return a != local && blockedAddr(a) }
+	return f
+}
+
+func TestFetch(t *testing.T) {
+	mux := http.NewServeMux()
+	page := func(path, contentType, body string) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			io.WriteString(w, body)
+		})
+	}
+	page("/og", "text/html; charset=utf-8", `<!doctype html><html><head>
+		<title>Plain title</title>
+		<meta property="og:title" content="  Open   Graph title ">
+		<meta property="og:description" content="What it is about">
+		<meta property="og:image" content="/img/cover.png">
+		<meta property="og:image" content="/img/second.png">
+		<meta property="og:site_name" content="Example">
+		<meta name="twitter:title" content="Card title">
+		</head><body><meta property="og:title" content="ignored"></body></html>`)
+	page("/card", "text/html", `<head><meta name="twitter:title" content="Card title">
+		<meta name="twitter:image" content="https://cdn.example/card.jpg">
+		<meta name="description" content="Plain description"></head>`)
+	page("/title", "text/html", `<html><head><title>Only a title</title>
+		<meta property="og:image" content="javascript:alert(1)"></head></html>`)
+	page("/latin1", "text/html; charset=iso-8859-1", "<title>Caf\xe9</title>")
+	page("/none", "text/html", `<html><body>nothing</body></html>`)
+	page("/image", "image/png", "\x89PNG")
+	page("/big", "text/html", "<html><head>"+strings.Repeat("<!-- padding -->", 1000)+"<title>too far</title></head>")
+	mux.HandleFunc("/hop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/og", http.StatusFound)
+	})
+	mux.HandleFunc("/loop", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/loop", http.StatusFound)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	f := localFetcher(4096)
+	ctx := context.Background()
+
+	got, err := f.Fetch(ctx, srv.URL+"/og")
+	want := &model.LinkPreview{
+		URL:         srv.URL + "/og",
+		Title:       "Open Graph title",
+		Description: "What it is about",
+		Image:       srv.URL + "/img/cover.png",
+		SiteName:    "Example",
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("og: %+v, %v", got, err)
+	}
+	if got, err := f.Fetch(ctx, srv.URL+"/hop"); err != nil || got.URL != srv.URL+"/hop" || got.Image != srv.URL+"/img/cover.png" {
+		t.Errorf("redirect: %+v, %v", got, err)
+	}
+	got, err = f.Fetch(ctx, srv.URL+"/card")
+	if err != nil || got.Title != "Card title" || got.Image != "https://cdn.example/card.jpg" || got.Description != "Plain description" {
+		t.Errorf("twitter card: %+v, %v", got, err)
+	}
+	if got, err := f.Fetch(ctx, srv.URL+"/title"); err != nil || got.Title != "Only a title" || got.Image != "" {
+		t.Errorf("title only: %+v, %v", got, err)
+	}
+	if got, err := f.Fetch(ctx, srv.URL+"/latin1"); err != nil || got.Title != "Café" {
+		t.Errorf("latin1: %+v, %v", got, err)
+	}
+
+	for _, path := range []string{"/none", "/image", "/big"} {
+		if _, err := f.Fetch(ctx, srv.URL+path); !errors.Is(err, ErrNoPreview) {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, path := range []string{"/missing", "/loop", "/slow"} {
+		if _, err := f.Fetch(ctx, srv.URL+path); err == nil || errors.Is(err, ErrNoPreview) {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+}
+
+func TestFetchBlocksPrivateAddresses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata":
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+		case "/loopback":
+			http.Redirect(w, r, "http://[::1]/", http.StatusFound)
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, "<title>internal</title>")
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	// the server itself is on loopback
+	f := NewFetcher(2*time.Second, 4096)
+	port := srv.URL[strings.LastIndex(srv.URL, ":"):]
+	for _, u := range []string{srv.URL, "http://localhost" + port} {
+		if _, err := f.Fetch(ctx, u); !errors.Is(err, ErrBlocked) {
+			t.Errorf("%s: %v", u, err)
+		}
+	}
+
+	// redirects are checked like the first request
+	f = localFetcher(4096)
+	for _, path := range []string{"/metadata", "/loopback"} {
+		if _, err := f.Fetch(ctx, srv.URL+path); !errors.Is(err, ErrBlocked) {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package linkpreview
+
+import (
+	"io"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"Krowka/model"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// lengths a preview's texts are cut to, in runes
+const (
+	maxTitle       = 200
+	maxDescription = 300
+	maxSiteName    = 100
+)
+
+// parse reads the head of an HTML page. Open Graph tags win over Twitter
+// cards, which win over the plain title and description.
+func parse(r io.Reader, base *url.URL) *model.LinkPreview {
+	meta := make(map[string]string)
+	var title string
+
+	z := html.NewTokenizer(r)
+loop:
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			// end of the page, or of what was read of it
+			break loop
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			switch atom.Lookup(name) {
+			case atom.Body:
+				break loop
+			case atom.Title:
+				if tt == html.StartTagToken && title == "" && z.Next() == html.TextToken {
+					title = string(z.Text())
+				}
+			case atom.Meta:
+				var key, content string
+				for hasAttr {
+					var k, v []byte
+					k, v, hasAttr = z.TagAttr()
+					switch string(k) {
+					case "property", "name":
+						key = strings.ToLower(string(v))
+					case "content":
+						content = string(v)
+					}
+				}
+				// the first of repeated tags, such as og:image, wins
+				if _, ok := meta[key]; key != "" && !ok {
+					meta[key] = content
+				}
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); atom.Lookup(name) == atom.Head {
+				break loop
+			}
+		}
+	}
+
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := clean(meta[k]); v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	p := &model.LinkPreview{
+		Title:       truncate(first("og:title", "twitter:title"), maxTitle),
+		Description: truncate(first("og:description", "twitter:description", "description"), maxDescription),
+		SiteName:    truncate(first("og:site_name"), maxSiteName),
+		Image:       imageURL(base, first("og:image:secure_url", "og:image", "og:image:url", "twitter:image", "twitter:image:src")),
+	}
+	if p.Title == "" {
+		p.Title = truncate(clean(title), maxTitle)
+	}
+	return p
+}
+
+// clean collapses the whitespace of a text
+func clean(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)
+	return strings.TrimSpace(string(runes[:max-1])) + "…"
+}
+
+// imageURL resolves the image against the page, keeping http and https
+// links only
+func imageURL(base *url.URL, ref string) string {
+	if ref == "" || len(ref) > maxURLLength {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return u.String()
+}
@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// redactedKeys are attribute keys whose values are replaced unless
+// sensitive logging is switched on
+var redactedKeys = map[string]bool{
+	"body":         true,
+	"link":         true, // taken from message bodies
+	"password":     true,
+	"old_password": true,
+	"new_password": true,
+	"token":        true,
+}
+
+const redactedValue = "[REDACTED]"
+
+type ctxKey int
+
+const (
+	requestIDKey ctxKey = iota
+	connIDKey
+)
+
+// Options configure the process wide logger
+type Options struct {
+	Level  string // debug, info, warn, error
+	Format string // text or json
+	// Sensitive keeps message bodies, passwords and tokens in logs
+	Sensitive bool
+}
+
+// New builds a logger writing to w. Request and connection IDs stored in
+// the context are added to every record logged with a *Context method.
+func New(w io.Writer, opts Options) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+		return nil, fmt.Errorf("log level %q: %w", opts.Level, err)
+	}
+
+	hopts := &slog.HandlerOptions{Level: level}
+	if !opts.Sensitive {
+		hopts.ReplaceAttr = redact
+	}
+
+	var h slog.Handler
+	switch strings.ToLower(opts.Format) {
+	case "json":
+		h = slog.NewJSONHandler(w, hopts)
+	case "text", "":
+		h = slog.NewTextHandler(w, hopts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", opts.Format)
+	}
+
+	return slog.New(contextHandler{h}), nil
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if redactedKeys[a.Key] {
+		return slog.String(a.Key, redactedValue)
+	}
+	return a
+}
+
+// contextHandler adds IDs carried by the context, including the current
+// trace ID, to each record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if id, ok := ctx.Value(connIDKey).(string); ok {
+		r.AddAttrs(slog.String("conn_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// WithRequestID stores the HTTP request ID in ctx
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request ID stored in ctx, if any
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithConnID stores the WebSocket connection ID in ctx
+func WithConnID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, connIDKey, id)
+}
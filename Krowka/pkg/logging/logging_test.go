@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedactionAndContextIDs(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Options{Level: "debug", Format: "json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := WithConnID(WithRequestID(context.Background(), "req-1"), "conn-1")
+	logger.DebugContext(ctx, "received message", "body", "hello bob", "password", "hunter2", "to", "bob")
+
+	var rec map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+		t.Fatal("decode", err, buf.String())
+	}
+
+	if rec["body"] != redactedValue || rec["password"] != redactedValue {
+		t.Error("sensitive values not redacted", rec)
+	}
+	if rec["to"] != "bob" || rec["request_id"] != "req-1" || rec["conn_id"] != "conn-1" {
+		t.Error("expected attributes missing", rec)
+	}
+
+	buf.Reset()
+	logger, _ = New(&buf, Options{Level: "info", Format: "json", Sensitive: true})
+	logger.Debug("dropped")
+	logger.Info("kept", "body", "hello bob")
+	if bytes.Contains(buf.Bytes(), []byte("dropped")) || !bytes.Contains(buf.Bytes(), []byte("hello bob")) {
+		t.Error("unexpected output", buf.String())
+	}
+}
+
+func TestMiddlewareRequestID(t *testing.T) {
+	var seen string
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r.Context())
+	}))
+
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)))
+	defer slog.SetDefault(prev)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if seen != "abc-123" || rec.Header().Get(RequestIDHeader) != "abc-123" {
+		t.Error("client request id not propagated", seen, rec.Header())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(RequestIDHeader, "bad id\nforged=1")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if len(seen) != 32 || seen != rec.Header().Get(RequestIDHeader) {
+		t.Error("invalid request id should be replaced", seen)
+	}
+}
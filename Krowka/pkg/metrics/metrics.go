@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "krowka"
+
+// Registry holds every krowka collector. Both servers expose it, so in
+// --server=all mode each /metrics shows the whole process.
+var Registry = prometheus.NewRegistry()
+
+var (
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of HTTP requests by mux route template, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	WSActiveConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "ws",
+		Name:      "active_connections",
+		Help:      "WebSocket connections currently open.",
+	})
+
+	WSMessagesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ws",
+		Name:      "messages_received_total",
+		Help:      "Chat frames received from clients.",
+	})
+
+	WSMessagesBroadcast = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ws",
+		Name:      "messages_broadcast_total",
+		Help:      "Chat frames written to participant connections.",
+	})
+
+	WSMessagesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ws",
+		Name:      "messages_dropped_total",
+		Help:      "Chat frames that were not delivered, by reason.",
+	}, []string{"reason"})
+
+	WSRateLimitDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ws",
+		Name:      "rate_limit_disconnects_total",
+		Help:      "Connections closed for sending frames over the rate limit.",
+	})
+
+	WSBroadcastQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "ws",
+		Name:      "broadcast_queue_depth",
+		Help:      "Chats waiting for the broadcaster.",
+	})
+
+	RedisCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "redis",
+		Name:      "command_duration_seconds",
+		Help:      "Latency of redis commands issued by redisrepo.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command"})
+
+	RedisErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "redis",
+		Name:      "errors_total",
+		Help:      "Redis commands that failed, nil replies excluded.",
+	}, []string{"command"})
+
+	AuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "failures_total",
+		Help:      "Rejected logins and API tokens, by reason.",
+	}, []string{"reason"})
+
+	PasswordVerifyFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "auth",
+		Name:      "password_verify_failures_total",
+		Help:      "Password hash comparisons that did not match, by stored algorithm.",
+	}, []string{"algorithm"})
+
+	GCRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "gc",
+		Name:      "runs_total",
+		Help:      "Janitor passes over the attachment store, by result.",
+	}, []string{"result"})
+
+	GCOrphanedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "gc",
+		Name:      "orphaned_bytes",
+		Help:      "Bytes of unreferenced files found by the last janitor pass, deleted or not.",
+	})
+
+	GCDeletedFiles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "gc",
+		Name:      "deleted_files_total",
+		Help:      "Unreferenced files deleted by the janitor, by kind.",
+	}, []string{"kind"})
+
+	GCReclaimedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "gc",
+		Name:      "reclaimed_bytes_total",
+		Help:      "Bytes of storage freed by the janitor.",
+	})
+
+	Scans = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "scan",
+		Name:      "files_total",
+		Help:      "Malware scans of attachments, by result: clean, infected, cached, too_large or error.",
+	}, []string{"result"})
+
+	LinkPreviews = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "ws",
+		Name:      "link_previews_total",
+		Help:      "Links in chats looked up for a preview, by result: fetched, cached, none, blocked, error or dropped.",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequestDuration,
+		WSActiveConnections,
+		WSMessagesReceived,
+		WSMessagesBroadcast,
+		WSMessagesDropped,
+		WSRateLimitDisconnects,
+		WSBroadcastQueueDepth,
+		RedisCommandDuration,
+		RedisErrors,
+		AuthFailures,
+		PasswordVerifyFailures,
+		GCRuns,
+		GCOrphanedBytes,
+		GCDeletedFiles,
+		GCReclaimedBytes,
+		Scans,
+		LinkPreviews,
+	)
+}
+
+// Handler serves Registry in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
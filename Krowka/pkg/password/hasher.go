@@ -0,0 +1,235 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	AlgorithmArgon2id  = "argon2id"
+	AlgorithmBcrypt    = "bcrypt"
+	AlgorithmPlaintext = "plaintext"
+)
+
+var ErrMalformedHash = errors.New("malformed password hash")
+
+// Hasher hashes and verifies passwords for one algorithm.
+type Hasher interface {
+	Algorithm() string
+	Hash(password string) (string, error)
+	Verify(encoded, password string) (bool, error)
+	// NeedsRehash reports whether encoded was produced with weaker
+	// parameters than the hasher currently uses.
+	NeedsRehash(encoded string) bool
+}
+
+var hashers = map[string]Hasher{}
+
+// Default is used for every new hash and as the upgrade target on login.
+var Default Hasher = NewArgon2id(DefaultArgon2Params)
+
+func init() {
+	Register(Default)
+	Register(bcryptHasher{cost: bcrypt.DefaultCost})
+	Register(plaintextHasher{})
+}
+
+// Register makes h available to ForAlgorithm under h.Algorithm().
+func Register(h Hasher) {
+	hashers[h.Algorithm()] = h
+}
+
+// ForAlgorithm returns the hasher able to verify hashes of the algorithm.
+func ForAlgorithm(algorithm string) (Hasher, bool) {
+	h, ok := hashers[algorithm]
+	return h, ok
+}
+
+// DetectAlgorithm guesses the algorithm of a stored hash from its prefix.
+func DetectAlgorithm(encoded string) string {
+	switch {
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		return AlgorithmArgon2id
+	case strings.HasPrefix(encoded, "$2a$"), strings.HasPrefix(encoded, "$2b$"), strings.HasPrefix(encoded, "$2y$"):
+		return AlgorithmBcrypt
+	default:
+		return AlgorithmPlaintext
+	}
+}
+
+// Argon2Params are the tunables encoded in every argon2id PHC string.
+type Argon2Params struct {
+	Memory  uint32 // KiB
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// DefaultArgon2Params follow the OWASP baseline for argon2id.
+var DefaultArgon2Params = Argon2Params{
+	Memory:  64 * 1024,
+	Time:    3,
+	Threads: 2,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+// bounds accepted from a stored argon2id hash, so that a corrupt or
+// planted hash can neither panic argon2 nor make it allocate without limit
+const (
+	maxArgon2Memory  = 1 << 20 // KiB, 1 GiB
+	maxArgon2Time    = 64
+	minArgon2SaltLen = 8
+	minArgon2KeyLen  = 16
+	maxArgon2Len     = 1024
+)
+
+type argon2idHasher struct {
+	params Argon2Params
+}
+
+func NewArgon2id(p Argon2Params) Hasher {
+	return argon2idHasher{params: p}
+}
+
+func (argon2idHasher) Algorithm() string {
+	return AlgorithmArgon2id
+}
+
+// Hash returns the PHC string
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func (h argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.Time, h.params.Memory, h.params.Threads, h.params.KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.params.Memory, h.params.Time, h.params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h argon2idHasher) Verify(encoded, password string) (bool, error) {
+	p, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, p.KeyLen)
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (h argon2idHasher) NeedsRehash(encoded string) bool {
+	p, salt, _, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return p.Memory < h.params.Memory ||
+		p.Time < h.params.Time ||
+		p.Threads < h.params.Threads ||
+		p.KeyLen < h.params.KeyLen ||
+		uint32(len(salt)) < h.params.SaltLen
+}
+
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+
+	// "", "argon2id", "v=19", "m=65536,t=3,p=2", salt, key
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != AlgorithmArgon2id {
+		return p, nil, nil, ErrMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return p, nil, nil, ErrMalformedHash
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return p, nil, nil, ErrMalformedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, ErrMalformedHash
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, ErrMalformedHash
+	}
+
+	p.SaltLen = uint32(len(salt))
+	p.KeyLen = uint32(len(key))
+
+	if p.Memory < 8*uint32(p.Threads) || p.Memory > maxArgon2Memory ||
+		p.Time < 1 || p.Time > maxArgon2Time || p.Threads < 1 ||
+		p.SaltLen < minArgon2SaltLen || p.SaltLen > maxArgon2Len ||
+		p.KeyLen < minArgon2KeyLen || p.KeyLen > maxArgon2Len {
+		return p, nil, nil, fmt.Errorf("%w: argon2id parameters out of range", ErrMalformedHash)
+	}
+
+	return p, salt, key, nil
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (bcryptHasher) Algorithm() string {
+	return AlgorithmBcrypt
+}
+
+func (h bcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	return string(hashed), err
+}
+
+func (bcryptHasher) Verify(encoded, password string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func (h bcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < h.cost
+}
+
+// plaintextHasher only exists to verify passwords of legacy users, it is
+// never used to store a new password.
+type plaintextHasher struct{}
+
+func (plaintextHasher) Algorithm() string {
+	return AlgorithmPlaintext
+}
+
+func (plaintextHasher) Hash(password string) (string, error) {
+	return "", errors.New("plaintext passwords can not be stored")
+}
+
+func (plaintextHasher) Verify(encoded, password string) (bool, error) {
+	return subtle.ConstantTimeCompare([]byte(encoded), []byte(password)) == 1, nil
+}
+
+func (plaintextHasher) NeedsRehash(string) bool {
+	return true
+}
@@ -0,0 +1,125 @@
+package password
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// cheap parameters keep the tests fast
+var testParams = Argon2Params{Memory: 1024, Time: 1, Threads: 1, SaltLen: 16, KeyLen: 32}
+
+func TestArgon2idRoundTrip(t *testing.T) {
+	h := NewArgon2id(testParams)
+
+	encoded, err := h.Hash("correct horse")
+	if err != nil {
+		t.Fatal("hash", err)
+	}
+
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Error("unexpected PHC string", encoded)
+	}
+
+	if ok, err := h.Verify(encoded, "correct horse"); err != nil || !ok {
+		t.Error("expected password to verify", ok, err)
+	}
+
+	if ok, _ := h.Verify(encoded, "Correct horse"); ok {
+		t.Error("expected different password to fail")
+	}
+}
+
+func TestArgon2idNeedsRehash(t *testing.T) {
+	weak, _ := NewArgon2id(testParams).Hash("secret")
+
+	if !NewArgon2id(DefaultArgon2Params).NeedsRehash(weak) {
+		t.Error("expected weaker parameters to need a rehash")
+	}
+	if NewArgon2id(testParams).NeedsRehash(weak) {
+		t.Error("expected same parameters to be current")
+	}
+	if _, err := NewArgon2id(testParams).Verify("$argon2id$v=19$garbage", "secret"); !errors.Is(err, ErrMalformedHash) {
+		t.Error("expected malformed hash error, got", err)
+	}
+}
+
+func TestArgon2idRejectsUnsafeParameters(t *testing.T) {
+	h := NewArgon2id(testParams)
+	valid, _ := h.Hash("secret")
+	params := "m=1024,t=1,p=1"
+	if !strings.Contains(valid, params) {
+		t.Fatal("unexpected PHC string", valid)
+	}
+
+	for _, bad := range []string{
+		"m=1024,t=1,p=0",          // argon2 panics without threads
+		"m=1024,t=0,p=1",          // no passes
+		"m=4294967295,t=1,p=1",    // 4 TiB of memory
+		"m=1024,t=4294967295,p=1", // runs forever
+		"m=8,t=1,p=4",             // less than 8 KiB per thread
+	} {
+		encoded := strings.Replace(valid, params, bad, 1)
+		if ok, err := h.Verify(encoded, "secret"); ok || !errors.Is(err, ErrMalformedHash) {
+			t.Errorf("%s: %v, %v", bad, ok, err)
+		}
+		if !h.NeedsRehash(encoded) {
+			t.Errorf("%s: no rehash", bad)
+		}
+	}
+}
+
+func TestPlaintextIsCaseSensitive(t *testing.T) {
+	h, _ := ForAlgorithm(AlgorithmPlaintext)
+
+	if ok, _ := h.Verify("Secret", "Secret"); !ok {
+		t.Error("expected exact match")
+	}
+	if ok, _ := h.Verify("Secret", "secret"); ok {
+		t.Error("expected case mismatch to fail")
+	}
+}
+
+func TestDetectAlgorithm(t *testing.T) {
+	tests := map[string]string{
+		"$argon2id$v=19$m=1,t=1,p=1$a$b": AlgorithmArgon2id,
+		"$2a$10$abcdefghijklmnopqrstuv":  AlgorithmBcrypt,
+		"hunter2":                        AlgorithmPlaintext,
+	}
+
+	for encoded, want := range tests {
+		if got := DetectAlgorithm(encoded); got != want {
+			t.Errorf("DetectAlgorithm(%q) = %s, want %s", encoded, got, want)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	os.WriteFile(path, []byte("# top passwords\nPassword123\n\nqwertyuiop\n"), 0644)
+
+	p := DefaultPolicy()
+	if err := p.LoadBlocklist(path); err != nil {
+		t.Fatal("load blocklist", err)
+	}
+
+	tests := []struct {
+		username, password string
+		want               error
+	}{
+		{"alice", "short", ErrTooShort},
+		{"alice", strings.Repeat("x", 129), ErrTooLong},
+		{"alicealice", "AliceAlice", ErrSameAsUsername},
+		{"alice", "password123", ErrBreached},
+		{"alice", "QWERTYUIOP", ErrBreached},
+		{"alice", "a long unusual passphrase", nil},
+	}
+
+	for _, tt := range tests {
+		if err := p.Validate(tt.username, tt.password); !errors.Is(err, tt.want) {
+			t.Errorf("Validate(%q, %q) = %v, want %v", tt.username, tt.password, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package password
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	ErrTooShort       = errors.New("password is too short")
+	ErrTooLong        = errors.New("password is too long")
+	ErrSameAsUsername = errors.New("password must not match the username")
+	ErrBreached       = errors.New("password appears in a list of breached passwords")
+)
+
+// Policy is the strength check applied whenever a password is chosen.
+type Policy struct {
+	MinLength int
+	MaxLength int
+
+	// blocklist holds lower-cased breached passwords
+	blocklist map[string]struct{}
+}
+
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinLength: 8,
+		MaxLength: 128,
+	}
+}
+
+// LoadBlocklist reads one breached password per line from path. Blank lines
+// and lines starting with # are ignored.
+func (p *Policy) LoadBlocklist(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	list := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list[strings.ToLower(line)] = struct{}{}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading password blocklist %s: %w", path, err)
+	}
+
+	p.blocklist = list
+	return nil
+}
+
+// Validate returns the first rule password breaks, or nil.
+func (p *Policy) Validate(username, password string) error {
+	n := utf8.RuneCountInString(password)
+	if n < p.MinLength {
+		return ErrTooShort
+	}
+	if p.MaxLength > 0 && n > p.MaxLength {
+		return ErrTooLong
+	}
+	if username != "" && strings.EqualFold(username, password) {
+		return ErrSameAsUsername
+	}
+	if _, ok := p.blocklist[strings.ToLower(password)]; ok {
+		return ErrBreached
+	}
+
+	return nil
+}
@@ -0,0 +1,202 @@
+package redisrepo
+
+import (
+	"context"
+	"strconv"
+
+	"Krowka/model"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// SaveAttachment stores the metadata of an uploaded file
+func SaveAttachment(ctx context.Context, a *model.Attachment) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: HSET key field value [field value ...]
+	// HSET attachment:<id> owner sun peer earth name photo.jpg mime image/jpeg size 1024 created_at 1661360942 width 640 height 480 blurhash LEHV6n thumb_mime image/jpeg status pending blob <sha256>
+	err := redisClient.HSet(ctx, attachmentKey(a.ID),
+		"owner", a.Owner,
+		"peer", a.Peer,
+		"name", a.Name,
+		"mime", a.MIME,
+		"size", a.Size,
+		"created_at", a.CreatedAt,
+		"width", a.Width,
+		"height", a.Height,
+		"blurhash", a.Blurhash,
+		"thumb_mime", a.ThumbMIME,
+		"status", a.Status,
+		"blob", a.Blob,
+	).Err()
+
+	return classify(err)
+}
+
+// setIfExistsScript sets the field ARGV[1] of the hash KEYS[1] to ARGV[2]
+// unless the hash is gone. Returns 1 if it was set.
+var setIfExistsScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+return 1
+`)
+
+// SetAttachmentStatus records the scan state of an attachment, or returns
+// ErrNotFound if it was deleted meanwhile
+func SetAttachmentStatus(ctx context.Context, id, status string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+	// EVALSHA <sha> 1 attachment:<id> status clean
+	ok, err := setIfExistsScript.Run(ctx, redisClient, []string{attachmentKey(id)}, "status", status).Int()
+	if err != nil {
+		return classify(err)
+	}
+	if ok == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// DeleteAttachment removes the metadata of an attachment, its file is the
+// caller's to delete. Returns ErrNotFound if someone else deleted it
+// first.
+func DeleteAttachment(ctx context.Context, id string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: DEL key
+	// DEL attachment:<id>
+	n, err := redisClient.Del(ctx, attachmentKey(id)).Result()
+	if err != nil {
+		return classify(err)
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// GetAttachment returns ErrNotFound for unknown IDs
+func GetAttachment(ctx context.Context, id string) (*model.Attachment, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: HGETALL key
+	// HGETALL attachment:<id>
+	fields, err := redisClient.HGetAll(ctx, attachmentKey(id)).Result()
+	if err != nil {
+		return nil, classify(err)
+	}
+	if len(fields) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return attachmentFromHash(id, fields), nil
+}
+
+// GetAttachments fetches several attachments at once, unknown IDs are
+// left out of the result
+func GetAttachments(ctx context.Context, ids []string) (map[string]*model.Attachment, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: HGETALL key, once per ID in a pipeline
+	cmds := make([]*redis.StringStringMapCmd, len(ids))
+	_, err := redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, id := range ids {
+			cmds[i] = pipe.HGetAll(ctx, attachmentKey(id))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	res := make(map[string]*model.Attachment, len(ids))
+	for i, id := range ids {
+		if fields := cmds[i].Val(); len(fields) > 0 {
+			res[id] = attachmentFromHash(id, fields)
+		}
+	}
+	return res, nil
+}
+
+func attachmentFromHash(id string, fields map[string]string) *model.Attachment {
+	a := &model.Attachment{
+		ID:        id,
+		Owner:     fields["owner"],
+		Peer:      fields["peer"],
+		Name:      fields["name"],
+		MIME:      fields["mime"],
+		Blurhash:  fields["blurhash"],
+		ThumbMIME: fields["thumb_mime"],
+		Status:    fields["status"],
+		Blob:      fields["blob"],
+	}
+	a.Size, _ = strconv.ParseInt(fields["size"], 10, 64)
+	a.CreatedAt, _ = strconv.ParseInt(fields["created_at"], 10, 64)
+	a.Width, _ = strconv.Atoi(fields["width"])
+	a.Height, _ = strconv.Atoi(fields["height"])
+	return a
+}
+
+// AddConversationMedia records attachments sent at ts in the conversation
+// between user1 and user2
+func AddConversationMedia(ctx context.Context, user1, user2 string, ts int64, ids ...string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	members := make([]*redis.Z, len(ids))
+	for i, id := range ids {
+		members[i] = &redis.Z{Score: float64(ts), Member: id}
+	}
+
+	// redis-cli
+	// SYNTAX: ZADD key score member [score member ...]
+	// ZADD media:{earth:sun} 1661360942 <id>
+	return classify(redisClient.ZAdd(ctx, mediaKey(user1, user2), members...).Err())
+}
+
+// FetchConversationMedia returns the attachments sent between user1 and
+// user2 from fromTS to toTS, newest first. The bounds take the same form
+// as those of FetchChatBetween.
+func FetchConversationMedia(ctx context.Context, user1, user2, fromTS, toTS string) ([]*model.Attachment, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: ZRANGE key max min BYSCORE REV
+	// ZRANGE media:{earth:sun} +inf 0 BYSCORE REV
+	ids, err := redisClient.ZRevRangeByScore(ctx, mediaKey(user1, user2), &redis.ZRangeBy{
+		Min: fromTS,
+		Max: toTS,
+	}).Result()
+	if err != nil {
+		return nil, classify(err)
+	}
+	if len(ids) == 0 {
+		return []*model.Attachment{}, nil
+	}
+
+	found, err := GetAttachments(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	media := make([]*model.Attachment, 0, len(ids))
+	for _, id := range ids {
+		if a, ok := found[id]; ok {
+			media = append(media, a)
+		}
+	}
+	return media, nil
+}
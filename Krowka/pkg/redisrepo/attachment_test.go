@@ -0,0 +1,121 @@
+package redisrepo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"Krowka/model"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestAttachments(t *testing.T) {
+	useClient(t, miniredis.RunT(t).Addr())
+	ctx := context.Background()
+
+	photo := &model.Attachment{
+		ID: "a1", Owner: "alice", Peer: "bob", Name: "cat.jpg", MIME: "image/jpeg",
+		Size: 1024, CreatedAt: 1661360942,
+		Width: 640, Height: 480, Blurhash: "LEHV6nWB2yk8", ThumbMIME: "image/jpeg", Status: model.ScanClean, Blob: "c0ffee",
+	}
+	notes := &model.Attachment{ID: "a2", Owner: "bob", Peer: "alice", Name: "notes.txt", MIME: "text/plain", Size: 9}
+	for _, a := range []*model.Attachment{photo, notes} {
+		if err := SaveAttachment(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := GetAttachment(ctx, "a1")
+	if err != nil || !reflect.DeepEqual(got, photo) {
+		t.Errorf("GetAttachment = %+v, %v", got, err)
+	}
+	if _, err := GetAttachment(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing: %v", err)
+	}
+
+	all, err := GetAttachments(ctx, []string{"a1", "missing", "a2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || !reflect.DeepEqual(all["a1"], photo) || !reflect.DeepEqual(all["a2"], notes) {
+		t.Errorf("GetAttachments = %+v", all)
+	}
+}
+
+func TestConversationMedia(t *testing.T) {
+	useClient(t, miniredis.RunT(t).Addr())
+	ctx := context.Background()
+
+	for i, id := range []string{"a1", "a2", "a3"} {
+		if err := SaveAttachment(ctx, &model.Attachment{ID: id, Owner: "alice", Peer: "bob", CreatedAt: int64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// either direction lands in the same list, a4 was never uploaded
+	if err := AddConversationMedia(ctx, "alice", "bob", 100, "a1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddConversationMedia(ctx, "bob", "alice", 200, "a2", "a4"); err != nil {
+		t.Fatal(err)
+	}
+
+	media, err := FetchConversationMedia(ctx, "bob", "alice", "0", "+inf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, a := range media {
+		ids = append(ids, a.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{"a2", "a1"}) {
+		t.Errorf("media = %v", ids)
+	}
+
+	if media, err := FetchConversationMedia(ctx, "alice", "bob", "0", "150"); err != nil || len(media) != 1 || media[0].ID != "a1" {
+		t.Errorf("until 150: %v %v", media, err)
+	}
+	if media, err := FetchConversationMedia(ctx, "alice", "carol", "0", "+inf"); err != nil || len(media) != 0 {
+		t.Errorf("other conversation: %v %v", media, err)
+	}
+}
+
+func TestAttachmentStatus(t *testing.T) {
+	useClient(t, miniredis.RunT(t).Addr())
+	ctx := context.Background()
+
+	if err := SaveAttachment(ctx, &model.Attachment{ID: "a1", Owner: "alice", Status: model.ScanPending}); err != nil {
+		t.Fatal(err)
+	}
+	if err := QueueScan(ctx, "a1", 100); err != nil {
+		t.Fatal(err)
+	}
+	if ids, err := DueScans(ctx, 99); err != nil || len(ids) != 0 {
+		t.Errorf("due before queued: %v, %v", ids, err)
+	}
+	if ids, err := DueScans(ctx, 100); err != nil || len(ids) != 1 || ids[0] != "a1" {
+		t.Errorf("due: %v, %v", ids, err)
+	}
+
+	if err := SetAttachmentStatus(ctx, "a1", model.ScanQuarantined); err != nil {
+		t.Fatal(err)
+	}
+	if a, _ := GetAttachment(ctx, "a1"); a.Status != model.ScanQuarantined || a.Downloadable() {
+		t.Errorf("after scanning: %+v", a)
+	}
+	if err := DoneScan(ctx, "a1"); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := DueScans(ctx, 100); len(ids) != 0 {
+		t.Errorf("still queued: %v", ids)
+	}
+
+	// a verdict for a deleted attachment does not bring it back
+	if err := SetAttachmentStatus(ctx, "gone", model.ScanClean); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted attachment: %v", err)
+	}
+	if _, err := GetAttachment(ctx, "gone"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted attachment recreated: %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package redisrepo
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// chargeBlobScript counts one more attachment of the content ARGV[1] for
+// the user at KEYS[1]. The first one adds ARGV[2] bytes and a file unless
+// that takes the bytes over the quota ARGV[3], 0 meaning unlimited.
+// Returns 1 if the attachment was counted.
+var chargeBlobScript = redis.NewScript(`
+local field = 'blob:' .. ARGV[1]
+if tonumber(redis.call('HGET', KEYS[1], field) or '0') == 0 then
+	local used = tonumber(redis.call('HGET', KEYS[1], 'bytes') or '0')
+	local size = tonumber(ARGV[2])
+	local quota = tonumber(ARGV[3])
+	if quota > 0 and used + size > quota then
+		return 0
+	end
+	redis.call('HINCRBY', KEYS[1], 'bytes', size)
+	redis.call('HINCRBY', KEYS[1], 'files', 1)
+end
+redis.call('HINCRBY', KEYS[1], field, 1)
+return 1
+`)
+
+// unchargeBlobScript undoes chargeBlobScript, the last attachment of the
+// content gives back its ARGV[2] bytes
+var unchargeBlobScript = redis.NewScript(`
+local field = 'blob:' .. ARGV[1]
+if redis.call('HINCRBY', KEYS[1], field, -1) <= 0 then
+	redis.call('HDEL', KEYS[1], field)
+	redis.call('HINCRBY', KEYS[1], 'bytes', -tonumber(ARGV[2]))
+	redis.call('HINCRBY', KEYS[1], 'files', -1)
+end
+return 1
+`)
+
+// releaseBlobScript drops a reference to the content at KEYS[1], deleting
+// the key with the last one. Returns the references left.
+var releaseBlobScript = redis.NewScript(`
+local refs = redis.call('HINCRBY', KEYS[1], 'refs', -1)
+if refs <= 0 then
+	redis.call('DEL', KEYS[1])
+	return 0
+end
+return refs
+`)
+
+// ChargeBlob accounts an attachment of size bytes with the content hash to
+// username. Only the first of the user's attachments with that content
+// counts against quota, otherwise it returns ErrQuotaExceeded like
+// ReserveStorage.
+func ChargeBlob(ctx context.Context, username, hash string, size, quota int64) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+	// EVALSHA <sha> 1 storage:sun <sha256> 1024 1073741824
+	ok, err := chargeBlobScript.Run(ctx, redisClient, []string{storageKey(username)}, hash, size, quota).Int()
+	if err != nil {
+		return classify(err)
+	}
+	if ok == 0 {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// UnchargeBlob gives back what ChargeBlob took once the user's last
+// attachment with the content is gone
+func UnchargeBlob(ctx context.Context, username, hash string, size int64) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+	// EVALSHA <sha> 1 storage:sun <sha256> 1024
+	return classify(unchargeBlobScript.Run(ctx, redisClient, []string{storageKey(username)}, hash, size).Err())
+}
+
+// AddBlobRef counts one more attachment stored as the content hash of size
+// bytes and returns how many there are. The first reference is the
+// caller's cue to store the file.
+func AddBlobRef(ctx context.Context, hash string, size int64) (int64, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: HINCRBY key field increment
+	// HINCRBY blob:<sha256> refs 1
+	// HSET blob:<sha256> size 1024
+	var refs *redis.IntCmd
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		refs = pipe.HIncrBy(ctx, blobKey(hash), "refs", 1)
+		pipe.HSet(ctx, blobKey(hash), "size", size)
+		return nil
+	})
+	if err != nil {
+		return 0, classify(err)
+	}
+	return refs.Val(), nil
+}
+
+// ReleaseBlobRef drops a reference to the content hash and returns how
+// many are left. At none the content is forgotten and its file is the
+// caller's to delete.
+func ReleaseBlobRef(ctx context.Context, hash string) (int64, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+	// EVALSHA <sha> 1 blob:<sha256>
+	refs, err := releaseBlobScript.Run(ctx, redisClient, []string{blobKey(hash)}).Int64()
+	if err != nil {
+		return 0, classify(err)
+	}
+	return refs, nil
+}
+
+// BlobRefs returns how many attachments share the content hash, 0 for
+// content nobody refers to
+func BlobRefs(ctx context.Context, hash string) (int64, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: HGET key field
+	// HGET blob:<sha256> refs
+	refs, err := redisClient.HGet(ctx, blobKey(hash), "refs").Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, classify(err)
+	}
+	return refs, nil
+}
+
+// SetBlobStatus remembers the scan verdict of a content, so that later
+// copies need no scan. A content nobody refers to any more is left alone.
+func SetBlobStatus(ctx context.Context, hash, status string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+	// EVALSHA <sha> 1 blob:<sha256> status clean
+	return classify(setIfExistsScript.Run(ctx, redisClient, []string{blobKey(hash)}, "status", status).Err())
+}
+
+// BlobStatus returns the scan verdict of a content, empty if it was not
+// scanned yet
+func BlobStatus(ctx context.Context, hash string) (string, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: HGET key field
+	// HGET blob:<sha256> status
+	status, err := redisClient.HGet(ctx, blobKey(hash), "status").Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", classify(err)
+	}
+	return status, nil
+}
@@ -0,0 +1,138 @@
+package redisrepo
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"testing"
+
+	"Krowka/model"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestChargeBlob(t *testing.T) {
+	useClient(t, miniredis.RunT(t).Addr())
+	ctx := context.Background()
+
+	usage := func() *model.StorageUsage {
+		t.Helper()
+		u, err := GetStorageUsage(ctx, "alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	// the same content sent twice counts once
+	for i := 0; i < 2; i++ {
+		if err := ChargeBlob(ctx, "alice", "h1", 60, 100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u := usage(); u.UsedBytes != 60 || u.Files != 1 {
+		t.Errorf("after charging twice: %+v", u)
+	}
+	if err := ChargeBlob(ctx, "alice", "h2", 50, 100); !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("over quota: %v", err)
+	}
+	// a copy the user already stores fits whatever the quota
+	if err := ChargeBlob(ctx, "alice", "h1", 60, 10); err != nil {
+		t.Errorf("known content over quota: %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := UnchargeBlob(ctx, "alice", "h1", 60); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if u := usage(); u.UsedBytes != 60 || u.Files != 1 {
+		t.Errorf("with one attachment left: %+v", u)
+	}
+	if err := UnchargeBlob(ctx, "alice", "h1", 60); err != nil {
+		t.Fatal(err)
+	}
+	if u := usage(); u.UsedBytes != 0 || u.Files != 0 {
+		t.Errorf("after the last attachment: %+v", u)
+	}
+}
+
+func TestBlobRefs(t *testing.T) {
+	useClient(t, miniredis.RunT(t).Addr())
+	ctx := context.Background()
+
+	for want := int64(1); want <= 2; want++ {
+		if refs, err := AddBlobRef(ctx, "h1", 10); err != nil || refs != want {
+			t.Fatalf("AddBlobRef = %d, %v, want %d", refs, err, want)
+		}
+	}
+	if refs, err := ReleaseBlobRef(ctx, "h1"); err != nil || refs != 1 {
+		t.Errorf("first release = %d, %v", refs, err)
+	}
+	if refs, err := BlobRefs(ctx, "h1"); err != nil || refs != 1 {
+		t.Errorf("BlobRefs = %d, %v", refs, err)
+	}
+	if refs, err := ReleaseBlobRef(ctx, "h1"); err != nil || refs != 0 {
+		t.Errorf("last release = %d, %v", refs, err)
+	}
+	if refs, err := BlobRefs(ctx, "h1"); err != nil || refs != 0 {
+		t.Errorf("forgotten content has %d refs, %v", refs, err)
+	}
+	// a stray release does not go negative
+	if refs, err := ReleaseBlobRef(ctx, "h1"); err != nil || refs != 0 {
+		t.Errorf("stray release = %d, %v", refs, err)
+	}
+	if refs, _ := AddBlobRef(ctx, "h1", 10); refs != 1 {
+		t.Errorf("content stored again has %d refs", refs)
+	}
+
+	// the verdict goes with the content
+	if err := SetBlobStatus(ctx, "h1", model.ScanClean); err != nil {
+		t.Fatal(err)
+	}
+	if status, err := BlobStatus(ctx, "h1"); err != nil || status != model.ScanClean {
+		t.Errorf("BlobStatus = %q, %v", status, err)
+	}
+	ReleaseBlobRef(ctx, "h1")
+	if status, err := BlobStatus(ctx, "h1"); err != nil || status != "" {
+		t.Errorf("forgotten content kept its verdict %q, %v", status, err)
+	}
+	if err := SetBlobStatus(ctx, "h1", model.ScanClean); err != nil {
+		t.Fatal(err)
+	}
+	if refs, _ := BlobRefs(ctx, "h1"); refs != 0 {
+		t.Errorf("verdict revived the content with %d refs", refs)
+	}
+}
+
+func TestEachAttachment(t *testing.T) {
+	useClient(t, miniredis.RunT(t).Addr())
+	ctx := context.Background()
+
+	for _, id := range []string{"a1", "a2", "a3"} {
+		if err := SaveAttachment(ctx, &model.Attachment{ID: id, Owner: "alice", Peer: "bob", Blob: "h" + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := CreateUpload(ctx, &model.Upload{ID: "u1", Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	err := EachAttachment(ctx, func(a *model.Attachment) error {
+		if a.Blob != "h"+a.ID {
+			t.Errorf("attachment %s has blob %q", a.ID, a.Blob)
+		}
+		ids = append(ids, a.ID)
+		return nil
+	})
+	sort.Strings(ids)
+	if err != nil || len(ids) != 3 || ids[0] != "a1" || ids[2] != "a3" {
+		t.Errorf("EachAttachment saw %v, %v", ids, err)
+	}
+
+	stop := errors.New("stop")
+	if err := EachAttachment(ctx, func(*model.Attachment) error { return stop }); !errors.Is(err, stop) {
+		t.Errorf("did not stop: %v", err)
+	}
+}
@@ -2,32 +2,154 @@ package redisrepo
 
 import (
 	"context"
-	"log"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
 	"os"
+	"strings"
+	"time"
+
+	"Krowka/pkg/config"
 
 	"github.com/go-redis/redis/v8"
 )
 
-var redisClient *redis.Client
+var redisClient redis.UniversalClient
 
-func InitialiseRedis() *redis.Client {
-	conn := redis.NewClient(&redis.Options{
-		Addr:     os.Getenv("REDIS_CONNECTION_STRING"),
-		Password: os.Getenv("REDIS_PASSWORD"),
-		DB:       0,
-	})
+// startup retries double from initialBackoff up to maxBackoff
+const (
+	initialBackoff = 250 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+)
 
-	// checking if redis is connected
-	pong, err := conn.Ping(context.Background()).Result()
+// InitialiseRedis connects to the standalone server, sentinel-managed
+// master or cluster described by cfg. It keeps retrying the first ping
+// with backoff until cfg.ConnectTimeout passes or ctx is cancelled.
+func InitialiseRedis(ctx context.Context, cfg config.Redis) (redis.UniversalClient, error) {
+	opts, err := universalOptions(cfg)
 	if err != nil {
-		log.Fatal("Redis Connection Failed",
-			err)
+		return nil, err
+	}
+
+	var conn redis.UniversalClient
+	switch cfg.Mode {
+	case "sentinel":
+		conn = redis.NewFailoverClient(opts.Failover())
+	case "cluster":
+		conn = redis.NewClusterClient(opts.Cluster())
+	default:
+		conn = redis.NewClient(opts.Simple())
+	}
+	conn.AddHook(instrumentHook{})
+	operationTimeout = cfg.OperationTimeout
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+	defer cancel()
+
+	// checking if redis is connected
+	backoff := initialBackoff
+	for attempt := 1; ; attempt++ {
+		pong, err := conn.Ping(ctx).Result()
+		if err == nil {
+			slog.Info("redis successfully connected", "mode", cfg.Mode, "addrs", opts.Addrs, "ping", pong)
+			redisClient = conn
+			return redisClient, nil
+		}
+
+		slog.Warn("redis not reachable, retrying",
+			"mode", cfg.Mode, "addrs", opts.Addrs, "attempt", attempt, "retry_in", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			conn.Close()
+			return nil, fmt.Errorf("connecting to redis %v after %d attempts: %w", opts.Addrs, attempt, err)
+		}
+
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+// universalOptions translates the config into go-redis options. In
+// standalone mode Addr may be a redis:// or rediss:// URL, settings given
+// in the URL win over the separate config keys.
+func universalOptions(cfg config.Redis) (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{
+		Addrs:            cfg.Addrs,
+		DB:               cfg.DB,
+		Username:         cfg.Username,
+		Password:         cfg.Password,
+		SentinelPassword: cfg.SentinelPassword,
+		MasterName:       cfg.MasterName,
+		PoolSize:         cfg.PoolSize,
+		MinIdleConns:     cfg.MinIdleConns,
+		DialTimeout:      cfg.DialTimeout,
+		ReadTimeout:      cfg.ReadTimeout,
+		WriteTimeout:     cfg.WriteTimeout,
+		PoolTimeout:      cfg.PoolTimeout,
 	}
 
-	log.Println("Redis Successfully Connected.",
-		"Ping", pong)
+	if strings.Contains(cfg.Addr, "://") {
+		u, err := redis.ParseURL(cfg.Addr)
+		if err != nil {
+			// the URL may carry a password, don't echo it
+			return nil, errors.New("redis.addr is not a valid redis:// or rediss:// URL")
+		}
+		opts.Addrs = []string{u.Addr}
+		if u.Username != "" {
+			opts.Username = u.Username
+		}
+		if u.Password != "" {
+			opts.Password = u.Password
+		}
+		if u.DB != 0 {
+			opts.DB = u.DB
+		}
+		opts.TLSConfig = u.TLSConfig
+	} else if len(opts.Addrs) == 0 {
+		opts.Addrs = []string{cfg.Addr}
+	}
 
-	redisClient = conn
+	if opts.TLSConfig == nil && cfg.TLS.Enabled {
+		opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if opts.TLSConfig != nil {
+		if err := applyTLS(opts.TLSConfig, cfg.TLS); err != nil {
+			return nil, err
+		}
+	}
+
+	return opts, nil
+}
+
+// applyTLS loads the CA bundle and client certificate into c
+func applyTLS(c *tls.Config, cfg config.RedisTLS) error {
+	if cfg.ServerName != "" {
+		c.ServerName = cfg.ServerName
+	}
+	c.InsecureSkipVerify = cfg.InsecureSkipVerify
+
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("reading redis CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in redis CA file %s", cfg.CAFile)
+		}
+		c.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("loading redis client certificate: %w", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
 
-	return redisClient
+	return nil
 }
@@ -0,0 +1,194 @@
+package redisrepo
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"Krowka/pkg/password"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	userStatusActive = "active"
+
+	credentialsMigration = "credentials"
+)
+
+// credentialsMigrated caches the migration marker once it has been seen,
+// the marker is never removed so there is no need to ask redis again.
+var credentialsMigrated atomic.Bool
+
+type credentials struct {
+	Hash      string
+	Algorithm string
+	CreatedAt int64
+	UpdatedAt int64
+	Status    string
+}
+
+// getCredentials reads the user:<username> hash. Until the credentials
+// migration has run it falls back to the legacy <username> string key.
+func getCredentials(ctx context.Context, username string) (*credentials, error) {
+	// redis-cli
+	// SYNTAX: HGETALL key
+	// HGETALL user:username
+	fields, err := redisClient.HGetAll(ctx, userKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(fields) > 0 {
+		c := &credentials{
+			Hash:      fields["hash"],
+			Algorithm: fields["algorithm"],
+			Status:    fields["status"],
+		}
+		if c.Algorithm == "" {
+			c.Algorithm = password.DetectAlgorithm(c.Hash)
+		}
+		c.CreatedAt, _ = strconv.ParseInt(fields["created_at"], 10, 64)
+		c.UpdatedAt, _ = strconv.ParseInt(fields["updated_at"], 10, 64)
+		return c, nil
+	}
+
+	if isCredentialsMigrated(ctx) {
+		return nil, redis.Nil
+	}
+
+	// legacy layout: GET username
+	p, err := redisClient.Get(ctx, username).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	return &credentials{
+		Hash:      p,
+		Algorithm: password.DetectAlgorithm(p),
+		Status:    userStatusActive,
+	}, nil
+}
+
+// setCredentials writes the password hash for username, keeping created_at
+// if the user already has one.
+func setCredentials(ctx context.Context, username, hash, algorithm string) error {
+	now := time.Now().Unix()
+
+	// redis-cli
+	// SYNTAX: HSET key field value [field value ...]
+	// HSET user:username hash <hash> algorithm argon2id updated_at 1661360942 status active
+	// HSETNX user:username created_at 1661360942
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, userKey(username),
+			"hash", hash,
+			"algorithm", algorithm,
+			"updated_at", now,
+			"status", userStatusActive,
+		)
+		pipe.HSetNX(ctx, userKey(username), "created_at", now)
+		return nil
+	})
+
+	return err
+}
+
+func isCredentialsMigrated(ctx context.Context) bool {
+	if credentialsMigrated.Load() {
+		return true
+	}
+
+	// redis-cli
+	// SYNTAX: EXISTS key
+	// EXISTS migration:credentials
+	if redisClient.Exists(ctx, migrationKey(credentialsMigration)).Val() == 1 {
+		credentialsMigrated.Store(true)
+		return true
+	}
+
+	return false
+}
+
+// MigrateCredentials moves passwords stored at the bare <username> key into
+// the user:<username> hash. It runs once; afterwards a marker key is set and
+// IsUserAuthentic stops looking at the legacy layout.
+func MigrateCredentials(ctx context.Context) error {
+	if isCredentialsMigrated(ctx) {
+		return nil
+	}
+
+	// redis-cli
+	// SYNTAX: SMEMBERS key
+	// SMEMBERS users
+	users, err := redisClient.SMembers(ctx, userSetKey()).Result()
+	if err != nil {
+		slog.ErrorContext(ctx, "error while listing users for credentials migration", "error", err)
+		return err
+	}
+
+	migrated := 0
+	for _, username := range users {
+		// only plain string keys can hold a legacy password, anything else
+		// is a system key that happens to share the username
+		if redisClient.Type(ctx, username).Val() != "string" {
+			continue
+		}
+
+		p, err := redisClient.Get(ctx, username).Result()
+		if err != nil {
+			slog.ErrorContext(ctx, "error while reading legacy credentials", "username", username, "error", err)
+			return err
+		}
+
+		// user:<username> and <username> live in different cluster slots,
+		// so the copy and the delete are separate steps. Each is safe to
+		// repeat: a run cut short between them finds the hash already
+		// written and only removes the legacy key.
+		if hash, _ := redisClient.HGet(ctx, userKey(username), "hash").Result(); hash == "" {
+			now := time.Now().Unix()
+
+			// redis-cli
+			// SYNTAX: HSET key field value [field value ...]
+			// HSET user:username hash <hash> algorithm bcrypt created_at 1661360942 updated_at 1661360942 status active
+			err = redisClient.HSet(ctx, userKey(username),
+				"hash", p,
+				"algorithm", password.DetectAlgorithm(p),
+				"created_at", now,
+				"updated_at", now,
+				"status", userStatusActive,
+			).Err()
+			if err != nil {
+				slog.ErrorContext(ctx, "error while migrating credentials", "username", username, "error", err)
+				return err
+			}
+			migrated++
+		} else if hash != p {
+			// the password was changed since, the legacy key is stale
+			slog.InfoContext(ctx, "dropping stale legacy credentials", "username", username)
+		}
+
+		// redis-cli
+		// SYNTAX: DEL key
+		// DEL username
+		if err := redisClient.Del(ctx, username).Err(); err != nil {
+			slog.ErrorContext(ctx, "error while removing legacy credentials", "username", username, "error", err)
+			return err
+		}
+	}
+
+	// redis-cli
+	// SYNTAX: SET key value
+	// SET migration:credentials 1661360942
+	err = redisClient.Set(ctx, migrationKey(credentialsMigration), time.Now().Unix(), 0).Err()
+	if err != nil {
+		slog.ErrorContext(ctx, "error while marking credentials migration", "error", err)
+		return err
+	}
+
+	credentialsMigrated.Store(true)
+	slog.InfoContext(ctx, "credentials migration complete", "migrated_users", migrated)
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package redisrepo
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestMigrateCredentials(t *testing.T) {
+	mr := miniredis.RunT(t)
+	useClient(t, mr.Addr())
+	credentialsMigrated.Store(false)
+	t.Cleanup(func() { credentialsMigrated.Store(false) })
+	ctx := context.Background()
+
+	mr.SAdd(userSetKey(), "sun", "moon", "star")
+	mr.Set("sun", "$2a$10$legacy-sun")
+	// moon was copied by a run that stopped before removing the old key
+	mr.Set("moon", "$2a$10$legacy-moon")
+	mr.HSet(userKey("moon"), "hash", "$2a$10$legacy-moon", "status", userStatusActive)
+	// star has no legacy key
+	mr.HSet(userKey("star"), "hash", "$argon2id$star", "status", userStatusActive)
+
+	if err := MigrateCredentials(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"sun", "moon"} {
+		if mr.Exists(name) {
+			t.Errorf("legacy key %s kept", name)
+		}
+	}
+	if got := mr.HGet(userKey("sun"), "hash"); got != "$2a$10$legacy-sun" {
+		t.Errorf("sun hash %q", got)
+	}
+	if got := mr.HGet(userKey("sun"), "algorithm"); got != "bcrypt" {
+		t.Errorf("sun algorithm %q", got)
+	}
+	if got := mr.HGet(userKey("star"), "hash"); got != "$argon2id$star" {
+		t.Errorf("star hash %q", got)
+	}
+	if !mr.Exists(migrationKey(credentialsMigration)) {
+		t.Error("migration not marked")
+	}
+
+	c, err := getCredentials(ctx, "sun")
+	if err != nil || c.Hash != "$2a$10$legacy-sun" {
+		t.Errorf("got %+v, %v", c, err)
+	}
+}
@@ -3,7 +3,8 @@ package redisrepo
 import (
 	"Krowka/model"
 	"encoding/json"
-	"log"
+	"fmt"
+	"log/slog"
 
 	"github.com/go-redis/redis/v8"
 )
@@ -37,7 +38,7 @@ func Deserialise(res interface{}) []Document {
 			return docs
 		}
 	default:
-		log.Printf("different response type otherthan []interface{}. type: %T", res)
+		slog.Warn("different response type otherthan []interface{}", "type", fmt.Sprintf("%T", res))
 		return nil
 	}
 
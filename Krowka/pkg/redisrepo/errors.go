@@ -0,0 +1,62 @@
+package redisrepo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var (
+	// ErrNotFound is returned when the requested key or member is missing
+	ErrNotFound = errors.New("not found")
+	// ErrTimeout is returned when redis did not answer before the
+	// operation deadline
+	ErrTimeout = errors.New("redis timeout")
+	// ErrConflict is returned when creating something that already exists
+	ErrConflict = errors.New("already exists")
+	// ErrInvalidCredentials is returned for an unknown user or a wrong
+	// password, without telling the two apart
+	ErrInvalidCredentials = errors.New("invalid username or password")
+	// ErrQuotaExceeded is returned when a user has no storage left
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	// ErrUploadChanged is returned when a chunked upload moved past the
+	// offset of a chunk, or is already being completed
+	ErrUploadChanged = errors.New("upload changed meanwhile")
+)
+
+// operationTimeout bounds every exported repo function, on top of any
+// deadline the caller's context already has
+var operationTimeout = 3 * time.Second
+
+// withTimeout derives the context a single repo operation runs under
+func withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, operationTimeout)
+}
+
+// classify maps go-redis and context errors onto the repo's typed errors.
+// The original error stays in the chain for logging.
+func classify(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, redis.Nil) {
+		return ErrNotFound
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return fmt.Errorf("%w: %w", ErrTimeout, err)
+	}
+
+	// context.Canceled means the client went away, callers check for it
+	return err
+}
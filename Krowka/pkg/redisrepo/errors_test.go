@@ -0,0 +1,82 @@
+package redisrepo
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// useClient points the package at addr for the duration of the test
+func useClient(t *testing.T, addr string) {
+	t.Helper()
+	prev := redisClient
+	redisClient = redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+	t.Cleanup(func() {
+		redisClient.Close()
+		redisClient = prev
+	})
+}
+
+func TestRegisterConflict(t *testing.T) {
+	useClient(t, miniredis.RunT(t).Addr())
+	ctx := context.Background()
+
+	if err := RegisterNewUser(ctx, "alice", "correct horse"); err != nil {
+		t.Fatal("register", err)
+	}
+	if err := RegisterNewUser(ctx, "alice", "other password"); !errors.Is(err, ErrConflict) {
+		t.Fatal("expected ErrConflict, got", err)
+	}
+
+	// the second attempt must not have replaced the password
+	if err := IsUserAuthentic(ctx, "alice", "correct horse"); err != nil {
+		t.Error("original password rejected", err)
+	}
+	if err := IsUserAuthentic(ctx, "bob", "whatever"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Error("expected ErrInvalidCredentials for unknown user, got", err)
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	// a server that accepts connections but never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	useClient(t, ln.Addr().String())
+	prev := operationTimeout
+	operationTimeout = 100 * time.Millisecond
+	defer func() { operationTimeout = prev }()
+
+	start := time.Now()
+	_, err = IsUserExist(context.Background(), "alice")
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatal("expected ErrTimeout, got", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("operation timeout not applied", time.Since(start))
+	}
+
+	// a cancelled caller is not reported as a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := IsUserExist(ctx, "alice"); !errors.Is(err, context.Canceled) || errors.Is(err, ErrTimeout) {
+		t.Error("expected context.Canceled, got", err)
+	}
+}
@@ -0,0 +1,71 @@
+package redisrepo
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+)
+
+// event is what goes over the events channel, Frame is written as is to
+// the WebSocket connections of User
+type event struct {
+	User  string          `json:"user"`
+	Frame json.RawMessage `json:"frame"`
+}
+
+// PublishEvent sends frame, encoded as JSON, to every connection of
+// username on any WebSocket server. Users that are offline miss it.
+func PublishEvent(ctx context.Context, username string, frame interface{}) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	by, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+	msg, err := json.Marshal(event{User: username, Frame: by})
+	if err != nil {
+		return err
+	}
+
+	// redis-cli
+	// SYNTAX: PUBLISH channel message
+	// PUBLISH events '{"user":"sun","frame":{"type":"attachment_rejected",...}}'
+	return classify(redisClient.Publish(ctx, eventsChannel(), msg).Err())
+}
+
+// SubscribeEvents calls fn for every event published until ctx is done.
+// The subscription is re-established after connection errors, events sent
+// meanwhile are lost. It returns once subscribed or on failure to.
+func SubscribeEvents(ctx context.Context, fn func(username string, frame []byte)) error {
+	// redis-cli
+	// SYNTAX: SUBSCRIBE channel
+	// SUBSCRIBE events
+	sub := redisClient.Subscribe(ctx, eventsChannel())
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return classify(err)
+	}
+
+	go func() {
+		defer sub.Close()
+		ch := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				var e event
+				if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+					slog.WarnContext(ctx, "ignoring malformed event", "error", err)
+					continue
+				}
+				fn(e.User, e.Frame)
+			}
+		}
+	}()
+	return nil
+}
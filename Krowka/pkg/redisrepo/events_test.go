@@ -0,0 +1,38 @@
+package redisrepo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestEvents(t *testing.T) {
+	useClient(t, miniredis.RunT(t).Addr())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type received struct {
+		user, frame string
+	}
+	got := make(chan received, 1)
+	err := SubscribeEvents(ctx, func(user string, frame []byte) {
+		got <- received{user, string(frame)}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := PublishEvent(ctx, "alice", map[string]string{"type": "ping"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-got:
+		if e.user != "alice" || e.frame != `{"type":"ping"}` {
+			t.Errorf("received %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event not received")
+	}
+}
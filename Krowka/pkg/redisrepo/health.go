@@ -0,0 +1,69 @@
+package redisrepo
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// requiredModules are the redis modules the chat storage depends on,
+// with the name MODULE LIST reports for them
+var requiredModules = []struct {
+	name   string
+	module string
+}{
+	{"rejson", "RedisJSON"},
+	{"search", "RediSearch"},
+}
+
+// Ping checks that redis answers
+func Ping(ctx context.Context) error {
+	return redisClient.Ping(ctx).Err()
+}
+
+// CheckModules checks that RedisJSON and RediSearch are loaded
+func CheckModules(ctx context.Context) error {
+	// redis-cli
+	// SYNTAX: MODULE LIST
+	res, err := redisClient.Do(ctx, "MODULE", "LIST").Result()
+	if err != nil {
+		return err
+	}
+
+	loaded := map[string]bool{}
+	modules, _ := res.([]interface{})
+	for _, m := range modules {
+		// every module is a flat list: name <name> ver <version> ...
+		fields, _ := m.([]interface{})
+		for i := 0; i+1 < len(fields); i += 2 {
+			if k, _ := fields[i].(string); k == "name" {
+				name, _ := fields[i+1].(string)
+				loaded[strings.ToLower(name)] = true
+			}
+		}
+	}
+
+	var missing []string
+	for _, m := range requiredModules {
+		if !loaded[m.name] {
+			missing = append(missing, m.module)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing redis modules: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// CheckChatIndex checks that the idx#chats search index exists
+func CheckChatIndex(ctx context.Context) error {
+	// redis-cli
+	// SYNTAX: FT.INFO index
+	// FT.INFO idx#chats
+	if err := redisClient.Do(ctx, "FT.INFO", chatIndex()).Err(); err != nil {
+		return fmt.Errorf("%s: %w", chatIndex(), err)
+	}
+
+	return nil
+}
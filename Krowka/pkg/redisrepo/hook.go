@@ -0,0 +1,90 @@
+package redisrepo
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"Krowka/pkg/metrics"
+	"Krowka/pkg/tracing"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type startKey struct{}
+
+// instrumentHook times every command, counts failures, records a span
+// named after the command and logs it at debug level with the caller's
+// request or connection ID
+type instrumentHook struct{}
+
+func (instrumentHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	ctx, _ = startSpan(ctx, cmd.FullName(), attribute.String("db.operation.name", cmd.FullName()))
+	return context.WithValue(ctx, startKey{}, time.Now()), nil
+}
+
+func (instrumentHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	observe(ctx, cmd.Name(), cmd.Err())
+	endSpan(ctx, cmd.Err())
+	return nil
+}
+
+func (instrumentHook) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	names := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		names[i] = cmd.FullName()
+	}
+	ctx, _ = startSpan(ctx, "pipeline",
+		attribute.StringSlice("db.redis.commands", names),
+		attribute.Int("db.operation.batch.size", len(cmds)))
+	return context.WithValue(ctx, startKey{}, time.Now()), nil
+}
+
+func (instrumentHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var firstErr error
+	for _, cmd := range cmds {
+		observe(ctx, cmd.Name(), cmd.Err())
+		if err := cmd.Err(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	endSpan(ctx, firstErr)
+	return nil
+}
+
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "redis "+name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemRedis),
+		trace.WithAttributes(attrs...))
+}
+
+func endSpan(ctx context.Context, err error) {
+	span := trace.SpanFromContext(ctx)
+	if err != nil && !errors.Is(err, redis.Nil) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func observe(ctx context.Context, name string, err error) {
+	var elapsed time.Duration
+	if start, ok := ctx.Value(startKey{}).(time.Time); ok {
+		elapsed = time.Since(start)
+		metrics.RedisCommandDuration.WithLabelValues(name).Observe(elapsed.Seconds())
+	}
+
+	if err != nil && !errors.Is(err, redis.Nil) {
+		metrics.RedisErrors.WithLabelValues(name).Inc()
+		slog.DebugContext(ctx, "redis command", "command", name, "duration", elapsed, "error", err)
+		return
+	}
+
+	slog.DebugContext(ctx, "redis command", "command", name, "duration", elapsed)
+}
@@ -1,6 +1,8 @@
 package redisrepo
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"time"
 )
@@ -13,8 +15,25 @@ func sessionKey(client string) string {
 	return "session#" + client
 }
 
-func chatKey() string {
-	return fmt.Sprintf("chat#%d", time.Now().UnixMilli())
+// hashTag makes Redis Cluster hash only s, so keys sharing a tag land in
+// the same slot
+func hashTag(s string) string {
+	return "{" + s + "}"
+}
+
+// conversationTag is the same for both directions of a conversation
+func conversationTag(user1, user2 string) string {
+	if user2 < user1 {
+		user1, user2 = user2, user1
+	}
+	return hashTag(user1 + ":" + user2)
+}
+
+// chatKey stores one chat at chat#{<user1>:<user2>}#<ms>, every chat of a
+// conversation shares a cluster slot. The chat# prefix is what the search
+// index covers.
+func chatKey(from, to string) string {
+	return fmt.Sprintf("chat#%s#%d", conversationTag(from, to), time.Now().UnixMilli())
 }
 
 func chatIndex() string {
@@ -29,3 +48,82 @@ func contactListZKey(username string) string {
 func profileKey(username string) string {
 	return "profile:" + username
 }
+
+// userKey stores credentials hash at key user:<username>
+func userKey(username string) string {
+	return "user:" + username
+}
+
+// migrationKey marks a one-shot data migration as applied
+func migrationKey(name string) string {
+	return "migration:" + name
+}
+
+// attachmentKey stores attachment metadata at attachment:<id>
+func attachmentKey(id string) string {
+	return "attachment:" + id
+}
+
+// mediaKey lists the attachments sent in a conversation at
+// media:{<user1>:<user2>}, scored by the time they were sent
+func mediaKey(user1, user2 string) string {
+	return "media:" + conversationTag(user1, user2)
+}
+
+// storageKey tracks the bytes and number of files a user stores at
+// storage:<username>, with a blob:<sha256> field counting the user's
+// attachments of each content
+func storageKey(username string) string {
+	return "storage:" + username
+}
+
+// blobKey counts the attachments sharing the content of SHA-256 hash at
+// blob:<hash>
+func blobKey(hash string) string {
+	return "blob:" + hash
+}
+
+// uploadKey stores a chunked upload at upload:{<id>}, the list of its
+// chunks at upload:{<id>}:chunks is in the same cluster slot
+func uploadKey(id string) string {
+	return "upload:" + hashTag(id)
+}
+
+func uploadChunksKey(id string) string {
+	return uploadKey(id) + ":chunks"
+}
+
+// uploadExpiryKey scores unfinished uploads by when they expire
+func uploadExpiryKey() string {
+	return "uploads:expiry"
+}
+
+// lockKey holds the token of whoever runs the job name, see TryLock
+func lockKey(name string) string {
+	return "lock:" + name
+}
+
+// scanQueueKey scores attachments waiting for a malware scan by when they
+// were queued
+func scanQueueKey() string {
+	return "scans:pending"
+}
+
+// eventsChannel carries frames for the WebSocket clients of one user,
+// published by any server
+func eventsChannel() string {
+	return "events"
+}
+
+// previewKey caches the preview of a linked page at preview:<sha256 of
+// the URL>, keeping long URLs out of key names
+func previewKey(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return "preview:" + hex.EncodeToString(sum[:])
+}
+
+// rateLimitKey holds the token bucket name, e.g. ratelimit:user:<username>,
+// as the fields tokens and ts
+func rateLimitKey(name string) string {
+	return "ratelimit:" + name
+}
@@ -0,0 +1,120 @@
+package redisrepo
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// unlockScript deletes KEYS[1] only while it still holds the token
+// ARGV[1], a lock that expired and was taken by someone else is left alone
+var unlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// extendScript pushes the expiry of KEYS[1] out to ARGV[2] milliseconds
+// only while it still holds the token ARGV[1]
+var extendScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// TryLock takes the lock name for at most ttl, so that one of several
+// servers runs a periodic job. It returns ErrConflict while another
+// process holds it. unlock gives the lock back early.
+func TryLock(ctx context.Context, name string, ttl time.Duration) (unlock func(), err error) {
+	token, err := takeLock(ctx, name, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return func() { releaseLock(ctx, name, token) }, nil
+}
+
+// takeLock sets the lock name to a new token unless it is taken
+func takeLock(ctx context.Context, name string, ttl time.Duration) (string, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	token := hex.EncodeToString(b)
+
+	// redis-cli
+	// SYNTAX: SET key value NX PX milliseconds
+	// SET lock:gc <token> NX PX 3600000
+	ok, err := redisClient.SetNX(ctx, lockKey(name), token, ttl).Result()
+	if err != nil {
+		return "", classify(err)
+	}
+	if !ok {
+		return "", ErrConflict
+	}
+	return token, nil
+}
+
+// releaseLock deletes the lock name if it still holds token
+func releaseLock(ctx context.Context, name, token string) {
+	ctx, cancel := withTimeout(context.WithoutCancel(ctx))
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+	// EVALSHA <sha> 1 lock:gc <token>
+	if err := unlockScript.Run(ctx, redisClient, []string{lockKey(name)}, token).Err(); err != nil {
+		slog.WarnContext(ctx, "error while releasing lock", "lock", name, "error", err)
+	}
+}
+
+// HoldLock takes the lock name like TryLock, then keeps pushing its expiry
+// out to ttl from now until unlock, so that work of unknown length keeps
+// it while ttl still bounds how long a crashed server holds it.
+func HoldLock(ctx context.Context, name string, ttl time.Duration) (unlock func(), err error) {
+	token, err := takeLock(ctx, name, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx := context.WithoutCancel(ctx)
+		t := time.NewTicker(ttl / 3)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+			}
+			// redis-cli
+			// SYNTAX: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+			// EVALSHA <sha> 1 lock:blob:<sha256> <token> 30000
+			ctx, cancel := withTimeout(ctx)
+			held, err := extendScript.Run(ctx, redisClient, []string{lockKey(name)}, token, ttl.Milliseconds()).Int()
+			cancel()
+			if err == nil && held == 0 {
+				slog.WarnContext(ctx, "lock expired while held", "lock", name)
+				return
+			}
+			if err != nil {
+				slog.WarnContext(ctx, "error while extending lock", "lock", name, "error", err)
+			}
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		releaseLock(ctx, name, token)
+	}, nil
+}
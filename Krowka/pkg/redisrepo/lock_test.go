@@ -0,0 +1,44 @@
+package redisrepo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestHoldLock(t *testing.T) {
+	m := miniredis.RunT(t)
+	useClient(t, m.Addr())
+	ctx := context.Background()
+
+	unlock, err := HoldLock(ctx, "blob:x", 300*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TryLock(ctx, "blob:x", time.Minute); !errors.Is(err, ErrConflict) {
+		t.Errorf("second holder: %v", err)
+	}
+
+	// the lock outlives its ttl while held
+	m.FastForward(250 * time.Millisecond)
+	deadline := time.Now().Add(5 * time.Second)
+	for m.TTL(lockKey("blob:x")) < 200*time.Millisecond {
+		if time.Now().After(deadline) {
+			t.Fatalf("lock not extended, ttl %v", m.TTL(lockKey("blob:x")))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	unlock()
+	if m.Exists(lockKey("blob:x")) {
+		t.Error("lock kept after unlock")
+	}
+	if unlock, err := TryLock(ctx, "blob:x", time.Minute); err != nil {
+		t.Errorf("lock not given back: %v", err)
+	} else {
+		unlock()
+	}
+}
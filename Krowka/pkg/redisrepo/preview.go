@@ -0,0 +1,46 @@
+package redisrepo
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"Krowka/model"
+)
+
+// SaveLinkPreview caches p for ttl. A preview without a title records a
+// page that has none, so that it is not fetched again meanwhile.
+func SaveLinkPreview(ctx context.Context, p *model.LinkPreview, ttl time.Duration) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	by, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	// redis-cli
+	// SYNTAX: SET key value EX seconds
+	// SET preview:<sha256> '{"url":"https://example.com","title":"Example"}' EX 86400
+	return classify(redisClient.Set(ctx, previewKey(p.URL), by, ttl).Err())
+}
+
+// GetLinkPreview returns the cached preview of url, ErrNotFound when there
+// is none
+func GetLinkPreview(ctx context.Context, url string) (*model.LinkPreview, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: GET key
+	// GET preview:<sha256>
+	by, err := redisClient.Get(ctx, previewKey(url)).Bytes()
+	if err != nil {
+		return nil, classify(err)
+	}
+	p := &model.LinkPreview{}
+	if err := json.Unmarshal(by, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
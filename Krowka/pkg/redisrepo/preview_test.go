@@ -0,0 +1,34 @@
+package redisrepo
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"Krowka/model"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestLinkPreview(t *testing.T) {
+	mr := miniredis.RunT(t)
+	useClient(t, mr.Addr())
+	ctx := context.Background()
+
+	if _, err := GetLinkPreview(ctx, "https://example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("uncached: %v", err)
+	}
+	p := &model.LinkPreview{URL: "https://example.com", Title: "Example", Image: "https://example.com/a.png"}
+	if err := SaveLinkPreview(ctx, p, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := GetLinkPreview(ctx, "https://example.com"); err != nil || *got != *p {
+		t.Errorf("cached: %+v, %v", got, err)
+	}
+
+	mr.FastForward(2 * time.Hour)
+	if _, err := GetLinkPreview(ctx, "https://example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expired: %v", err)
+	}
+}
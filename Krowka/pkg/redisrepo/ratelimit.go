@@ -0,0 +1,57 @@
+package redisrepo
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// takeTokenScript refills the bucket at KEYS[1], holding at most ARGV[2]
+// tokens, at ARGV[1] tokens per second up to the time ARGV[3] in
+// milliseconds, then takes a token if there is one. A missing bucket is
+// full, an idle one expires once it would be full again.
+var takeTokenScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(b[1]) or burst
+local ts = tonumber(b[2]) or now
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate / 1000)
+	ts = now
+end
+local taken = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	taken = 1
+end
+-- fixed point, tonumber does not read back the exponent tostring gives
+-- a nearly empty bucket
+redis.call('HSET', KEYS[1], 'tokens', string.format('%.6f', tokens), 'ts', string.format('%d', ts))
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return taken
+`)
+
+// TakeToken takes a token at now from the bucket name, shared by every
+// server, which holds burst tokens and refills at rate per second. It
+// reports false when the bucket is empty.
+func TakeToken(ctx context.Context, name string, rate float64, burst int, now time.Time) (bool, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// time for an empty bucket to fill up, plus a second
+	ttl := int64(math.Ceil(float64(burst)*1000/rate)) + 1000
+
+	// redis-cli
+	// SYNTAX: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+	// EVALSHA <sha> 1 ratelimit:user:sun 10 40 1661360942000 5000
+	taken, err := takeTokenScript.Run(ctx, redisClient, []string{rateLimitKey(name)},
+		rate, burst, now.UnixMilli(), ttl).Int()
+	if err != nil {
+		return false, classify(err)
+	}
+	return taken == 1, nil
+}
@@ -0,0 +1,73 @@
+package redisrepo
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestTakeToken(t *testing.T) {
+	mr := miniredis.RunT(t)
+	useClient(t, mr.Addr())
+	ctx := context.Background()
+	now := time.Now()
+
+	take := func(name string, at time.Time) bool {
+		t.Helper()
+		ok, err := TakeToken(ctx, name, 2, 3, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	// a full bucket lets a burst through, then nothing until it refills
+	for i := 0; i < 3; i++ {
+		if !take("user:sun", now) {
+			t.Fatalf("token %d refused", i)
+		}
+	}
+	if take("user:sun", now) {
+		t.Error("empty bucket gave a token")
+	}
+	if !take("user:moon", now) {
+		t.Error("buckets are not separate")
+	}
+	if !take("user:sun", now.Add(500*time.Millisecond)) || take("user:sun", now.Add(500*time.Millisecond)) {
+		t.Error("half a second at 2/s should refill one token")
+	}
+
+	// refilling stops at the burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !take("user:sun", later) {
+			t.Fatalf("token %d refused after a pause", i)
+		}
+	}
+	if take("user:sun", later) {
+		t.Error("bucket refilled past its burst")
+	}
+
+	if ttl := mr.TTL(rateLimitKey("user:sun")); ttl <= 0 || ttl > 3*time.Second {
+		t.Errorf("ttl = %s", ttl)
+	}
+}
+
+func TestTakeTokenSlowRefill(t *testing.T) {
+	useClient(t, miniredis.RunT(t).Addr())
+	ctx := context.Background()
+	now := time.Now()
+
+	// a few milliseconds at 0.01/s leave a tiny fraction of a token
+	for i := 0; i < 4; i++ {
+		ok, err := TakeToken(ctx, "user:sun", 0.01, 1, now.Add(time.Duration(i)*3*time.Millisecond))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != (i == 0) {
+			t.Errorf("take %d: %v", i, ok)
+		}
+	}
+}
@@ -3,121 +3,155 @@ package redisrepo
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
 	"Krowka/model"
+	"Krowka/pkg/metrics"
+	"Krowka/pkg/password"
 
 	"github.com/go-redis/redis/v8"
-	"golang.org/x/crypto/bcrypt"
 )
 
-func RegisterNewUser(username, password string) error {
-	// redis-cli
-	// SYNTAX: SET key value
-	// SET username password
+// RegisterNewUser stores a new user. It returns ErrConflict if the
+// username is already taken.
+func RegisterNewUser(ctx context.Context, username, pw string) error {
 	// Hash the password before storing
-	hashed, errHash := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashed, errHash := password.Default.Hash(pw)
 	if errHash != nil {
-		log.Println("error while hashing password", errHash)
+		slog.ErrorContext(ctx, "error while hashing password", "error", errHash)
 		return errHash
 	}
-	// register new username:password key-value pair (hashed)
-	err := redisClient.Set(context.Background(), username, string(hashed), 0).Err()
-	if err != nil {
-		log.Println("error while adding new user", err)
-		return err
-	}
 
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// claim the username first so two registrations can't overwrite each
+	// other's password
 	// redis-cli
 	// SYNTAX: SADD key value
 	// SADD users username
-	err = redisClient.SAdd(context.Background(), userSetKey(), username).Err()
+	added, err := redisClient.SAdd(ctx, userSetKey(), username).Result()
 	if err != nil {
-		log.Println("error while adding user in set", err)
+		slog.ErrorContext(ctx, "error while adding user in set", "username", username, "error", err)
+		return classify(err)
+	}
+	if added == 0 {
+		return ErrConflict
+	}
+
+	// register new user:<username> credentials hash
+	err = setCredentials(ctx, username, hashed, password.Default.Algorithm())
+	if err != nil {
+		slog.ErrorContext(ctx, "error while adding new user", "username", username, "error", err)
 		// redis-cli
-		// SYNTAX: DEL key
-		// DEL username
-		// drop the registered user
-		redisClient.Del(context.Background(), username)
+		// SYNTAX: SREM key value
+		// SREM users username
+		// release the username again
+		redisClient.SRem(context.WithoutCancel(ctx), userSetKey(), username)
 
-		return err
+		return classify(err)
 	}
 
 	return nil
 }
 
-func IsUserExist(username string) bool {
+func IsUserExist(ctx context.Context, username string) (bool, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
 	// redis-cli
 	// SYNTAX: SISMEMBER key value
 	// SISMEMBER users username
-	return redisClient.SIsMember(context.Background(), userSetKey(), username).Val()
+	ok, err := redisClient.SIsMember(ctx, userSetKey(), username).Result()
+	return ok, classify(err)
 }
 
-func IsUserAuthentic(username, password string) error {
-	// redis-cli
-	// SYNTAX: GET key
-	// GET username
-	p := redisClient.Get(context.Background(), username).Val()
+// IsUserAuthentic returns ErrInvalidCredentials for an unknown user or a
+// wrong password, and ErrTimeout if redis could not be asked.
+func IsUserAuthentic(ctx context.Context, username, pw string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
 
-	if p == "" {
-		return fmt.Errorf("invalid username or password")
+	c, err := getCredentials(ctx, username)
+	if err != nil {
+		if err = classify(err); errors.Is(err, ErrNotFound) {
+			return ErrInvalidCredentials
+		}
+		return err
+	}
+	if c.Hash == "" || c.Status != userStatusActive {
+		return ErrInvalidCredentials
 	}
 
-	// If stored value looks like bcrypt hash, compare with bcrypt
-	if strings.HasPrefix(p, "$2a$") || strings.HasPrefix(p, "$2b$") || strings.HasPrefix(p, "$2y$") {
-		if err := bcrypt.CompareHashAndPassword([]byte(p), []byte(password)); err != nil {
-			return fmt.Errorf("invalid username or password")
-		}
-		return nil
+	h, ok := password.ForAlgorithm(c.Algorithm)
+	if !ok {
+		slog.ErrorContext(ctx, "unknown password algorithm", "algorithm", c.Algorithm, "username", username)
+		return ErrInvalidCredentials
+	}
+
+	match, err := h.Verify(c.Hash, pw)
+	if err != nil || !match {
+		metrics.PasswordVerifyFailures.WithLabelValues(c.Algorithm).Inc()
+		return ErrInvalidCredentials
 	}
 
-	// Backward-compat: plaintext stored. If matches, migrate to bcrypt.
-	if strings.EqualFold(p, password) {
-		if hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err == nil {
-			_ = redisClient.Set(context.Background(), username, string(hashed), 0).Err()
+	// transparently upgrade bcrypt, plaintext and weaker argon2id hashes
+	if c.Algorithm != password.Default.Algorithm() || password.Default.NeedsRehash(c.Hash) {
+		if hashed, err := password.Default.Hash(pw); err == nil {
+			if err := setCredentials(ctx, username, hashed, password.Default.Algorithm()); err != nil {
+				slog.ErrorContext(ctx, "error while rehashing password", "username", username, "error", err)
+			}
 		}
-		return nil
 	}
 
-	return fmt.Errorf("invalid username or password")
+	return nil
 }
 
 // UpdateContactList add contact to username's contact list
 // if not present or update its timestamp as last contacted
-func UpdateContactList(username, contact string) error {
+func UpdateContactList(ctx context.Context, username, contact string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
 	zs := &redis.Z{Score: float64(time.Now().Unix()), Member: contact}
 
 	// redis-cli SCORE is always float or int
 	// SYNTAX: ZADD key SCORE MEMBER
 	// ZADD contacts:username 1661360942123 contact
-	err := redisClient.ZAdd(context.Background(),
+	err := redisClient.ZAdd(ctx,
 		contactListZKey(username),
 		zs,
 	).Err()
 
 	if err != nil {
-		log.Println("error while updating contact list. username: ",
-			username, "contact:", contact, err)
-		return err
+		slog.ErrorContext(ctx, "error while updating contact list",
+			"username", username, "contact", contact, "error", err)
+		return classify(err)
 	}
 
 	return nil
 }
 
-func CreateChat(c *model.Chat) (string, error) {
-	chatKey := chatKey()
-	fmt.Println("chat key", chatKey)
+func CreateChat(ctx context.Context, c *model.Chat) (string, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	chatKey := chatKey(c.From, c.To)
 
 	by, _ := json.Marshal(c)
 
 	// redis-cli
 	// SYNTAX: JSON.SET key $ json_in_string
-	// JSON.SET chat#1661360942123 $ '{"from": "sun", "to":"earth","message":"good morning!"}'
+	// JSON.SET chat#{earth:sun}#1661360942123 $ '{"from": "sun", "to":"earth","message":"good morning!"}'
 	res, err := redisClient.Do(
-		context.Background(),
+		ctx,
 		"JSON.SET",
 		chatKey,
 		"$",
@@ -125,28 +159,41 @@ func CreateChat(c *model.Chat) (string, error) {
 	).Result()
 
 	if err != nil {
-		log.Println("error while setting chat json", err)
-		return "", err
+		slog.ErrorContext(ctx, "error while setting chat json", "chat_id", chatKey, "error", err)
+		return "", classify(err)
 	}
 
-	log.Println("chat successfully set", res)
+	slog.DebugContext(ctx, "chat successfully set", "chat_id", chatKey, "result", res)
+
+	if len(c.Attachments) > 0 {
+		ids := make([]string, len(c.Attachments))
+		for i, a := range c.Attachments {
+			ids[i] = a.ID
+		}
+		if err := AddConversationMedia(ctx, c.From, c.To, c.Timestamp, ids...); err != nil {
+			slog.ErrorContext(ctx, "error while indexing chat attachments", "chat_id", chatKey, "error", err)
+		}
+	}
 
 	// add contacts to both user's contact list
-	err = UpdateContactList(c.From, c.To)
+	err = UpdateContactList(ctx, c.From, c.To)
 	if err != nil {
-		log.Println("error while updating contact list of", c.From)
+		slog.ErrorContext(ctx, "error while updating contact list", "username", c.From)
 	}
 
-	err = UpdateContactList(c.To, c.From)
+	err = UpdateContactList(ctx, c.To, c.From)
 	if err != nil {
-		log.Println("error while updating contact list of", c.To)
+		slog.ErrorContext(ctx, "error while updating contact list", "username", c.To)
 	}
 
 	return chatKey, nil
 }
 
-func CreateFetchChatBetweenIndex() {
-	res, err := redisClient.Do(context.Background(),
+func CreateFetchChatBetweenIndex(ctx context.Context) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	res, err := redisClient.Do(ctx,
 		"FT.CREATE",
 		chatIndex(),
 		"ON", "JSON",
@@ -156,17 +203,47 @@ func CreateFetchChatBetweenIndex() {
 		"$.timestamp", "AS", "timestamp", "NUMERIC", "SORTABLE",
 	).Result()
 
-	fmt.Println(res, err)
+	if err != nil {
+		// FT.CREATE fails with "Index already exists" on every restart
+		slog.InfoContext(ctx, "chat index not created", "index", chatIndex(), "reason", err)
+		return
+	}
+	slog.InfoContext(ctx, "chat index created", "index", chatIndex(), "result", res)
+}
+
+// escapeTag escapes what RediSearch would read as query syntax in a TAG
+// value, so that a name can only ever match itself
+func escapeTag(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
 }
 
-func FetchChatBetween(username1, username2, fromTS, toTS string) ([]model.Chat, error) {
+// FetchChatBetween returns the chats between username1 and username2 sent
+// from fromTS to toTS, which are numbers, -inf or +inf, newest first
+func FetchChatBetween(ctx context.Context, username1, username2, fromTS, toTS string) ([]model.Chat, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	for _, ts := range []string{fromTS, toTS} {
+		if v, err := strconv.ParseFloat(ts, 64); err != nil || math.IsNaN(v) {
+			return nil, fmt.Errorf("invalid timestamp %q", ts)
+		}
+	}
+	u1, u2 := escapeTag(username1), escapeTag(username2)
+
 	// redis-cli
 	// SYNTAX: FT.SEARCH index query
 	// FT.SEARCH idx#chats '@from:{user2|user1} @to:{user1|user2} @timestamp:[0 +inf] SORTBY timestamp DESC'
 	query := fmt.Sprintf("@from:{%s|%s} @to:{%s|%s} @timestamp:[%s %s]",
-		username1, username2, username1, username2, fromTS, toTS)
+		u1, u2, u1, u2, fromTS, toTS)
 
-	res, err := redisClient.Do(context.Background(),
+	res, err := redisClient.Do(ctx,
 		"FT.SEARCH",
 		chatIndex(),
 		query,
@@ -174,20 +251,30 @@ func FetchChatBetween(username1, username2, fromTS, toTS string) ([]model.Chat,
 	).Result()
 
 	if err != nil {
-		return nil, err
+		return nil, classify(err)
 	}
 
 	// deserialise redis data to map
 	data := Deserialise(res)
 
-	// deserialise data map to chat
+	// deserialise data map to chat, keeping only the two users' chats
+	// whatever the index matched
 	chats := DeserialiseChat(data)
-	return chats, nil
+	between := chats[:0]
+	for _, c := range chats {
+		if (c.From == username1 && c.To == username2) || (c.From == username2 && c.To == username1) {
+			between = append(between, c)
+		}
+	}
+	return between, nil
 }
 
 // FetchContactList of the user. It includes all the messages sent to and received by contact
 // It will return a sorted list by last activity with a contact
-func FetchContactList(username string) ([]model.ContactList, error) {
+func FetchContactList(ctx context.Context, username string) ([]model.ContactList, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
 	zRangeArg := redis.ZRangeArgs{
 		Key:   contactListZKey(username),
 		Start: 0,
@@ -198,12 +285,12 @@ func FetchContactList(username string) ([]model.ContactList, error) {
 	// redis-cli
 	// SYNTAX: ZRANGE key from_index to_index REV WITHSCORES
 	// ZRANGE contacts:username 0 -1 REV WITHSCORES
-	res, err := redisClient.ZRangeArgsWithScores(context.Background(), zRangeArg).Result()
+	res, err := redisClient.ZRangeArgsWithScores(ctx, zRangeArg).Result()
 
 	if err != nil {
-		log.Println("error while fetching contact list. username: ",
-			username, err)
-		return nil, err
+		slog.ErrorContext(ctx, "error while fetching contact list",
+			"username", username, "error", err)
+		return nil, classify(err)
 	}
 
 	contactList := DeserialiseContactList(res)
@@ -213,15 +300,21 @@ func FetchContactList(username string) ([]model.ContactList, error) {
 
 // Profile management
 
-func GetProfile(username string) (*model.Profile, error) {
+func GetProfile(ctx context.Context, username string) (*model.Profile, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
 	// Try to fetch JSON profile; if missing, return defaults
-	res, err := redisClient.Do(context.Background(),
+	res, err := redisClient.Do(ctx,
 		"JSON.GET",
 		profileKey(username),
 		"$",
 	).Result()
 
-	if err != nil || res == nil {
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, classify(err)
+	}
+	if res == nil {
 		// Return default profile
 		p := &model.Profile{Username: username}
 		return p, nil
@@ -238,33 +331,43 @@ func GetProfile(username string) (*model.Profile, error) {
 	return &p, nil
 }
 
-func SaveProfile(p *model.Profile) error {
+func SaveProfile(ctx context.Context, p *model.Profile) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
 	by, _ := json.Marshal(p)
-	_, err := redisClient.Do(context.Background(),
+	_, err := redisClient.Do(ctx,
 		"JSON.SET",
 		profileKey(p.Username),
 		"$",
 		string(by),
 	).Result()
-	return err
+	return classify(err)
 }
 
-func SetTwoFA(username string, enabled bool) error {
+func SetTwoFA(ctx context.Context, username string, enabled bool) error {
 	// Update only the twoFA field; if doc doesn't exist, create minimal
-	p, _ := GetProfile(username)
+	p, err := GetProfile(ctx, username)
+	if err != nil {
+		return err
+	}
 	p.TwoFA = enabled
-	return SaveProfile(p)
+	return SaveProfile(ctx, p)
 }
 
-func ChangePassword(username, oldPassword, newPassword string) error {
+func ChangePassword(ctx context.Context, username, oldPassword, newPassword string) error {
 	// Verify old password
-	if err := IsUserAuthentic(username, oldPassword); err != nil {
+	if err := IsUserAuthentic(ctx, username, oldPassword); err != nil {
 		return err
 	}
 	// Hash and set new password
-	hashed, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	hashed, err := password.Default.Hash(newPassword)
 	if err != nil {
 		return err
 	}
-	return redisClient.Set(context.Background(), username, string(hashed), 0).Err()
+
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	return classify(setCredentials(ctx, username, hashed, password.Default.Algorithm()))
 }
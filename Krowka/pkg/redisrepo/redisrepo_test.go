@@ -3,31 +3,47 @@ package redisrepo
 import (
 	"context"
 	"fmt"
+	"os"
 	"testing"
 	"time"
 
+	"Krowka/pkg/config"
+
 	"github.com/joho/godotenv"
 )
 
+var testConfig = config.Default()
+
 func init() {
 	godotenv.Load("../../.env")
+	// the tests sign nothing, the default JWT secret is fine
+	os.Setenv("KROWKA_DEV", "true")
+	if c, err := config.Load("", nil); err == nil {
+		testConfig = c
+	}
+	// fail fast instead of retrying for a minute when redis is missing
+	testConfig.Redis.ConnectTimeout = 5 * time.Second
 }
 
 func TestUpdateContactList(t *testing.T) {
-	InitialiseRedis()
+	if _, err := InitialiseRedis(context.Background(), testConfig.Redis); err != nil {
+		t.Fatal(err)
+	}
 	defer redisClient.Close()
 
 	for i := 4; i < 20; i++ {
-		UpdateContactList("user1", fmt.Sprintf("user%d", i))
+		UpdateContactList(context.Background(), "user1", fmt.Sprintf("user%d", i))
 		time.Sleep(time.Second * 2)
 	}
 }
 
 func TestFetchContactList(t *testing.T) {
-	InitialiseRedis()
+	if _, err := InitialiseRedis(context.Background(), testConfig.Redis); err != nil {
+		t.Fatal(err)
+	}
 	defer redisClient.Close()
 
-	res, err := FetchContactList("user1")
+	res, err := FetchContactList(context.Background(), "user1")
 	if err != nil {
 		t.Error("error in fetch", err)
 		return
@@ -37,10 +53,12 @@ func TestFetchContactList(t *testing.T) {
 }
 
 func TestFetchChatBetween(t *testing.T) {
-	InitialiseRedis()
+	if _, err := InitialiseRedis(context.Background(), testConfig.Redis); err != nil {
+		t.Fatal(err)
+	}
 	defer redisClient.Close()
 
-	res, err := FetchChatBetween("user1", "user2", "0", "+inf")
+	res, err := FetchChatBetween(context.Background(), "user1", "user2", "0", "+inf")
 
 	if err != nil {
 		t.Error("error in fetch", err)
@@ -51,7 +69,9 @@ func TestFetchChatBetween(t *testing.T) {
 }
 
 func TestIndexExist(t *testing.T) {
-	InitialiseRedis()
+	if _, err := InitialiseRedis(context.Background(), testConfig.Redis); err != nil {
+		t.Fatal(err)
+	}
 	defer redisClient.Close()
 	res, err := redisClient.Do(context.Background(),
 		"FT._LIST",
@@ -103,7 +123,9 @@ func TestIndexExist(t *testing.T) {
 // }
 
 func TestCreateSortableIndex(t *testing.T) {
-	InitialiseRedis()
+	if _, err := InitialiseRedis(context.Background(), testConfig.Redis); err != nil {
+		t.Fatal(err)
+	}
 	defer redisClient.Close()
 
 	res, err := redisClient.Do(context.Background(),
@@ -0,0 +1,169 @@
+package redisrepo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+
+	"Krowka/model"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// scanBatch is how many keys one SCAN step asks for
+const scanBatch = 500
+
+// EachChat calls fn for every stored chat, in no particular order, until
+// fn returns an error. Chats sent meanwhile may or may not be seen. In
+// cluster mode every master is scanned, fn is never called concurrently.
+func EachChat(ctx context.Context, fn func(*model.Chat) error) error {
+	return eachKeyBatch(ctx, "chat#*", func(ctx context.Context, c redis.Cmdable, keys []string) error {
+		chats, err := readChats(ctx, c, keys)
+		if err != nil {
+			return err
+		}
+		for i := range chats {
+			if err := fn(&chats[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// EachAttachment calls fn for every stored attachment like EachChat does
+// for chats
+func EachAttachment(ctx context.Context, fn func(*model.Attachment) error) error {
+	return eachKeyBatch(ctx, attachmentKey("*"), func(ctx context.Context, c redis.Cmdable, keys []string) error {
+		found, err := readAttachments(ctx, c, keys)
+		if err != nil {
+			return err
+		}
+		for _, a := range found {
+			if err := fn(a); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// eachKeyBatch calls batch with the keys of each SCAN step matching
+// pattern, on every master in cluster mode, never concurrently
+func eachKeyBatch(ctx context.Context, pattern string, batch func(context.Context, redis.Cmdable, []string) error) error {
+	cc, ok := redisClient.(*redis.ClusterClient)
+	if !ok {
+		return scanKeys(ctx, redisClient, pattern, batch)
+	}
+
+	var mu sync.Mutex
+	serial := func(ctx context.Context, c redis.Cmdable, keys []string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return batch(ctx, c, keys)
+	}
+	return cc.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		return scanKeys(ctx, node, pattern, serial)
+	})
+}
+
+func scanKeys(ctx context.Context, c redis.Cmdable, pattern string, batch func(context.Context, redis.Cmdable, []string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := scanStep(ctx, c, cursor, pattern)
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := batch(ctx, c, keys); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func scanStep(ctx context.Context, c redis.Cmdable, cursor uint64, pattern string) ([]string, uint64, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: SCAN cursor [MATCH pattern] [COUNT count]
+	// SCAN 0 MATCH chat#* COUNT 500
+	keys, next, err := c.Scan(ctx, cursor, pattern, scanBatch).Result()
+	if err != nil {
+		return nil, 0, classify(err)
+	}
+	return keys, next, nil
+}
+
+// readChats reads the chats of one SCAN step, each step gets the
+// operation timeout
+func readChats(ctx context.Context, c redis.Cmdable, keys []string) ([]model.Chat, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: JSON.GET key path, once per key in a pipeline
+	// JSON.GET chat#{earth:sun}#1661360942123 $
+	cmds := make([]*redis.Cmd, len(keys))
+	// errors are checked per command below
+	c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Do(ctx, "JSON.GET", key, "$")
+		}
+		return nil
+	})
+
+	chats := make([]model.Chat, 0, len(keys))
+	for _, cmd := range cmds {
+		s, err := cmd.Text()
+		if errors.Is(err, redis.Nil) {
+			// deleted since the SCAN
+			continue
+		}
+		if err != nil {
+			// a chat that can't be read may hold references, stop
+			return nil, classify(err)
+		}
+		var arr []model.Chat
+		if json.Unmarshal([]byte(s), &arr) == nil && len(arr) > 0 {
+			chats = append(chats, arr[0])
+		}
+	}
+	return chats, nil
+}
+
+// readAttachments reads the attachments of one SCAN step
+func readAttachments(ctx context.Context, c redis.Cmdable, keys []string) ([]*model.Attachment, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: HGETALL key, once per key in a pipeline
+	// HGETALL attachment:<id>
+	cmds := make([]*redis.StringStringMapCmd, len(keys))
+	_, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.HGetAll(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	found := make([]*model.Attachment, 0, len(keys))
+	for i, key := range keys {
+		// empty once deleted since the SCAN
+		if fields := cmds[i].Val(); len(fields) > 0 {
+			found = append(found, attachmentFromHash(strings.TrimPrefix(key, attachmentKey("")), fields))
+		}
+	}
+	return found, nil
+}
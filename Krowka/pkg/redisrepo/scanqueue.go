@@ -0,0 +1,48 @@
+package redisrepo
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// QueueScan records that the attachment id waits for a malware scan since
+// at, a Unix time, so that it is scanned again should this attempt fail
+func QueueScan(ctx context.Context, id string, at int64) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: ZADD key score member
+	// ZADD scans:pending 1661360942 <id>
+	return classify(redisClient.ZAdd(ctx, scanQueueKey(), &redis.Z{Score: float64(at), Member: id}).Err())
+}
+
+// DueScans returns the attachments queued at or before the Unix time
+// before and not scanned since
+func DueScans(ctx context.Context, before int64) ([]string, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: ZRANGEBYSCORE key min max
+	// ZRANGEBYSCORE scans:pending -inf 1661360942
+	ids, err := redisClient.ZRangeByScore(ctx, scanQueueKey(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(before, 10),
+	}).Result()
+	return ids, classify(err)
+}
+
+// DoneScan takes an attachment off the queue once it has its verdict or is
+// gone
+func DoneScan(ctx context.Context, id string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: ZREM key member
+	// ZREM scans:pending <id>
+	return classify(redisClient.ZRem(ctx, scanQueueKey(), id).Err())
+}
@@ -0,0 +1,85 @@
+package redisrepo
+
+import (
+	"context"
+	"strconv"
+
+	"Krowka/model"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// reserveScript adds ARGV[1] bytes and one file to KEYS[1] unless that
+// takes the bytes over the quota ARGV[2], 0 meaning unlimited. Returns 1
+// if the space was reserved.
+var reserveScript = redis.NewScript(`
+local used = tonumber(redis.call('HGET', KEYS[1], 'bytes') or '0')
+local size = tonumber(ARGV[1])
+local quota = tonumber(ARGV[2])
+if quota > 0 and used + size > quota then
+	return 0
+end
+redis.call('HINCRBY', KEYS[1], 'bytes', size)
+redis.call('HINCRBY', KEYS[1], 'files', 1)
+return 1
+`)
+
+// ReserveStorage accounts a stored file of size bytes to username, or
+// returns ErrQuotaExceeded if it does not fit in quota
+func ReserveStorage(ctx context.Context, username string, size, quota int64) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+	// EVALSHA <sha> 1 storage:sun 1024 1073741824
+	ok, err := reserveScript.Run(ctx, redisClient, []string{storageKey(username)}, size, quota).Int()
+	if err != nil {
+		return classify(err)
+	}
+	if ok == 0 {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// ReleaseStorage gives back the space of a deleted file
+func ReleaseStorage(ctx context.Context, username string, size int64) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: HINCRBY key field increment
+	// HINCRBY storage:sun bytes -1024
+	// HINCRBY storage:sun files -1
+	_, err := redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HIncrBy(ctx, storageKey(username), "bytes", -size)
+		pipe.HIncrBy(ctx, storageKey(username), "files", -1)
+		return nil
+	})
+
+	return classify(err)
+}
+
+// GetStorageUsage returns what username stores, zero for new users
+func GetStorageUsage(ctx context.Context, username string) (*model.StorageUsage, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: HMGET key field [field ...]
+	// HMGET storage:sun bytes files
+	vals, err := redisClient.HMGet(ctx, storageKey(username), "bytes", "files").Result()
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	u := &model.StorageUsage{}
+	if s, ok := vals[0].(string); ok {
+		u.UsedBytes, _ = strconv.ParseInt(s, 10, 64)
+	}
+	if s, ok := vals[1].(string); ok {
+		u.Files, _ = strconv.ParseInt(s, 10, 64)
+	}
+	return u, nil
+}
@@ -0,0 +1,39 @@
+package redisrepo
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestStorageQuota(t *testing.T) {
+	useClient(t, miniredis.RunT(t).Addr())
+	ctx := context.Background()
+
+	if u, err := GetStorageUsage(ctx, "alice"); err != nil || u.UsedBytes != 0 || u.Files != 0 {
+		t.Fatalf("new user: %+v, %v", u, err)
+	}
+
+	if err := ReserveStorage(ctx, "alice", 60, 100); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReserveStorage(ctx, "alice", 50, 100); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("over quota: %v", err)
+	}
+	if err := ReserveStorage(ctx, "alice", 40, 100); err != nil {
+		t.Fatal("exactly at quota:", err)
+	}
+	if err := ReserveStorage(ctx, "bob", 500, 0); err != nil {
+		t.Fatal("unlimited:", err)
+	}
+
+	if err := ReleaseStorage(ctx, "alice", 60); err != nil {
+		t.Fatal(err)
+	}
+	u, err := GetStorageUsage(ctx, "alice")
+	if err != nil || u.UsedBytes != 40 || u.Files != 1 {
+		t.Errorf("after release: %+v, %v", u, err)
+	}
+}
@@ -0,0 +1,267 @@
+package redisrepo
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"Krowka/model"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// appendChunkScript records the chunk ARGV[3] of ARGV[2] bytes sent at
+// offset ARGV[1] of the upload KEYS[1], unless the upload is elsewhere or
+// completing. ARGV[4] is the new expiry, ARGV[5] the media type detected
+// from the first chunk. Returns 1 on success, 0 if the upload is gone and
+// -1 if it changed.
+var appendChunkScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local s = redis.call('HMGET', KEYS[1], 'offset', 'completing')
+if s[1] ~= ARGV[1] or s[2] then
+	return -1
+end
+redis.call('HINCRBY', KEYS[1], 'offset', ARGV[2])
+redis.call('HSET', KEYS[1], 'expires_at', ARGV[4])
+if ARGV[5] ~= '' then
+	redis.call('HSET', KEYS[1], 'mime', ARGV[5])
+end
+redis.call('RPUSH', KEYS[2], ARGV[3])
+return 1
+`)
+
+// claimScript marks the complete upload KEYS[1] as completing until
+// ARGV[1]. Returns 1 on success, 0 if the upload is gone and -1 if it is
+// incomplete or claimed already.
+var claimScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local s = redis.call('HMGET', KEYS[1], 'offset', 'size', 'completing')
+if s[1] ~= s[2] or s[3] then
+	return -1
+end
+redis.call('HSET', KEYS[1], 'completing', 1, 'expires_at', ARGV[1])
+return 1
+`)
+
+// takeScript deletes the upload KEYS[1] and its chunk list KEYS[2] and
+// returns both, if it expired by ARGV[1] or ARGV[1] is 0. Returns 0 if the
+// upload is gone and -1 if it has not expired.
+var takeScript = redis.NewScript(`
+local u = redis.call('HGETALL', KEYS[1])
+if #u == 0 then
+	return 0
+end
+local by = tonumber(ARGV[1])
+if by > 0 and tonumber(redis.call('HGET', KEYS[1], 'expires_at')) > by then
+	return -1
+end
+local chunks = redis.call('LRANGE', KEYS[2], 0, -1)
+redis.call('DEL', KEYS[1], KEYS[2])
+return {u, chunks}
+`)
+
+// CreateUpload starts a chunked upload at offset 0
+func CreateUpload(ctx context.Context, u *model.Upload) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: HSET key field value [field value ...]
+	// HSET upload:{<id>} owner sun peer earth name film.mp4 size 104857600 offset 0 created_at 1661360942 expires_at 1661447342
+	// SYNTAX: ZADD key score member
+	// ZADD uploads:expiry 1661447342 <id>
+	_, err := redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, uploadKey(u.ID),
+			"owner", u.Owner,
+			"peer", u.Peer,
+			"name", u.Name,
+			"size", u.Size,
+			"offset", 0,
+			"created_at", u.CreatedAt,
+			"expires_at", u.ExpiresAt,
+		)
+		pipe.ZAdd(ctx, uploadExpiryKey(), &redis.Z{Score: float64(u.ExpiresAt), Member: u.ID})
+		return nil
+	})
+
+	return classify(err)
+}
+
+// GetUpload returns ErrNotFound for unknown, completed or expired uploads
+func GetUpload(ctx context.Context, id string) (*model.Upload, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: HGETALL key
+	// HGETALL upload:{<id>}
+	fields, err := redisClient.HGetAll(ctx, uploadKey(id)).Result()
+	if err != nil {
+		return nil, classify(err)
+	}
+	if len(fields) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return uploadFromHash(id, fields), nil
+}
+
+func uploadFromHash(id string, fields map[string]string) *model.Upload {
+	u := &model.Upload{
+		ID:    id,
+		Owner: fields["owner"],
+		Peer:  fields["peer"],
+		Name:  fields["name"],
+		MIME:  fields["mime"],
+	}
+	u.Size, _ = strconv.ParseInt(fields["size"], 10, 64)
+	u.Offset, _ = strconv.ParseInt(fields["offset"], 10, 64)
+	u.CreatedAt, _ = strconv.ParseInt(fields["created_at"], 10, 64)
+	u.ExpiresAt, _ = strconv.ParseInt(fields["expires_at"], 10, 64)
+	return u
+}
+
+// AppendChunk records that the blob chunk holds the n bytes sent at offset
+// and pushes the expiry to expiresAt. mediaType is set with the first
+// chunk. Returns ErrUploadChanged if another chunk was recorded at offset
+// meanwhile.
+func AppendChunk(ctx context.Context, id string, offset, n int64, chunk, mediaType string, expiresAt int64) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+	// EVALSHA <sha> 2 upload:{<id>} upload:{<id>}:chunks 0 8388608 partial/<id>/0-1f2e image/png 1661447342
+	res, err := appendChunkScript.Run(ctx, redisClient, []string{uploadKey(id), uploadChunksKey(id)},
+		offset, n, chunk, expiresAt, mediaType).Int()
+	if err != nil {
+		return classify(err)
+	}
+	switch res {
+	case 0:
+		return ErrNotFound
+	case -1:
+		return ErrUploadChanged
+	}
+
+	// SYNTAX: ZADD key score member
+	// ZADD uploads:expiry 1661447342 <id>
+	return classify(redisClient.ZAdd(ctx, uploadExpiryKey(), &redis.Z{Score: float64(expiresAt), Member: id}).Err())
+}
+
+// UploadChunks lists the blobs of an upload in order
+func UploadChunks(ctx context.Context, id string) ([]string, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: LRANGE key start stop
+	// LRANGE upload:{<id>}:chunks 0 -1
+	chunks, err := redisClient.LRange(ctx, uploadChunksKey(id), 0, -1).Result()
+	return chunks, classify(err)
+}
+
+// ClaimUpload reserves a fully received upload for the one request that
+// completes it, until expiresAt. Returns ErrUploadChanged if it is
+// incomplete or claimed already.
+func ClaimUpload(ctx context.Context, id string, expiresAt int64) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+	// EVALSHA <sha> 1 upload:{<id>} 1661447342
+	res, err := claimScript.Run(ctx, redisClient, []string{uploadKey(id)}, expiresAt).Int()
+	if err != nil {
+		return classify(err)
+	}
+	switch res {
+	case 0:
+		return ErrNotFound
+	case -1:
+		return ErrUploadChanged
+	}
+
+	// SYNTAX: ZADD key score member
+	// ZADD uploads:expiry 1661447342 <id>
+	return classify(redisClient.ZAdd(ctx, uploadExpiryKey(), &redis.Z{Score: float64(expiresAt), Member: id}).Err())
+}
+
+// UnclaimUpload lets the upload be completed again after a failed attempt
+func UnclaimUpload(ctx context.Context, id string) error {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: HDEL key field
+	// HDEL upload:{<id>} completing
+	return classify(redisClient.HDel(ctx, uploadKey(id), "completing").Err())
+}
+
+// TakeUpload removes an upload and returns it with its chunks, which the
+// caller now owns. With expiredBy set only an upload that expired by then
+// is taken, ErrNotFound is returned otherwise.
+func TakeUpload(ctx context.Context, id string, expiredBy int64) (*model.Upload, []string, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: EVALSHA sha1 numkeys [key [key ...]] [arg [arg ...]]
+	// EVALSHA <sha> 2 upload:{<id>} upload:{<id>}:chunks 1661447342
+	res, err := takeScript.Run(ctx, redisClient, []string{uploadKey(id), uploadChunksKey(id)}, expiredBy).Result()
+	if err != nil {
+		return nil, nil, classify(err)
+	}
+	if n, ok := res.(int64); ok {
+		if n == 0 {
+			// already gone, drop what is left in the index
+			redisClient.ZRem(ctx, uploadExpiryKey(), id)
+		}
+		return nil, nil, ErrNotFound
+	}
+
+	parts, ok := res.([]interface{})
+	if !ok || len(parts) != 2 {
+		return nil, nil, errors.New("unexpected reply to take upload")
+	}
+	fields := map[string]string{}
+	pairs, _ := parts[0].([]interface{})
+	for i := 0; i+1 < len(pairs); i += 2 {
+		k, _ := pairs[i].(string)
+		v, _ := pairs[i+1].(string)
+		fields[k] = v
+	}
+	var chunks []string
+	list, _ := parts[1].([]interface{})
+	for _, c := range list {
+		if s, ok := c.(string); ok {
+			chunks = append(chunks, s)
+		}
+	}
+
+	// the upload is ours now, a leftover index entry is dropped by the
+	// next sweep
+	// SYNTAX: ZREM key member
+	// ZREM uploads:expiry <id>
+	redisClient.ZRem(ctx, uploadExpiryKey(), id)
+	return uploadFromHash(id, fields), chunks, nil
+}
+
+// ExpiredUploads lists the uploads that expired by now
+func ExpiredUploads(ctx context.Context, now int64) ([]string, error) {
+	ctx, cancel := withTimeout(ctx)
+	defer cancel()
+
+	// redis-cli
+	// SYNTAX: ZRANGEBYSCORE key min max
+	// ZRANGEBYSCORE uploads:expiry -inf 1661447342
+	ids, err := redisClient.ZRangeByScore(ctx, uploadExpiryKey(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(now, 10),
+	}).Result()
+	return ids, classify(err)
+}
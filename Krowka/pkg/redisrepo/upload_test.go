@@ -0,0 +1,107 @@
+package redisrepo
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"Krowka/model"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestUploadLifecycle(t *testing.T) {
+	useClient(t, miniredis.RunT(t).Addr())
+	ctx := context.Background()
+
+	u := &model.Upload{ID: "u1", Owner: "alice", Peer: "bob", Name: "film.mp4", Size: 10, CreatedAt: 100, ExpiresAt: 200}
+	if err := CreateUpload(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := GetUpload(ctx, "u1"); err != nil || !reflect.DeepEqual(got, u) {
+		t.Fatalf("GetUpload = %+v, %v", got, err)
+	}
+
+	if err := ClaimUpload(ctx, "u1", 300); !errors.Is(err, ErrUploadChanged) {
+		t.Errorf("claiming an incomplete upload: %v", err)
+	}
+	if err := AppendChunk(ctx, "u1", 0, 6, "c0", "video/mp4", 250); err != nil {
+		t.Fatal(err)
+	}
+	// a second chunk for the same offset lost the race
+	if err := AppendChunk(ctx, "u1", 0, 6, "c0b", "", 250); !errors.Is(err, ErrUploadChanged) {
+		t.Errorf("stale offset: %v", err)
+	}
+	if err := AppendChunk(ctx, "u1", 6, 4, "c1", "", 260); err != nil {
+		t.Fatal(err)
+	}
+	if err := AppendChunk(ctx, "missing", 0, 1, "x", "", 260); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing upload: %v", err)
+	}
+
+	got, _ := GetUpload(ctx, "u1")
+	if got.Offset != 10 || got.MIME != "video/mp4" || got.ExpiresAt != 260 {
+		t.Errorf("after chunks: %+v", got)
+	}
+	if chunks, err := UploadChunks(ctx, "u1"); err != nil || !reflect.DeepEqual(chunks, []string{"c0", "c1"}) {
+		t.Errorf("chunks = %v, %v", chunks, err)
+	}
+
+	if err := ClaimUpload(ctx, "u1", 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClaimUpload(ctx, "u1", 300); !errors.Is(err, ErrUploadChanged) {
+		t.Errorf("second claim: %v", err)
+	}
+	if err := UnclaimUpload(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ClaimUpload(ctx, "u1", 300); err != nil {
+		t.Errorf("claim after unclaim: %v", err)
+	}
+
+	taken, chunks, err := TakeUpload(ctx, "u1", 0)
+	if err != nil || taken.Owner != "alice" || taken.Size != 10 || !reflect.DeepEqual(chunks, []string{"c0", "c1"}) {
+		t.Errorf("TakeUpload = %+v %v %v", taken, chunks, err)
+	}
+	if _, err := GetUpload(ctx, "u1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("after take: %v", err)
+	}
+	if _, _, err := TakeUpload(ctx, "u1", 0); !errors.Is(err, ErrNotFound) {
+		t.Errorf("taken twice: %v", err)
+	}
+}
+
+func TestExpiredUploads(t *testing.T) {
+	useClient(t, miniredis.RunT(t).Addr())
+	ctx := context.Background()
+
+	for _, u := range []*model.Upload{
+		{ID: "old", Owner: "alice", Size: 5, ExpiresAt: 100},
+		{ID: "busy", Owner: "alice", Size: 5, ExpiresAt: 100},
+		{ID: "new", Owner: "alice", Size: 5, ExpiresAt: 500},
+	} {
+		if err := CreateUpload(ctx, u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a chunk arriving pushes the expiry back
+	if err := AppendChunk(ctx, "busy", 0, 1, "c", "", 400); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, err := ExpiredUploads(ctx, 200)
+	if err != nil || !reflect.DeepEqual(ids, []string{"old"}) {
+		t.Fatalf("ExpiredUploads = %v, %v", ids, err)
+	}
+	if _, _, err := TakeUpload(ctx, "new", 200); !errors.Is(err, ErrNotFound) {
+		t.Errorf("took an upload before it expired: %v", err)
+	}
+	if u, _, err := TakeUpload(ctx, "old", 200); err != nil || u.ID != "old" {
+		t.Errorf("TakeUpload(old) = %+v, %v", u, err)
+	}
+	if ids, _ := ExpiredUploads(ctx, 200); len(ids) != 0 {
+		t.Errorf("still listed: %v", ids)
+	}
+}
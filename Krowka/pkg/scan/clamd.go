@@ -0,0 +1,140 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// chunkSize is how much of the file goes into one INSTREAM chunk
+const chunkSize = 64 << 10
+
+// dialTimeout bounds connecting when ctx has no deadline
+const dialTimeout = 10 * time.Second
+
+// Clamd talks to ClamAV's daemon over TCP or a unix socket, streaming
+// files with the INSTREAM command so that clamd needs no access to the
+// store
+type Clamd struct {
+	network string
+	addr    string
+}
+
+// NewClamd connects to addr, a path such as /run/clamav/clamd.ctl being a
+// unix socket and anything else host:port
+func NewClamd(addr string) *Clamd {
+	if strings.HasPrefix(addr, "/") {
+		return &Clamd{network: "unix", addr: addr}
+	}
+	return &Clamd{network: "tcp", addr: addr}
+}
+
+// Scan sends r in length-prefixed chunks, ending with an empty one, and
+// reads a reply such as "stream: OK" or "stream: Eicar-Signature FOUND"
+func (c *Clamd) Scan(ctx context.Context, r io.Reader) (Verdict, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return Verdict{}, err
+	}
+	defer conn.Close()
+
+	// clamd stops reading once a stream is over StreamMaxLength and
+	// answers with an error, which is read even if writing failed
+	errWrite := stream(conn, r)
+	reply, err := readReply(conn)
+	if err != nil {
+		if errWrite != nil {
+			return Verdict{}, fmt.Errorf("clamd: sending file: %w", errWrite)
+		}
+		return Verdict{}, fmt.Errorf("clamd: reading reply: %w", err)
+	}
+	return parseReply(reply)
+}
+
+func stream(w io.Writer, r io.Reader) error {
+	if _, err := io.WriteString(w, "zINSTREAM\x00"); err != nil {
+		return err
+	}
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			if _, err := w.Write(buf[:4+n]); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+func parseReply(reply string) (Verdict, error) {
+	// replies to INSTREAM are prefixed with the pseudo file name
+	result := strings.TrimPrefix(reply, "stream: ")
+	switch {
+	case result == "OK":
+		return Verdict{}, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return Verdict{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	case strings.Contains(result, "size limit exceeded"):
+		return Verdict{}, ErrTooLarge
+	default:
+		return Verdict{}, fmt.Errorf("clamd: %s", result)
+	}
+}
+
+// Check sends PING, clamd answers PONG
+func (c *Clamd) Check(ctx context.Context) error {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := io.WriteString(conn, "zPING\x00"); err != nil {
+		return fmt.Errorf("clamd: %w", err)
+	}
+	reply, err := readReply(conn)
+	if err != nil {
+		return fmt.Errorf("clamd: %w", err)
+	}
+	if reply != "PONG" {
+		return fmt.Errorf("clamd: unexpected reply %q to PING", reply)
+	}
+	return nil
+}
+
+// dial connects with ctx's deadline applied to the whole conversation
+func (c *Clamd) dial(ctx context.Context) (net.Conn, error) {
+	d := net.Dialer{Timeout: dialTimeout}
+	conn, err := d.DialContext(ctx, c.network, c.addr)
+	if err != nil {
+		return nil, fmt.Errorf("clamd: %w", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	return conn, nil
+}
+
+// readReply reads up to the NUL that ends replies to z-prefixed commands
+func readReply(r io.Reader) (string, error) {
+	reply, err := bufio.NewReader(r).ReadBytes(0)
+	if err != nil && len(reply) == 0 {
+		return "", err
+	}
+	return string(bytes.TrimRight(reply, "\x00\n")), nil
+}
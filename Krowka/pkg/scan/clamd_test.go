@@ -0,0 +1,132 @@
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// eicar is the antivirus test file every scanner detects
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// fakeClamd answers PING and INSTREAM like clamd, finding eicar and
+// refusing streams over maxBytes
+func fakeClamd(t *testing.T, maxBytes int) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveClamd(conn, maxBytes)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func serveClamd(conn net.Conn, maxBytes int) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString(0)
+	if err != nil {
+		return
+	}
+	switch cmd {
+	case "zPING\x00":
+		io.WriteString(conn, "PONG\x00")
+	case "zINSTREAM\x00":
+		var data bytes.Buffer
+		for {
+			var size uint32
+			if binary.Read(r, binary.BigEndian, &size) != nil {
+				return
+			}
+			if size == 0 {
+				break
+			}
+			if data.Len()+int(size) > maxBytes {
+				io.WriteString(conn, "INSTREAM size limit exceeded. ERROR\x00")
+				return
+			}
+			if _, err := io.CopyN(&data, r, int64(size)); err != nil {
+				return
+			}
+		}
+		if bytes.Contains(data.Bytes(), []byte(eicar)) {
+			io.WriteString(conn, "stream: Win.Test.EICAR_HDB-1 FOUND\x00")
+		} else {
+			io.WriteString(conn, "stream: OK\x00")
+		}
+	default:
+		io.WriteString(conn, "UNKNOWN COMMAND\x00")
+	}
+}
+
+// testScanner runs the behaviour any clamd must show
+func testScanner(t *testing.T, s Scanner) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := s.Check(ctx); err != nil {
+		t.Fatal("check:", err)
+	}
+
+	// more than one chunk
+	v, err := s.Scan(ctx, strings.NewReader(strings.Repeat("harmless ", 20000)))
+	if err != nil || v.Infected {
+		t.Errorf("clean file: %+v, %v", v, err)
+	}
+	v, err = s.Scan(ctx, strings.NewReader(eicar))
+	if err != nil || !v.Infected || !strings.Contains(v.Signature, "EICAR") {
+		t.Errorf("eicar: %+v, %v", v, err)
+	}
+}
+
+func TestClamd(t *testing.T) {
+	testScanner(t, NewClamd(fakeClamd(t, 1<<20)))
+}
+
+func TestClamdErrors(t *testing.T) {
+	ctx := context.Background()
+
+	s := NewClamd(fakeClamd(t, 1000))
+	if _, err := s.Scan(ctx, strings.NewReader(strings.Repeat("x", 100000))); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("over the stream limit: %v", err)
+	}
+
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err := NewClamd(addr).Scan(ctx, strings.NewReader("x")); err == nil {
+		t.Error("scan without clamd succeeded")
+	}
+	if err := NewClamd(addr).Check(ctx); err == nil {
+		t.Error("check without clamd succeeded")
+	}
+}
+
+// TestRealClamd runs against a local clamd, e.g.
+//
+//	docker run -p 3310:3310 clamav/clamav
+//	CLAMD_TEST_ADDR=localhost:3310 go test ./pkg/scan
+func TestRealClamd(t *testing.T) {
+	addr := os.Getenv("CLAMD_TEST_ADDR")
+	if addr == "" {
+		t.Skip("CLAMD_TEST_ADDR not set")
+	}
+	testScanner(t, NewClamd(addr))
+}
@@ -0,0 +1,44 @@
+// Package scan checks uploaded files for malware before other users may
+// download them.
+package scan
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"Krowka/pkg/config"
+)
+
+// ErrTooLarge is returned for files larger than the scanner accepts
+var ErrTooLarge = errors.New("file too large to scan")
+
+// Verdict is the outcome of scanning one file
+type Verdict struct {
+	Infected bool
+	// Signature names what was found in an infected file
+	Signature string
+}
+
+// Scanner looks for malware in a stream of bytes
+type Scanner interface {
+	// Scan reads r to the end unless it fails. An error means the file
+	// could not be scanned, not that it is infected.
+	Scan(ctx context.Context, r io.Reader) (Verdict, error)
+	// Check reports whether the scanner is reachable, for readiness
+	// probes
+	Check(ctx context.Context) error
+}
+
+// Open returns the configured scanner, nil when scanning is turned off
+func Open(cfg config.Scan) (Scanner, error) {
+	switch cfg.Backend {
+	case "none", "":
+		return nil, nil
+	case "clamd":
+		return NewClamd(cfg.ClamdAddr), nil
+	default:
+		return nil, fmt.Errorf("unknown scan backend %q", cfg.Backend)
+	}
+}
@@ -0,0 +1,37 @@
+// Package token issues and verifies the bearer tokens that identify users
+// to the HTTP and WebSocket servers.
+package token
+
+import (
+	"errors"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// ErrInvalid is returned for tokens that are malformed, expired, signed
+// with another key or name no user
+var ErrInvalid = errors.New("invalid token")
+
+// Issue returns a token for username signed with secret, valid for ttl
+func Issue(secret []byte, username string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := jwt.RegisteredClaims{
+		Subject:   username,
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		IssuedAt:  jwt.NewNumericDate(now),
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+}
+
+// Verify checks a token signed with secret and returns the user it names
+func Verify(secret []byte, s string) (string, error) {
+	claims := &jwt.RegisteredClaims{}
+	t, err := jwt.ParseWithClaims(s, claims, func(*jwt.Token) (interface{}, error) {
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil || !t.Valid || claims.Subject == "" {
+		return "", ErrInvalid
+	}
+	return claims.Subject, nil
+}
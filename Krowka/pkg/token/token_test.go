@@ -0,0 +1,45 @@
+package token
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+func TestVerify(t *testing.T) {
+	secret := []byte("secret")
+	valid, err := Issue(secret, "alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err := Verify(secret, valid); err != nil || user != "alice" {
+		t.Fatalf("got %q, %v", user, err)
+	}
+
+	expired, _ := Issue(secret, "alice", -time.Minute)
+	nobody, _ := Issue(secret, "", time.Hour)
+	none, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.RegisteredClaims{Subject: "alice"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	for name, s := range map[string]string{
+		"other key": mustIssue(t, []byte("other"), "alice"),
+		"expired":   expired,
+		"no user":   nobody,
+		"unsigned":  none,
+		"garbage":   "not.a.token",
+		"empty":     "",
+	} {
+		if user, err := Verify(secret, s); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s: got %q, %v", name, user, err)
+		}
+	}
+}
+
+func mustIssue(t *testing.T, secret []byte, user string) string {
+	t.Helper()
+	s, err := Issue(secret, user, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
@@ -0,0 +1,93 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "Krowka"
+
+// Options select where spans are exported
+type Options struct {
+	// Exporter is none, stdout or otlp
+	Exporter string
+	// Endpoint is the OTLP/HTTP collector, host:port or a full URL
+	Endpoint    string
+	Insecure    bool
+	SampleRatio float64
+	ServiceName string
+}
+
+// Tracer returns the tracer used across krowka packages
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Propagator carries trace context over HTTP headers and chat frames
+func Propagator() propagation.TextMapPropagator {
+	return otel.GetTextMapPropagator()
+}
+
+// Setup installs the global tracer provider and W3C trace context
+// propagation. The returned function flushes pending spans.
+func Setup(ctx context.Context, opts Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(opts.Exporter) {
+	case "", "none":
+		// spans are still created so trace IDs propagate, just not exported
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		exporter, err = otlptracehttp.New(ctx, otlpOptions(opts)...)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", opts.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("creating %s trace exporter: %w", opts.Exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(opts.ServiceName),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+func otlpOptions(opts Options) []otlptracehttp.Option {
+	var o []otlptracehttp.Option
+	if strings.Contains(opts.Endpoint, "://") {
+		o = append(o, otlptracehttp.WithEndpointURL(opts.Endpoint))
+	} else if opts.Endpoint != "" {
+		o = append(o, otlptracehttp.WithEndpoint(opts.Endpoint))
+	}
+	if opts.Insecure {
+		o = append(o, otlptracehttp.WithInsecure())
+	}
+	return o
+}
@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestMiddlewareContinuesTrace(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	r := mux.NewRouter()
+	r.Use(Middleware)
+	r.HandleFunc("/profile/{name}", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	req := httptest.NewRequest(http.MethodGet, "/profile/alice", nil)
+	req.Header.Set("traceparent", parent)
+	r.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := rec.Ended()
+	if len(spans) != 1 {
+		t.Fatal("expected one span, got", len(spans))
+	}
+	s := spans[0]
+	if s.Name() != "GET /profile/{name}" {
+		t.Error("span not named after the route template:", s.Name())
+	}
+	if s.SpanContext().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Error("incoming trace not continued", s.SpanContext().TraceID())
+	}
+	if s.Status().Code.String() != "Error" {
+		t.Error("5xx should mark the span as failed", s.Status())
+	}
+}
@@ -0,0 +1,57 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"Krowka/model"
+	"Krowka/pkg/redisrepo"
+)
+
+// maxAttachments bounds the files one chat may carry
+const maxAttachments = 10
+
+// errInvalidAttachment is reported to the client, the chat is not sent
+var errInvalidAttachment = errors.New("invalid attachment")
+
+// resolveAttachments checks that every attachment of c exists, was
+// uploaded by sender and is addressed to the recipient of c, then
+// replaces the client's references with the stored metadata
+func resolveAttachments(ctx context.Context, sender string, c *model.Chat) error {
+	if len(c.Attachments) > maxAttachments {
+		return fmt.Errorf("%w: at most %d files per message", errInvalidAttachment, maxAttachments)
+	}
+
+	ids := make([]string, len(c.Attachments))
+	seen := make(map[string]bool, len(ids))
+	for i, ref := range c.Attachments {
+		if ref.ID == "" || seen[ref.ID] {
+			return fmt.Errorf("%w: missing or repeated id", errInvalidAttachment)
+		}
+		seen[ref.ID] = true
+		ids[i] = ref.ID
+	}
+
+	found, err := redisrepo.GetAttachments(ctx, ids)
+	if err != nil {
+		return err
+	}
+	for i, id := range ids {
+		a, ok := found[id]
+		switch {
+		case !ok:
+			return fmt.Errorf("%w: %s does not exist", errInvalidAttachment, id)
+		case sender == "" || a.Owner != sender || c.From != sender:
+			return fmt.Errorf("%w: %s was not uploaded by you", errInvalidAttachment, id)
+		case a.Peer != c.To:
+			return fmt.Errorf("%w: %s was uploaded for another conversation", errInvalidAttachment, id)
+		case a.Status == model.ScanQuarantined:
+			return fmt.Errorf("%w: %s was rejected by the malware scan", errInvalidAttachment, id)
+		case a.Status == model.ScanTooLarge:
+			return fmt.Errorf("%w: %s is too large to be scanned", errInvalidAttachment, id)
+		}
+		c.Attachments[i] = a.Ref()
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/config"
+	"Krowka/pkg/redisrepo"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func useRedis(t *testing.T) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Redis.Addr = miniredis.RunT(t).Addr()
+	client, err := redisrepo.InitialiseRedis(context.Background(), cfg.Redis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+}
+
+func TestResolveAttachments(t *testing.T) {
+	useRedis(t)
+	ctx := context.Background()
+	photo := &model.Attachment{ID: "p1", Owner: "alice", Peer: "bob", Name: "cat.png", MIME: "image/png", Size: 10, Width: 4, Height: 3}
+	other := &model.Attachment{ID: "p2", Owner: "alice", Peer: "carol", Name: "dog.png", MIME: "image/png", Size: 10}
+	infected := &model.Attachment{ID: "p3", Owner: "alice", Peer: "bob", Name: "setup.exe", MIME: "application/octet-stream", Size: 10, Status: model.ScanQuarantined}
+	for _, a := range []*model.Attachment{photo, other, infected} {
+		if err := redisrepo.SaveAttachment(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the client's name and size are replaced by the stored ones
+	c := &model.Chat{From: "alice", To: "bob", Attachments: []model.AttachmentRef{{ID: "p1", Name: "evil.exe", Size: 1}}}
+	if err := resolveAttachments(ctx, "alice", c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Attachments[0] != photo.Ref() {
+		t.Errorf("ref = %+v", c.Attachments[0])
+	}
+
+	for _, tc := range []struct {
+		name, sender, from, to string
+		ids                    []string
+	}{
+		{"unknown", "alice", "alice", "bob", []string{"nope"}},
+		{"someone else's", "bob", "bob", "alice", []string{"p1"}},
+		{"spoofed from", "bob", "alice", "bob", []string{"p1"}},
+		{"not bootstrapped", "", "alice", "bob", []string{"p1"}},
+		{"other conversation", "alice", "alice", "bob", []string{"p2"}},
+		{"quarantined", "alice", "alice", "bob", []string{"p3"}},
+		{"repeated", "alice", "alice", "bob", []string{"p1", "p1"}},
+		{"empty id", "alice", "alice", "bob", []string{""}},
+		{"too many", "alice", "alice", "bob", []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11"}},
+	} {
+		c := &model.Chat{From: tc.from, To: tc.to}
+		for _, id := range tc.ids {
+			c.Attachments = append(c.Attachments, model.AttachmentRef{ID: id})
+		}
+		if err := resolveAttachments(ctx, tc.sender, c); !errors.Is(err, errInvalidAttachment) {
+			t.Errorf("%s: got %v", tc.name, err)
+		}
+	}
+}
+
+func TestInvalidAttachmentIsRejected(t *testing.T) {
+	useRedis(t)
+	cfg := config.Default()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHub(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.run(ctx, cfg, ln)
+
+	conn := dialAs(t, "ws://"+ln.Addr().String()+"/ws", "alice")
+	conn.WriteJSON(Message{Type: "message", Chat: model.Chat{
+		From: "alice", To: "bob", Msg: "look",
+		Attachments: []model.AttachmentRef{{ID: "0123456789abcdef0123456789abcdef"}},
+	}})
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame errorFrame
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+	if frame.Type != "error" || frame.Code != "invalid_attachment" {
+		t.Errorf("got %+v", frame)
+	}
+}
+
+func TestEventsReachUser(t *testing.T) {
+	useRedis(t)
+	cfg := config.Default()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHub(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := redisrepo.SubscribeEvents(ctx, h.sendTo); err != nil {
+		t.Fatal(err)
+	}
+	go h.run(ctx, cfg, ln)
+
+	url := "ws://" + ln.Addr().String() + "/ws"
+	alice, bob := dialAs(t, url, "alice"), dialAs(t, url, "bob")
+	waitFor(t, func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		mapped := 0
+		for c := range h.clients {
+			if c.Username != "" {
+				mapped++
+			}
+		}
+		return mapped == 2
+	})
+
+	// claiming to be alice does not get bob her events
+	bob.WriteJSON(Message{Type: "bootup", User: "alice"})
+	if frame := readError(t, bob); frame.Code != "forbidden" {
+		t.Fatalf("bob claiming alice: %+v", frame)
+	}
+
+	for _, frame := range []map[string]string{
+		{"type": "attachment_rejected", "reason": "Eicar-Signature"},
+		{"type": "preview", "chatId": "c1"},
+	} {
+		if err := redisrepo.PublishEvent(ctx, "alice", frame); err != nil {
+			t.Fatal(err)
+		}
+		alice.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var got map[string]string
+		if err := alice.ReadJSON(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got["type"] != frame["type"] {
+			t.Errorf("got %v, want %v", got, frame)
+		}
+	}
+
+	bob.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, p, err := bob.ReadMessage(); err == nil {
+		t.Errorf("bob got %s", p)
+	}
+}
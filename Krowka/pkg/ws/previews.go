@@ -0,0 +1,146 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/linkpreview"
+	"Krowka/pkg/metrics"
+	"Krowka/pkg/redisrepo"
+	"Krowka/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// previewQueueSize is how many chats with links may wait for a worker
+	previewQueueSize = 256
+	// noPreviewTTL is how long a page that has no preview, or failed to
+	// load, is not fetched again
+	noPreviewTTL = time.Hour
+)
+
+// previewFrame carries the previews of the links in a chat, sent to both
+// participants once the pages are fetched
+type previewFrame struct {
+	Type     string               `json:"type"` // always "preview"
+	ChatID   string               `json:"chatId"`
+	Previews []*model.LinkPreview `json:"previews"`
+}
+
+// previewJob is a stored chat whose links wait to be previewed, ctx
+// carries the span of the frame that sent it
+type previewJob struct {
+	ctx  context.Context
+	chat *model.Chat
+	urls []string
+}
+
+// queuePreviews hands the links of a stored chat to the preview workers.
+// The chat is never held back for them: when the queue is full its links
+// go without a preview.
+func (h *hub) queuePreviews(ctx context.Context, c *model.Chat) {
+	if h.fetcher == nil {
+		return
+	}
+	urls := linkpreview.ExtractURLs(c.Msg)
+	if len(urls) == 0 {
+		return
+	}
+	select {
+	case h.previews <- previewJob{ctx: context.WithoutCancel(ctx), chat: c, urls: urls}:
+	default:
+		slog.WarnContext(ctx, "preview queue full, links not previewed", "chat_id", c.ID)
+		metrics.LinkPreviews.WithLabelValues("dropped").Add(float64(len(urls)))
+	}
+}
+
+// previewWorker fetches previews until ctx is done
+func (h *hub) previewWorker(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case job := <-h.previews:
+			h.sendPreviews(job)
+		}
+	}
+}
+
+// sendPreviews pushes the previews of a chat's links to its participants,
+// on whichever server they are connected
+func (h *hub) sendPreviews(job previewJob) {
+	ctx, span := tracing.Tracer().Start(job.ctx, "ws.preview",
+		trace.WithAttributes(attribute.String("chat.id", job.chat.ID), attribute.Int("links", len(job.urls))))
+	defer span.End()
+
+	var previews []*model.LinkPreview
+	for _, url := range job.urls {
+		if p := h.linkPreview(ctx, url); p != nil {
+			previews = append(previews, p)
+		}
+	}
+	if len(previews) == 0 {
+		return
+	}
+
+	frame := previewFrame{Type: "preview", ChatID: job.chat.ID, Previews: previews}
+	users := []string{job.chat.From}
+	if job.chat.To != job.chat.From {
+		users = append(users, job.chat.To)
+	}
+	for _, user := range users {
+		if err := redisrepo.PublishEvent(ctx, user, frame); err != nil {
+			slog.WarnContext(ctx, "sending link previews failed", "chat_id", job.chat.ID, "error", err)
+			span.RecordError(err)
+		}
+	}
+}
+
+// linkPreview returns the preview of url, cached or fetched, nil when the
+// page has none
+func (h *hub) linkPreview(ctx context.Context, url string) *model.LinkPreview {
+	p, err := redisrepo.GetLinkPreview(ctx, url)
+	if err == nil {
+		metrics.LinkPreviews.WithLabelValues("cached").Inc()
+		if p.Title == "" {
+			return nil
+		}
+		return p
+	}
+	if !errors.Is(err, redisrepo.ErrNotFound) {
+		slog.WarnContext(ctx, "reading cached link preview failed", "error", err)
+	}
+
+	p, err = h.fetcher.Fetch(ctx, url)
+	ttl := h.previewTTL
+	switch {
+	case err == nil:
+		metrics.LinkPreviews.WithLabelValues("fetched").Inc()
+	case errors.Is(err, linkpreview.ErrBlocked):
+		slog.WarnContext(ctx, "link to a private address not previewed", "link", url, "error", err)
+		metrics.LinkPreviews.WithLabelValues("blocked").Inc()
+	case errors.Is(err, linkpreview.ErrNoPreview):
+		slog.DebugContext(ctx, "linked page has no preview", "link", url, "error", err)
+		metrics.LinkPreviews.WithLabelValues("none").Inc()
+	default:
+		slog.InfoContext(ctx, "fetching link preview failed", "link", url, "error", err)
+		metrics.LinkPreviews.WithLabelValues("error").Inc()
+	}
+	if err != nil {
+		p = &model.LinkPreview{URL: url}
+		ttl = min(ttl, noPreviewTTL)
+	}
+
+	if err := redisrepo.SaveLinkPreview(ctx, p, ttl); err != nil {
+		slog.WarnContext(ctx, "caching link preview failed", "error", err)
+	}
+	if p.Title == "" {
+		return nil
+	}
+	return p
+}
@@ -0,0 +1,127 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/config"
+	"Krowka/pkg/linkpreview"
+	"Krowka/pkg/redisrepo"
+)
+
+// stubFetcher knows a few pages and counts the fetches
+type stubFetcher struct {
+	mu      sync.Mutex
+	fetched map[string]int
+}
+
+func (f *stubFetcher) Fetch(ctx context.Context, url string) (*model.LinkPreview, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fetched[url]++
+	if url == "https://example.com/post" {
+		return &model.LinkPreview{URL: url, Title: "A post", SiteName: "Example"}, nil
+	}
+	return nil, linkpreview.ErrNoPreview
+}
+
+func (f *stubFetcher) count(url string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fetched[url]
+}
+
+func TestLinkPreviews(t *testing.T) {
+	useRedis(t)
+	h := newHub(config.Default())
+	fetcher := &stubFetcher{fetched: make(map[string]int)}
+	h.fetcher = fetcher
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.previewWorker(ctx)
+
+	type event struct {
+		user  string
+		frame previewFrame
+	}
+	events := make(chan event, 10)
+	err := redisrepo.SubscribeEvents(ctx, func(user string, frame []byte) {
+		var f previewFrame
+		json.Unmarshal(frame, &f)
+		events <- event{user, f}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive := func() event {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no preview event")
+			return event{}
+		}
+	}
+
+	h.queuePreviews(ctx, &model.Chat{ID: "c1", From: "alice", To: "bob", Msg: "look https://example.com/post and https://example.com/nothing."})
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		e := receive()
+		if e.frame.Type != "preview" || e.frame.ChatID != "c1" || len(e.frame.Previews) != 1 || e.frame.Previews[0].Title != "A post" {
+			t.Errorf("event for %s: %+v", e.user, e.frame)
+		}
+		got[e.user] = true
+	}
+	if !got["alice"] || !got["bob"] {
+		t.Errorf("events went to %v", got)
+	}
+
+	// both pages are cached, the one without a preview too
+	h.queuePreviews(ctx, &model.Chat{ID: "c2", From: "bob", To: "alice", Msg: "https://example.com/nothing https://example.com/post"})
+	receive()
+	receive()
+	if fetcher.count("https://example.com/post") != 1 || fetcher.count("https://example.com/nothing") != 1 {
+		t.Errorf("fetched %v", fetcher.fetched)
+	}
+
+	// chats without previews send nothing
+	h.queuePreviews(ctx, &model.Chat{ID: "c3", From: "alice", To: "bob", Msg: "https://example.com/nothing"})
+	h.queuePreviews(ctx, &model.Chat{ID: "c4", From: "alice", To: "bob", Msg: "no links"})
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %+v", e)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestLinkPreviewOfPrivateAddress(t *testing.T) {
+	useRedis(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, "<title>admin console</title>")
+	}))
+	defer srv.Close()
+
+	// the real fetcher, the test server is on loopback
+	h := newHub(config.Default())
+	ctx := context.Background()
+	if p := h.linkPreview(ctx, srv.URL); p != nil {
+		t.Fatalf("previewed %+v", p)
+	}
+	p, err := redisrepo.GetLinkPreview(ctx, srv.URL)
+	if err != nil || p.Title != "" {
+		t.Errorf("cached %+v, %v", p, err)
+	}
+	if _, err := h.fetcher.Fetch(ctx, srv.URL); !errors.Is(err, linkpreview.ErrBlocked) {
+		t.Errorf("fetch: %v", err)
+	}
+}
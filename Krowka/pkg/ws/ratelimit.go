@@ -0,0 +1,147 @@
+package ws
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"Krowka/pkg/config"
+	"Krowka/pkg/metrics"
+	"Krowka/pkg/redisrepo"
+
+	"github.com/gorilla/websocket"
+)
+
+// tokenBucket is the in-memory twin of redisrepo.TakeToken for limits
+// that stay with one connection. A nil bucket never runs out.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a full bucket, nil when rate is 0
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+func (b *tokenBucket) take(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// localBuckets stand in for the users' shared buckets while Redis is
+// unreachable, limiting each user per server rather than not at all
+type localBuckets struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func (l *localBuckets) take(name string, rate float64, burst int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[name]
+	if !ok {
+		if l.buckets == nil {
+			l.buckets = make(map[string]*tokenBucket)
+		}
+		b = newTokenBucket(rate, burst)
+		l.buckets[name] = b
+	}
+	return b.take(now)
+}
+
+// reset forgets the buckets once Redis answers again
+func (l *localBuckets) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buckets = nil
+}
+
+// rateLimiter tracks the frames of one connection. It is only used by the
+// connection's receiver, so it needs no lock.
+type rateLimiter struct {
+	conn *tokenBucket
+
+	// refused counts the frames refused since windowStart
+	refused     int
+	windowStart time.Time
+	// throttled is set once the client was told to slow down, until one
+	// of its frames goes through again
+	throttled bool
+}
+
+func newRateLimiter(cfg config.RateLimit) *rateLimiter {
+	return &rateLimiter{conn: newTokenBucket(cfg.ConnRate, cfg.ConnBurst)}
+}
+
+// allowFrame takes a token for any frame from the connection's bucket and,
+// for chats, from the bucket of the token's user shared by every server.
+// While Redis fails the user's bucket on this server is used instead.
+func (h *hub) allowFrame(ctx context.Context, client *Client, chat bool) bool {
+	now := time.Now()
+	if !client.limiter.conn.take(now) {
+		return false
+	}
+	rl := h.rateLimit
+	if !chat || rl.UserRate <= 0 {
+		return true
+	}
+	ok, err := redisrepo.TakeToken(ctx, "user:"+client.Username, rl.UserRate, rl.UserBurst, now)
+	if err != nil {
+		slog.WarnContext(ctx, "checking user rate limit failed, limiting locally", "error", err)
+		return h.fallbackBuckets.take(client.Username, rl.UserRate, rl.UserBurst, now)
+	}
+	h.fallbackBuckets.reset()
+	return ok
+}
+
+// throttle drops a frame over the rate limit. The client gets an error
+// frame when it starts being throttled, and is disconnected once it keeps
+// sending regardless. It returns false when the connection must be
+// dropped.
+func (h *hub) throttle(ctx context.Context, client *Client) bool {
+	metrics.WSMessagesDropped.WithLabelValues("rate_limited").Inc()
+
+	l := client.limiter
+	now := time.Now()
+	if now.Sub(l.windowStart) > h.rateLimit.AbuseWindow {
+		l.windowStart = now
+		l.refused = 0
+	}
+	l.refused++
+
+	if max := h.rateLimit.MaxThrottled; max > 0 && l.refused >= max {
+		slog.WarnContext(ctx, "closing connection over the rate limit", "username", client.Username, "refused", l.refused)
+		metrics.WSRateLimitDisconnects.Inc()
+		// sent by the writer once the receiver returns
+		h.mu.Lock()
+		h.enqueue(client, websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"))
+		h.mu.Unlock()
+		return false
+	}
+
+	if !l.throttled {
+		l.throttled = true
+		slog.InfoContext(ctx, "throttling client", "username", client.Username)
+		h.sendError(client, "rate_limited", "too many messages, slow down")
+	}
+	return true
+}
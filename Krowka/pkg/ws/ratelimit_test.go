@@ -0,0 +1,180 @@
+package ws
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/config"
+	"Krowka/pkg/redisrepo"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/websocket"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, 3)
+	for i := 0; i < 3; i++ {
+		if !b.take(now) {
+			t.Fatalf("token %d refused", i)
+		}
+	}
+	if b.take(now) {
+		t.Error("empty bucket gave a token")
+	}
+	if !b.take(now.Add(500*time.Millisecond)) || b.take(now.Add(500*time.Millisecond)) {
+		t.Error("half a second at 2/s should refill one token")
+	}
+	for i := 0; i < 3; i++ {
+		b.take(now.Add(time.Hour))
+	}
+	if b.take(now.Add(time.Hour)) {
+		t.Error("bucket refilled past its burst")
+	}
+
+	off := newTokenBucket(0, 0)
+	if !off.take(now) {
+		t.Error("a rate of 0 limits")
+	}
+}
+
+// startHub serves a hub with the rate limits rl on a local port
+func startHub(t *testing.T, rl config.RateLimit) string {
+	t.Helper()
+	cfg := config.Default()
+	cfg.WebSocket.RateLimit = rl
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHub(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go h.run(ctx, cfg, ln)
+	return "ws://" + ln.Addr().String() + "/ws"
+}
+
+func dialAs(t *testing.T, url, user string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, bearer(t, user))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readError(t *testing.T, conn *websocket.Conn) errorFrame {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var frame errorFrame
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func TestConnectionRateLimit(t *testing.T) {
+	useRedis(t)
+	url := startHub(t, config.RateLimit{ConnRate: 0.01, ConnBurst: 3, MaxThrottled: 5, AbuseWindow: time.Minute})
+
+	// bootup frames take tokens like any other
+	conn := dialAs(t, url, "alice")
+	conn.WriteJSON(Message{Type: "bootup", User: "alice"})
+	conn.WriteJSON(Message{Type: "bootup", User: "alice"})
+	conn.WriteJSON(Message{Type: "bootup", User: "alice"})
+	for i := 0; i < 5; i++ {
+		conn.WriteJSON(Message{Type: "bootup", User: "alice"})
+	}
+
+	// one error frame, then the connection is closed
+	if frame := readError(t, conn); frame.Type != "error" || frame.Code != "rate_limited" {
+		t.Errorf("got %+v", frame)
+	}
+	_, _, err := conn.ReadMessage()
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+		t.Errorf("expected a policy violation close, got %v", err)
+	}
+
+	// other connections are not affected
+	other := dialAs(t, url, "bob")
+	other.WriteJSON(Message{Type: "bootup", User: "bob"})
+	other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, p, err := other.ReadMessage(); err == nil {
+		t.Errorf("bob got %s", p)
+	}
+}
+
+func TestUserRateLimit(t *testing.T) {
+	useRedis(t)
+	url := startHub(t, config.RateLimit{UserRate: 0.01, UserBurst: 3, AbuseWindow: time.Minute})
+
+	// chats with an unknown attachment are refused after the rate limit
+	// is checked, without being stored
+	chat := Message{Type: "message", Chat: model.Chat{
+		From: "alice", To: "bob", Msg: "look",
+		Attachments: []model.AttachmentRef{{ID: "0123456789abcdef0123456789abcdef"}},
+	}}
+
+	// the user's bucket is shared by both connections
+	first, second := dialAs(t, url, "alice"), dialAs(t, url, "alice")
+	for _, conn := range []*websocket.Conn{first, first, second} {
+		conn.WriteJSON(chat)
+		if frame := readError(t, conn); frame.Code != "invalid_attachment" {
+			t.Fatalf("got %+v", frame)
+		}
+	}
+	second.WriteJSON(chat)
+	if frame := readError(t, second); frame.Code != "rate_limited" {
+		t.Errorf("got %+v", frame)
+	}
+	// told once while throttled, max_throttled 0 never disconnects
+	second.WriteJSON(chat)
+	second.WriteJSON(Message{Type: "bootup", User: "alice"})
+	second.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, p, err := second.ReadMessage(); err == nil {
+		t.Errorf("second error frame %s", p)
+	}
+
+	// other users have their own bucket
+	bob := dialAs(t, url, "bob")
+	bob.WriteJSON(Message{Type: "message", Chat: model.Chat{From: "bob", To: "alice", Attachments: chat.Chat.Attachments}})
+	if frame := readError(t, bob); frame.Code != "invalid_attachment" {
+		t.Errorf("bob got %+v", frame)
+	}
+}
+
+func TestUserRateLimitWithoutRedis(t *testing.T) {
+	cfg := config.Default()
+	cfg.Redis.Addr = miniredis.RunT(t).Addr()
+	client, err := redisrepo.InitialiseRedis(context.Background(), cfg.Redis)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+
+	cfg.WebSocket.RateLimit = config.RateLimit{UserRate: 0.01, UserBurst: 2}
+	h := newHub(cfg)
+	ctx := context.Background()
+	alice := &Client{Username: "alice", limiter: newRateLimiter(h.rateLimit)}
+	bob := &Client{Username: "bob", limiter: newRateLimiter(h.rateLimit)}
+
+	// the user's bucket on this server takes over rather than letting
+	// everything through
+	for i := 0; i < 2; i++ {
+		if !h.allowFrame(ctx, alice, true) {
+			t.Fatalf("chat %d refused", i)
+		}
+	}
+	if h.allowFrame(ctx, alice, true) {
+		t.Error("chat over the burst let through while Redis is down")
+	}
+	if !h.allowFrame(ctx, bob, true) {
+		t.Error("bob limited by alice's bucket")
+	}
+}
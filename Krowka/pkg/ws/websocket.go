@@ -1,151 +1,617 @@
 package ws
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"Krowka/model"
+	"Krowka/pkg/config"
+	"Krowka/pkg/graceful"
+	"Krowka/pkg/health"
+	"Krowka/pkg/linkpreview"
+	"Krowka/pkg/logging"
+	"Krowka/pkg/metrics"
 	"Krowka/pkg/redisrepo"
+	"Krowka/pkg/token"
+	"Krowka/pkg/tracing"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type Client struct {
-	Conn     *websocket.Conn
+	ID   string
+	Conn *websocket.Conn
+	// Username comes from the token verified on upgrade
 	Username string
+
+	limiter *rateLimiter
+
+	// send holds the frames waiting for the connection's writer, it is
+	// only sent to with the hub's lock held and closed once the client
+	// left the hub
+	send chan wsFrame
+
+	// ctx carries the connection ID into logs and redis calls, it is
+	// cancelled as soon as the connection is closed
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// close drops the connection and cancels redis work done on its behalf
+func (c *Client) close() {
+	c.cancel()
+	c.Conn.Close()
 }
 
 type Message struct {
 	Type string     `json:"type"`
 	User string     `json:"user,omitempty"`
 	Chat model.Chat `json:"chat,omitempty"`
+
+	// TraceParent optionally continues a client side trace (W3C format)
+	TraceParent string `json:"traceparent,omitempty"`
+}
+
+// chatFrame is what clients receive for every chat. TraceParent links the
+// delivery to the trace of the frame that sent it.
+type chatFrame struct {
+	*model.Chat
+	TraceParent string `json:"traceparent,omitempty"`
+}
+
+// errorFrame tells a client why a frame it sent was rejected
+type errorFrame struct {
+	Type    string `json:"type"` // always "error"
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// wsFrame is a message waiting in a client's send buffer
+type wsFrame struct {
+	messageType int
+	data        []byte
+}
+
+// outbound is a stored chat waiting to be fanned out, ctx carries the
+// span of the frame that produced it
+type outbound struct {
+	ctx  context.Context
+	chat *model.Chat
+}
+
+const (
+	// broadcastQueueSize is how many chats may wait for the broadcaster
+	broadcastQueueSize = 256
+	// sendBufferSize is how many frames may wait for one client's writer,
+	// a client that falls further behind is disconnected
+	sendBufferSize = 64
+)
+
+// hub tracks connected clients and fans chats out to them
+type hub struct {
+	mu      sync.Mutex
+	clients map[*Client]bool
+
+	broadcast chan outbound
+
+	// quit stops the broadcaster, done is closed once it drained the queue
+	quit chan struct{}
+	done chan struct{}
+
+	// receivers counts connections still being read from
+	receivers sync.WaitGroup
+
+	upgrader     websocket.Upgrader
+	writeTimeout time.Duration
+
+	// fetcher is nil when link previews are off, the workers take chats
+	// with links from previews
+	fetcher interface {
+		Fetch(ctx context.Context, url string) (*model.LinkPreview, error)
+	}
+	previews       chan previewJob
+	previewWorkers int
+	previewTTL     time.Duration
+
+	rateLimit config.RateLimit
+	// fallbackBuckets limit users while their shared buckets can't be read
+	fallbackBuckets localBuckets
+
+	// jwtSecret verifies the token every connection must present
+	jwtSecret []byte
+
+	health *health.Checker
+}
+
+func newHub(cfg *config.Config) *hub {
+	h := &hub{
+		clients:   make(map[*Client]bool),
+		broadcast: make(chan outbound, broadcastQueueSize),
+		quit:      make(chan struct{}),
+		done:      make(chan struct{}),
+
+		// We'll need to define an Upgrader
+		// this will require a Read and Write buffer size
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:   1024,
+			WriteBufferSize:  1024,
+			HandshakeTimeout: cfg.WebSocket.HandshakeTimeout,
+			CheckOrigin:      checkOrigin(cfg.WebSocket.AllowedOrigins),
+			Subprotocols:     []string{bearerProtocol},
+		},
+		jwtSecret:    []byte(cfg.Auth.JWTSecret),
+		writeTimeout: cfg.WebSocket.WriteTimeout,
+		rateLimit:    cfg.WebSocket.RateLimit,
+		health:       health.New(),
+	}
+	if p := cfg.WebSocket.Previews; p.Enabled {
+		h.fetcher = linkpreview.NewFetcher(p.Timeout, p.MaxBytes)
+		h.previews = make(chan previewJob, previewQueueSize)
+		h.previewWorkers = p.Workers
+		h.previewTTL = p.CacheTTL
+	}
+	return h
 }
 
-var clients = make(map[*Client]bool)
-var broadcast = make(chan *model.Chat)
+// checkOrigin lets browsers connect from the allowed origins only, so that
+// other sites cannot open a connection with the user's cookies. Requests
+// without an Origin header do not come from a browser.
+func checkOrigin(allowed []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		for _, o := range allowed {
+			if o == "*" || strings.EqualFold(o, origin) {
+				return true
+			}
+		}
+		slog.WarnContext(r.Context(), "websocket origin not allowed", "origin", origin)
+		return false
+	}
+}
 
-// We'll need to define an Upgrader
-// this will require a Read and Write buffer size
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// bearerProtocol is offered by browsers, which cannot set headers on a
+// WebSocket, together with their token as a second subprotocol
+const bearerProtocol = "krowka.bearer"
 
-	// We'll need to check the origin of our connection
-	// this will allow us to make requests from our React
-	// development server to here.
-	// For now, we'll do no checking and just allow any connection
-	CheckOrigin: func(r *http.Request) bool { return true },
+// authenticate returns the user named by the token of an upgrade request,
+// sent as an Authorization bearer header or as the subprotocol following
+// bearerProtocol
+func (h *hub) authenticate(r *http.Request) (string, error) {
+	tok, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		protocols := websocket.Subprotocols(r)
+		for i := 0; i+1 < len(protocols); i++ {
+			if protocols[i] == bearerProtocol {
+				tok, ok = protocols[i+1], true
+				break
+			}
+		}
+	}
+	if !ok {
+		metrics.AuthFailures.WithLabelValues("missing_token").Inc()
+		return "", errors.New("missing token")
+	}
+	user, err := token.Verify(h.jwtSecret, tok)
+	if err != nil {
+		metrics.AuthFailures.WithLabelValues("invalid_token").Inc()
+		return "", err
+	}
+	return user, nil
 }
 
 // define our WebSocket endpoint
-func serveWs(w http.ResponseWriter, r *http.Request) {
-	fmt.Println(r.Host, r.URL.Query())
+func (h *hub) serveWs(w http.ResponseWriter, r *http.Request) {
+	id := logging.NewID()
+	ctx, cancel := context.WithCancel(logging.WithConnID(r.Context(), id))
+	defer cancel()
+
+	// the user is known before the connection is, frames never name it
+	username, err := h.authenticate(r)
+	if err != nil {
+		slog.InfoContext(ctx, "websocket authentication failed", "error", err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
 
 	// upgrade this connection to a WebSocket
 	// connection
-	ws, err := upgrader.Upgrade(w, r, nil)
+	ws, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Println(err)
+		slog.WarnContext(ctx, "websocket upgrade failed", "error", err)
+		return
 	}
 
-	client := &Client{Conn: ws}
+	client := &Client{
+		ID: id, Conn: ws, Username: username, ctx: ctx, cancel: cancel,
+		limiter: newRateLimiter(h.rateLimit),
+		send:    make(chan wsFrame, sendBufferSize),
+	}
 	// register client
-	clients[client] = true
-	fmt.Println("clients", len(clients), clients, ws.RemoteAddr())
+	h.mu.Lock()
+	select {
+	case <-h.quit:
+		h.mu.Unlock()
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(h.writeTimeout))
+		ws.Close()
+		return
+	default:
+	}
+	h.clients[client] = true
+	h.receivers.Add(1)
+	metrics.WSActiveConnections.Inc()
+	slog.InfoContext(ctx, "client connected", "remote_addr", ws.RemoteAddr().String(), "username", username, "clients", len(h.clients))
+	h.mu.Unlock()
+
+	written := make(chan struct{})
+	go func() {
+		h.writer(client)
+		close(written)
+	}()
 
 	// listen indefinitely for new messages coming
 	// through on our WebSocket connection
-	receiver(client)
+	h.receiver(client)
 
-	fmt.Println("exiting", ws.RemoteAddr().String())
-	delete(clients, client)
+	slog.InfoContext(ctx, "client disconnected", "remote_addr", ws.RemoteAddr().String(), "username", client.Username)
+	h.mu.Lock()
+	delete(h.clients, client)
+	close(client.send)
+	h.mu.Unlock()
+	// let the writer flush what is queued, a close frame in particular
+	<-written
+	client.close()
+	metrics.WSActiveConnections.Dec()
+	h.receivers.Done()
 }
 
 // define a receiver which will listen for
 // new messages being sent to our WebSocket
 // endpoint
-func receiver(client *Client) {
+func (h *hub) receiver(client *Client) {
 	for {
 		// read in a message
 		// readMessage returns messageType, message, err
 		// messageType: 1-> Text Message, 2 -> Binary Message
 		_, p, err := client.Conn.ReadMessage()
 		if err != nil {
-			log.Println(err)
+			slog.DebugContext(client.ctx, "read failed", "error", err)
 			return
 		}
 
-		m := &Message{}
+		if !h.handleFrame(client, p) {
+			return
+		}
+	}
+}
 
-		err = json.Unmarshal(p, m)
-		if err != nil {
-			log.Println("error while unmarshaling chat", err)
+// writer writes the frames queued for client until its send buffer is
+// closed. After a failed write the rest of the buffer is discarded.
+func (h *hub) writer(client *Client) {
+	failed := false
+	for f := range client.send {
+		if failed {
 			continue
 		}
+		client.Conn.SetWriteDeadline(time.Now().Add(h.writeTimeout))
+		if err := client.Conn.WriteMessage(f.messageType, f.data); err != nil {
+			slog.WarnContext(client.ctx, "websocket write failed", "error", err)
+			metrics.WSMessagesDropped.WithLabelValues("write_error").Inc()
+			failed = true
+			// the receiver notices and the client leaves the hub
+			client.close()
+		}
+	}
+}
 
-		fmt.Println("host", client.Conn.RemoteAddr())
-		if m.Type == "bootup" {
-			// do mapping on bootup
-			client.Username = m.User
-			fmt.Println("client successfully mapped", &client, client, client.Username)
-		} else {
-			fmt.Println("received message", m.Type, m.Chat)
-			c := m.Chat
-			c.Timestamp = time.Now().Unix()
-
-			// save in redis
-			id, err := redisrepo.CreateChat(&c)
-			if err != nil {
-				log.Println("error while saving chat in redis", err)
-				return
-			}
+// enqueue hands a frame to client's writer without blocking, h.mu must be
+// held. A client whose buffer is full is too slow to keep up and is
+// disconnected.
+func (h *hub) enqueue(client *Client, messageType int, data []byte) bool {
+	select {
+	case client.send <- wsFrame{messageType: messageType, data: data}:
+		return true
+	default:
+		slog.WarnContext(client.ctx, "send buffer full, closing connection", "username", client.Username)
+		metrics.WSMessagesDropped.WithLabelValues("slow_client").Inc()
+		client.close()
+		delete(h.clients, client)
+		return false
+	}
+}
+
+// handleFrame processes one frame inside its own span. It returns false
+// when the connection should be dropped.
+func (h *hub) handleFrame(client *Client, p []byte) bool {
+	m := &Message{}
+
+	err := json.Unmarshal(p, m)
+	// every frame costs the connection a token, chats cost the user one
+	if !h.allowFrame(client.ctx, client, err == nil && m.Type != "bootup") {
+		return h.throttle(client.ctx, client)
+	}
+	client.limiter.throttled = false
+	if err != nil {
+		slog.WarnContext(client.ctx, "error while unmarshaling chat", "error", err)
+		return true
+	}
+
+	ctx := client.ctx
+	if m.TraceParent != "" {
+		ctx = tracing.Propagator().Extract(ctx, propagation.MapCarrier{"traceparent": m.TraceParent})
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "ws.receive",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("ws.message.type", m.Type),
+			attribute.String("ws.conn_id", client.ID),
+		))
+	defer span.End()
+
+	if m.Type == "bootup" {
+		// the token mapped the connection already, older clients still
+		// announce themselves
+		if m.User != client.Username {
+			slog.WarnContext(ctx, "bootup names another user", "username", client.Username, "claimed", m.User)
+			h.sendError(client, "forbidden", "the connection belongs to "+client.Username)
+		}
+		return true
+	}
+
+	slog.DebugContext(ctx, "received message",
+		"type", m.Type, "from", m.Chat.From, "to", m.Chat.To, "body", m.Chat.Msg)
+	metrics.WSMessagesReceived.Inc()
+	c := m.Chat
+	c.Timestamp = time.Now().Unix()
+	if c.From != client.Username {
+		slog.WarnContext(ctx, "chat rejected", "from", c.From, "username", client.Username)
+		metrics.WSMessagesDropped.WithLabelValues("forbidden").Inc()
+		h.sendError(client, "forbidden", "chats can only be sent as "+client.Username)
+		return true
+	}
 
-			c.ID = id
-			broadcast <- &c
+	if len(c.Attachments) > 0 {
+		err := resolveAttachments(ctx, client.Username, &c)
+		if errors.Is(err, errInvalidAttachment) {
+			slog.InfoContext(ctx, "chat rejected", "from", c.From, "to", c.To, "error", err)
+			metrics.WSMessagesDropped.WithLabelValues("invalid_attachment").Inc()
+			h.sendError(client, "invalid_attachment", err.Error())
+			return true
 		}
+		if err != nil {
+			slog.ErrorContext(ctx, "error while checking chat attachments", "error", err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, "checking attachments failed")
+			return false
+		}
+	}
+
+	// save in redis, bounded by the repo's operation timeout and
+	// abandoned if the connection closes meanwhile
+	id, err := redisrepo.CreateChat(ctx, &c)
+	if err != nil {
+		slog.ErrorContext(ctx, "error while saving chat in redis", "error", err)
+		span.RecordError(err)
+		span.SetStatus(codes.Error, "saving chat failed")
+		return false
+	}
+
+	c.ID = id
+	span.SetAttributes(attribute.String("chat.id", c.ID))
+	h.queuePreviews(ctx, &c)
+	select {
+	case h.broadcast <- outbound{ctx: ctx, chat: &c}:
+		metrics.WSBroadcastQueueDepth.Set(float64(len(h.broadcast)))
+	case <-h.quit:
+		// the chat is stored, the client will see it in its history
+		slog.WarnContext(ctx, "shutting down, chat not broadcast", "chat_id", c.ID)
+		metrics.WSMessagesDropped.WithLabelValues("shutdown").Inc()
 	}
+	return true
+}
+
+// sendError queues an error frame for one client
+func (h *hub) sendError(client *Client, code, msg string) {
+	frame, _ := json.Marshal(errorFrame{Type: "error", Code: code, Message: msg})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.enqueue(client, websocket.TextMessage, frame)
 }
 
-func broadcaster() {
+func (h *hub) broadcaster() {
+	defer close(h.done)
+
 	for {
-		message := <-broadcast
-		// send to every client that is currently connected
-		fmt.Println("new message", message)
-
-		for client := range clients {
-			// send message only to involved users
-			fmt.Println("username:", client.Username,
-				"from:", message.From,
-				"to:", message.To)
-
-			if client.Username == message.From || client.Username == message.To {
-				err := client.Conn.WriteJSON(message)
-				if err != nil {
-					log.Printf("Websocket error: %s", err)
-					client.Conn.Close()
-					delete(clients, client)
+		select {
+		case message := <-h.broadcast:
+			h.deliver(message)
+		case <-h.quit:
+			// drain chats accepted before shutdown started
+			for {
+				select {
+				case message := <-h.broadcast:
+					h.deliver(message)
+				default:
+					return
 				}
 			}
 		}
 	}
 }
 
-func setupRoutes() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+func (h *hub) deliver(out outbound) {
+	message := out.chat
+	ctx := out.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "ws.broadcast",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("chat.id", message.ID)))
+	defer span.End()
+
+	// send to every client that is currently connected
+	slog.DebugContext(ctx, "new message", "chat_id", message.ID, "from", message.From, "to", message.To)
+	metrics.WSBroadcastQueueDepth.Set(float64(len(h.broadcast)))
+
+	carrier := propagation.MapCarrier{}
+	tracing.Propagator().Inject(ctx, carrier)
+	frame, err := json.Marshal(chatFrame{Chat: message, TraceParent: carrier["traceparent"]})
+	if err != nil {
+		slog.ErrorContext(ctx, "encoding chat failed", "chat_id", message.ID, "error", err)
+		span.RecordError(err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delivered := 0
+	for client := range h.clients {
+		// send message only to involved users
+		if client.Username == message.From || client.Username == message.To {
+			if !h.enqueue(client, websocket.TextMessage, frame) {
+				continue
+			}
+			metrics.WSMessagesBroadcast.Inc()
+			delivered++
+		}
+	}
+	span.SetAttributes(attribute.Int("ws.recipients", delivered))
+}
+
+// sendTo queues an event published by the HTTP server or a preview
+// worker, already encoded, for every connection whose token names username
+func (h *hub) sendTo(username string, frame []byte) {
+	if username == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for client := range h.clients {
+		if client.Username == username {
+			h.enqueue(client, websocket.TextMessage, frame)
+		}
+	}
+}
+
+// shutdown delivers queued chats, then tells every client the server is
+// going away and waits for their connections to finish.
+func (h *hub) shutdown(ctx context.Context) error {
+	close(h.quit)
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	closeMsg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+
+	h.mu.Lock()
+	for client := range h.clients {
+		h.enqueue(client, websocket.CloseMessage, closeMsg)
+	}
+	h.mu.Unlock()
+
+	// receivers return once the client answers the close frame
+	finished := make(chan struct{})
+	go func() {
+		h.receivers.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		h.mu.Lock()
+		for client := range h.clients {
+			client.close()
+		}
+		h.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+func (h *hub) routes() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Fprintf(w, "Simple Server")
 	})
 	// map our `/ws` endpoint to the `serveWs` function
-	http.HandleFunc("/ws", serveWs)
+	mux.HandleFunc("/ws", h.serveWs)
+	mux.HandleFunc("GET /healthz", h.health.Liveness)
+	mux.HandleFunc("GET /readyz", h.health.Readiness)
+	mux.Handle("GET /metrics", metrics.Handler())
+
+	return mux
+}
+
+// run serves on ln until ctx is cancelled, then stops accepting
+// connections and shuts the hub down.
+func (h *hub) run(ctx context.Context, cfg *config.Config, ln net.Listener) error {
+	go h.broadcaster()
+	for i := 0; i < h.previewWorkers; i++ {
+		go h.previewWorker(ctx)
+	}
+
+	srv := &http.Server{
+		Handler:           h.routes(),
+		ReadHeaderTimeout: cfg.WebSocket.HandshakeTimeout,
+	}
+
+	err := graceful.ServeListener(ctx, srv, ln, graceful.Options{
+		Timeout:    cfg.ShutdownTimeout,
+		DrainDelay: cfg.ShutdownDelay,
+		OnShutdown: h.health.SetShuttingDown,
+	})
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if errHub := h.shutdown(shutdownCtx); errHub != nil && err == nil {
+		err = errHub
+	}
+
+	return err
 }
 
-func StartWebsocketServer() {
-	redisClient := redisrepo.InitialiseRedis()
-	defer redisClient.Close()
+// StartWebsocketServer serves until ctx is cancelled. Redis must already be
+// initialised.
+func StartWebsocketServer(ctx context.Context, cfg *config.Config) error {
+	ln, err := net.Listen("tcp", cfg.WebSocket.Addr)
+	if err != nil {
+		return err
+	}
+
+	h := newHub(cfg)
+	h.health.Add("redis", redisrepo.Ping)
+	h.health.Add("redis_modules", redisrepo.CheckModules)
+	h.health.Add("chat_index", redisrepo.CheckChatIndex)
+
+	// events such as rejected attachments come from the HTTP server
+	if err := redisrepo.SubscribeEvents(ctx, h.sendTo); err != nil {
+		ln.Close()
+		return fmt.Errorf("unable to subscribe to events: %w", err)
+	}
 
-	go broadcaster()
-	setupRoutes()
-	http.ListenAndServe(":8081", nil)
+	return h.run(ctx, cfg, ln)
 }
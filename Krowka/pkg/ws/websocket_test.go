@@ -0,0 +1,227 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"Krowka/model"
+	"Krowka/pkg/config"
+	"Krowka/pkg/token"
+
+	"github.com/gorilla/websocket"
+)
+
+// bearer returns the headers of an upgrade request signed in as user
+func bearer(t *testing.T, user string) http.Header {
+	t.Helper()
+	tok, err := token.Issue([]byte(config.DefaultJWTSecret), user, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return http.Header{"Authorization": {"Bearer " + tok}}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	cfg := config.Default()
+	cfg.ShutdownTimeout = 5 * time.Second
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "ws://" + ln.Addr().String() + "/ws"
+
+	h := newHub(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- h.run(ctx, cfg, ln)
+	}()
+
+	conn, _, err := websocket.DefaultDialer.Dial(addr, bearer(t, "alice"))
+	if err != nil {
+		t.Fatal("dial", err)
+	}
+	defer conn.Close()
+
+	waitFor(t, func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for c := range h.clients {
+			if c.Username == "alice" {
+				return true
+			}
+		}
+		return false
+	})
+
+	// a chat that is still queued when the signal arrives must be delivered
+	// before the close frame
+	h.mu.Lock()
+	h.broadcast <- outbound{ctx: context.Background(), chat: &model.Chat{ID: "chat#1", From: "alice", To: "bob", Msg: "in flight"}}
+	cancel()
+	h.mu.Unlock()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, p, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal("expected queued chat before close, got", err)
+	}
+	var c model.Chat
+	if err := json.Unmarshal(p, &c); err != nil || c.ID != "chat#1" {
+		t.Fatal("unexpected frame", string(p), err)
+	}
+
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatal("expected going away close frame, got", err)
+	}
+
+	// answer the close handshake so the receiver can finish
+	conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+
+	select {
+	case err := <-runErr:
+		if err != nil {
+			t.Fatal("run returned", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop")
+	}
+
+	if _, _, err := websocket.DefaultDialer.Dial(addr, bearer(t, "alice")); err == nil {
+		t.Fatal("server still accepting connections after shutdown")
+	}
+}
+
+func TestAllowedOrigins(t *testing.T) {
+	url := startHub(t, config.RateLimit{})
+
+	for _, tc := range []struct {
+		origin string
+		ok     bool
+	}{
+		{"", true},
+		{"http://localhost:3000", true},
+		{"HTTP://LOCALHOST:3001", true},
+		{"https://evil.example", false},
+		{"http://localhost:3000.evil.example", false},
+	} {
+		header := bearer(t, "alice")
+		if tc.origin != "" {
+			header.Set("Origin", tc.origin)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) != tc.ok {
+			t.Errorf("origin %q: connected %v, want %v", tc.origin, err == nil, tc.ok)
+		}
+		if !tc.ok && resp != nil && resp.StatusCode != http.StatusForbidden {
+			t.Errorf("origin %q: status %d", tc.origin, resp.StatusCode)
+		}
+	}
+}
+
+func TestSlowClientDoesNotBlockHub(t *testing.T) {
+	cfg := config.Default()
+	cfg.WebSocket.WriteTimeout = time.Minute
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newHub(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go h.run(ctx, cfg, ln)
+
+	// alice never reads, her connection fills up
+	conn := dialAs(t, "ws://"+ln.Addr().String()+"/ws", "alice")
+	connected := func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		for c := range h.clients {
+			if c.Username == "alice" {
+				return true
+			}
+		}
+		return false
+	}
+	waitFor(t, connected)
+
+	frame := make([]byte, 64<<10)
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10*sendBufferSize && connected(); i++ {
+			h.sendTo("alice", frame)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sending to a stalled client blocked the hub")
+	}
+	waitFor(t, func() bool { return !connected() })
+	conn.Close()
+}
+
+func TestUpgradeNeedsToken(t *testing.T) {
+	useRedis(t)
+	url := startHub(t, config.RateLimit{})
+
+	forged, err := token.Issue([]byte("another secret"), "alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, header := range map[string]http.Header{
+		"no token":     nil,
+		"forged token": {"Authorization": {"Bearer " + forged}},
+		"bad protocol": {"Sec-WebSocket-Protocol": {bearerProtocol + ", " + forged}},
+		"not a bearer": {"Authorization": {"Basic YWxpY2U6YWxpY2U="}},
+	} {
+		_, resp, err := websocket.DefaultDialer.Dial(url, header)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: %v %v", name, resp, err)
+		}
+	}
+
+	// browsers send the token as a subprotocol, which is echoed back
+	tok, _ := token.Issue([]byte(config.DefaultJWTSecret), "alice", time.Hour)
+	dialer := websocket.Dialer{Subprotocols: []string{bearerProtocol, tok}}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.Subprotocol() != bearerProtocol {
+		t.Errorf("subprotocol %q", conn.Subprotocol())
+	}
+
+	// the connection is alice's whatever it claims
+	conn.WriteJSON(Message{Type: "bootup", User: "bob"})
+	if frame := readError(t, conn); frame.Code != "forbidden" {
+		t.Errorf("bootup as bob: %+v", frame)
+	}
+	conn.WriteJSON(Message{Type: "message", Chat: model.Chat{From: "bob", To: "alice", Msg: "hi"}})
+	if frame := readError(t, conn); frame.Code != "forbidden" {
+		t.Errorf("chat from bob: %+v", frame)
+	}
+}